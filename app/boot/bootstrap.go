@@ -2,8 +2,20 @@ package boot
 
 import (
 	"context"
+	"errors"
+	"icetea/app/config"
+	"icetea/client"
 	"icetea/service"
+	"icetea/service/acl"
+	"icetea/service/admin"
+	"icetea/service/auth"
+	"icetea/service/bridge"
+	"icetea/service/cluster"
+	"icetea/service/subtree"
 	"log"
+	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 type Service interface {
@@ -11,22 +23,150 @@ type Service interface {
 	Stop() error
 	Name() string
 }
+
+// GracefulService 停止时需要等待的服务，在 ctx 的截止时间前完成停止
+type GracefulService interface {
+	Service
+	Shutdown(ctx context.Context) error
+}
+
 type App struct {
+	Config *config.Config
+	// started 已启动的服务，按启动顺序排列
+	started []Service
 }
 
-func (*App) Run(ctx context.Context) error {
+func (a *App) Run(ctx context.Context) error {
+	if a.Config == nil {
+		a.Config = config.Default()
+	}
+	services, err := a.services()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range services {
+		if err := s.Run(ctx); err != nil {
+			return err
+		}
+		a.started = append(a.started, s)
+		log.Println(`service: ` + s.Name() + ` started`)
+	}
+	return nil
+}
+
+// Stop 按启动的逆序停止服务：先关闭监听并断开客户端，最后保存快照、关闭日志。
+// 超过 ctx 的截止时间后剩余的连接被强制关闭，其余服务仍然会停止
+func (a *App) Stop(ctx context.Context) error {
+	var errs []string
+	for i := len(a.started) - 1; i >= 0; i-- {
+		var (
+			s   = a.started[i]
+			err error
+		)
+		if graceful, ok := s.(GracefulService); ok {
+			err = graceful.Shutdown(ctx)
+		} else {
+			err = s.Stop()
+		}
+		if err != nil {
+			errs = append(errs, s.Name()+": "+err.Error())
+			log.Println(`service: ` + s.Name() + ` stop failed: ` + err.Error())
+			continue
+		}
+		log.Println(`service: ` + s.Name() + ` stopped`)
+	}
+	a.started = nil
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// services 按配置创建服务，日志最先启动，快照在监听之前恢复订阅，
+// 监听最后启动，停止时最先关闭
+func (a *App) services() ([]Service, error) {
 	var (
+		cfg      = a.Config
+		level, _ = logrus.ParseLevel(cfg.Log.Level)
 		services = []Service{
-			newServer(),
-			service.NewLogger(),
+			service.NewLogger(level, cfg.Log.Format == "json", cfg.Log.File),
+			service.NewSnapshotService(service.Handler, cfg.Persistence.SnapshotPath, cfg.Persistence.SnapshotInterval.Duration()),
 		}
 	)
+	if err := configureHandler(cfg); err != nil {
+		return nil, err
+	}
+	listeners, err := newListeners(cfg.Listeners)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Cluster.Listen != "" {
+		clusterConfig := cfg.ClusterConfig()
+		if err = clusterConfig.Validate(); err != nil {
+			return nil, err
+		}
+		services = append(services, cluster.New(clusterConfig, service.Handler))
+	}
+	for i := range cfg.Bridges {
+		bridgeConfig, err := cfg.Bridges[i].Build()
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, bridge.New(bridgeConfig, service.Handler))
+	}
+	if cfg.Admin.Listen != "" {
+		services = append(services, admin.New(admin.Config{
+			Listen: cfg.Admin.Listen,
+			Token:  cfg.Admin.Token,
+		}, service.Handler))
+	}
+	if cfg.Metrics.Listen != "" {
+		services = append(services, service.NewMetricsService(service.Handler, cfg.Metrics.Listen))
+	}
+	services = append(services, service.NewSysPublisher(service.Handler, cfg.Sys.Interval.Duration()))
+	overflowPolicy, err := client.ParseOverflowPolicy(cfg.Limits.OverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	services = append(services, newServer(listeners, []client.Option{
+		client.WithConnectTimeout(cfg.Limits.ConnectTimeout.Duration()),
+		client.WithMaxPacketSize(cfg.Limits.MaxPacketSize),
+		client.WithTopicAliasMaximum(cfg.Limits.TopicAliasMaximum),
+		client.WithOutboundQueue(cfg.Limits.OutboundQueueLength, overflowPolicy),
+	}))
+	return services, nil
+}
 
-	for _, s := range services {
-		if err := s.Run(ctx); err != nil {
+// configureHandler 按配置设置认证、授权、共享订阅与会话队列
+func configureHandler(cfg *config.Config) error {
+	var next auth.Authenticator
+	if cfg.Auth.PasswordFile != "" {
+		passwordFile, err := auth.NewPasswordFile(cfg.Auth.PasswordFile)
+		if err != nil {
 			return err
 		}
-		log.Println(`service: ` + s.Name() + ` started`)
+		next = passwordFile
+	}
+	if next != nil || !cfg.Auth.AllowAnonymous {
+		service.Handler.SetAuthenticator(auth.Certificate(auth.Anonymous(cfg.Auth.AllowAnonymous, next)))
+	}
+	if cfg.Auth.ACLFile != "" {
+		rules, err := acl.LoadFile(cfg.Auth.ACLFile)
+		if err != nil {
+			return err
+		}
+		service.Handler.SetAuthorizer(rules)
+	}
+	strategy, err := service.ParseShareStrategy(cfg.SharedStrategy)
+	if err != nil {
+		return err
 	}
+	service.Handler.SetShareStrategy(strategy)
+	subtree.GetTopicSub().SetMaxQueueLength(cfg.Limits.MaxQueueLength)
+	service.Handler.SetTopicLimits(subtree.TopicLimits{
+		MaxLength: cfg.Limits.MaxTopicLength,
+		MaxLevels: cfg.Limits.MaxTopicLevels,
+	})
 	return nil
 }
@@ -0,0 +1,102 @@
+package boot
+
+import (
+	"context"
+	"errors"
+	"icetea/app/config"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeService 记录停止顺序的服务
+type fakeService struct {
+	name    string
+	stopped *[]string
+	err     error
+}
+
+func (s *fakeService) Run(ctx context.Context) error {
+	return nil
+}
+
+func (s *fakeService) Stop() error {
+	*s.stopped = append(*s.stopped, s.name)
+	return s.err
+}
+
+func (s *fakeService) Name() string {
+	return s.name
+}
+
+// gracefulService 记录停止时收到的截止时间
+type gracefulService struct {
+	fakeService
+	deadline time.Time
+}
+
+func (s *gracefulService) Shutdown(ctx context.Context) error {
+	s.deadline, _ = ctx.Deadline()
+	return s.fakeService.Stop()
+}
+
+// TestAppStopOrder 按启动的逆序停止服务，GracefulService 在 ctx 的截止时间内停止，
+// 一个服务停止失败时其余服务仍然停止，返回所有错误
+func TestAppStopOrder(t *testing.T) {
+	var (
+		stopped  []string
+		server   = &gracefulService{fakeService: fakeService{name: "server", stopped: &stopped}}
+		snapshot = &fakeService{name: "snapshot", stopped: &stopped, err: errors.New("disk full")}
+		app      = &App{started: []Service{
+			&fakeService{name: "logger", stopped: &stopped},
+			snapshot,
+			&fakeService{name: "bridge", stopped: &stopped, err: errors.New("timeout")},
+			server,
+		}}
+	)
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	err := app.Stop(ctx)
+	if strings.Join(stopped, ",") != "server,bridge,snapshot,logger" {
+		t.Fatalf("stop order = %v", stopped)
+	}
+	if !server.deadline.Equal(deadline) {
+		t.Fatalf("graceful service deadline = %v, want %v", server.deadline, deadline)
+	}
+	if err == nil || err.Error() != "bridge: timeout; snapshot: disk full" {
+		t.Fatalf("Stop() = %v", err)
+	}
+
+	// 已经停止的服务不会再次停止
+	stopped = nil
+	if err := app.Stop(ctx); err != nil || len(stopped) != 0 {
+		t.Fatalf("second Stop() = %v, stopped %v", err, stopped)
+	}
+}
+
+// TestAppServicesOrder 日志最先启动、监听最后启动，停止时先关闭监听、最后关闭日志
+func TestAppServicesOrder(t *testing.T) {
+	cfg := config.Default()
+	cfg.Persistence.SnapshotPath = filepath.Join(t.TempDir(), "snapshot")
+	cfg.Bridges = []config.Bridge{{
+		Name:    "central",
+		Address: "tcp://127.0.0.1:1883",
+		Topics:  []config.BridgeTopic{{Topic: "sensors/#"}},
+	}}
+	cfg.Admin.Listen = "127.0.0.1:0"
+	cfg.Metrics.Listen = "127.0.0.1:0"
+	services, err := (&App{Config: cfg}).services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(services))
+	for i, s := range services {
+		names[i] = s.Name()
+	}
+	if got := strings.Join(names, ","); got != "logger,snapshot,bridge:central,admin,metrics,sys,server" {
+		t.Fatalf("services = %s", got)
+	}
+}
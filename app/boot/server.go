@@ -3,74 +3,203 @@ package boot
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/sirupsen/logrus"
+	"icetea/app/config"
 	"icetea/client"
+	"icetea/pkg/metrics"
 	"icetea/service"
 	server2 "icetea/service/server"
-	"log"
+	"net"
 	"strings"
+	"sync"
+	"time"
 )
 
-var (
-	listeners = []server2.Listener{
-		server2.NewTCPListener("127.0.0.1", 1883),
+type Server struct {
+	listeners []server2.Listener
+	// listening Run 中已经启动的监听，Shutdown 只关闭这些监听
+	listening []server2.Listener
+	options   []client.Option
+	// clients 已接受的连接，包括尚未完成 CONNECT 的连接
+	clients map[*client.Client]struct{}
+	// closing Shutdown 开始后新接受的连接直接关闭
+	closing bool
+	mux     sync.Mutex
+}
+
+func newServer(listeners []server2.Listener, options []client.Option) *Server {
+	return &Server{
+		listeners: listeners,
+		options:   options,
+		clients:   make(map[*client.Client]struct{}),
 	}
-)
+}
 
-type Server struct {
+// newListeners 按配置创建监听
+func newListeners(listeners []config.Listener) ([]server2.Listener, error) {
+	var result []server2.Listener
+	for _, l := range listeners {
+		switch l.Protocol {
+		case "tcp":
+			result = append(result, server2.NewTCPListener(l.Host, l.Port))
+		case "tls":
+			result = append(result, server2.NewTLSListener(l.Host, l.Port, tlsConfig(l.TLS)))
+		case "ws":
+			result = append(result, server2.NewWebsocketListener(l.Host, l.Port, l.Path, l.AllowedOrigins, nil))
+		case "wss":
+			result = append(result, server2.NewWebsocketListener(l.Host, l.Port, l.Path, l.AllowedOrigins, tlsConfig(l.TLS)))
+		default:
+			return nil, fmt.Errorf("unknown listener protocol %q", l.Protocol)
+		}
+	}
+	return result, nil
 }
 
-func newServer() *Server {
-	return &Server{}
+func tlsConfig(c config.TLS) *server2.TLSConfig {
+	return &server2.TLSConfig{
+		CertFile:          c.CertFile,
+		KeyFile:           c.KeyFile,
+		CAFile:            c.CAFile,
+		RequireClientCert: c.RequireClientCert,
+		MinVersion:        c.MinVersion,
+		CipherSuites:      c.CipherSuites,
+		UsernameFrom:      c.UsernameFrom,
+		ClientIDFrom:      c.ClientIDFrom,
+	}
 }
 
 func (s *Server) Name() string {
 	return `server`
 }
 
+// Run 依次启动所有监听，任意一个失败时关闭已经启动的监听并返回错误，全部启动后在后台接受连接
 func (s *Server) Run(ctx context.Context) error {
-	for _, v := range listeners {
-		go func(listener server2.Listener) {
-			if err := listener.Listen(); err != nil {
-				log.Fatalln(err)
+	listening := make([]server2.Listener, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		if err := listener.Listen(); err != nil {
+			for _, l := range listening {
+				l.Close()
 			}
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					conn, err := listener.Accept()
-					if err == nil {
-						// TODO: add to service manager
-						cli := client.NewClient(conn, service.Handler)
-						if err := cli.Run(ctx); err != nil {
-							cli.Close()
-							break
-						}
-						service.DefaultClientService.CreateClient(cli)
-					} else {
-						logrus.Error(err)
-						conn.Close()
-						continue
-					}
+			return err
+		}
+		listening = append(listening, listener)
+	}
+	s.mux.Lock()
+	s.listening = listening
+	s.mux.Unlock()
+	for _, listener := range listening {
+		go s.accept(ctx, listener)
+	}
+	return nil
+}
+
+// accept 接受连接直到监听关闭
+func (s *Server) accept(ctx context.Context, listener server2.Listener) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			conn, err := listener.Accept()
+			if err == nil {
+				metrics.ConnectionsAccepted.Inc()
+				// TODO: add to service manager
+				cli := client.NewClient(conn, service.Handler, s.options...)
+				if err := cli.Run(ctx); err != nil {
+					cli.Close()
+					break
 				}
+				s.track(cli)
+				service.DefaultClientService.CreateClient(cli)
+			} else if errors.Is(err, net.ErrClosed) {
+				return
+			} else {
+				metrics.AcceptErrors.Inc()
+				logrus.Error(err)
+				continue
 			}
-		}(v)
+		}
 	}
-	return nil
 }
 
 func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.DefaultShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// Shutdown 先关闭监听不再接受新连接，再断开所有连接并等待连接断开的处理完成，
+// 持久会话未确认的消息在此时放回会话队列。超过截止时间后强制关闭剩余的连接
+func (s *Server) Shutdown(ctx context.Context) error {
 	var (
 		errs []string
 	)
-	for _, v := range listeners {
+	s.mux.Lock()
+	listening := s.listening
+	s.listening = nil
+	s.mux.Unlock()
+	for _, v := range listening {
 		if err := v.Close(); err != nil {
 			errs = append(errs, err.Error())
 		}
 	}
+
+	s.mux.Lock()
+	s.closing = true
+	clients := make([]*client.Client, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mux.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(config.DefaultShutdownTimeout)
+	}
+	for _, c := range clients {
+		go c.Shutdown(deadline)
+	}
+	for _, c := range clients {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			for _, c := range clients {
+				c.Close()
+			}
+			errs = append(errs, fmt.Sprintf("%d connections not closed before deadline: %v", s.connections(), ctx.Err()))
+			return errors.New(strings.Join(errs, ","))
+		}
+	}
+	logrus.WithFields(map[string]interface{}{
+		"clients": len(clients),
+	}).Info("all connections closed")
+
 	if len(errs) != 0 {
 		return errors.New(strings.Join(errs, ","))
 	}
 	return nil
 }
+
+// track 记录连接，连接断开的处理完成后移除
+func (s *Server) track(c *client.Client) {
+	s.mux.Lock()
+	if s.closing {
+		s.mux.Unlock()
+		c.Close()
+		return
+	}
+	s.clients[c] = struct{}{}
+	s.mux.Unlock()
+	go func() {
+		<-c.Done()
+		s.mux.Lock()
+		delete(s.clients, c)
+		s.mux.Unlock()
+	}()
+}
+
+func (s *Server) connections() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.clients)
+}
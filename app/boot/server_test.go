@@ -0,0 +1,59 @@
+package boot
+
+import (
+	"context"
+	"errors"
+	server2 "icetea/service/server"
+	"net"
+	"testing"
+)
+
+// TestServerListenError 监听启动失败时 Run 返回错误，并关闭已经启动的监听
+func TestServerListenError(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+	var (
+		first = server2.NewTCPListener("127.0.0.1", 0)
+		s     = newServer([]server2.Listener{
+			first,
+			server2.NewTCPListener("127.0.0.1", occupied.Addr().(*net.TCPAddr).Port),
+		}, nil)
+	)
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("expected bind error")
+	}
+	if _, err := first.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("accept on the started listener = %v, want closed", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestServerShutdownAfterRun Run 返回时监听已经启动，紧接着 Shutdown 关闭监听
+func TestServerShutdownAfterRun(t *testing.T) {
+	var (
+		listener = server2.NewTCPListener("127.0.0.1", 0)
+		s        = newServer([]server2.Listener{listener}, nil)
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("listener still accepting after shutdown")
+	}
+	// 没有启动的服务停止时不关闭任何监听
+	if err := newServer([]server2.Listener{server2.NewTCPListener("127.0.0.1", 0)}, nil).Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"icetea/service/bridge"
+	"os"
+)
+
+// Bridge 到远端服务端的桥接
+type Bridge struct {
+	Name         string   `yaml:"name" toml:"name"`
+	Address      string   `yaml:"address" toml:"address"`
+	ClientID     string   `yaml:"client_id" toml:"client_id"`
+	Username     string   `yaml:"username" toml:"username"`
+	Password     string   `yaml:"password" toml:"password"`
+	CleanSession bool     `yaml:"clean_session" toml:"clean_session"`
+	KeepAlive    Duration `yaml:"keepalive" toml:"keepalive"`
+	// TryPrivate 以桥接协议级别连接，默认开启
+	TryPrivate *bool    `yaml:"try_private" toml:"try_private"`
+	MinBackoff Duration `yaml:"min_backoff" toml:"min_backoff"`
+	MaxBackoff Duration `yaml:"max_backoff" toml:"max_backoff"`
+	// QueueLength 等待转发到远端的消息数量上限，默认 1024
+	QueueLength int           `yaml:"queue_length" toml:"queue_length"`
+	TLS         BridgeTLS     `yaml:"tls" toml:"tls"`
+	Topics      []BridgeTopic `yaml:"topics" toml:"topics"`
+}
+
+// BridgeTLS 连接远端服务端时使用的证书
+type BridgeTLS struct {
+	CAFile             string `yaml:"ca_file" toml:"ca_file"`
+	CertFile           string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile            string `yaml:"key_file" toml:"key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// BridgeTopic 桥接的主题转发规则
+type BridgeTopic struct {
+	Topic        string `yaml:"topic" toml:"topic"`
+	Direction    string `yaml:"direction" toml:"direction"`
+	Qos          byte   `yaml:"qos" toml:"qos"`
+	LocalPrefix  string `yaml:"local_prefix" toml:"local_prefix"`
+	RemotePrefix string `yaml:"remote_prefix" toml:"remote_prefix"`
+}
+
+// Build 生成并校验桥接服务的配置
+func (b *Bridge) Build() (bridge.Config, error) {
+	config := bridge.Config{
+		Name:         b.Name,
+		Address:      b.Address,
+		ClientID:     b.ClientID,
+		Username:     b.Username,
+		Password:     b.Password,
+		CleanSession: b.CleanSession,
+		KeepAlive:    b.KeepAlive.Duration(),
+		TryPrivate:   b.TryPrivate == nil || *b.TryPrivate,
+		MinBackoff:   b.MinBackoff.Duration(),
+		MaxBackoff:   b.MaxBackoff.Duration(),
+		QueueLength:  b.QueueLength,
+	}
+	for _, t := range b.Topics {
+		direction := bridge.Direction(t.Direction)
+		if direction == "" {
+			direction = bridge.Out
+		}
+		config.Mappings = append(config.Mappings, bridge.Mapping{
+			Topic:        t.Topic,
+			Direction:    direction,
+			Qos:          t.Qos,
+			LocalPrefix:  t.LocalPrefix,
+			RemotePrefix: t.RemotePrefix,
+		})
+	}
+	tlsConfig, err := b.TLS.build()
+	if err != nil {
+		return config, fmt.Errorf("bridge %s: %w", b.Name, err)
+	}
+	config.TLS = tlsConfig
+	return config, config.Validate()
+}
+
+// build 生成客户端 tls.Config，没有配置时返回nil
+func (t *BridgeTLS) build() (*tls.Config, error) {
+	if t.CAFile == "" && t.CertFile == "" && !t.InsecureSkipVerify {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls.ca_file %s: no certificates found", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"icetea/client"
+	"icetea/service"
+	"icetea/service/subtree"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config 服务端配置，可以从 YAML 或 TOML 文件加载，命令行参数覆盖文件中的值
+type Config struct {
+	Listeners   []Listener  `yaml:"listeners" toml:"listeners"`
+	Auth        Auth        `yaml:"auth" toml:"auth"`
+	Limits      Limits      `yaml:"limits" toml:"limits"`
+	Persistence Persistence `yaml:"persistence" toml:"persistence"`
+	Log         Log         `yaml:"log" toml:"log"`
+	Sys         Sys         `yaml:"sys" toml:"sys"`
+	// SharedStrategy 共享订阅的负载均衡策略: random, round_robin, sticky, hash
+	SharedStrategy string   `yaml:"shared_strategy" toml:"shared_strategy"`
+	Bridges        []Bridge `yaml:"bridges" toml:"bridges"`
+	Cluster        Cluster  `yaml:"cluster" toml:"cluster"`
+	Admin          Admin    `yaml:"admin" toml:"admin"`
+	Metrics        Metrics  `yaml:"metrics" toml:"metrics"`
+	// ShutdownTimeout 关闭时等待连接断开、消息写完与状态保存的最长时间
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+// DefaultShutdownTimeout 默认的关闭截止时间
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Listener 监听的地址与协议
+type Listener struct {
+	// Protocol 协议: tcp, tls, ws, wss
+	Protocol string `yaml:"protocol" toml:"protocol"`
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	// Path WebSocket 的路径，默认为 /mqtt
+	Path string `yaml:"path" toml:"path"`
+	// AllowedOrigins 浏览器通过 ws、wss 跨域连接时允许的 Origin，如 https://app.example.com，* 允许所有来源。
+	// 默认只允许与请求的 Host 相同的来源以及不带 Origin 的非浏览器客户端
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins"`
+	TLS            TLS      `yaml:"tls" toml:"tls"`
+}
+
+// TLS 监听的证书与客户端证书校验
+type TLS struct {
+	CertFile          string   `yaml:"cert_file" toml:"cert_file"`
+	KeyFile           string   `yaml:"key_file" toml:"key_file"`
+	CAFile            string   `yaml:"ca_file" toml:"ca_file"`
+	RequireClientCert bool     `yaml:"require_client_cert" toml:"require_client_cert"`
+	MinVersion        string   `yaml:"min_version" toml:"min_version"`
+	CipherSuites      []string `yaml:"cipher_suites" toml:"cipher_suites"`
+	UsernameFrom      string   `yaml:"username_from" toml:"username_from"`
+	ClientIDFrom      string   `yaml:"client_id_from" toml:"client_id_from"`
+}
+
+// Auth 连接认证与发布、订阅授权
+type Auth struct {
+	AllowAnonymous bool `yaml:"allow_anonymous" toml:"allow_anonymous"`
+	// PasswordFile 账号文件，每行 username:bcrypt-hash
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	// ACLFile 访问控制规则文件
+	ACLFile string `yaml:"acl_file" toml:"acl_file"`
+}
+
+// Limits 连接与会话的限制
+type Limits struct {
+	ConnectTimeout Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+	// MaxPacketSize 接收报文的最大长度，默认 1 MiB，0 表示不限制，CONNECT 报文始终不超过 1 MiB
+	MaxPacketSize     uint32 `yaml:"max_packet_size" toml:"max_packet_size"`
+	TopicAliasMaximum uint16 `yaml:"topic_alias_maximum" toml:"topic_alias_maximum"`
+	// MaxQueueLength 离线会话消息队列的最大长度，0 表示不限制
+	MaxQueueLength int32 `yaml:"max_queue_length" toml:"max_queue_length"`
+	// OutboundQueueLength 每个在线客户端等待写出的 PUBLISH 上限，0 表示不限制
+	OutboundQueueLength int `yaml:"outbound_queue_length" toml:"outbound_queue_length"`
+	// OverflowPolicy 出站队列满时的处理方式: drop_oldest, drop_newest, disconnect
+	OverflowPolicy string `yaml:"overflow_policy" toml:"overflow_policy"`
+	// MaxTopicLength 主题名与主题过滤器的最大字节数，不超过 65535
+	MaxTopicLength int `yaml:"max_topic_length" toml:"max_topic_length"`
+	// MaxTopicLevels 主题名与主题过滤器的最大层级数，0 表示不限制
+	MaxTopicLevels int `yaml:"max_topic_levels" toml:"max_topic_levels"`
+}
+
+// Persistence 订阅快照
+type Persistence struct {
+	// SnapshotPath 快照文件，为空时不保存
+	SnapshotPath     string   `yaml:"snapshot_path" toml:"snapshot_path"`
+	SnapshotInterval Duration `yaml:"snapshot_interval" toml:"snapshot_interval"`
+}
+
+// Log 日志
+type Log struct {
+	// Level 日志级别: trace, debug, info, warn, error
+	Level string `yaml:"level" toml:"level"`
+	// Format 日志格式: text, json
+	Format string `yaml:"format" toml:"format"`
+	// File 日志文件，为空时输出到标准错误
+	File string `yaml:"file" toml:"file"`
+}
+
+// Sys $SYS 统计信息
+type Sys struct {
+	// Interval 发布间隔，0 表示不发布
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// Cluster 集群，Listen 为空时单机运行
+type Cluster struct {
+	Listen    string   `yaml:"listen" toml:"listen"`
+	Advertise string   `yaml:"advertise" toml:"advertise"`
+	Seeds     []string `yaml:"seeds" toml:"seeds"`
+	// Secret 节点之间的共享密钥，所有节点必须相同，只监听回环地址时可以为空
+	Secret string `yaml:"secret" toml:"secret"`
+}
+
+// Admin HTTP 管理接口，Listen 为空时不启动
+type Admin struct {
+	Listen string `yaml:"listen" toml:"listen"`
+	// Token 请求需要携带 Authorization: Bearer <token>，只监听回环地址时可以为空
+	Token string `yaml:"token" toml:"token"`
+}
+
+// Metrics Prometheus 指标，Listen 为空时不启动
+type Metrics struct {
+	Listen string `yaml:"listen" toml:"listen"`
+}
+
+// Duration 以 Go 时长格式书写的时间，例如 10s, 1m30s
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected a value like 10s or 1m", string(text))
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Default 默认配置，与没有配置文件时的行为一致
+func Default() *Config {
+	return &Config{
+		Listeners: []Listener{
+			{Protocol: "tcp", Host: "127.0.0.1", Port: 1883},
+		},
+		Auth: Auth{AllowAnonymous: true},
+		Limits: Limits{
+			ConnectTimeout:      Duration(client.DefaultConnectTimeout),
+			TopicAliasMaximum:   client.DefaultTopicAliasMaximum,
+			MaxPacketSize:       client.DefaultMaxPacketSize,
+			MaxQueueLength:      subtree.DefaultMaxQueueLength,
+			OutboundQueueLength: client.DefaultOutboundQueueLength,
+			OverflowPolicy:      string(client.DefaultOverflowPolicy),
+			MaxTopicLength:      subtree.MaxTopicLength,
+		},
+		Persistence: Persistence{
+			SnapshotPath:     service.DefaultSnapshotPath,
+			SnapshotInterval: Duration(service.DefaultSnapshotInterval),
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Sys:             Sys{Interval: Duration(service.DefaultSysInterval)},
+		SharedStrategy:  string(service.ShareRandom),
+		ShutdownTimeout: Duration(DefaultShutdownTimeout),
+	}
+}
+
+// LoadFile 在默认配置上加载配置文件，按扩展名选择 YAML (.yaml, .yml) 或 TOML (.toml)，
+// 文件中未知的配置项视为错误
+//
+// param: path 配置文件路径
+// return: 配置，错误信息
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := Default()
+	// 文件中出现 listeners 时替换默认的监听
+	c.Listeners = nil
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown option %q", path, undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format %q, expected .yaml, .yml or .toml", path, ext)
+	}
+	if c.Listeners == nil {
+		c.Listeners = Default().Listeners
+	}
+	return c, nil
+}
+
+// Duration 转换为 time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// listenFlags 可以重复的 -listen 参数
+type listenFlags []Listener
+
+func (l *listenFlags) String() string {
+	return ""
+}
+
+func (l *listenFlags) Set(value string) error {
+	listener, err := parseListen(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, listener)
+	return nil
+}
+
+// parseListen 解析 protocol://host:port/path 格式的监听地址
+func parseListen(value string) (Listener, error) {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Port() == "" {
+		return Listener{}, fmt.Errorf("invalid listener %q, expected protocol://host:port, e.g. tcp://0.0.0.0:1883", value)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid listener %q: bad port", value)
+	}
+	host := u.Hostname()
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return Listener{Protocol: u.Scheme, Host: host, Port: port, Path: u.Path}, nil
+}
+
+// Load 解析命令行参数，从 -config 指定的文件加载配置，再用显式设置的参数覆盖，最后校验
+//
+// param: name 程序名
+// param: args 命令行参数，不含程序名
+// param: output 帮助与错误信息的输出
+// return: 配置，错误信息
+func Load(name string, args []string, output io.Writer) (*Config, error) {
+	var (
+		fs        = flag.NewFlagSet(name, flag.ContinueOnError)
+		file      = fs.String("config", "", "config file (.yaml, .yml or .toml)")
+		listeners listenFlags
+		tlsCert   = fs.String("tls-cert", "", "certificate file for tls and wss listeners")
+		tlsKey    = fs.String("tls-key", "", "private key file for tls and wss listeners")
+		tlsCA     = fs.String("tls-ca", "", "CA file to verify client certificates on tls and wss listeners")
+		wsOrigins = fs.String("ws-allowed-origins", "", "comma separated origins allowed to connect to ws and wss listeners, * for any")
+
+		allowAnonymous = fs.Bool("allow-anonymous", true, "allow clients to connect without a username")
+		passwordFile   = fs.String("password-file", "", "password file with username:bcrypt-hash lines")
+		aclFile        = fs.String("acl-file", "", "access control rule file")
+
+		connectTimeout = fs.Duration("connect-timeout", 0, "time allowed between accept and CONNECT")
+		maxPacketSize  = fs.Uint("max-packet-size", 0, "maximum accepted packet size in bytes (default 1 MiB), 0 for unlimited")
+		maxQueueLength = fs.Int("max-queue-length", 0, "maximum queued messages per offline session, 0 for unlimited")
+		outboundQueue  = fs.Int("outbound-queue-length", 0, "maximum PUBLISH packets waiting to be written per client, 0 for unlimited")
+		overflowPolicy = fs.String("overflow-policy", "", "outbound queue overflow policy: drop_oldest, drop_newest, disconnect")
+		maxTopicLength = fs.Int("max-topic-length", 0, "maximum topic name and filter length in bytes, at most 65535")
+		maxTopicLevels = fs.Int("max-topic-levels", 0, "maximum topic name and filter levels, 0 for unlimited")
+
+		snapshotPath     = fs.String("snapshot-path", "", "subscription snapshot file, empty to disable")
+		snapshotInterval = fs.Duration("snapshot-interval", 0, "interval between subscription snapshots")
+
+		logLevel  = fs.String("log-level", "", "log level: trace, debug, info, warn, error")
+		logFormat = fs.String("log-format", "", "log format: text, json")
+		logFile   = fs.String("log-file", "", "log file, empty for stderr")
+
+		sysInterval    = fs.Duration("sys-interval", 0, "interval between $SYS updates, 0 to disable")
+		sharedStrategy = fs.String("shared-strategy", "", "shared subscription strategy: random, round_robin, sticky, hash")
+
+		clusterListen    = fs.String("cluster-listen", "", "cluster listen address, enables cluster mode")
+		clusterAdvertise = fs.String("cluster-advertise", "", "cluster address other nodes use to reach this node")
+		clusterSeeds     = fs.String("cluster-seeds", "", "comma separated cluster seed addresses")
+		clusterSecret    = fs.String("cluster-secret", "", "shared secret authenticating cluster nodes, required unless cluster-listen is loopback")
+
+		adminListen = fs.String("admin-listen", "", "admin HTTP API listen address, enables the admin API")
+		adminToken  = fs.String("admin-token", "", "bearer token required by the admin HTTP API, may be empty only on a loopback admin-listen")
+
+		metricsListen = fs.String("metrics-listen", "", "Prometheus metrics listen address, serves /metrics")
+
+		shutdownTimeout = fs.Duration("shutdown-timeout", 0, "time allowed for connections to close and state to be saved on shutdown")
+	)
+	fs.Var(&listeners, "listen", "listener as protocol://host:port[/path], repeatable, replaces configured listeners")
+	fs.SetOutput(output)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *file != "" {
+		var err error
+		if c, err = LoadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	overrides := map[string]func(){
+		"listen":                func() { c.Listeners = listeners },
+		"allow-anonymous":       func() { c.Auth.AllowAnonymous = *allowAnonymous },
+		"password-file":         func() { c.Auth.PasswordFile = *passwordFile },
+		"acl-file":              func() { c.Auth.ACLFile = *aclFile },
+		"connect-timeout":       func() { c.Limits.ConnectTimeout = Duration(*connectTimeout) },
+		"max-packet-size":       func() { c.Limits.MaxPacketSize = uint32(*maxPacketSize) },
+		"max-queue-length":      func() { c.Limits.MaxQueueLength = int32(*maxQueueLength) },
+		"outbound-queue-length": func() { c.Limits.OutboundQueueLength = *outboundQueue },
+		"overflow-policy":       func() { c.Limits.OverflowPolicy = *overflowPolicy },
+		"max-topic-length":      func() { c.Limits.MaxTopicLength = *maxTopicLength },
+		"max-topic-levels":      func() { c.Limits.MaxTopicLevels = *maxTopicLevels },
+		"snapshot-path":         func() { c.Persistence.SnapshotPath = *snapshotPath },
+		"snapshot-interval":     func() { c.Persistence.SnapshotInterval = Duration(*snapshotInterval) },
+		"log-level":             func() { c.Log.Level = *logLevel },
+		"log-format":            func() { c.Log.Format = *logFormat },
+		"log-file":              func() { c.Log.File = *logFile },
+		"sys-interval":          func() { c.Sys.Interval = Duration(*sysInterval) },
+		"shared-strategy":       func() { c.SharedStrategy = *sharedStrategy },
+		"cluster-listen":        func() { c.Cluster.Listen = *clusterListen },
+		"cluster-advertise":     func() { c.Cluster.Advertise = *clusterAdvertise },
+		"cluster-seeds":         func() { c.Cluster.Seeds = splitList(*clusterSeeds) },
+		"cluster-secret":        func() { c.Cluster.Secret = *clusterSecret },
+		"admin-listen":          func() { c.Admin.Listen = *adminListen },
+		"admin-token":           func() { c.Admin.Token = *adminToken },
+		"metrics-listen":        func() { c.Metrics.Listen = *metricsListen },
+		"shutdown-timeout":      func() { c.ShutdownTimeout = Duration(*shutdownTimeout) },
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if override, ok := overrides[f.Name]; ok {
+			override()
+		}
+	})
+	// 证书、Origin 参数在监听确定之后应用到所有 tls、wss 或 ws、wss 监听
+	fs.Visit(func(f *flag.Flag) {
+		for i := range c.Listeners {
+			l := &c.Listeners[i]
+			if f.Name == "ws-allowed-origins" && (l.Protocol == "ws" || l.Protocol == "wss") {
+				l.AllowedOrigins = splitList(*wsOrigins)
+			}
+			if l.Protocol == "tls" || l.Protocol == "wss" {
+				switch f.Name {
+				case "tls-cert":
+					l.TLS.CertFile = *tlsCert
+				case "tls-key":
+					l.TLS.KeyFile = *tlsKey
+				case "tls-ca":
+					l.TLS.CAFile = *tlsCA
+				}
+			}
+		}
+	})
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"icetea/client"
+	"icetea/pkg"
+	"icetea/service"
+	"icetea/service/cluster"
+	"icetea/service/server"
+	"icetea/service/subtree"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var protocols = map[string]bool{"tcp": true, "tls": true, "ws": true, "wss": true}
+
+// Validate 校验配置，返回所有不合法的配置项
+func (c *Config) Validate() error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	fileExists := func(field, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			fail("%s: %v", field, err)
+		}
+	}
+
+	if len(c.Listeners) == 0 {
+		fail("listeners: at least one listener is required")
+	}
+	addrs := make(map[string]int)
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		if !protocols[l.Protocol] {
+			fail("%s.protocol: %q is not supported, expected tcp, tls, ws or wss", field, l.Protocol)
+		}
+		if l.Port <= 0 || l.Port > 65535 {
+			fail("%s.port: %d is out of range 1-65535", field, l.Port)
+		}
+		addr := fmt.Sprintf("%s:%d", l.Host, l.Port)
+		if j, ok := addrs[addr]; ok {
+			fail("%s: address %s is already used by listeners[%d]", field, addr, j)
+		}
+		addrs[addr] = i
+		if l.Protocol == "tls" || l.Protocol == "wss" {
+			if l.TLS.CertFile == "" || l.TLS.KeyFile == "" {
+				fail("%s.tls: cert_file and key_file are required for %s", field, l.Protocol)
+			}
+			fileExists(field+".tls.cert_file", l.TLS.CertFile)
+			fileExists(field+".tls.key_file", l.TLS.KeyFile)
+			fileExists(field+".tls.ca_file", l.TLS.CAFile)
+			if l.TLS.RequireClientCert && l.TLS.CAFile == "" {
+				fail("%s.tls: require_client_cert needs ca_file", field)
+			}
+			for name, from := range map[string]string{"username_from": l.TLS.UsernameFrom, "client_id_from": l.TLS.ClientIDFrom} {
+				if from != "" && from != server.IdentityCN && from != server.IdentitySAN {
+					fail("%s.tls.%s: %q is not supported, expected cn or san", field, name, from)
+				}
+			}
+		}
+		if l.Path != "" && !strings.HasPrefix(l.Path, "/") {
+			fail("%s.path: %q must start with /", field, l.Path)
+		}
+		if len(l.AllowedOrigins) > 0 && l.Protocol != "ws" && l.Protocol != "wss" {
+			fail("%s.allowed_origins: only applies to ws and wss listeners", field)
+		}
+		for _, origin := range l.AllowedOrigins {
+			if origin == "*" {
+				continue
+			}
+			if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+				fail("%s.allowed_origins: %q is not an origin, expected scheme://host[:port] or *", field, origin)
+			}
+		}
+	}
+
+	fileExists("auth.password_file", c.Auth.PasswordFile)
+	fileExists("auth.acl_file", c.Auth.ACLFile)
+	// 不允许匿名连接时，只有由客户端证书认证的监听不需要账号文件
+	if c.Auth.PasswordFile == "" && !c.Auth.AllowAnonymous {
+		for i, l := range c.Listeners {
+			if !l.certificateAuth() {
+				fail("auth: allow_anonymous is false but no password_file is set, no client could connect to listeners[%d] without a client certificate identity", i)
+			}
+		}
+	}
+
+	if c.Limits.ConnectTimeout < 0 {
+		fail("limits.connect_timeout: must not be negative")
+	}
+	if c.Limits.MaxPacketSize > 0 && c.Limits.MaxPacketSize < 64 {
+		fail("limits.max_packet_size: %d is too small", c.Limits.MaxPacketSize)
+	}
+	if c.Limits.MaxQueueLength < 0 {
+		fail("limits.max_queue_length: must not be negative")
+	}
+	if c.Limits.OutboundQueueLength < 0 {
+		fail("limits.outbound_queue_length: must not be negative")
+	}
+	if _, err := client.ParseOverflowPolicy(c.Limits.OverflowPolicy); err != nil {
+		fail("limits.overflow_policy: %q is not supported, expected drop_oldest, drop_newest or disconnect", c.Limits.OverflowPolicy)
+	}
+	if c.Limits.MaxTopicLength < 1 || c.Limits.MaxTopicLength > subtree.MaxTopicLength {
+		fail("limits.max_topic_length: %d is out of range 1-%d", c.Limits.MaxTopicLength, subtree.MaxTopicLength)
+	}
+	if c.Limits.MaxTopicLevels < 0 {
+		fail("limits.max_topic_levels: must not be negative")
+	}
+	if c.Persistence.SnapshotInterval < 0 {
+		fail("persistence.snapshot_interval: must not be negative")
+	}
+	if c.Sys.Interval < 0 {
+		fail("sys.interval: must not be negative")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		fail("shutdown_timeout: must be positive")
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		fail("log.level: %q is not a valid level, expected trace, debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("log.format: %q is not supported, expected text or json", c.Log.Format)
+	}
+
+	if _, err := service.ParseShareStrategy(c.SharedStrategy); err != nil {
+		fail("shared_strategy: %q is not supported, expected random, round_robin, sticky or hash", c.SharedStrategy)
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Bridges {
+		if names[c.Bridges[i].Name] {
+			fail("bridges[%d].name: %q is duplicated", i, c.Bridges[i].Name)
+		}
+		names[c.Bridges[i].Name] = true
+		if _, err := c.Bridges[i].Build(); err != nil {
+			fail("bridges[%d]: %v", i, err)
+		}
+	}
+
+	if c.Cluster.Listen != "" {
+		cfg := c.ClusterConfig()
+		if err := cfg.Validate(); err != nil {
+			fail("%v", err)
+		}
+	} else if c.Cluster.Advertise != "" || len(c.Cluster.Seeds) > 0 || c.Cluster.Secret != "" {
+		fail("cluster.listen: required when advertise, seeds or secret are set")
+	}
+
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			fail("admin.listen: %v", err)
+		} else if c.Admin.Token == "" && !pkg.IsLoopback(c.Admin.Listen) {
+			fail("admin.token: required when admin.listen %s is not a loopback address", c.Admin.Listen)
+		}
+	} else if c.Admin.Token != "" {
+		fail("admin.listen: required when token is set")
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			fail("metrics.listen: %v", err)
+		} else if c.Metrics.Listen == c.Admin.Listen {
+			fail("metrics.listen: %s is already used by admin.listen", c.Metrics.Listen)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// certificateAuth 监听的每个连接都提供了已校验的客户端证书，并从证书派生用户名，由 auth.Certificate 认证
+func (l Listener) certificateAuth() bool {
+	return l.Protocol == "tls" && l.TLS.RequireClientCert && l.TLS.UsernameFrom != ""
+}
+
+// ClusterConfig 生成集群节点的配置
+func (c *Config) ClusterConfig() cluster.Config {
+	return cluster.Config{
+		Listen:    c.Cluster.Listen,
+		Advertise: c.Cluster.Advertise,
+		Seeds:     c.Cluster.Seeds,
+		Secret:    c.Cluster.Secret,
+	}
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempFile 创建一个空文件，校验配置时只检查文件是否存在
+func tempFile(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestValidateAuth 不允许匿名连接时，除了由客户端证书认证的 tls 监听，其他监听都需要账号文件
+func TestValidateAuth(t *testing.T) {
+	var (
+		cert     = tempFile(t, "server.crt")
+		key      = tempFile(t, "server.key")
+		ca       = tempFile(t, "ca.crt")
+		password = tempFile(t, "passwords")
+		mtls     = Listener{Protocol: "tls", Port: 8883, TLS: TLS{
+			CertFile: cert, KeyFile: key, CAFile: ca, RequireClientCert: true, UsernameFrom: "cn",
+		}}
+	)
+	optionalCert := mtls
+	optionalCert.TLS.RequireClientCert = false
+	noUsername := mtls
+	noUsername.TLS.UsernameFrom = ""
+	wss := mtls
+	wss.Protocol = "wss"
+	tcp := Listener{Protocol: "tcp", Port: 1883}
+
+	tests := []struct {
+		name         string
+		listeners    []Listener
+		passwordFile string
+		err          string
+	}{
+		{"client certificates only", []Listener{mtls}, "", ""},
+		{"optional client certificate", []Listener{optionalCert}, "", "listeners[0] without a client certificate identity"},
+		{"no username from certificate", []Listener{noUsername}, "", "listeners[0] without a client certificate identity"},
+		{"wss", []Listener{wss}, "", "listeners[0] without a client certificate identity"},
+		{"plain tcp alongside", []Listener{mtls, tcp}, "", "listeners[1] without a client certificate identity"},
+		{"password file", []Listener{mtls, tcp}, password, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Listeners = tt.listeners
+			c.Auth = Auth{PasswordFile: tt.passwordFile}
+			err := c.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestValidate 默认配置合法，每个不合法的配置项都在错误中指出
+func TestValidate(t *testing.T) {
+	var (
+		cert = tempFile(t, "server.crt")
+		key  = tempFile(t, "server.key")
+	)
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"default", func(c *Config) {}, ""},
+		{"no listeners", func(c *Config) { c.Listeners = nil }, "listeners: at least one listener is required"},
+		{"unknown protocol", func(c *Config) { c.Listeners[0].Protocol = "udp" }, `listeners[0].protocol: "udp" is not supported`},
+		{"port out of range", func(c *Config) { c.Listeners[0].Port = 70000 }, "listeners[0].port: 70000 is out of range"},
+		{"duplicate address", func(c *Config) {
+			c.Listeners = append(c.Listeners, Listener{Protocol: "ws", Host: "127.0.0.1", Port: 1883})
+		}, "listeners[1]: address 127.0.0.1:1883 is already used by listeners[0]"},
+		{"tls without certificate", func(c *Config) { c.Listeners[0].Protocol = "tls" }, "listeners[0].tls: cert_file and key_file are required for tls"},
+		{"missing certificate file", func(c *Config) {
+			c.Listeners[0] = Listener{Protocol: "tls", Port: 8883, TLS: TLS{CertFile: cert + ".missing", KeyFile: key}}
+		}, "listeners[0].tls.cert_file"},
+		{"client certificate without ca", func(c *Config) {
+			c.Listeners[0] = Listener{Protocol: "tls", Port: 8883, TLS: TLS{CertFile: cert, KeyFile: key, RequireClientCert: true}}
+		}, "listeners[0].tls: require_client_cert needs ca_file"},
+		{"unknown identity field", func(c *Config) {
+			c.Listeners[0] = Listener{Protocol: "tls", Port: 8883, TLS: TLS{CertFile: cert, KeyFile: key, UsernameFrom: "email"}}
+		}, `listeners[0].tls.username_from: "email" is not supported`},
+		{"relative path", func(c *Config) { c.Listeners[0] = Listener{Protocol: "ws", Port: 8080, Path: "mqtt"} }, `listeners[0].path: "mqtt" must start with /`},
+		{"origins on tcp", func(c *Config) { c.Listeners[0].AllowedOrigins = []string{"*"} }, "listeners[0].allowed_origins: only applies to ws and wss listeners"},
+		{"invalid origin", func(c *Config) {
+			c.Listeners[0] = Listener{Protocol: "ws", Port: 8080, AllowedOrigins: []string{"https://app.example.com/path"}}
+		}, `"https://app.example.com/path" is not an origin`},
+		{"missing password file", func(c *Config) { c.Auth.PasswordFile = cert + ".missing" }, "auth.password_file"},
+		{"negative connect timeout", func(c *Config) { c.Limits.ConnectTimeout = -1 }, "limits.connect_timeout: must not be negative"},
+		{"small max packet size", func(c *Config) { c.Limits.MaxPacketSize = 10 }, "limits.max_packet_size: 10 is too small"},
+		{"negative queue length", func(c *Config) { c.Limits.MaxQueueLength = -1 }, "limits.max_queue_length: must not be negative"},
+		{"unknown overflow policy", func(c *Config) { c.Limits.OverflowPolicy = "block" }, `limits.overflow_policy: "block" is not supported`},
+		{"max topic length", func(c *Config) { c.Limits.MaxTopicLength = 0 }, "limits.max_topic_length: 0 is out of range"},
+		{"zero shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown_timeout: must be positive"},
+		{"unknown log level", func(c *Config) { c.Log.Level = "verbose" }, `log.level: "verbose" is not a valid level`},
+		{"unknown log format", func(c *Config) { c.Log.Format = "xml" }, `log.format: "xml" is not supported`},
+		{"unknown shared strategy", func(c *Config) { c.SharedStrategy = "least_busy" }, `shared_strategy: "least_busy" is not supported`},
+		{"duplicate bridge", func(c *Config) {
+			topics := []BridgeTopic{{Topic: "sensors/#"}}
+			c.Bridges = []Bridge{
+				{Name: "central", Address: "tcp://central:1883", Topics: topics},
+				{Name: "central", Address: "tcp://backup:1883", Topics: topics},
+			}
+		}, `bridges[1].name: "central" is duplicated`},
+		{"bridge without topics", func(c *Config) {
+			c.Bridges = []Bridge{{Name: "central", Address: "tcp://central:1883"}}
+		}, "bridges[0]: bridge central: no topic mappings"},
+		{"cluster without listen", func(c *Config) { c.Cluster.Seeds = []string{"10.0.0.2:7946"} }, "cluster.listen: required when advertise, seeds or secret are set"},
+		{"admin without token", func(c *Config) { c.Admin.Listen = "0.0.0.0:8081" }, "admin.token: required when admin.listen 0.0.0.0:8081 is not a loopback address"},
+		{"admin on loopback", func(c *Config) { c.Admin.Listen = "127.0.0.1:8081" }, ""},
+		{"token without admin", func(c *Config) { c.Admin.Token = "secret" }, "admin.listen: required when token is set"},
+		{"invalid metrics address", func(c *Config) { c.Metrics.Listen = "9100" }, "metrics.listen"},
+		{"metrics on admin address", func(c *Config) {
+			c.Admin.Listen = "127.0.0.1:8081"
+			c.Metrics.Listen = "127.0.0.1:8081"
+		}, "metrics.listen: 127.0.0.1:8081 is already used by admin.listen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			err := c.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestValidateAllErrors 一次返回所有不合法的配置项
+func TestValidateAllErrors(t *testing.T) {
+	c := Default()
+	c.Log.Format = "xml"
+	c.SharedStrategy = "least_busy"
+	c.ShutdownTimeout = 0
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil")
+	}
+	if n := strings.Count(err.Error(), "\n  "); n != 3 {
+		t.Fatalf("%d errors reported, want 3:\n%v", n, err)
+	}
+}
+
+// TestLoadFile 配置文件中的 listeners 替换默认的监听，未设置的配置项保持默认值，未知的配置项是错误
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	yamlPath := write("icetea.yaml", "listeners:\n  - protocol: ws\n    port: 8080\nlimits:\n  connect_timeout: 5s\n")
+	tomlPath := write("icetea.toml", "[[listeners]]\nprotocol = \"ws\"\nport = 8080\n[limits]\nconnect_timeout = \"5s\"\n")
+	for _, path := range []string{yamlPath, tomlPath} {
+		c, err := LoadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if len(c.Listeners) != 1 || c.Listeners[0].Protocol != "ws" || c.Listeners[0].Port != 8080 {
+			t.Fatalf("%s: listeners = %+v", path, c.Listeners)
+		}
+		if c.Limits.ConnectTimeout.Duration() != 5*time.Second || c.Limits.OverflowPolicy != Default().Limits.OverflowPolicy {
+			t.Fatalf("%s: limits = %+v", path, c.Limits)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	for _, path := range []string{
+		write("unknown.yaml", "limits:\n  connect_timout: 5s\n"),
+		write("unknown.toml", "[limits]\nconnect_timout = \"5s\"\n"),
+		write("duration.yaml", "limits:\n  connect_timeout: 5\n"),
+		write("icetea.json", "{}"),
+	} {
+		if _, err := LoadFile(path); err == nil {
+			t.Errorf("LoadFile(%s) succeeded", filepath.Base(path))
+		}
+	}
+}
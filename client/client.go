@@ -2,31 +2,92 @@ package client
 
 import (
 	"context"
+	"errors"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/sirupsen/logrus"
+	"icetea/pkg"
+	"icetea/pkg/metrics"
+	"icetea/pkg/mqtt5"
+	"icetea/pkg/stats"
 	"math/rand"
 	"net"
 	"sync"
+	"time"
 )
 
 type Client struct {
-	conn      net.Conn
-	Id        string
-	handler   PacketHandler
-	messageId uint16
-	mux       sync.RWMutex
+	conn        net.Conn
+	Id          string
+	username    string
+	handler     PacketHandler
+	messageId   uint16
+	outbound    map[uint16]*inflightMessage
+	awaitingRel map[uint16]struct{}
+	pending     []*Message
+	will        *Message
+	// sessionExpiry 断开后会话保留的秒数，0 表示断开时删除会话
+	sessionExpiry uint32
+	// connected 是否已经成功处理 CONNECT 报文，只在读协程中访问
+	connected      bool
+	connectTimeout time.Duration
+	keepalive      time.Duration
+	// version CONNECT 报文中的协议级别，codec 为对应的编解码，在 CONNECT 之后不再改变
+	version byte
+	codec   codec
+	// bridge 是否为其他服务端的桥接连接，桥接连接不会收到自己发布的消息
+	bridge            bool
+	maxPacketSize     uint32
+	topicAliasMaximum uint16
+	// current 正在处理的 MQTT 5.0 报文的附加信息，只在读协程中访问
+	current *mqtt5.Packet
+	// receiveMaximum 客户端允许同时飞行的 QoS 1/2 消息数量，0 表示不限制
+	receiveMaximum uint16
+	// connectedAt 收到 CONNECT 报文的时间，在 CONNECT 之后不再改变
+	connectedAt time.Time
+	// outbox 出站队列，由写协程写出
+	outbox              *outbox
+	outboundQueueLength int
+	overflowPolicy      OverflowPolicy
+	writerDone          chan struct{}
+	// done 读写协程都已退出、ConnectionLost 处理完成后关闭
+	done chan struct{}
+	mux  sync.RWMutex
 }
 
-func NewClient(conn net.Conn, handler PacketHandler) *Client {
+// Message 下发给客户端的消息，Properties 只会发送给 MQTT 5.0 客户端
+type Message struct {
+	Packet     *packets.PublishPacket
+	Properties *mqtt5.Properties
+}
+
+// SessionNeverExpire 会话永不过期
+const SessionNeverExpire = 0xFFFFFFFF
 
-	return &Client{
-		conn:      conn,
-		handler:   handler,
-		messageId: uint16(rand.Intn(10000)),
+func NewClient(conn net.Conn, handler PacketHandler, opts ...Option) *Client {
+	c := &Client{
+		conn:                conn,
+		handler:             handler,
+		messageId:           uint16(rand.Intn(10000)),
+		outbound:            make(map[uint16]*inflightMessage),
+		awaitingRel:         make(map[uint16]struct{}),
+		connectTimeout:      DefaultConnectTimeout,
+		topicAliasMaximum:   DefaultTopicAliasMaximum,
+		maxPacketSize:       DefaultMaxPacketSize,
+		outboundQueueLength: DefaultOutboundQueueLength,
+		overflowPolicy:      DefaultOverflowPolicy,
+		writerDone:          make(chan struct{}),
+		done:                make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	c.outbox = newOutbox(c.outboundQueueLength, c.overflowPolicy)
+	c.codec = &v311Codec{maxPacketSize: c.maxPacketSize}
+	return c
 }
 
 func (c *Client) Run(ctx context.Context) error {
+	go c.writeLoop()
 	go c.handleReadByte(ctx)
 	return nil
 }
@@ -40,34 +101,188 @@ func (c *Client) Name() string {
 }
 
 func (c *Client) handleReadByte(ctx context.Context) {
+	defer func() {
+		c.finish(nil, time.Now().Add(closeTimeout))
+		<-c.writerDone
+		close(c.done)
+	}()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-
-			if mqttPacket, err := packets.ReadPacket(c.conn); err != nil {
-				// TODO:
-				c.Close()
+			c.setReadDeadline()
+			if mqttPacket, err := c.readPacket(); err != nil {
+				c.lost(err)
 				return
 			} else {
-				if err := handlePacket(c, mqttPacket, c.handler); err != nil {
-					// TODO: handle error
-					c.Close()
+				countPacket(mqttPacket, false)
+				mqttPacket, c.current = mqtt5.Unwrap(mqttPacket)
+				if err := c.checkConnect(mqttPacket); err != nil {
+					c.lost(err)
+					return
+				}
+				start := time.Now()
+				err := handlePacket(c, mqttPacket, c.handler)
+				metrics.HandlerDuration.WithLabelValues(packetName(mqttPacket)).Observe(time.Since(start).Seconds())
+				if err != nil {
+					c.lost(err)
 					return
 				}
+				if connect, ok := mqttPacket.(*packets.ConnectPacket); ok {
+					stats.ClientsConnected.Add(1)
+					c.connected = true
+					c.keepalive = time.Duration(connect.Keepalive) * time.Second
+				}
 			}
 		}
 	}
 
 }
 
+func (c *Client) readPacket() (packets.ControlPacket, error) {
+	if !c.connected {
+		return c.readConnect()
+	}
+	return c.codec.ReadPacket(countingReader{c.conn})
+}
+
+// setReadDeadline 连接前等待 CONNECT 报文最多 connectTimeout，
+// 连接后 1.5 倍 keepalive 内没有收到任何报文则断开
+func (c *Client) setReadDeadline() {
+	var deadline time.Time
+	if !c.connected {
+		if c.connectTimeout > 0 {
+			deadline = time.Now().Add(c.connectTimeout)
+		}
+	} else if c.keepalive > 0 {
+		deadline = time.Now().Add(c.keepalive * 3 / 2)
+	}
+	c.conn.SetReadDeadline(deadline)
+}
+
+// checkConnect 第一个报文必须是 CONNECT，且只能发送一次 CONNECT
+func (c *Client) checkConnect(packet packets.ControlPacket) error {
+	_, isConnect := packet.(*packets.ConnectPacket)
+	if !c.connected && !isConnect {
+		return pkg.ErrFirstPacketNotConnect
+	}
+	if c.connected && isConnect {
+		return pkg.ErrDuplicateConnect
+	}
+	return nil
+}
+
+// lost 关闭连接并通知处理器，MQTT 5.0 客户端会先收到带原因码的 DISCONNECT
+func (c *Client) lost(err error) {
+	logrus.WithFields(map[string]interface{}{
+		"clientId": c.GetId(),
+		"error":    err,
+	}).Debug("connection lost")
+	if reason, ok := disconnectReason(err); ok && c.connected {
+		c.Disconnect(reason)
+	} else {
+		c.finish(nil, time.Now().Add(closeTimeout))
+	}
+	c.handler.ConnectionLost(c, err)
+}
+
+// Disconnect 写出队列中剩余的报文后断开连接，MQTT 5.0 客户端会先收到带原因码的 DISCONNECT
+//
+// param: reason MQTT 5.0 原因码
+func (c *Client) Disconnect(reason byte) error {
+	c.finish(c.disconnectPacket(reason), time.Now().Add(closeTimeout))
+	return nil
+}
+
+// disconnectPacket 带原因码的 DISCONNECT，3.1.1 连接返回nil
+func (c *Client) disconnectPacket(reason byte) packets.ControlPacket {
+	if c.version != mqtt5.ProtocolVersion {
+		return nil
+	}
+	return mqtt5.Wrap(packets.NewControlPacket(packets.Disconnect), nil, reason)
+}
+
+// Shutdown 服务端关闭时断开连接，在截止时间前写出队列中剩余的报文，
+// MQTT 5.0 客户端会收到 ServerShuttingDown
+//
+// param: deadline 写入的截止时间
+func (c *Client) Shutdown(deadline time.Time) error {
+	c.finish(c.disconnectPacket(mqtt5.ServerShuttingDown), deadline)
+	return nil
+}
+
+// Done 读写协程退出、连接断开的处理完成后关闭
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// HandleWrite 报文进入出站队列，队列已满时按溢出策略处理，
+// 新的 PUBLISH 被丢弃时返回 pkg.ErrMessageDropped，连接不受影响
 func (c *Client) HandleWrite(packet packets.ControlPacket) error {
-	logrus.WithField("packet", packet.String()).WithField("detail", packet.Details()).Debug("client.HandleWrite")
-	return packet.Write(c.conn)
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		logrus.WithField("packet", packet.String()).WithField("detail", packet.Details()).Debug("client.HandleWrite")
+	}
+	dropped, err := c.outbox.push(packet)
+	if dropped != nil {
+		c.forgetInflight(dropped)
+	}
+	if errors.Is(err, pkg.ErrOutboundQueueFull) {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": c.GetId(),
+		}).Warn("outbound queue full, disconnecting slow client")
+		c.Close()
+	}
+	return err
+}
+
+// ProtocolVersion CONNECT 报文中的协议级别
+func (c *Client) ProtocolVersion() byte {
+	return c.version
 }
 
+// ConnectedAt 收到 CONNECT 报文的时间
+func (c *Client) ConnectedAt() time.Time {
+	return c.connectedAt
+}
+
+// IsBridge 是否为其他服务端的桥接连接
+func (c *Client) IsBridge() bool {
+	return c.bridge
+}
+
+// PacketV5 正在处理的 MQTT 5.0 报文的属性与原因码，3.1.1 连接返回nil，
+// 只能在 PacketHandler 中调用
+func (c *Client) PacketV5() *mqtt5.Packet {
+	return c.current
+}
+
+// MaxPacketSize 服务端接收报文的最大长度，0 表示不限制
+func (c *Client) MaxPacketSize() uint32 {
+	return c.maxPacketSize
+}
+
+// TopicAliasMaximum 服务端允许 MQTT 5.0 客户端使用的主题别名最大值
+func (c *Client) TopicAliasMaximum() uint16 {
+	return c.topicAliasMaximum
+}
+
+// SetPeerLimits 设置 MQTT 5.0 客户端在 CONNECT 中声明的接收限制
+//
+// param: receiveMaximum 同时飞行的 QoS 1/2 消息数量
+// param: maxPacketSize 可以接收的最大报文长度，0 表示不限制
+func (c *Client) SetPeerLimits(receiveMaximum uint16, maxPacketSize uint32) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.receiveMaximum = receiveMaximum
+	if codec, ok := c.codec.(*mqtt5.Codec); ok {
+		codec.PeerMaxPacketSize = maxPacketSize
+	}
+}
+
+// Close 丢弃出站队列中的报文并立即关闭连接
 func (c *Client) Close() error {
+	c.outbox.abort()
 	return c.conn.Close()
 }
 
@@ -82,12 +297,65 @@ func (c *Client) SetId(id string) {
 	c.Id = id
 }
 
+// SetWill 保存客户端的遗嘱消息
+func (c *Client) SetWill(will *Message) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.will = will
+}
+
+// TakeWill 取出并清除客户端的遗嘱消息，正常断开时调用以丢弃遗嘱
+//
+// return: 遗嘱消息，没有遗嘱时为nil
+func (c *Client) TakeWill() *Message {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	will := c.will
+	c.will = nil
+	return will
+}
+
+func (c *Client) GetUsername() string {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.username
+}
+
+func (c *Client) SetUsername(username string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.username = username
+}
+
+// SetSessionExpiry 设置断开后会话保留的秒数
+func (c *Client) SetSessionExpiry(seconds uint32) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.sessionExpiry = seconds
+}
+
+func (c *Client) SessionExpiry() uint32 {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.sessionExpiry
+}
+
 func (c *Client) NextMessageId() uint16 {
 	c.mux.Lock()
 	defer c.mux.Unlock()
-	c.messageId += 1
-	if c.messageId == uint16(0xff) {
-		c.messageId = 0
+	return c.nextMessageIdWithoutLock()
+}
+
+// nextMessageIdWithoutLock 生成下一个报文ID，跳过0和仍在飞行中的ID
+func (c *Client) nextMessageIdWithoutLock() uint16 {
+	for i := 0; i < 0xffff; i++ {
+		c.messageId++
+		if c.messageId == 0 {
+			c.messageId = 1
+		}
+		if _, ok := c.outbound[c.messageId]; !ok {
+			break
+		}
 	}
 	return c.messageId
 }
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bytes"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg"
+	"icetea/pkg/mqtt5"
+	"io"
+	"time"
+)
+
+// codec 按连接协商的协议版本读写报文
+type codec interface {
+	ReadPacket(r io.Reader) (packets.ControlPacket, error)
+	WritePacket(w io.Writer, packet packets.ControlPacket) error
+}
+
+// v311Codec MQTT 3.1/3.1.1 编解码，写出时忽略 5.0 的附加信息
+type v311Codec struct {
+	maxPacketSize uint32
+}
+
+func (c *v311Codec) ReadPacket(r io.Reader) (packets.ControlPacket, error) {
+	raw, err := mqtt5.ReadRaw(r, c.maxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+	return packets.ReadPacket(bytes.NewReader(raw))
+}
+
+func (c *v311Codec) WritePacket(w io.Writer, packet packets.ControlPacket) error {
+	packet, _ = mqtt5.Unwrap(packet)
+	if subAck, ok := packet.(*packets.SubackPacket); ok {
+		// 3.1.1 SUBACK 的失败返回码只有 0x80
+		downgrade := *subAck
+		downgrade.ReturnCodes = make([]byte, len(subAck.ReturnCodes))
+		for i, code := range subAck.ReturnCodes {
+			if code >= 0x80 {
+				code = 0x80
+			}
+			downgrade.ReturnCodes[i] = code
+		}
+		packet = &downgrade
+	}
+	return packet.Write(w)
+}
+
+// bridgeFlag 桥接连接在协议级别中设置的标志位
+const bridgeFlag = 0x80
+
+// readConnect 读取连接的第一个报文，根据 CONNECT 中的协议级别选择编解码
+func (c *Client) readConnect() (packets.ControlPacket, error) {
+	limit := uint32(MaxConnectPacketSize)
+	if c.maxPacketSize > 0 && c.maxPacketSize < limit {
+		limit = c.maxPacketSize
+	}
+	raw, err := mqtt5.ReadRaw(countingReader{c.conn}, limit)
+	if err != nil {
+		return nil, err
+	}
+	version, err := mqtt5.Version(raw)
+	if err != nil {
+		return nil, pkg.ErrFirstPacketNotConnect
+	}
+	c.connectedAt = time.Now()
+	if version == mqtt5.ProtocolVersion {
+		codec := &mqtt5.Codec{
+			MaxPacketSize:     c.maxPacketSize,
+			TopicAliasMaximum: c.topicAliasMaximum,
+		}
+		c.version, c.codec = version, codec
+		return codec.Decode(raw)
+	}
+	// 桥接连接的协议级别带有 0x80 标志，例如 Mosquitto 的 try_private
+	c.bridge = version&bridgeFlag != 0
+	c.version = version &^ bridgeFlag
+	packet, err := packets.ReadPacket(bytes.NewReader(raw))
+	if connect, ok := packet.(*packets.ConnectPacket); ok {
+		connect.ProtocolVersion = c.version
+	}
+	return packet, err
+}
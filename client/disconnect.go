@@ -0,0 +1,34 @@
+package client
+
+import (
+	"errors"
+	"icetea/pkg"
+	"icetea/pkg/mqtt5"
+	"net"
+)
+
+// disconnectReason 连接因错误关闭时发送给 MQTT 5.0 客户端的原因码
+//
+// return: 原因码，网络错误等无需通知客户端的情况返回false
+func disconnectReason(err error) (byte, bool) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, mqtt5.ErrMalformed):
+		return mqtt5.MalformedPacket, true
+	case errors.Is(err, mqtt5.ErrPacketTooLarge):
+		return mqtt5.PacketTooLarge, true
+	case errors.Is(err, mqtt5.ErrTopicAliasInvalid):
+		return mqtt5.TopicAliasInvalid, true
+	case errors.Is(err, pkg.ErrTopicNameInvalid):
+		return mqtt5.TopicNameInvalid, true
+	case errors.Is(err, mqtt5.ErrProtocol),
+		errors.Is(err, pkg.ErrDuplicateConnect),
+		errors.Is(err, pkg.ErrMQTTCodeProtocolError),
+		errors.Is(err, pkg.ErrSwitchType):
+		return mqtt5.ProtocolError, true
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return mqtt5.KeepAliveTimeout, true
+	default:
+		return 0, false
+	}
+}
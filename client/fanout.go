@@ -0,0 +1,105 @@
+package client
+
+import (
+	"bytes"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg/mqtt5"
+	"sync"
+	"time"
+)
+
+// Fanout 一条消息向多个订阅者的一次下发。QoS 0 的下发没有报文ID，
+// 同一协议版本、同一保留标志的订阅者共享一份编码结果，只编码一次
+type Fanout struct {
+	packet     *packets.PublishPacket
+	properties *mqtt5.Properties
+	// forward 转发给 MQTT 5.0 订阅者的属性，在创建时计算一次
+	forward    *mqtt5.Properties
+	expired    bool
+	v311       encodedOnce
+	v5         encodedOnce
+	v311Retain encodedOnce
+	v5Retain   encodedOnce
+}
+
+type encodedOnce struct {
+	once    sync.Once
+	encoded *encodedPublish
+	err     error
+}
+
+// encodedPublish 已经编码好的 QoS 0 PUBLISH，写协程直接写出字节
+type encodedPublish struct {
+	*packets.PublishPacket
+	raw []byte
+}
+
+// NewFanout 创建一次下发
+//
+// param: packet 发布的消息
+// param: properties MQTT 5.0 属性，可以为nil
+func NewFanout(packet *packets.PublishPacket, properties *mqtt5.Properties) *Fanout {
+	now := time.Now()
+	return &Fanout{
+		packet:     packet,
+		properties: properties,
+		forward:    properties.ForForward(now),
+		expired:    properties.Expired(now),
+	}
+}
+
+// encoded QoS 0 报文的编码结果，并发安全，所有订阅者共享同一个只读的报文
+//
+// param: v5 是否为 MQTT 5.0 订阅者
+// param: retain 下发的报文的保留标志
+func (f *Fanout) encoded(v5, retain bool) (*encodedPublish, error) {
+	e := &f.v311
+	switch {
+	case v5 && retain:
+		e = &f.v5Retain
+	case v5:
+		e = &f.v5
+	case retain:
+		e = &f.v311Retain
+	}
+	e.once.Do(func() {
+		var (
+			packet = f.packet.Copy()
+			raw    []byte
+		)
+		packet.Retain = retain
+		if v5 {
+			raw, e.err = (&mqtt5.Codec{}).Encode(mqtt5.Wrap(packet, f.forward, mqtt5.Success))
+		} else {
+			var buf bytes.Buffer
+			e.err = packet.Write(&buf)
+			raw = buf.Bytes()
+		}
+		e.encoded = &encodedPublish{PublishPacket: packet, raw: raw}
+	})
+	return e.encoded, e.err
+}
+
+// PublishFanout 按授予的 QoS 向客户端下发消息，QoS 0 时复用编码结果
+//
+// param: fanout 一次下发
+// param: qos 授予的 QoS
+// param: retainAsPublished 是否保持消息的保留标志，否则下发的报文保留标志为 0
+// return: 写入错误
+func (c *Client) PublishFanout(fanout *Fanout, qos byte, retainAsPublished bool) error {
+	retain := retainAsPublished && fanout.packet.Retain
+	if qos > 0 {
+		packet := fanout.packet.Copy()
+		packet.Qos = qos
+		packet.Retain = retain
+		return c.Publish(packet, fanout.properties)
+	}
+	if fanout.expired {
+		return nil
+	}
+	encoded, err := fanout.encoded(c.version == mqtt5.ProtocolVersion, retain)
+	if err != nil {
+		return err
+	}
+	return c.HandleWrite(encoded)
+}
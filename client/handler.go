@@ -9,10 +9,16 @@ import (
 type PacketHandler interface {
 	ConnectPacket(client *Client, packet *packets.ConnectPacket) error
 	PublishPacket(client *Client, packet *packets.PublishPacket) error
+	PubackPacket(client *Client, packet *packets.PubackPacket) error
+	PubrecPacket(client *Client, packet *packets.PubrecPacket) error
+	PubrelPacket(client *Client, packet *packets.PubrelPacket) error
+	PubcompPacket(client *Client, packet *packets.PubcompPacket) error
 	SubscribePacket(client *Client, packet *packets.SubscribePacket) error
 	UnsubscribePacket(client *Client, packet *packets.UnsubscribePacket) error
 	PingPacket(client *Client, packet *packets.PingreqPacket) error
 	DisconnectPacket(client *Client, packet *packets.DisconnectPacket) error
+	// ConnectionLost 连接因读取错误或处理错误被关闭
+	ConnectionLost(client *Client, err error)
 }
 
 func handlePacket(client *Client, packet packets.ControlPacket, handler PacketHandler) error {
@@ -28,6 +34,14 @@ func handlePacket(client *Client, packet packets.ControlPacket, handler PacketHa
 		return handler.ConnectPacket(client, packet.(*packets.ConnectPacket))
 	case *packets.PublishPacket:
 		return handler.PublishPacket(client, packet.(*packets.PublishPacket))
+	case *packets.PubackPacket:
+		return handler.PubackPacket(client, packet.(*packets.PubackPacket))
+	case *packets.PubrecPacket:
+		return handler.PubrecPacket(client, packet.(*packets.PubrecPacket))
+	case *packets.PubrelPacket:
+		return handler.PubrelPacket(client, packet.(*packets.PubrelPacket))
+	case *packets.PubcompPacket:
+		return handler.PubcompPacket(client, packet.(*packets.PubcompPacket))
 	case *packets.SubscribePacket:
 		return handler.SubscribePacket(client, packet.(*packets.SubscribePacket))
 	case *packets.UnsubscribePacket:
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg"
+	"icetea/pkg/mqtt5"
+	"sort"
+	"time"
+)
+
+// inflightState 出站消息当前等待的确认报文
+type inflightState byte
+
+const (
+	waitPuback inflightState = iota
+	waitPubrec
+	waitPubcomp
+)
+
+// inflightMessage 已下发但尚未完成确认流程的 QoS 1/2 消息
+type inflightMessage struct {
+	// message 下发的消息，会话恢复时重新记录的等待 PUBCOMP 的消息为nil
+	message *Message
+	state   inflightState
+	sentAt  time.Time
+}
+
+// Publish 向客户端下发一条消息，QoS > 0 时分配报文ID并记录为飞行中消息。
+// 已过期的消息被丢弃；飞行中的消息达到客户端的 Receive Maximum 时消息进入等待队列
+//
+// param: packet 下发的消息, QoS 应为已授予的 QoS
+// param: properties MQTT 5.0 属性，可以为nil
+// return: 写入错误
+func (c *Client) Publish(packet *packets.PublishPacket, properties *mqtt5.Properties) error {
+	now := time.Now()
+	if properties.Expired(now) {
+		return nil
+	}
+	message := &Message{Packet: packet}
+	if c.version == mqtt5.ProtocolVersion {
+		message.Properties = properties.ForForward(now)
+	}
+	if packet.Qos > 0 {
+		c.mux.Lock()
+		if c.receiveMaximum > 0 && len(c.outbound) >= int(c.receiveMaximum) {
+			c.pending = append(c.pending, message)
+			c.mux.Unlock()
+			return nil
+		}
+		c.storeInflightWithoutLock(message, now)
+		c.mux.Unlock()
+	} else {
+		packet.MessageID = 0
+	}
+	return c.writePublish(message)
+}
+
+// storeInflightWithoutLock 为消息分配报文ID并记录为飞行中消息
+func (c *Client) storeInflightWithoutLock(message *Message, now time.Time) {
+	packet := message.Packet
+	// 重发的消息尽量沿用原来的报文ID
+	if _, ok := c.outbound[packet.MessageID]; ok || !packet.Dup || packet.MessageID == 0 {
+		packet.MessageID = c.nextMessageIdWithoutLock()
+	}
+	state := waitPuback
+	if packet.Qos == 2 {
+		state = waitPubrec
+	}
+	c.outbound[packet.MessageID] = &inflightMessage{
+		message: message,
+		state:   state,
+		sentAt:  now,
+	}
+}
+
+// writePublish 消息进入出站队列，超过客户端最大报文长度的消息在写出时被丢弃
+func (c *Client) writePublish(message *Message) error {
+	var packet packets.ControlPacket = message.Packet
+	if message.Properties != nil {
+		packet = mqtt5.Wrap(message.Packet, message.Properties, mqtt5.Success)
+	}
+	return c.HandleWrite(packet)
+}
+
+// flushPending 飞行窗口有空余时发送等待队列中的消息
+func (c *Client) flushPending() error {
+	for {
+		now := time.Now()
+		c.mux.Lock()
+		if len(c.pending) == 0 || (c.receiveMaximum > 0 && len(c.outbound) >= int(c.receiveMaximum)) {
+			c.mux.Unlock()
+			return nil
+		}
+		message := c.pending[0]
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+		if message.Properties.Expired(now) {
+			c.mux.Unlock()
+			continue
+		}
+		c.storeInflightWithoutLock(message, now)
+		c.mux.Unlock()
+		if err := c.writePublish(message); err != nil && !errors.Is(err, pkg.ErrMessageDropped) {
+			return err
+		}
+	}
+}
+
+// AckPublish 收到 PUBACK，结束 QoS 1 消息的飞行
+//
+// param: id 报文ID
+// return: 报文ID是否处于等待 PUBACK 状态
+func (c *Client) AckPublish(id uint16) bool {
+	c.mux.Lock()
+	m, ok := c.outbound[id]
+	ok = ok && m.state == waitPuback
+	if ok {
+		delete(c.outbound, id)
+	}
+	c.mux.Unlock()
+	if ok {
+		c.flushPending()
+	}
+	return ok
+}
+
+// ReceivedPublish 收到 PUBREC，QoS 2 消息进入等待 PUBCOMP 阶段
+//
+// param: id 报文ID
+// param: failed PUBREC 的原因码表示失败，消息的飞行直接结束
+// return: 报文ID是否为飞行中的 QoS 2 消息
+func (c *Client) ReceivedPublish(id uint16, failed bool) bool {
+	c.mux.Lock()
+	m, ok := c.outbound[id]
+	ok = ok && m.state != waitPuback
+	if ok {
+		if failed {
+			delete(c.outbound, id)
+		} else {
+			m.state = waitPubcomp
+		}
+	}
+	c.mux.Unlock()
+	if ok && failed {
+		c.flushPending()
+	}
+	return ok
+}
+
+// CompletePublish 收到 PUBCOMP，结束 QoS 2 消息的飞行
+//
+// param: id 报文ID
+// return: 报文ID是否处于等待 PUBCOMP 状态
+func (c *Client) CompletePublish(id uint16) bool {
+	c.mux.Lock()
+	m, ok := c.outbound[id]
+	ok = ok && m.state == waitPubcomp
+	if ok {
+		delete(c.outbound, id)
+	}
+	c.mux.Unlock()
+	if ok {
+		c.flushPending()
+	}
+	return ok
+}
+
+// InflightLen 飞行中的出站消息数量
+func (c *Client) InflightLen() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return len(c.outbound)
+}
+
+// TakeInflight 取出并清空飞行中的出站消息与等待队列，用于会话保持时的重发。
+// 已收到 PUBREC 的 QoS 2 消息对端已经持有，重连后只重发 PUBREL，单独返回它们的报文ID
+//
+// return: 按下发时间排列的待重发消息，已下发的消息设置了 DUP 标志；按下发时间排列的等待 PUBCOMP 的报文ID
+func (c *Client) TakeInflight() ([]*Message, []uint16) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	messages := make([]*inflightMessage, 0, len(c.outbound))
+	ids := make(map[*inflightMessage]uint16, len(c.outbound))
+	for id, m := range c.outbound {
+		messages = append(messages, m)
+		ids[m] = id
+	}
+	c.outbound = make(map[uint16]*inflightMessage)
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].sentAt.Before(messages[j].sentAt)
+	})
+	var (
+		result   = make([]*Message, 0, len(messages)+len(c.pending))
+		releases []uint16
+	)
+	for _, m := range messages {
+		if m.state == waitPubcomp {
+			releases = append(releases, ids[m])
+			continue
+		}
+		m.message.Packet.Dup = true
+		result = append(result, m.message)
+	}
+	result = append(result, c.pending...)
+	c.pending = nil
+	return result, releases
+}
+
+// ResumeReleases 会话恢复时重新记录断开前已收到 PUBREC 的 QoS 2 消息并重发 PUBREL，
+// 见 MQTT 3.1.1 4.4、MQTT 5.0 4.4
+//
+// param: ids 等待 PUBCOMP 的报文ID
+// return: 写入错误
+func (c *Client) ResumeReleases(ids []uint16) error {
+	now := time.Now()
+	c.mux.Lock()
+	for _, id := range ids {
+		c.outbound[id] = &inflightMessage{state: waitPubcomp, sentAt: now}
+	}
+	c.mux.Unlock()
+	for _, id := range ids {
+		pubRel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubRel.MessageID = id
+		if err := c.HandleWrite(mqtt5.Wrap(pubRel, nil, mqtt5.Success)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StoreAwaitingRel 记录收到的 QoS 2 消息，等待客户端发送 PUBREL
+//
+// param: id 报文ID
+// return: false 表示该报文ID已记录过，是重复投递的消息
+func (c *Client) StoreAwaitingRel(id uint16) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if _, ok := c.awaitingRel[id]; ok {
+		return false
+	}
+	c.awaitingRel[id] = struct{}{}
+	return true
+}
+
+// ReleaseAwaitingRel 收到 PUBREL，释放 QoS 2 入站消息的报文ID
+//
+// param: id 报文ID
+// return: 报文ID是否在等待 PUBREL
+func (c *Client) ReleaseAwaitingRel(id uint16) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	_, ok := c.awaitingRel[id]
+	delete(c.awaitingRel, id)
+	return ok
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"net"
+	"testing"
+)
+
+// newTestClient 创建一个不启动读写协程的客户端，下发的报文留在出站队列中
+func newTestClient(t *testing.T, opts ...Option) *Client {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return NewClient(remote, nil, opts...)
+}
+
+func newPublish(topic string, qos byte) *packets.PublishPacket {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Qos = qos
+	packet.Payload = []byte(topic)
+	return packet
+}
+
+// TestQos1Handshake QoS 1 消息分配报文ID并等待 PUBACK，重复或状态不对的确认被忽略
+func TestQos1Handshake(t *testing.T) {
+	c := newTestClient(t)
+	packet := newPublish("qos1", 1)
+	if err := c.Publish(packet, nil); err != nil {
+		t.Fatal(err)
+	}
+	id := packet.MessageID
+	if id == 0 || c.InflightLen() != 1 {
+		t.Fatalf("message id %d, inflight %d", id, c.InflightLen())
+	}
+	if c.ReceivedPublish(id, false) || c.CompletePublish(id) {
+		t.Fatal("QoS 1 message accepted PUBREC or PUBCOMP")
+	}
+	if !c.AckPublish(id) {
+		t.Fatal("PUBACK not accepted")
+	}
+	if c.AckPublish(id) {
+		t.Fatal("duplicate PUBACK accepted")
+	}
+	if c.InflightLen() != 0 {
+		t.Fatalf("inflight %d after PUBACK", c.InflightLen())
+	}
+}
+
+// TestQos2Handshake QoS 2 消息依次等待 PUBREC 与 PUBCOMP，失败的 PUBREC 直接结束飞行
+func TestQos2Handshake(t *testing.T) {
+	c := newTestClient(t)
+	packet := newPublish("qos2", 2)
+	if err := c.Publish(packet, nil); err != nil {
+		t.Fatal(err)
+	}
+	id := packet.MessageID
+	if c.AckPublish(id) || c.CompletePublish(id) {
+		t.Fatal("PUBACK or PUBCOMP accepted before PUBREC")
+	}
+	if !c.ReceivedPublish(id, false) {
+		t.Fatal("PUBREC not accepted")
+	}
+	if c.InflightLen() != 1 {
+		t.Fatalf("inflight %d after PUBREC", c.InflightLen())
+	}
+	if !c.ReceivedPublish(id, false) {
+		t.Fatal("repeated PUBREC not accepted")
+	}
+	if !c.CompletePublish(id) || c.CompletePublish(id) {
+		t.Fatal("PUBCOMP not accepted exactly once")
+	}
+
+	failed := newPublish("qos2/failed", 2)
+	if err := c.Publish(failed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !c.ReceivedPublish(failed.MessageID, true) {
+		t.Fatal("failed PUBREC not accepted")
+	}
+	if c.InflightLen() != 0 || c.CompletePublish(failed.MessageID) {
+		t.Fatal("failed PUBREC did not end the flow")
+	}
+}
+
+// TestMessageIdAllocation 报文ID跳过0与仍在飞行中的ID，确认后的ID可以再次使用
+func TestMessageIdAllocation(t *testing.T) {
+	c := newTestClient(t)
+	c.messageId = 0xfffe
+	var ids []uint16
+	for i := 0; i < 3; i++ {
+		packet := newPublish("ids", 1)
+		if err := c.Publish(packet, nil); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, packet.MessageID)
+	}
+	if ids[0] != 0xffff || ids[1] != 1 || ids[2] != 2 {
+		t.Fatalf("ids = %v, want [65535 1 2]", ids)
+	}
+
+	// 1 仍在飞行中，回绕后跳过；确认后的 2 再次使用
+	c.AckPublish(2)
+	c.messageId = 0
+	for _, want := range []uint16{2, 3} {
+		packet := newPublish("ids", 1)
+		if err := c.Publish(packet, nil); err != nil {
+			t.Fatal(err)
+		}
+		if packet.MessageID != want {
+			t.Fatalf("id = %d, want %d", packet.MessageID, want)
+		}
+	}
+}
+
+// TestReceiveMaximum 飞行中的消息达到 Receive Maximum 时进入等待队列，确认后按顺序下发
+func TestReceiveMaximum(t *testing.T) {
+	c := newTestClient(t)
+	c.SetPeerLimits(1, 0)
+	first, second := newPublish("first", 1), newPublish("second", 1)
+	c.Publish(first, nil)
+	c.Publish(second, nil)
+	if c.InflightLen() != 1 || second.MessageID != 0 {
+		t.Fatalf("inflight %d, second id %d", c.InflightLen(), second.MessageID)
+	}
+	c.AckPublish(first.MessageID)
+	if c.InflightLen() != 1 || second.MessageID == 0 {
+		t.Fatalf("second message not sent after PUBACK: inflight %d", c.InflightLen())
+	}
+}
+
+// TestStoreAwaitingRel 入站 QoS 2 消息的报文ID在收到 PUBREL 之前识别重复投递，PUBREL 之后可以再次使用
+func TestStoreAwaitingRel(t *testing.T) {
+	c := newTestClient(t)
+	if !c.StoreAwaitingRel(7) {
+		t.Fatal("first delivery reported as duplicate")
+	}
+	if c.StoreAwaitingRel(7) {
+		t.Fatal("duplicate delivery not detected")
+	}
+	if !c.ReleaseAwaitingRel(7) || c.ReleaseAwaitingRel(7) {
+		t.Fatal("PUBREL not released exactly once")
+	}
+	if !c.StoreAwaitingRel(7) {
+		t.Fatal("released id not reusable")
+	}
+}
+
+// TestTakeInflight 会话保持时按下发顺序取出未确认的消息并设置 DUP，等待 PUBCOMP 的消息只返回报文ID，
+// 重新下发时沿用原来的报文ID
+func TestTakeInflight(t *testing.T) {
+	c := newTestClient(t)
+	c.SetPeerLimits(3, 0)
+	var published []*packets.PublishPacket
+	for _, qos := range []byte{1, 2, 2, 1} {
+		packet := newPublish("take", qos)
+		c.Publish(packet, nil)
+		published = append(published, packet)
+	}
+	// 第三条已收到 PUBREC，第四条在等待队列中
+	c.ReceivedPublish(published[2].MessageID, false)
+
+	messages, releases := c.TakeInflight()
+	if len(releases) != 1 || releases[0] != published[2].MessageID {
+		t.Fatalf("releases = %v, want [%d]", releases, published[2].MessageID)
+	}
+	if len(messages) != 3 || messages[0].Packet != published[0] || messages[1].Packet != published[1] || messages[2].Packet != published[3] {
+		t.Fatalf("messages not in delivery order")
+	}
+	if !messages[0].Packet.Dup || !messages[1].Packet.Dup || messages[2].Packet.Dup {
+		t.Fatal("DUP must be set only on delivered messages")
+	}
+	if c.InflightLen() != 0 {
+		t.Fatalf("inflight %d after take", c.InflightLen())
+	}
+
+	resumed := newTestClient(t)
+	if err := resumed.ResumeReleases(releases); err != nil {
+		t.Fatal(err)
+	}
+	id := messages[0].Packet.MessageID
+	if err := resumed.Publish(messages[0].Packet, nil); err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].Packet.MessageID != id {
+		t.Fatalf("resent message id %d, want %d", messages[0].Packet.MessageID, id)
+	}
+	// 与等待 PUBCOMP 的报文ID冲突时分配新的ID
+	conflict := newPublish("take", 1)
+	conflict.Dup = true
+	conflict.MessageID = releases[0]
+	resumed.Publish(conflict, nil)
+	if conflict.MessageID == releases[0] {
+		t.Fatal("resent message reused an id awaiting PUBCOMP")
+	}
+	if !resumed.CompletePublish(releases[0]) {
+		t.Fatal("PUBCOMP for the resumed PUBREL not accepted")
+	}
+}
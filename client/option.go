@@ -0,0 +1,46 @@
+package client
+
+import "time"
+
+const (
+	// DefaultConnectTimeout 建立连接后等待 CONNECT 报文的默认时长
+	DefaultConnectTimeout = 10 * time.Second
+	// DefaultTopicAliasMaximum MQTT 5.0 客户端可以使用的主题别名默认最大值
+	DefaultTopicAliasMaximum = 16
+	// DefaultMaxPacketSize 接收报文的默认最大长度
+	DefaultMaxPacketSize = 1 << 20
+	// MaxConnectPacketSize CONNECT 报文的最大长度，与 WithMaxPacketSize 中较小的一个生效。
+	// 认证之前的连接不能让服务端分配更多的内存，CONNECT 中的每个字段都不超过 65535 字节
+	MaxConnectPacketSize = 1 << 20
+)
+
+type Option func(c *Client)
+
+// WithConnectTimeout 设置等待 CONNECT 报文的时长，超时未收到时关闭连接
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.connectTimeout = timeout
+	}
+}
+
+// WithMaxPacketSize 设置接收报文的最大长度，默认为 DefaultMaxPacketSize，0 表示不限制
+func WithMaxPacketSize(size uint32) Option {
+	return func(c *Client) {
+		c.maxPacketSize = size
+	}
+}
+
+// WithTopicAliasMaximum 设置 MQTT 5.0 客户端可以使用的主题别名最大值
+func WithTopicAliasMaximum(maximum uint16) Option {
+	return func(c *Client) {
+		c.topicAliasMaximum = maximum
+	}
+}
+
+// WithOutboundQueue 设置出站队列中等待写出的 PUBLISH 上限与溢出时的处理方式，0 表示不限制
+func WithOutboundQueue(length int, policy OverflowPolicy) Option {
+	return func(c *Client) {
+		c.outboundQueueLength = length
+		c.overflowPolicy = policy
+	}
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg"
+	"icetea/pkg/metrics"
+	"icetea/pkg/mqtt5"
+	"io"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy 出站队列中的 PUBLISH 达到上限时的处理方式
+type OverflowPolicy string
+
+const (
+	// DropOldest 丢弃队列中最早的 PUBLISH
+	DropOldest OverflowPolicy = "drop_oldest"
+	// DropNewest 丢弃新的 PUBLISH，入队返回 pkg.ErrMessageDropped
+	DropNewest OverflowPolicy = "drop_newest"
+	// DisconnectOnOverflow 断开客户端的连接
+	DisconnectOnOverflow OverflowPolicy = "disconnect"
+)
+
+const (
+	// DefaultOutboundQueueLength 出站队列中等待写出的 PUBLISH 的默认上限
+	DefaultOutboundQueueLength = 1000
+	// DefaultOverflowPolicy 默认的出站队列溢出处理方式
+	DefaultOverflowPolicy = DropNewest
+	// closeTimeout 断开连接前写出队列中剩余报文的最长时间
+	closeTimeout = 3 * time.Second
+)
+
+// ParseOverflowPolicy 解析出站队列溢出的处理方式
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(policy); p {
+	case DropOldest, DropNewest, DisconnectOnOverflow:
+		return p, nil
+	default:
+		return "", pkg.ErrUnknownOverflowPolicy
+	}
+}
+
+// outbox 客户端的出站队列，所有报文由写协程按入队顺序写出。
+// 只有 PUBLISH 计入上限并可能被丢弃，确认等控制报文总是入队
+type outbox struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []packets.ControlPacket
+	limit  int
+	policy OverflowPolicy
+	// publishes 队列中 PUBLISH 的数量
+	publishes int
+	// closing 不再接受新报文，写出剩余的报文后关闭连接
+	closing bool
+	// aborted 丢弃剩余的报文，写协程立即退出
+	aborted bool
+}
+
+func newOutbox(limit int, policy OverflowPolicy) *outbox {
+	o := &outbox{limit: limit, policy: policy}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// push 报文入队
+//
+// return: 因溢出被丢弃的 PUBLISH，错误信息，丢弃的是新的 PUBLISH 时为 pkg.ErrMessageDropped
+func (o *outbox) push(packet packets.ControlPacket) (dropped *packets.PublishPacket, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closing || o.aborted {
+		return nil, pkg.ErrClientClosed
+	}
+	publish := publishOf(packet)
+	if publish != nil && o.limit > 0 && o.publishes >= o.limit {
+		metrics.OutboundOverflow.WithLabelValues(string(o.policy)).Inc()
+		switch o.policy {
+		case DropNewest:
+			return publish, pkg.ErrMessageDropped
+		case DropOldest:
+			for i, p := range o.queue {
+				if dropped = publishOf(p); dropped != nil {
+					o.queue = append(o.queue[:i], o.queue[i+1:]...)
+					o.publishes--
+					break
+				}
+			}
+		default:
+			return nil, pkg.ErrOutboundQueueFull
+		}
+	}
+	if publish != nil {
+		o.publishes++
+	}
+	o.queue = append(o.queue, packet)
+	o.cond.Signal()
+	return dropped, nil
+}
+
+// take 等待并取出队列中的全部报文
+//
+// return: 报文，写完后是否应关闭连接
+func (o *outbox) take() (batch []packets.ControlPacket, done bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for len(o.queue) == 0 && !o.closing && !o.aborted {
+		o.cond.Wait()
+	}
+	if o.aborted {
+		return nil, true
+	}
+	batch, o.queue = o.queue, nil
+	o.publishes = 0
+	return batch, len(batch) == 0
+}
+
+// finish 放入最后一个报文并停止接受新报文，packet 可以为nil
+func (o *outbox) finish(packet packets.ControlPacket) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closing || o.aborted {
+		return
+	}
+	if packet != nil {
+		o.queue = append(o.queue, packet)
+	}
+	o.closing = true
+	o.cond.Signal()
+}
+
+// abort 丢弃剩余的报文
+func (o *outbox) abort() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.aborted = true
+	o.queue = nil
+	o.publishes = 0
+	o.cond.Signal()
+}
+
+// len 等待写出的报文数
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queue)
+}
+
+func publishOf(packet packets.ControlPacket) *packets.PublishPacket {
+	if encoded, ok := packet.(*encodedPublish); ok {
+		return encoded.PublishPacket
+	}
+	packet, _ = mqtt5.Unwrap(packet)
+	publish, _ := packet.(*packets.PublishPacket)
+	return publish
+}
+
+// writeLoop 写协程，按入队顺序写出报文，队列为空时刷新缓冲。
+// 写入失败时关闭连接，由读协程处理连接断开
+func (c *Client) writeLoop() {
+	defer close(c.writerDone)
+	w := bufio.NewWriter(countingWriter{c.conn})
+	for {
+		batch, done := c.outbox.take()
+		for _, packet := range batch {
+			if err := c.writePacket(w, packet); err != nil {
+				if errors.Is(err, mqtt5.ErrPacketTooLarge) {
+					c.dropOversized(packet)
+					continue
+				}
+				c.writeFailed(err)
+				return
+			}
+			countPacket(publishOrPacket(packet), true)
+		}
+		if err := w.Flush(); err != nil {
+			c.writeFailed(err)
+			return
+		}
+		if done {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// writePacket 编码并写出报文，已经编码的 PUBLISH 直接写出
+func (c *Client) writePacket(w io.Writer, packet packets.ControlPacket) error {
+	encoded, ok := packet.(*encodedPublish)
+	if !ok {
+		return c.codec.WritePacket(w, packet)
+	}
+	if codec, ok := c.codec.(*mqtt5.Codec); ok && codec.PeerMaxPacketSize > 0 && len(encoded.raw) > int(codec.PeerMaxPacketSize) {
+		return mqtt5.ErrPacketTooLarge
+	}
+	_, err := w.Write(encoded.raw)
+	return err
+}
+
+// publishOrPacket 已经编码的 PUBLISH 返回原始报文，用于统计
+func publishOrPacket(packet packets.ControlPacket) packets.ControlPacket {
+	if encoded, ok := packet.(*encodedPublish); ok {
+		return encoded.PublishPacket
+	}
+	return packet
+}
+
+// writeFailed 写入失败，关闭连接并丢弃剩余的报文
+func (c *Client) writeFailed(err error) {
+	metrics.WriteErrors.Inc()
+	logrus.WithFields(map[string]interface{}{
+		"clientId": c.GetId(),
+		"error":    err,
+	}).Debug("write failed")
+	c.outbox.abort()
+	c.conn.Close()
+}
+
+// dropOversized 丢弃超过客户端最大报文长度的报文
+func (c *Client) dropOversized(packet packets.ControlPacket) {
+	publish := publishOf(packet)
+	if publish == nil {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": c.GetId(),
+			"packet":   packet.String(),
+		}).Warn("packet exceeds client maximum packet size, dropped")
+		return
+	}
+	logrus.WithFields(map[string]interface{}{
+		"clientId": c.GetId(),
+		"topic":    publish.TopicName,
+	}).Warn("message exceeds client maximum packet size, dropped")
+	c.forgetInflight(publish)
+}
+
+// forgetInflight 不会写出的 QoS 1/2 消息不再等待确认
+func (c *Client) forgetInflight(publish *packets.PublishPacket) {
+	if publish.Qos == 0 {
+		return
+	}
+	c.mux.Lock()
+	delete(c.outbound, publish.MessageID)
+	c.mux.Unlock()
+}
+
+// finish 停止接受新报文，在截止时间前写出队列中剩余的报文后关闭连接
+//
+// param: final 最后写出的报文，可以为nil
+// param: deadline 写入的截止时间
+func (c *Client) finish(final packets.ControlPacket, deadline time.Time) {
+	c.conn.SetWriteDeadline(deadline)
+	c.outbox.finish(final)
+}
+
+// QueueLen 出站队列中等待写出的报文数
+func (c *Client) QueueLen() int {
+	return c.outbox.len()
+}
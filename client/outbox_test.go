@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg"
+	"io"
+	"testing"
+	"time"
+)
+
+// TestOutboxOverflow 出站队列中的 PUBLISH 达到上限时按溢出策略处理，控制报文不计入上限也不会被丢弃
+func TestOutboxOverflow(t *testing.T) {
+	tests := []struct {
+		policy OverflowPolicy
+		err    error
+		// topics 第三条 PUBLISH 入队后队列中 PUBLISH 的主题
+		topics  []string
+		dropped string
+	}{
+		{DropNewest, pkg.ErrMessageDropped, []string{"1", "2"}, "3"},
+		{DropOldest, nil, []string{"2", "3"}, "1"},
+		{DisconnectOnOverflow, pkg.ErrOutboundQueueFull, []string{"1", "2"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			o := newOutbox(2, tt.policy)
+			o.push(newPublish("1", 0))
+			o.push(packets.NewControlPacket(packets.Pingresp))
+			o.push(newPublish("2", 0))
+			dropped, err := o.push(newPublish("3", 0))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("push error = %v, want %v", err, tt.err)
+			}
+			if (dropped == nil) != (tt.dropped == "") || (dropped != nil && dropped.TopicName != tt.dropped) {
+				t.Fatalf("dropped %v, want %q", dropped, tt.dropped)
+			}
+			if _, err := o.push(packets.NewControlPacket(packets.Pingresp)); err != nil {
+				t.Fatalf("control packet rejected: %v", err)
+			}
+
+			batch, _ := o.take()
+			var topics []string
+			for _, packet := range batch {
+				if publish := publishOf(packet); publish != nil {
+					topics = append(topics, publish.TopicName)
+				}
+			}
+			if len(batch) != len(topics)+2 || len(topics) != len(tt.topics) || topics[0] != tt.topics[0] || topics[1] != tt.topics[1] {
+				t.Fatalf("queued %v (%d packets), want %v and 2 PINGRESP", topics, len(batch), tt.topics)
+			}
+		})
+	}
+}
+
+// TestOutboxDropOldestInflight 丢弃的 QoS 1 消息不再等待确认，报文ID可以再次分配
+func TestOutboxDropOldestInflight(t *testing.T) {
+	c := newTestClient(t, WithOutboundQueue(1, DropOldest))
+	first, second := newPublish("first", 1), newPublish("second", 1)
+	c.Publish(first, nil)
+	if err := c.Publish(second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.InflightLen() != 1 || c.AckPublish(first.MessageID) || !c.AckPublish(second.MessageID) {
+		t.Fatal("dropped message still inflight")
+	}
+}
+
+// TestOutboxDisconnectOnOverflow disconnect 策略在队列已满时断开客户端的连接
+func TestOutboxDisconnectOnOverflow(t *testing.T) {
+	c := newTestClient(t, WithOutboundQueue(1, DisconnectOnOverflow))
+	c.Publish(newPublish("first", 0), nil)
+	if err := c.Publish(newPublish("second", 0), nil); !errors.Is(err, pkg.ErrOutboundQueueFull) {
+		t.Fatalf("error = %v, want %v", err, pkg.ErrOutboundQueueFull)
+	}
+	if err := c.HandleWrite(packets.NewControlPacket(packets.Pingresp)); !errors.Is(err, pkg.ErrClientClosed) {
+		t.Fatalf("write after overflow: %v, want %v", err, pkg.ErrClientClosed)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("connection not closed: %v", err)
+	}
+}
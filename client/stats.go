@@ -0,0 +1,89 @@
+package client
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg/metrics"
+	"icetea/pkg/mqtt5"
+	"icetea/pkg/stats"
+	"io"
+)
+
+// countingReader 统计从连接读取的字节数
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	stats.BytesReceived.Add(uint64(n))
+	return n, err
+}
+
+// countingWriter 统计写入连接的字节数
+type countingWriter struct {
+	w io.Writer
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	stats.BytesSent.Add(uint64(n))
+	return n, err
+}
+
+// countPacket 统计收发的报文数
+//
+// param: packet 报文
+// param: sent 是否为发送的报文
+func countPacket(packet packets.ControlPacket, sent bool) {
+	packet, _ = mqtt5.Unwrap(packet)
+	_, publish := packet.(*packets.PublishPacket)
+	if sent {
+		metrics.PacketsSent.WithLabelValues(packetName(packet)).Inc()
+		stats.MessagesSent.Add(1)
+		if publish {
+			stats.PublishSent.Add(1)
+		}
+		return
+	}
+	metrics.PacketsReceived.WithLabelValues(packetName(packet)).Inc()
+	stats.MessagesReceived.Add(1)
+	if publish {
+		stats.PublishReceived.Add(1)
+	}
+}
+
+// packetName 报文类型的名称，用作指标的标签
+func packetName(packet packets.ControlPacket) string {
+	switch packet.(type) {
+	case *packets.ConnectPacket:
+		return "CONNECT"
+	case *packets.ConnackPacket:
+		return "CONNACK"
+	case *packets.PublishPacket:
+		return "PUBLISH"
+	case *packets.PubackPacket:
+		return "PUBACK"
+	case *packets.PubrecPacket:
+		return "PUBREC"
+	case *packets.PubrelPacket:
+		return "PUBREL"
+	case *packets.PubcompPacket:
+		return "PUBCOMP"
+	case *packets.SubscribePacket:
+		return "SUBSCRIBE"
+	case *packets.SubackPacket:
+		return "SUBACK"
+	case *packets.UnsubscribePacket:
+		return "UNSUBSCRIBE"
+	case *packets.UnsubackPacket:
+		return "UNSUBACK"
+	case *packets.PingreqPacket:
+		return "PINGREQ"
+	case *packets.PingrespPacket:
+		return "PINGRESP"
+	case *packets.DisconnectPacket:
+		return "DISCONNECT"
+	default:
+		return "UNKNOWN"
+	}
+}
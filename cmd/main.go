@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"icetea/app/boot"
+	"icetea/app/config"
 	"log"
 	"os"
 	"os/signal"
@@ -14,14 +17,34 @@ func main() {
 		rootCtx, cancel = context.WithCancel(context.TODO())
 		sign            = make(chan os.Signal, 1)
 		err             error
-		app             = &boot.App{}
 	)
+	defer cancel()
 
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	app := &boot.App{Config: cfg}
+	// SIGKILL 与 SIGSTOP 无法被捕获
+	signal.Notify(sign, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGUSR1)
 	err = app.Run(rootCtx)
 	if err != nil {
+		app.Stop(rootCtx)
 		log.Fatalln(err)
 	}
-	signal.Notify(sign, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGUSR1)
-	<-sign
-	cancel()
+	log.Println(`received signal ` + (<-sign).String() + `, shutting down`)
+
+	// 关闭期间再次收到信号时立即退出
+	go func() {
+		log.Println(`received signal ` + (<-sign).String() + `, exiting immediately`)
+		os.Exit(1)
+	}()
+	ctx, stop := context.WithTimeout(rootCtx, cfg.ShutdownTimeout.Duration())
+	defer stop()
+	if err = app.Stop(ctx); err != nil {
+		log.Println(err)
+	}
 }
@@ -5,4 +5,27 @@ import "errors"
 var (
 	ErrMQTTCodeProtocolError = errors.New(`mqtt protocl code error`)
 	ErrSwitchType            = errors.New(`swi`)
+	ErrBadUsernameOrPassword = errors.New(`bad username or password`)
+	ErrNotAuthorized         = errors.New(`not authorized`)
+	ErrConnectRefused        = errors.New(`connect refused`)
+	ErrFirstPacketNotConnect = errors.New(`first packet is not connect`)
+	ErrDuplicateConnect      = errors.New(`duplicate connect packet`)
+	ErrUnknownShareStrategy  = errors.New(`unknown shared subscription strategy`)
+	ErrSnapshotCorrupt       = errors.New(`snapshot file is corrupt`)
+	ErrSnapshotVersion       = errors.New(`unsupported snapshot version`)
+	ErrUnknownOverflowPolicy = errors.New(`unknown outbound queue overflow policy`)
+	ErrOutboundQueueFull     = errors.New(`outbound queue full`)
+	ErrMessageDropped        = errors.New(`outbound queue full, message dropped`)
+	ErrClientClosed          = errors.New(`client connection closed`)
+	ErrTopicNameInvalid      = errors.New(`topic name invalid`)
+	ErrTopicEmpty            = errors.New(`topic is empty`)
+	ErrTopicTooLong          = errors.New(`topic exceeds maximum length`)
+	ErrTopicTooManyLevels    = errors.New(`topic exceeds maximum number of levels`)
+	ErrTopicInvalidUTF8      = errors.New(`topic is not valid UTF-8`)
+	ErrTopicNullCharacter    = errors.New(`topic contains null character`)
+	ErrTopicNameWildcard     = errors.New(`topic name contains wildcard`)
+	ErrTopicFilterWildcard   = errors.New(`wildcard must occupy an entire level and # must be the last level`)
+	ErrSharedFilterInvalid   = errors.New(`invalid shared subscription`)
+	ErrClusterHandshake      = errors.New(`cluster peer did not send hello`)
+	ErrClusterAuthFailed     = errors.New(`cluster peer authentication failed`)
 )
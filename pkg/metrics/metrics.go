@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"icetea/pkg/stats"
+)
+
+const namespace = `icetea`
+
+// 连接、报文与消息分发的指标，注册在 prometheus.DefaultRegisterer 上
+var (
+	// ConnectionsAccepted 监听接受的 TCP 连接数
+	ConnectionsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_accepted_total",
+		Help:      "Network connections accepted by the listeners.",
+	})
+	// AcceptErrors 监听接受连接失败的次数
+	AcceptErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accept_errors_total",
+		Help:      "Errors returned while accepting connections.",
+	})
+	// PacketsReceived 按报文类型统计收到的报文数
+	PacketsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_received_total",
+		Help:      "MQTT control packets received, by packet type.",
+	}, []string{"type"})
+	// PacketsSent 按报文类型统计发送的报文数
+	PacketsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_sent_total",
+		Help:      "MQTT control packets sent, by packet type.",
+	}, []string{"type"})
+	// WriteErrors 写入客户端连接失败的次数
+	WriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_errors_total",
+		Help:      "Errors while writing packets to client connections.",
+	})
+	// OutboundOverflow 按溢出处理方式统计出站队列溢出的次数
+	OutboundOverflow = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbound_overflow_total",
+		Help:      "PUBLISH packets that hit a full client outbound queue, by overflow policy.",
+	}, []string{"policy"})
+	// PublishFanout 每条发布的消息投递的本节点订阅者数量，包括离线会话与共享订阅组
+	PublishFanout = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "publish_fanout",
+		Help:      "Number of local subscribers each published message was delivered or queued to.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 1000},
+	})
+	// HandlerDuration 按报文类型统计 PacketHandler 处理报文的耗时
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent handling an incoming packet, by packet type.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"type"})
+)
+
+func init() {
+	// 流量与连接总数复用 $SYS 的统计
+	counters := map[string]struct {
+		help  string
+		value func() uint64
+	}{
+		"bytes_received_total": {"Bytes read from client connections.", stats.BytesReceived.Load},
+		"bytes_sent_total":     {"Bytes written to client connections.", stats.BytesSent.Load},
+		"connections_total":    {"Clients that completed CONNECT.", stats.ClientsConnected.Load},
+	}
+	for name, c := range counters {
+		value := c.value
+		promauto.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      c.help,
+		}, func() float64 {
+			return float64(value())
+		})
+	}
+}
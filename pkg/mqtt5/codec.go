@@ -0,0 +1,513 @@
+package mqtt5
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"io"
+)
+
+// Codec MQTT 5.0 报文编解码，每个连接一个实例，保存连接级别的主题别名
+type Codec struct {
+	// MaxPacketSize 接收报文的最大长度，0 表示不限制
+	MaxPacketSize uint32
+	// PeerMaxPacketSize 对端可以接收的最大报文长度，0 表示不限制
+	PeerMaxPacketSize uint32
+	// TopicAliasMaximum 允许对端使用的主题别名最大值，0 表示不允许使用
+	TopicAliasMaximum uint16
+
+	aliases map[uint16]string
+}
+
+// ReadRaw 读取一个完整的报文，包括固定报头
+//
+// param: r 连接
+// param: maxSize 报文最大长度，0 表示不限制
+// return: 报文字节
+func ReadRaw(r io.Reader, maxSize uint32) ([]byte, error) {
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var (
+		length     int
+		multiplier = 1
+		b          = make([]byte, 1)
+	)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMalformed
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			// 固定报头已经开始，连接关闭说明报文不完整
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		header = append(header, b[0])
+		length += int(b[0]&0x7f) * multiplier
+		if b[0]&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if maxSize > 0 && len(header)+length > int(maxSize) {
+		return nil, ErrPacketTooLarge
+	}
+	raw := make([]byte, len(header)+length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[len(header):]); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// Version 读取 CONNECT 报文中的协议级别
+//
+// param: raw ReadRaw 读取的报文
+// return: 协议级别 3、4、5
+func Version(raw []byte) (byte, error) {
+	r, typ, _, err := split(raw)
+	if err != nil {
+		return 0, err
+	}
+	if typ != packets.Connect {
+		return 0, ErrProtocol
+	}
+	if _, err = r.string(); err != nil {
+		return 0, err
+	}
+	return r.byte()
+}
+
+// split 拆分固定报头，返回可变报头与负载的 reader
+func split(raw []byte) (*reader, byte, byte, error) {
+	if len(raw) < 2 {
+		return nil, 0, 0, ErrMalformed
+	}
+	r := &reader{buf: raw, offset: 1}
+	length, err := r.varint()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if r.remaining() != length {
+		return nil, 0, 0, ErrMalformed
+	}
+	return r, raw[0] >> 4, raw[0] & 0x0f, nil
+}
+
+func (c *Codec) ReadPacket(r io.Reader) (packets.ControlPacket, error) {
+	raw, err := ReadRaw(r, c.MaxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decode(raw)
+}
+
+func (c *Codec) WritePacket(w io.Writer, packet packets.ControlPacket) error {
+	raw, err := c.Encode(packet)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(raw)
+	return err
+}
+
+// Decode 解码客户端发送的报文，PINGREQ 以外的报文都返回 *Packet
+func (c *Codec) Decode(raw []byte) (packets.ControlPacket, error) {
+	r, typ, flags, err := split(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case packets.Connect:
+		return c.decodeConnect(r, flags)
+	case packets.Publish:
+		return c.decodePublish(r, flags, true)
+	case packets.Puback, packets.Pubrec, packets.Pubrel, packets.Pubcomp:
+		return decodeAck(r, typ, flags)
+	case packets.Subscribe:
+		return decodeSubscribe(r, flags)
+	case packets.Unsubscribe:
+		return decodeUnsubscribe(r, flags)
+	case packets.Pingreq:
+		if flags != 0 || r.remaining() != 0 {
+			return nil, ErrMalformed
+		}
+		return packets.NewControlPacket(packets.Pingreq), nil
+	case packets.Disconnect:
+		return decodeDisconnect(r, flags)
+	default:
+		return nil, fmt.Errorf("%w: unexpected packet type %d", ErrProtocol, typ)
+	}
+}
+
+func (c *Codec) decodeConnect(r *reader, flags byte) (packets.ControlPacket, error) {
+	var (
+		cp  = packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		p   = &Packet{ControlPacket: cp}
+		err error
+	)
+	if flags != 0 {
+		return nil, ErrMalformed
+	}
+	if cp.ProtocolName, err = r.string(); err != nil {
+		return nil, err
+	}
+	if cp.ProtocolVersion, err = r.byte(); err != nil {
+		return nil, err
+	}
+	options, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	cp.ReservedBit = options & 0x01
+	cp.CleanSession = options&0x02 != 0
+	cp.WillFlag = options&0x04 != 0
+	cp.WillQos = (options >> 3) & 0x03
+	cp.WillRetain = options&0x20 != 0
+	cp.PasswordFlag = options&0x40 != 0
+	cp.UsernameFlag = options&0x80 != 0
+	if cp.ProtocolName != "MQTT" || cp.ReservedBit != 0 || cp.WillQos > 2 ||
+		(!cp.WillFlag && (cp.WillQos != 0 || cp.WillRetain)) {
+		return nil, ErrMalformed
+	}
+	if cp.Keepalive, err = r.uint16(); err != nil {
+		return nil, err
+	}
+	if p.Properties, err = decodeProperties(r); err != nil {
+		return nil, err
+	}
+	if cp.ClientIdentifier, err = r.string(); err != nil {
+		return nil, err
+	}
+	if cp.WillFlag {
+		if p.WillProperties, err = decodeProperties(r); err != nil {
+			return nil, err
+		}
+		if cp.WillTopic, err = r.string(); err != nil {
+			return nil, err
+		}
+		if cp.WillMessage, err = r.binary(); err != nil {
+			return nil, err
+		}
+	}
+	if cp.UsernameFlag {
+		if cp.Username, err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	if cp.PasswordFlag {
+		if cp.Password, err = r.binary(); err != nil {
+			return nil, err
+		}
+	}
+	if r.remaining() != 0 {
+		return nil, ErrMalformed
+	}
+	return p, nil
+}
+
+func (c *Codec) decodePublish(r *reader, flags byte, strict bool) (*Packet, error) {
+	var (
+		pp  = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p   = &Packet{ControlPacket: pp}
+		err error
+	)
+	pp.Dup = flags&0x08 != 0
+	pp.Qos = (flags >> 1) & 0x03
+	pp.Retain = flags&0x01 != 0
+	if pp.Qos > 2 {
+		return nil, ErrMalformed
+	}
+	if pp.TopicName, err = r.string(); err != nil {
+		return nil, err
+	}
+	if pp.Qos > 0 {
+		if pp.MessageID, err = r.uint16(); err != nil {
+			return nil, err
+		}
+		if strict && pp.MessageID == 0 {
+			return nil, ErrProtocol
+		}
+	}
+	if p.Properties, err = decodeProperties(r); err != nil {
+		return nil, err
+	}
+	pp.Payload = r.rest()
+	if strict {
+		if err = c.resolveTopicAlias(pp, p.Properties); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// MarshalPublish 将消息编码为 5.0 PUBLISH 报文，用于消息的持久化
+func MarshalPublish(packet *packets.PublishPacket, properties *Properties) ([]byte, error) {
+	return new(Codec).Encode(Wrap(packet, properties, Success))
+}
+
+// UnmarshalPublish 解码 MarshalPublish 编码的消息
+func UnmarshalPublish(raw []byte) (*packets.PublishPacket, *Properties, error) {
+	r, typ, flags, err := split(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if typ != packets.Publish {
+		return nil, nil, ErrProtocol
+	}
+	p, err := new(Codec).decodePublish(r, flags, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.ControlPacket.(*packets.PublishPacket), p.Properties, nil
+}
+
+// resolveTopicAlias 记录或解析客户端发送的主题别名
+func (c *Codec) resolveTopicAlias(pp *packets.PublishPacket, properties *Properties) error {
+	if properties.TopicAlias == nil {
+		if pp.TopicName == "" {
+			return ErrProtocol
+		}
+		return nil
+	}
+	alias := *properties.TopicAlias
+	properties.TopicAlias = nil
+	if alias == 0 || alias > c.TopicAliasMaximum {
+		return ErrTopicAliasInvalid
+	}
+	if c.aliases == nil {
+		c.aliases = make(map[uint16]string)
+	}
+	if pp.TopicName != "" {
+		c.aliases[alias] = pp.TopicName
+		return nil
+	}
+	topic, ok := c.aliases[alias]
+	if !ok {
+		return ErrProtocol
+	}
+	pp.TopicName = topic
+	return nil
+}
+
+func decodeAck(r *reader, typ, flags byte) (packets.ControlPacket, error) {
+	var (
+		p   = &Packet{ControlPacket: packets.NewControlPacket(typ)}
+		id  uint16
+		err error
+	)
+	if (typ == packets.Pubrel && flags != 0x02) || (typ != packets.Pubrel && flags != 0) {
+		return nil, ErrMalformed
+	}
+	if id, err = r.uint16(); err != nil {
+		return nil, err
+	}
+	if r.remaining() > 0 {
+		if p.ReasonCode, err = r.byte(); err != nil {
+			return nil, err
+		}
+	}
+	if r.remaining() > 0 {
+		if p.Properties, err = decodeProperties(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.remaining() != 0 {
+		return nil, ErrMalformed
+	}
+	switch ack := p.ControlPacket.(type) {
+	case *packets.PubackPacket:
+		ack.MessageID = id
+	case *packets.PubrecPacket:
+		ack.MessageID = id
+	case *packets.PubrelPacket:
+		ack.MessageID = id
+	case *packets.PubcompPacket:
+		ack.MessageID = id
+	}
+	return p, nil
+}
+
+func decodeSubscribe(r *reader, flags byte) (packets.ControlPacket, error) {
+	var (
+		sp  = packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+		p   = &Packet{ControlPacket: sp}
+		err error
+	)
+	if flags != 0x02 {
+		return nil, ErrMalformed
+	}
+	if sp.MessageID, err = r.uint16(); err != nil {
+		return nil, err
+	}
+	if p.Properties, err = decodeProperties(r); err != nil {
+		return nil, err
+	}
+	for r.remaining() > 0 {
+		topic, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		options, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if options&0xc0 != 0 || options&SubOptionQos > 2 || RetainHandling(options) > 2 {
+			return nil, ErrMalformed
+		}
+		sp.Topics = append(sp.Topics, topic)
+		sp.Qoss = append(sp.Qoss, options&SubOptionQos)
+		p.SubOptions = append(p.SubOptions, options)
+	}
+	if len(sp.Topics) == 0 {
+		return nil, ErrProtocol
+	}
+	return p, nil
+}
+
+func decodeUnsubscribe(r *reader, flags byte) (packets.ControlPacket, error) {
+	var (
+		up  = packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+		p   = &Packet{ControlPacket: up}
+		err error
+	)
+	if flags != 0x02 {
+		return nil, ErrMalformed
+	}
+	if up.MessageID, err = r.uint16(); err != nil {
+		return nil, err
+	}
+	if p.Properties, err = decodeProperties(r); err != nil {
+		return nil, err
+	}
+	for r.remaining() > 0 {
+		topic, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		up.Topics = append(up.Topics, topic)
+	}
+	if len(up.Topics) == 0 {
+		return nil, ErrProtocol
+	}
+	return p, nil
+}
+
+func decodeDisconnect(r *reader, flags byte) (packets.ControlPacket, error) {
+	var (
+		p   = &Packet{ControlPacket: packets.NewControlPacket(packets.Disconnect)}
+		err error
+	)
+	if flags != 0 {
+		return nil, ErrMalformed
+	}
+	if r.remaining() > 0 {
+		if p.ReasonCode, err = r.byte(); err != nil {
+			return nil, err
+		}
+	}
+	if r.remaining() > 0 {
+		if p.Properties, err = decodeProperties(r); err != nil {
+			return nil, err
+		}
+	}
+	if r.remaining() != 0 {
+		return nil, ErrMalformed
+	}
+	return p, nil
+}
+
+// Encode 编码发送给客户端的报文，报文超过对端的最大报文长度时返回 ErrPacketTooLarge
+func (c *Codec) Encode(packet packets.ControlPacket) ([]byte, error) {
+	var (
+		inner, p = Unwrap(packet)
+		body     bytes.Buffer
+		header   byte
+	)
+	if p == nil {
+		p = &Packet{ControlPacket: inner}
+	}
+	switch cp := inner.(type) {
+	case *packets.ConnackPacket:
+		header = packets.Connack << 4
+		if cp.SessionPresent {
+			body.WriteByte(0x01)
+		} else {
+			body.WriteByte(0x00)
+		}
+		reason := p.ReasonCode
+		if reason == Success {
+			if reason = connackReasons[cp.ReturnCode]; cp.ReturnCode != packets.Accepted && reason == Success {
+				reason = UnspecifiedError
+			}
+		}
+		body.WriteByte(reason)
+		body.Write(p.Properties.encode())
+	case *packets.PublishPacket:
+		header = packets.Publish<<4 | boolToByte(cp.Dup)<<3 | cp.Qos<<1 | boolToByte(cp.Retain)
+		body.Write(encodeString(cp.TopicName))
+		if cp.Qos > 0 {
+			body.Write(encodeUint16(cp.MessageID))
+		}
+		body.Write(p.Properties.encode())
+		body.Write(cp.Payload)
+	case *packets.PubackPacket:
+		header = packets.Puback << 4
+		encodeAck(&body, cp.MessageID, p)
+	case *packets.PubrecPacket:
+		header = packets.Pubrec << 4
+		encodeAck(&body, cp.MessageID, p)
+	case *packets.PubrelPacket:
+		header = packets.Pubrel<<4 | 0x02
+		encodeAck(&body, cp.MessageID, p)
+	case *packets.PubcompPacket:
+		header = packets.Pubcomp << 4
+		encodeAck(&body, cp.MessageID, p)
+	case *packets.SubackPacket:
+		header = packets.Suback << 4
+		body.Write(encodeUint16(cp.MessageID))
+		body.Write(p.Properties.encode())
+		body.Write(cp.ReturnCodes)
+	case *packets.UnsubackPacket:
+		header = packets.Unsuback << 4
+		body.Write(encodeUint16(cp.MessageID))
+		body.Write(p.Properties.encode())
+		body.Write(p.ReasonCodes)
+	case *packets.PingrespPacket:
+		header = packets.Pingresp << 4
+	case *packets.DisconnectPacket:
+		header = packets.Disconnect << 4
+		if p.ReasonCode != Success || p.Properties != nil {
+			body.WriteByte(p.ReasonCode)
+			body.Write(p.Properties.encode())
+		}
+	default:
+		return nil, fmt.Errorf("%w: cannot encode %T", ErrProtocol, inner)
+	}
+	raw := append([]byte{header}, encodeVarint(body.Len())...)
+	raw = append(raw, body.Bytes()...)
+	if c.PeerMaxPacketSize > 0 && len(raw) > int(c.PeerMaxPacketSize) {
+		return nil, ErrPacketTooLarge
+	}
+	return raw, nil
+}
+
+func encodeAck(body *bytes.Buffer, id uint16, p *Packet) {
+	body.Write(encodeUint16(id))
+	if p.ReasonCode != Success || p.Properties != nil {
+		body.WriteByte(p.ReasonCode)
+		if p.Properties != nil {
+			body.Write(p.Properties.encode())
+		}
+	}
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,251 @@
+package mqtt5
+
+import (
+	"bytes"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// TestVarint 变长字节整数在每个长度边界上的编解码
+func TestVarint(t *testing.T) {
+	tests := []struct {
+		value   int
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		if got := encodeVarint(tt.value); !bytes.Equal(got, tt.encoded) {
+			t.Errorf("encodeVarint(%d) = %x, want %x", tt.value, got, tt.encoded)
+		}
+		r := &reader{buf: tt.encoded}
+		got, err := r.varint()
+		if err != nil || got != tt.value || r.remaining() != 0 {
+			t.Errorf("varint(%x) = %d, %v, want %d", tt.encoded, got, err, tt.value)
+		}
+	}
+}
+
+// TestVarintMalformed 超过4个字节或被截断的变长字节整数
+func TestVarintMalformed(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x80},
+		{0xff, 0xff, 0xff},
+		{0xff, 0xff, 0xff, 0xff, 0x7f},
+	}
+	for _, encoded := range tests {
+		r := &reader{buf: encoded}
+		if _, err := r.varint(); !errors.Is(err, ErrMalformed) {
+			t.Errorf("varint(%x) error = %v, want ErrMalformed", encoded, err)
+		}
+	}
+}
+
+// TestPropertiesRoundTrip 所有属性编码后解码得到相同的值
+func TestPropertiesRoundTrip(t *testing.T) {
+	var (
+		b   byte   = 1
+		u16 uint16 = 0x1234
+		u32 uint32 = 0x12345678
+	)
+	properties := &Properties{
+		PayloadFormat:          &b,
+		MessageExpiry:          &u32,
+		ContentType:            "text/plain",
+		ResponseTopic:          "reply/to",
+		CorrelationData:        []byte{0, 1, 2},
+		SubscriptionIdentifier: []uint32{1, 268435455},
+		SessionExpiryInterval:  &u32,
+		AssignedClientID:       "assigned",
+		ServerKeepAlive:        &u16,
+		AuthMethod:             "method",
+		AuthData:               []byte("data"),
+		RequestProblemInfo:     &b,
+		WillDelayInterval:      &u32,
+		RequestResponseInfo:    &b,
+		ResponseInfo:           "info",
+		ServerReference:        "other:1883",
+		ReasonString:           "reason",
+		ReceiveMaximum:         &u16,
+		TopicAliasMaximum:      &u16,
+		TopicAlias:             &u16,
+		MaximumQoS:             &b,
+		RetainAvailable:        &b,
+		User:                   []UserProperty{{"k", "v"}, {"k", "v2"}},
+		MaximumPacketSize:      &u32,
+		WildcardSubAvailable:   &b,
+		SubIDAvailable:         &b,
+		SharedSubAvailable:     &b,
+	}
+	encoded := properties.encode()
+	r := &reader{buf: encoded}
+	decoded, err := decodeProperties(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.remaining() != 0 {
+		t.Fatalf("%d bytes left after properties", r.remaining())
+	}
+	if !reflect.DeepEqual(decoded, properties) {
+		t.Fatalf("decoded %+v, want %+v", decoded, properties)
+	}
+
+	r = &reader{buf: new(Properties).encode()}
+	if decoded, err = decodeProperties(r); err != nil || !reflect.DeepEqual(decoded, new(Properties)) {
+		t.Fatalf("empty properties decoded %+v, %v", decoded, err)
+	}
+}
+
+// TestPublishRoundTrip PUBLISH 报文与属性经 MarshalPublish 编码后解码得到相同的值
+func TestPublishRoundTrip(t *testing.T) {
+	var expiry uint32 = 60
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = "a/b"
+	packet.Qos = 1
+	packet.Retain = true
+	packet.MessageID = 7
+	packet.Payload = []byte("payload")
+	properties := &Properties{
+		MessageExpiry: &expiry,
+		User:          []UserProperty{{"k", "v"}},
+	}
+	raw, err := MarshalPublish(packet, properties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, decodedProperties, err := UnmarshalPublish(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TopicName != packet.TopicName || decoded.Qos != packet.Qos || !decoded.Retain ||
+		decoded.MessageID != packet.MessageID || !bytes.Equal(decoded.Payload, packet.Payload) {
+		t.Fatalf("decoded %s, want %s", decoded, packet)
+	}
+	if !reflect.DeepEqual(decodedProperties, properties) {
+		t.Fatalf("decoded properties %+v, want %+v", decodedProperties, properties)
+	}
+}
+
+// TestReadRaw 报文长度的限制与截断的报文
+func TestReadRaw(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		maxSize uint32
+		err     error
+	}{
+		{"complete", []byte{0xc0, 0x00}, 0, nil},
+		{"at limit", []byte{0x30, 0x03, 0, 1, 'a'}, 5, nil},
+		{"over limit", []byte{0x30, 0x03, 0, 1, 'a'}, 4, ErrPacketTooLarge},
+		{"over limit before body", []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, 1 << 20, ErrPacketTooLarge},
+		{"length too long", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, ErrMalformed},
+		{"empty", []byte{}, 0, io.EOF},
+		{"truncated length", []byte{0x30, 0x80}, 0, io.ErrUnexpectedEOF},
+		{"truncated body", []byte{0x30, 0x03, 0, 1}, 0, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := ReadRaw(bytes.NewReader(tt.raw), tt.maxSize)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(raw, tt.raw) {
+				t.Fatalf("raw = %x, want %x", raw, tt.raw)
+			}
+		})
+	}
+}
+
+// TestDecodeMalformed 格式错误或被截断的报文返回 ErrMalformed 或 ErrProtocol
+func TestDecodeMalformed(t *testing.T) {
+	var (
+		connect = func(b ...byte) []byte { return append(append(encodeString("MQTT"), 5, 0x02, 0, 30), b...) }
+		topic   = func(b ...byte) []byte { return append(encodeString("a/b"), b...) }
+	)
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{"short", []byte{0x30}, ErrMalformed},
+		{"length mismatch", []byte{0x30, 0x05, 0, 1, 'a'}, ErrMalformed},
+		{"unknown type", []byte{0xf0, 0x00}, ErrProtocol},
+		{"pingreq flags", []byte{0xc1, 0x00}, ErrMalformed},
+		{"pingreq body", []byte{0xc0, 0x01, 0x00}, ErrMalformed},
+		{"connect protocol name", withHeader(0x10, append(encodeString("MQIsdp"), 5, 0x02, 0, 30, 0, 0, 0)), ErrMalformed},
+		{"connect reserved flag", withHeader(0x10, append(encodeString("MQTT"), 5, 0x03, 0, 30, 0, 0, 0)), ErrMalformed},
+		{"connect will qos without will", withHeader(0x10, append(encodeString("MQTT"), 5, 0x0a, 0, 30, 0, 0, 0)), ErrMalformed},
+		{"connect truncated client id", withHeader(0x10, connect(0, 0, 5, 'a')), ErrMalformed},
+		{"connect trailing bytes", withHeader(0x10, connect(0, 0, 0, 0)), ErrMalformed},
+		{"connect truncated will", withHeader(0x10, append(append(encodeString("MQTT"), 5, 0x06, 0, 30, 0), 0, 0, 0)), ErrMalformed},
+		{"publish qos 3", withHeader(0x36, topic(0, 1, 0)), ErrMalformed},
+		{"publish invalid utf-8", withHeader(0x30, []byte{0, 2, 0xc3, 0x28, 0}), ErrMalformed},
+		{"publish packet id 0", withHeader(0x32, topic(0, 0, 0)), ErrProtocol},
+		{"publish missing properties", withHeader(0x30, topic()), ErrMalformed},
+		{"publish properties too long", withHeader(0x30, topic(5, 0x01)), ErrMalformed},
+		{"publish unknown property", withHeader(0x30, topic(2, 0xff, 0)), ErrMalformed},
+		{"publish truncated property", withHeader(0x30, topic(3, 0x02, 0, 0)), ErrMalformed},
+		{"publish property past length", withHeader(0x30, topic(2, 0x02, 0, 0, 0, 0)), ErrMalformed},
+		{"publish empty topic without alias", withHeader(0x30, []byte{0, 0, 0}), ErrProtocol},
+		{"publish topic alias not allowed", withHeader(0x30, topic(3, 0x23, 0, 1)), ErrTopicAliasInvalid},
+		{"puback flags", withHeader(0x41, []byte{0, 1}), ErrMalformed},
+		{"pubrel flags", withHeader(0x60, []byte{0, 1}), ErrMalformed},
+		{"puback truncated", withHeader(0x40, []byte{0}), ErrMalformed},
+		{"subscribe flags", withHeader(0x80, append([]byte{0, 1, 0}, topic(0)...)), ErrMalformed},
+		{"subscribe no topics", withHeader(0x82, []byte{0, 1, 0}), ErrProtocol},
+		{"subscribe reserved options", withHeader(0x82, append([]byte{0, 1, 0}, topic(0x40)...)), ErrMalformed},
+		{"subscribe qos 3", withHeader(0x82, append([]byte{0, 1, 0}, topic(0x03)...)), ErrMalformed},
+		{"subscribe retain handling 3", withHeader(0x82, append([]byte{0, 1, 0}, topic(0x30)...)), ErrMalformed},
+		{"subscribe missing options", withHeader(0x82, append([]byte{0, 1, 0}, topic()...)), ErrMalformed},
+		{"unsubscribe no topics", withHeader(0xa2, []byte{0, 1, 0}), ErrProtocol},
+		{"disconnect flags", withHeader(0xe1, nil), ErrMalformed},
+		{"disconnect truncated properties", withHeader(0xe0, []byte{0, 5}), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := new(Codec).Decode(tt.raw); !errors.Is(err, tt.err) {
+				t.Fatalf("Decode(%x) error = %v, want %v", tt.raw, err, tt.err)
+			}
+		})
+	}
+}
+
+// TestDecodeTruncated 截断完整报文的任意位置都返回错误
+func TestDecodeTruncated(t *testing.T) {
+	var expiry uint32 = 60
+	body := append(encodeString("MQTT"), 5, 0xc6, 0, 30)
+	body = append(body, (&Properties{SessionExpiryInterval: &expiry}).encode()...)
+	body = append(body, encodeString("client")...)
+	body = append(body, (&Properties{WillDelayInterval: &expiry}).encode()...)
+	body = append(body, encodeString("will")...)
+	body = append(body, encodeBytes([]byte("offline"))...)
+	body = append(body, encodeString("user")...)
+	body = append(body, encodeBytes([]byte("pass"))...)
+	raw := withHeader(0x10, body)
+	if _, err := new(Codec).Decode(raw); err != nil {
+		t.Fatalf("complete packet: %v", err)
+	}
+	// 修改剩余长度使其与截断后的长度一致，只留下内容被截断的错误
+	for n := 2; n < len(raw); n++ {
+		truncated := withHeader(0x10, raw[2:n])
+		if _, err := new(Codec).Decode(truncated); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("truncated to %d bytes: error = %v, want ErrMalformed", n-2, err)
+		}
+	}
+}
+
+// withHeader 为可变报头与负载加上固定报头
+func withHeader(header byte, body []byte) []byte {
+	return append(append([]byte{header}, encodeVarint(len(body))...), body...)
+}
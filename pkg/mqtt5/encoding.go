@@ -0,0 +1,144 @@
+package mqtt5
+
+import (
+	"encoding/binary"
+	"unicode/utf8"
+)
+
+// reader 按 MQTT 数据类型顺序读取报文的可变报头与负载
+type reader struct {
+	buf    []byte
+	offset int
+}
+
+func (r *reader) remaining() int {
+	return len(r.buf) - r.offset
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.remaining() < 1 {
+		return 0, ErrMalformed
+	}
+	b := r.buf[r.offset]
+	r.offset++
+	return b, nil
+}
+
+func (r *reader) uint16() (uint16, error) {
+	if r.remaining() < 2 {
+		return 0, ErrMalformed
+	}
+	v := binary.BigEndian.Uint16(r.buf[r.offset:])
+	r.offset += 2
+	return v, nil
+}
+
+func (r *reader) uint32() (uint32, error) {
+	if r.remaining() < 4 {
+		return 0, ErrMalformed
+	}
+	v := binary.BigEndian.Uint32(r.buf[r.offset:])
+	r.offset += 4
+	return v, nil
+}
+
+func (r *reader) varint() (int, error) {
+	var (
+		value      int
+		multiplier = 1
+	)
+	for i := 0; i < 4; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, ErrMalformed
+}
+
+func (r *reader) binary() ([]byte, error) {
+	length, err := r.uint16()
+	if err != nil {
+		return nil, err
+	}
+	if r.remaining() < int(length) {
+		return nil, ErrMalformed
+	}
+	b := make([]byte, length)
+	copy(b, r.buf[r.offset:])
+	r.offset += int(length)
+	return b, nil
+}
+
+func (r *reader) string() (string, error) {
+	b, err := r.binary()
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(b) {
+		return "", ErrMalformed
+	}
+	return string(b), nil
+}
+
+func (r *reader) rest() []byte {
+	b := make([]byte, r.remaining())
+	copy(b, r.buf[r.offset:])
+	r.offset = len(r.buf)
+	return b
+}
+
+func (r *reader) bytePtr() (*byte, error) {
+	v, err := r.byte()
+	return &v, err
+}
+
+func (r *reader) uint16Ptr() (*uint16, error) {
+	v, err := r.uint16()
+	return &v, err
+}
+
+func (r *reader) uint32Ptr() (*uint32, error) {
+	v, err := r.uint32()
+	return &v, err
+}
+
+func encodeUint16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func encodeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func encodeBytes(v []byte) []byte {
+	return append(encodeUint16(uint16(len(v))), v...)
+}
+
+func encodeString(v string) []byte {
+	return encodeBytes([]byte(v))
+}
+
+func encodeVarint(v int) []byte {
+	var b []byte
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if v == 0 {
+			return b
+		}
+	}
+}
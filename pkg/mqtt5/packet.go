@@ -0,0 +1,103 @@
+package mqtt5
+
+import (
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// ProtocolVersion MQTT 5.0 在 CONNECT 报文中的协议级别
+const ProtocolVersion = 5
+
+// 原因码
+const (
+	Success                     = 0x00
+	DisconnectWithWill          = 0x04
+	NoMatchingSubscribers       = 0x10
+	NoSubscriptionExisted       = 0x11
+	UnspecifiedError            = 0x80
+	MalformedPacket             = 0x81
+	ProtocolError               = 0x82
+	ImplementationSpecificError = 0x83
+	UnsupportedProtocolVersion  = 0x84
+	ClientIdentifierNotValid    = 0x85
+	BadUsernameOrPassword       = 0x86
+	NotAuthorized               = 0x87
+	ServerUnavailable           = 0x88
+	ServerBusy                  = 0x89
+	ServerShuttingDown          = 0x8B
+	BadAuthenticationMethod     = 0x8C
+	KeepAliveTimeout            = 0x8D
+	SessionTakenOver            = 0x8E
+	TopicFilterInvalid          = 0x8F
+	TopicNameInvalid            = 0x90
+	PacketIdentifierNotFound    = 0x92
+	ReceiveMaximumExceeded      = 0x93
+	TopicAliasInvalid           = 0x94
+	PacketTooLarge              = 0x95
+	QuotaExceeded               = 0x97
+	AdministrativeAction        = 0x98
+	SharedSubNotSupported       = 0x9E
+)
+
+var (
+	ErrMalformed         = errors.New(`mqtt5: malformed packet`)
+	ErrProtocol          = errors.New(`mqtt5: protocol error`)
+	ErrPacketTooLarge    = errors.New(`mqtt5: packet too large`)
+	ErrTopicAliasInvalid = errors.New(`mqtt5: topic alias invalid`)
+)
+
+// connackReasons 3.1.1 CONNACK 返回码对应的 5.0 原因码
+var connackReasons = map[byte]byte{
+	packets.Accepted:                        Success,
+	packets.ErrRefusedBadProtocolVersion:    UnsupportedProtocolVersion,
+	packets.ErrRefusedIDRejected:            ClientIdentifierNotValid,
+	packets.ErrRefusedServerUnavailable:     ServerUnavailable,
+	packets.ErrRefusedBadUsernameOrPassword: BadUsernameOrPassword,
+	packets.ErrRefusedNotAuthorised:         NotAuthorized,
+}
+
+// Packet MQTT 5.0 报文，在 3.1.1 报文结构的基础上附加属性与原因码。
+// 嵌入的 ControlPacket 使其可以按 3.1.1 协议写出，多出的字段会被忽略
+type Packet struct {
+	packets.ControlPacket
+	Properties *Properties
+	// WillProperties CONNECT 报文的遗嘱属性
+	WillProperties *Properties
+	// ReasonCode CONNACK、PUBACK、PUBREC、PUBREL、PUBCOMP、DISCONNECT 的原因码
+	ReasonCode byte
+	// ReasonCodes UNSUBACK 每个主题的原因码，SUBACK 使用 SubackPacket.ReturnCodes
+	ReasonCodes []byte
+	// SubOptions SUBSCRIBE 每个主题的订阅选项
+	SubOptions []byte
+}
+
+// Wrap 为 3.1.1 报文附加属性与原因码
+func Wrap(packet packets.ControlPacket, properties *Properties, reasonCode byte) *Packet {
+	return &Packet{
+		ControlPacket: packet,
+		Properties:    properties,
+		ReasonCode:    reasonCode,
+	}
+}
+
+// Unwrap 拆分出 3.1.1 报文与 5.0 附加信息，3.1.1 报文的附加信息为nil
+func Unwrap(packet packets.ControlPacket) (packets.ControlPacket, *Packet) {
+	if p, ok := packet.(*Packet); ok {
+		return p.ControlPacket, p
+	}
+	return packet, nil
+}
+
+// 订阅选项
+const (
+	SubOptionQos               = 0x03
+	SubOptionNoLocal           = 0x04
+	SubOptionRetainAsPublished = 0x08
+	SubOptionRetainHandling    = 0x30
+)
+
+// RetainHandling 订阅选项中的保留消息处理方式：
+// 0 订阅时发送，1 仅在新建订阅时发送，2 不发送
+func RetainHandling(options byte) byte {
+	return (options & SubOptionRetainHandling) >> 4
+}
@@ -0,0 +1,280 @@
+package mqtt5
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// 属性标识符
+const (
+	propPayloadFormat          = 0x01
+	propMessageExpiry          = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0B
+	propSessionExpiry          = 0x11
+	propAssignedClientID       = 0x12
+	propServerKeepAlive        = 0x13
+	propAuthMethod             = 0x15
+	propAuthData               = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelayInterval      = 0x18
+	propRequestResponseInfo    = 0x19
+	propResponseInfo           = 0x1A
+	propServerReference        = 0x1C
+	propReasonString           = 0x1F
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propMaximumQoS             = 0x24
+	propRetainAvailable        = 0x25
+	propUser                   = 0x26
+	propMaximumPacketSize      = 0x27
+	propWildcardSubAvailable   = 0x28
+	propSubIDAvailable         = 0x29
+	propSharedSubAvailable     = 0x2A
+)
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties MQTT 5.0 报文属性，指针字段为nil表示报文中不包含该属性
+type Properties struct {
+	PayloadFormat          *byte
+	MessageExpiry          *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier []uint32
+	SessionExpiryInterval  *uint32
+	AssignedClientID       string
+	ServerKeepAlive        *uint16
+	AuthMethod             string
+	AuthData               []byte
+	RequestProblemInfo     *byte
+	WillDelayInterval      *uint32
+	RequestResponseInfo    *byte
+	ResponseInfo           string
+	ServerReference        string
+	ReasonString           string
+	ReceiveMaximum         *uint16
+	TopicAliasMaximum      *uint16
+	TopicAlias             *uint16
+	MaximumQoS             *byte
+	RetainAvailable        *byte
+	User                   []UserProperty
+	MaximumPacketSize      *uint32
+	WildcardSubAvailable   *byte
+	SubIDAvailable         *byte
+	SharedSubAvailable     *byte
+
+	// ExpiresAt 由 MessageExpiry 换算出的过期时间，不参与编码
+	ExpiresAt time.Time
+}
+
+// Copy 浅拷贝属性，用于转发时修改部分字段
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+// StartExpiry 根据 MessageExpiry 计算消息的过期时间
+//
+// param: from 消息的接收时间
+func (p *Properties) StartExpiry(from time.Time) {
+	if p != nil && p.MessageExpiry != nil {
+		p.ExpiresAt = from.Add(time.Duration(*p.MessageExpiry) * time.Second)
+	}
+}
+
+// Expired 消息是否已过期
+func (p *Properties) Expired(now time.Time) bool {
+	return p != nil && !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt)
+}
+
+// ForForward 生成转发给订阅者的属性：去掉主题别名，并将 MessageExpiry 更新为剩余的秒数
+func (p *Properties) ForForward(now time.Time) *Properties {
+	if p == nil {
+		return nil
+	}
+	c := p.Copy()
+	c.TopicAlias = nil
+	c.SubscriptionIdentifier = nil
+	if !c.ExpiresAt.IsZero() {
+		remaining := uint32((c.ExpiresAt.Sub(now) + time.Second - 1) / time.Second)
+		c.MessageExpiry = &remaining
+	}
+	return c
+}
+
+func (p *Properties) encode() []byte {
+	var buf bytes.Buffer
+	if p != nil {
+		writeByteProp(&buf, propPayloadFormat, p.PayloadFormat)
+		writeUint32Prop(&buf, propMessageExpiry, p.MessageExpiry)
+		writeStringProp(&buf, propContentType, p.ContentType)
+		writeStringProp(&buf, propResponseTopic, p.ResponseTopic)
+		if p.CorrelationData != nil {
+			buf.WriteByte(propCorrelationData)
+			buf.Write(encodeBytes(p.CorrelationData))
+		}
+		for _, id := range p.SubscriptionIdentifier {
+			buf.WriteByte(propSubscriptionIdentifier)
+			buf.Write(encodeVarint(int(id)))
+		}
+		writeUint32Prop(&buf, propSessionExpiry, p.SessionExpiryInterval)
+		writeStringProp(&buf, propAssignedClientID, p.AssignedClientID)
+		writeUint16Prop(&buf, propServerKeepAlive, p.ServerKeepAlive)
+		writeStringProp(&buf, propAuthMethod, p.AuthMethod)
+		if p.AuthData != nil {
+			buf.WriteByte(propAuthData)
+			buf.Write(encodeBytes(p.AuthData))
+		}
+		writeByteProp(&buf, propRequestProblemInfo, p.RequestProblemInfo)
+		writeUint32Prop(&buf, propWillDelayInterval, p.WillDelayInterval)
+		writeByteProp(&buf, propRequestResponseInfo, p.RequestResponseInfo)
+		writeStringProp(&buf, propResponseInfo, p.ResponseInfo)
+		writeStringProp(&buf, propServerReference, p.ServerReference)
+		writeStringProp(&buf, propReasonString, p.ReasonString)
+		writeUint16Prop(&buf, propReceiveMaximum, p.ReceiveMaximum)
+		writeUint16Prop(&buf, propTopicAliasMaximum, p.TopicAliasMaximum)
+		writeUint16Prop(&buf, propTopicAlias, p.TopicAlias)
+		writeByteProp(&buf, propMaximumQoS, p.MaximumQoS)
+		writeByteProp(&buf, propRetainAvailable, p.RetainAvailable)
+		for _, u := range p.User {
+			buf.WriteByte(propUser)
+			buf.Write(encodeString(u.Key))
+			buf.Write(encodeString(u.Value))
+		}
+		writeUint32Prop(&buf, propMaximumPacketSize, p.MaximumPacketSize)
+		writeByteProp(&buf, propWildcardSubAvailable, p.WildcardSubAvailable)
+		writeByteProp(&buf, propSubIDAvailable, p.SubIDAvailable)
+		writeByteProp(&buf, propSharedSubAvailable, p.SharedSubAvailable)
+	}
+	result := encodeVarint(buf.Len())
+	return append(result, buf.Bytes()...)
+}
+
+func decodeProperties(r *reader) (*Properties, error) {
+	length, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	end := r.offset + length
+	if end > len(r.buf) {
+		return nil, ErrMalformed
+	}
+	p := new(Properties)
+	for r.offset < end {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case propPayloadFormat:
+			p.PayloadFormat, err = r.bytePtr()
+		case propMessageExpiry:
+			p.MessageExpiry, err = r.uint32Ptr()
+		case propContentType:
+			p.ContentType, err = r.string()
+		case propResponseTopic:
+			p.ResponseTopic, err = r.string()
+		case propCorrelationData:
+			p.CorrelationData, err = r.binary()
+		case propSubscriptionIdentifier:
+			var id int
+			id, err = r.varint()
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, uint32(id))
+		case propSessionExpiry:
+			p.SessionExpiryInterval, err = r.uint32Ptr()
+		case propAssignedClientID:
+			p.AssignedClientID, err = r.string()
+		case propServerKeepAlive:
+			p.ServerKeepAlive, err = r.uint16Ptr()
+		case propAuthMethod:
+			p.AuthMethod, err = r.string()
+		case propAuthData:
+			p.AuthData, err = r.binary()
+		case propRequestProblemInfo:
+			p.RequestProblemInfo, err = r.bytePtr()
+		case propWillDelayInterval:
+			p.WillDelayInterval, err = r.uint32Ptr()
+		case propRequestResponseInfo:
+			p.RequestResponseInfo, err = r.bytePtr()
+		case propResponseInfo:
+			p.ResponseInfo, err = r.string()
+		case propServerReference:
+			p.ServerReference, err = r.string()
+		case propReasonString:
+			p.ReasonString, err = r.string()
+		case propReceiveMaximum:
+			p.ReceiveMaximum, err = r.uint16Ptr()
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum, err = r.uint16Ptr()
+		case propTopicAlias:
+			p.TopicAlias, err = r.uint16Ptr()
+		case propMaximumQoS:
+			p.MaximumQoS, err = r.bytePtr()
+		case propRetainAvailable:
+			p.RetainAvailable, err = r.bytePtr()
+		case propUser:
+			var u UserProperty
+			if u.Key, err = r.string(); err == nil {
+				u.Value, err = r.string()
+			}
+			p.User = append(p.User, u)
+		case propMaximumPacketSize:
+			p.MaximumPacketSize, err = r.uint32Ptr()
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable, err = r.bytePtr()
+		case propSubIDAvailable:
+			p.SubIDAvailable, err = r.bytePtr()
+		case propSharedSubAvailable:
+			p.SharedSubAvailable, err = r.bytePtr()
+		default:
+			return nil, fmt.Errorf("%w: unknown property 0x%02x", ErrMalformed, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.offset != end {
+		return nil, ErrMalformed
+	}
+	return p, nil
+}
+
+func writeByteProp(buf *bytes.Buffer, id byte, v *byte) {
+	if v != nil {
+		buf.WriteByte(id)
+		buf.WriteByte(*v)
+	}
+}
+
+func writeUint16Prop(buf *bytes.Buffer, id byte, v *uint16) {
+	if v != nil {
+		buf.WriteByte(id)
+		buf.Write(encodeUint16(*v))
+	}
+}
+
+func writeUint32Prop(buf *bytes.Buffer, id byte, v *uint32) {
+	if v != nil {
+		buf.WriteByte(id)
+		buf.Write(encodeUint32(*v))
+	}
+}
+
+func writeStringProp(buf *bytes.Buffer, id byte, v string) {
+	if v != "" {
+		buf.WriteByte(id)
+		buf.Write(encodeString(v))
+	}
+}
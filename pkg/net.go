@@ -0,0 +1,19 @@
+package pkg
+
+import "net"
+
+// IsLoopback 判断监听地址是否只接受本机连接，主机为空或未指定地址时监听所有网卡
+//
+// param: addr host:port 形式的地址
+// return: 主机为 localhost 或回环地址时为 true
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
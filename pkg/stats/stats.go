@@ -0,0 +1,21 @@
+package stats
+
+import "sync/atomic"
+
+// 服务端运行以来的累计流量，所有连接共享
+var (
+	// BytesReceived 收到的字节数
+	BytesReceived atomic.Uint64
+	// BytesSent 发送的字节数
+	BytesSent atomic.Uint64
+	// MessagesReceived 收到的所有类型的报文数
+	MessagesReceived atomic.Uint64
+	// MessagesSent 发送的所有类型的报文数
+	MessagesSent atomic.Uint64
+	// PublishReceived 收到的 PUBLISH 报文数
+	PublishReceived atomic.Uint64
+	// PublishSent 发送的 PUBLISH 报文数
+	PublishSent atomic.Uint64
+	// ClientsConnected 运行以来成功建立的连接数
+	ClientsConnected atomic.Uint64
+)
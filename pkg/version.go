@@ -0,0 +1,4 @@
+package pkg
+
+// Version 服务端版本，构建时可以通过 -ldflags "-X icetea/pkg.Version=..." 设置
+var Version = "dev"
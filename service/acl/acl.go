@@ -0,0 +1,45 @@
+package acl
+
+// Action 需要授权的操作
+type Action byte
+
+const (
+	Publish Action = 1 << iota
+	Subscribe
+)
+
+func (a Action) String() string {
+	switch a {
+	case Publish:
+		return `publish`
+	case Subscribe:
+		return `subscribe`
+	default:
+		return `unknown`
+	}
+}
+
+// Access 一次授权请求，发布时 Topic 为发布的主题，订阅时为订阅的主题过滤器
+type Access struct {
+	Username string
+	ClientID string
+	Topic    string
+	Action   Action
+}
+
+// Authorizer 主题级别的发布、订阅授权
+type Authorizer interface {
+	Authorize(access *Access) bool
+}
+
+// AuthorizerFunc 函数形式的 Authorizer
+type AuthorizerFunc func(access *Access) bool
+
+func (f AuthorizerFunc) Authorize(access *Access) bool {
+	return f(access)
+}
+
+// AllowAll 允许所有的发布与订阅
+var AllowAll = AuthorizerFunc(func(*Access) bool {
+	return true
+})
@@ -0,0 +1,100 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadFile 从文件加载授权规则
+//
+// 文件每行一条规则，以 # 开头的行为注释：
+//
+//	allow|deny  pub|sub|pubsub  all|user=<username>|client=<clientID>  <topic>
+//	default allow|deny
+//
+// 没有 default 行时，未匹配任何规则的请求被拒绝
+func LoadFile(path string) (*RuleSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ruleSet := &RuleSet{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if fields[0] == "default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected default allow|deny", path, line)
+			}
+			if ruleSet.Default, err = parseAllow(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			continue
+		}
+		rule, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ruleSet.Rules = append(ruleSet.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ruleSet, nil
+}
+
+func parseRule(fields []string) (Rule, error) {
+	var (
+		rule Rule
+		err  error
+	)
+	if len(fields) != 4 {
+		return rule, fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	if rule.Allow, err = parseAllow(fields[0]); err != nil {
+		return rule, err
+	}
+	switch fields[1] {
+	case "pub":
+		rule.Actions = Publish
+	case "sub":
+		rule.Actions = Subscribe
+	case "pubsub":
+		rule.Actions = Publish | Subscribe
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[1])
+	}
+	switch who := fields[2]; {
+	case who == "all":
+	case strings.HasPrefix(who, "user="):
+		rule.Username = strings.TrimPrefix(who, "user=")
+	case strings.HasPrefix(who, "client="):
+		rule.ClientID = strings.TrimPrefix(who, "client=")
+	default:
+		return rule, fmt.Errorf("unknown subject %q", who)
+	}
+	if fields[2] != "all" && rule.Username == "" && rule.ClientID == "" {
+		return rule, fmt.Errorf("empty subject %q", fields[2])
+	}
+	rule.Topic = fields[3]
+	return rule, nil
+}
+
+func parseAllow(s string) (bool, error) {
+	switch s {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected allow or deny, got %q", s)
+	}
+}
@@ -0,0 +1,145 @@
+package acl
+
+import (
+	"icetea/service/subtree"
+	"strings"
+)
+
+// Rule 一条授权规则
+//
+// Username、ClientID 为空表示匹配任意用户、客户端；
+// Topic 为主题过滤器，其中的 %u、%c 分别替换为用户名和客户端ID
+type Rule struct {
+	Allow    bool
+	Actions  Action
+	Username string
+	ClientID string
+	Topic    string
+}
+
+// Match 判断规则是否适用于该授权请求
+func (r *Rule) Match(access *Access) bool {
+	if r.Actions&access.Action == 0 {
+		return false
+	}
+	if r.Username != "" && r.Username != access.Username {
+		return false
+	}
+	if r.ClientID != "" && r.ClientID != access.ClientID {
+		return false
+	}
+	topic, ok := r.expandTopic(access)
+	if !ok {
+		return false
+	}
+	if access.Action == Subscribe {
+		// 拒绝规则只要与订阅的过滤器可能匹配到同一个主题就适用，
+		// 否则订阅 # 这样更宽的过滤器即可绕过拒绝规则收到被拒绝的主题
+		if !r.Allow {
+			return filterOverlaps(topic, access.Topic)
+		}
+		return filterCovers(topic, access.Topic)
+	}
+	return subtree.TopicMatch(topic, access.Topic)
+}
+
+// expandTopic 替换规则主题中的 %u、%c，
+// 用户名或客户端ID为空或包含通配符时规则不适用
+func (r *Rule) expandTopic(access *Access) (string, bool) {
+	topic := r.Topic
+	if strings.Contains(topic, "%u") {
+		if access.Username == "" || subtree.HasWildcard(access.Username) {
+			return "", false
+		}
+		topic = strings.ReplaceAll(topic, "%u", access.Username)
+	}
+	if strings.Contains(topic, "%c") {
+		if access.ClientID == "" || subtree.HasWildcard(access.ClientID) {
+			return "", false
+		}
+		topic = strings.ReplaceAll(topic, "%c", access.ClientID)
+	}
+	return topic, true
+}
+
+// RuleSet 按顺序匹配的授权规则，第一条适用的规则决定结果，没有适用规则时使用 Default
+type RuleSet struct {
+	Rules   []Rule
+	Default bool
+}
+
+func (s *RuleSet) Authorize(access *Access) bool {
+	for i := range s.Rules {
+		if s.Rules[i].Match(access) {
+			return s.Rules[i].Allow
+		}
+	}
+	return s.Default
+}
+
+// filterCovers 判断订阅的主题过滤器是否完全被规则的主题过滤器覆盖
+//
+// param: rule 规则的主题过滤器
+// param: filter 客户端订阅的主题过滤器
+// return: filter 能匹配到的主题是否都能被 rule 匹配
+func filterCovers(rule, filter string) bool {
+	var (
+		ruleSlice   = strings.Split(rule, "/")
+		filterSlice = strings.Split(filter, "/")
+	)
+	for i, section := range ruleSlice {
+		if section == "#" {
+			return true
+		}
+		if i >= len(filterSlice) {
+			return false
+		}
+		if section == "+" {
+			if filterSlice[i] == "#" {
+				return false
+			}
+			continue
+		}
+		if section != filterSlice[i] {
+			return false
+		}
+	}
+	return len(ruleSlice) == len(filterSlice)
+}
+
+// filterOverlaps 判断两个主题过滤器是否至少能匹配到同一个主题
+//
+// param: rule 规则的主题过滤器
+// param: filter 客户端订阅的主题过滤器
+// return: 是否存在同时被 rule 和 filter 匹配的主题
+func filterOverlaps(rule, filter string) bool {
+	var (
+		ruleSlice   = strings.Split(rule, "/")
+		filterSlice = strings.Split(filter, "/")
+	)
+	// 以通配符开头的过滤器不匹配以 $ 开头的主题
+	if isWildcard(ruleSlice[0]) && strings.HasPrefix(filterSlice[0], "$") ||
+		isWildcard(filterSlice[0]) && strings.HasPrefix(ruleSlice[0], "$") {
+		return false
+	}
+	for i := 0; ; i++ {
+		switch {
+		case i == len(ruleSlice) && i == len(filterSlice):
+			return true
+		case i == len(ruleSlice):
+			// # 同时匹配父层级，a 与 a/# 都能匹配主题 a
+			return i+1 == len(filterSlice) && filterSlice[i] == "#"
+		case i == len(filterSlice):
+			return i+1 == len(ruleSlice) && ruleSlice[i] == "#"
+		case ruleSlice[i] == "#" || filterSlice[i] == "#":
+			return true
+		case ruleSlice[i] == "+" || filterSlice[i] == "+":
+		case ruleSlice[i] != filterSlice[i]:
+			return false
+		}
+	}
+}
+
+func isWildcard(section string) bool {
+	return section == "#" || section == "+"
+}
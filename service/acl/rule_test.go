@@ -0,0 +1,100 @@
+package acl
+
+import "testing"
+
+func TestFilterOverlaps(t *testing.T) {
+	cases := []struct {
+		rule, filter string
+		want         bool
+	}{
+		{"secret/#", "#", true},
+		{"secret/#", "+/x", true},
+		{"secret/#", "secret/+/#", true},
+		{"secret/#", "secret", true},
+		{"secret/#", "public/#", false},
+		{"secret/+", "secret/a/b", false},
+		{"secret/+", "secret/#", true},
+		{"secret/+", "+/+", true},
+		{"secret/+", "+", false},
+		{"secret", "secret/#", true},
+		{"secret", "secret/+", false},
+		{"a/+/c", "a/b/+", true},
+		{"a/+/c", "a/b/d", false},
+		{"a//c", "a/+/c", true},
+		{"$SYS/#", "#", false},
+		{"$SYS/#", "+/broker", false},
+		{"#", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/+", true},
+	}
+	for _, c := range cases {
+		if got := filterOverlaps(c.rule, c.filter); got != c.want {
+			t.Errorf("filterOverlaps(%q, %q) = %v, want %v", c.rule, c.filter, got, c.want)
+		}
+		if got := filterOverlaps(c.filter, c.rule); got != c.want {
+			t.Errorf("filterOverlaps(%q, %q) = %v, want %v", c.filter, c.rule, got, c.want)
+		}
+	}
+}
+
+func TestFilterCovers(t *testing.T) {
+	cases := []struct {
+		rule, filter string
+		want         bool
+	}{
+		{"#", "a/b", true},
+		{"a/#", "a/+/c", true},
+		{"a/#", "#", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a/+", false},
+		{"a/b", "a/b", true},
+	}
+	for _, c := range cases {
+		if got := filterCovers(c.rule, c.filter); got != c.want {
+			t.Errorf("filterCovers(%q, %q) = %v, want %v", c.rule, c.filter, got, c.want)
+		}
+	}
+}
+
+func TestRuleSetAuthorize(t *testing.T) {
+	ruleSet := &RuleSet{
+		Rules: []Rule{
+			{Allow: true, Actions: Publish | Subscribe, Topic: "users/%u/#"},
+			{Allow: true, Actions: Publish | Subscribe, Topic: "clients/%c/#"},
+			{Allow: false, Actions: Publish | Subscribe, Topic: "users/#"},
+			{Allow: false, Actions: Publish | Subscribe, Topic: "clients/#"},
+			{Allow: false, Actions: Subscribe, Topic: "secret/#"},
+			{Allow: true, Actions: Subscribe, Topic: "#"},
+			{Allow: true, Actions: Publish, Username: "admin", Topic: "secret/#"},
+		},
+	}
+	cases := []struct {
+		name   string
+		access Access
+		want   bool
+	}{
+		{"deny overlaps wider filter", Access{Username: "u", Topic: "#", Action: Subscribe}, false},
+		{"deny overlaps single level", Access{Username: "u", Topic: "+/x", Action: Subscribe}, false},
+		{"deny overlaps nested", Access{Username: "u", Topic: "secret/+/#", Action: Subscribe}, false},
+		{"deny exact", Access{Username: "u", Topic: "secret/a", Action: Subscribe}, false},
+		{"allow disjoint", Access{Username: "u", Topic: "public/+", Action: Subscribe}, true},
+		{"allow $SYS", Access{Username: "u", Topic: "$SYS/#", Action: Subscribe}, true},
+		{"publish user", Access{Username: "admin", Topic: "secret/a", Action: Publish}, true},
+		{"publish other user", Access{Username: "u", Topic: "secret/a", Action: Publish}, false},
+		{"%u own", Access{Username: "alice", Topic: "users/alice/inbox", Action: Publish}, true},
+		{"%u own subtree", Access{Username: "alice", Topic: "users/alice/#", Action: Subscribe}, true},
+		{"%u other", Access{Username: "alice", Topic: "users/bob/inbox", Action: Publish}, false},
+		{"%u wider", Access{Username: "alice", Topic: "users/+/inbox", Action: Subscribe}, false},
+		{"%u empty", Access{Topic: "users//inbox", Action: Publish}, false},
+		{"%u wildcard", Access{Username: "+", Topic: "users/+/inbox", Action: Subscribe}, false},
+		{"%c own", Access{ClientID: "c1", Topic: "clients/c1/x", Action: Publish}, true},
+		{"%c other", Access{ClientID: "c1", Topic: "clients/c2/x", Action: Subscribe}, false},
+		{"%c wildcard", Access{ClientID: "#", Topic: "clients/#", Action: Subscribe}, false},
+	}
+	for _, c := range cases {
+		if got := ruleSet.Authorize(&c.access); got != c.want {
+			t.Errorf("%s: Authorize(%+v) = %v, want %v", c.name, c.access, got, c.want)
+		}
+	}
+}
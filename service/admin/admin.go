@@ -0,0 +1,158 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg"
+	"icetea/service"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// shutdownTimeout 停止时等待处理中的请求完成的时间
+const shutdownTimeout = 5 * time.Second
+
+// Config 管理接口配置
+type Config struct {
+	// Listen 监听地址，例如 127.0.0.1:8080
+	Listen string
+	// Token 请求需要携带 Authorization: Bearer <token>，只监听回环地址时可以为空
+	Token string
+}
+
+// Server 管理接口，以 JSON 提供客户端、订阅的查询以及踢出客户端、发布消息
+type Server struct {
+	config  Config
+	handler *service.HandlerService
+	server  *http.Server
+}
+
+// New 创建管理接口服务
+//
+// param: config 管理接口配置
+// param: handler 报文处理器
+func New(config Config, handler *service.HandlerService) *Server {
+	s := &Server{
+		config:  config,
+		handler: handler,
+	}
+	s.server = &http.Server{
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+func (s *Server) Run(ctx context.Context) error {
+	if s.config.Token == "" && !pkg.IsLoopback(s.config.Listen) {
+		return fmt.Errorf("admin: token is required when listen address %q is not loopback", s.config.Listen)
+	}
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithFields(map[string]interface{}{
+				"listen": s.config.Listen,
+				"error":  err,
+			}).Error("admin server stopped")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+	logrus.WithFields(map[string]interface{}{
+		"listen": s.config.Listen,
+	}).Info("admin server listening")
+	return nil
+}
+
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) Name() string {
+	return `admin`
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/clients", s.method(http.MethodGet, s.listClients))
+	mux.HandleFunc("/api/v1/clients/", s.client)
+	mux.HandleFunc("/api/v1/subscribers", s.method(http.MethodGet, s.listSubscribers))
+	mux.HandleFunc("/api/v1/publish", s.method(http.MethodPost, s.publish))
+	return s.authenticate(mux)
+}
+
+// authenticate 校验 Bearer token，未配置 token 时不校验
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if s.config.Token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + s.config.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// method 只允许指定的请求方法
+func (s *Server) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// client 处理 /api/v1/clients/{id} 与 /api/v1/clients/{id}/subscriptions，
+// 客户端ID中的 / 需要编码为 %2F
+func (s *Server) client(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/clients/"), "/")
+	if segments[0] == "" || len(segments) > 2 || (len(segments) == 2 && segments[1] != "subscriptions") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	clientId, err := url.PathUnescape(segments[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid client id")
+		return
+	}
+	switch {
+	case len(segments) == 2 && r.Method == http.MethodGet:
+		s.clientSubscriptions(w, clientId)
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		s.getClient(w, clientId)
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		s.kickClient(w, clientId)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,237 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/client"
+	"icetea/service"
+	"icetea/service/subtree"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectClient 通过 net.Pipe 连接一个 3.1.1 客户端并订阅 filter，返回客户端一侧的连接
+func connectClient(t *testing.T, handler *service.HandlerService, clientId, filter string) net.Conn {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	local, remote := net.Pipe()
+	c := client.NewClient(remote, handler)
+	c.Run(ctx)
+	t.Cleanup(func() {
+		local.Close()
+		cancel()
+		<-c.Done()
+		subtree.GetTopicSub().DeleteClient(clientId)
+	})
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = clientId
+	connect.Write(local)
+	if connAck, err := packets.ReadPacket(local); err != nil || connAck.(*packets.ConnackPacket).ReturnCode != packets.Accepted {
+		t.Fatalf("connect %s: %v", clientId, err)
+	}
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{filter}
+	subscribe.Qoss = []byte{1}
+	subscribe.Write(local)
+	if _, err := packets.ReadPacket(local); err != nil {
+		t.Fatalf("subscribe %s: %v", clientId, err)
+	}
+	return local
+}
+
+// request 向管理接口发送请求，body 不为nil时解码 JSON 响应
+func request(t *testing.T, server *Server, method, target, token, payload string, body interface{}) int {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(payload))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(recorder, r)
+	if body != nil && recorder.Code < 300 {
+		if err := json.NewDecoder(recorder.Body).Decode(body); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return recorder.Code
+}
+
+// TestAdminToken 非回环地址必须配置 token，配置 token 后请求需要携带正确的 Bearer token
+func TestAdminToken(t *testing.T) {
+	handler := service.NewHandlerService()
+	if err := New(Config{Listen: "0.0.0.0:0"}, handler).Run(context.Background()); err == nil {
+		t.Fatal("admin started on a non-loopback address without a token")
+	}
+	loopback := New(Config{Listen: "127.0.0.1:0"}, handler)
+	if err := loopback.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	loopback.Stop()
+	secured := New(Config{Listen: "0.0.0.0:0", Token: "secret"}, handler)
+	if err := secured.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	secured.Stop()
+
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status := request(t, secured, http.MethodGet, "/api/v1/clients", tt.token, "", nil); status != tt.status {
+			t.Errorf("token %q: status %d, want %d", tt.token, status, tt.status)
+		}
+	}
+	if status := request(t, loopback, http.MethodGet, "/api/v1/clients", "", "", nil); status != http.StatusOK {
+		t.Errorf("loopback without token: status %d", status)
+	}
+}
+
+// TestAdminClients 查询在线客户端与保留了会话的离线客户端，踢出在线客户端
+func TestAdminClients(t *testing.T) {
+	var (
+		handler  = service.NewHandlerService()
+		server   = New(Config{Listen: "127.0.0.1:0"}, handler)
+		topicSub = subtree.GetTopicSub()
+	)
+	conn := connectClient(t, handler, "admin-online", "admin/clients")
+	topicSub.CreateSub(map[string]int32{"admin/offline": 2}, "admin/offline", nil, "")
+	defer topicSub.DeleteClient("admin/offline")
+
+	var clients []clientInfo
+	if status := request(t, server, http.MethodGet, "/api/v1/clients", "", "", &clients); status != http.StatusOK {
+		t.Fatalf("list clients: status %d", status)
+	}
+	if len(clients) != 1 || clients[0].ID != "admin-online" || !clients[0].Online || clients[0].ProtocolVersion != 4 {
+		t.Fatalf("clients = %+v", clients)
+	}
+
+	var info clientInfo
+	request(t, server, http.MethodGet, "/api/v1/clients/admin-online", "", "", &info)
+	if !info.Online || len(info.Subscriptions) != 1 || info.Subscriptions[0] != (subscription{Topic: "admin/clients", Qos: 1}) {
+		t.Fatalf("online client = %+v", info)
+	}
+	info = clientInfo{}
+	request(t, server, http.MethodGet, "/api/v1/clients/admin%2Foffline", "", "", &info)
+	if info.Online || info.ID != "admin/offline" || len(info.Subscriptions) != 1 || info.Subscriptions[0].Qos != 2 {
+		t.Fatalf("offline client = %+v", info)
+	}
+	var subscriptions []subscription
+	request(t, server, http.MethodGet, "/api/v1/clients/admin%2Foffline/subscriptions", "", "", &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0].Topic != "admin/offline" {
+		t.Fatalf("subscriptions = %+v", subscriptions)
+	}
+
+	for _, tt := range []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/api/v1/clients/missing", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/clients/missing/subscriptions", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/clients/admin-online/other", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/clients/", http.StatusNotFound},
+		{http.MethodPost, "/api/v1/clients", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/api/v1/clients/admin-online", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/api/v1/clients/admin%2Foffline", http.StatusNotFound},
+	} {
+		if status := request(t, server, tt.method, tt.target, "", "", nil); status != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, status, tt.status)
+		}
+	}
+
+	if status := request(t, server, http.MethodDelete, "/api/v1/clients/admin-online", "", "", nil); status != http.StatusNoContent {
+		t.Fatalf("kick: status %d", status)
+	}
+	if _, err := packets.ReadPacket(conn); err == nil {
+		t.Fatal("kicked client still connected")
+	}
+}
+
+// TestAdminSubscribers 按客户端ID分页查询会收到主题消息的客户端
+func TestAdminSubscribers(t *testing.T) {
+	var (
+		handler  = service.NewHandlerService()
+		server   = New(Config{Listen: "127.0.0.1:0"}, handler)
+		topicSub = subtree.GetTopicSub()
+	)
+	for _, id := range []string{"page-a", "page-b", "page-c"} {
+		topicSub.CreateSub(map[string]int32{"admin/page/+": 1}, id, nil, "")
+		defer topicSub.DeleteClient(id)
+	}
+
+	var page subscriberPage
+	request(t, server, http.MethodGet, "/api/v1/subscribers?topic=admin/page/1&limit=2", "", "", &page)
+	if page.Total != 3 || page.Next != "page-b" || len(page.Subscribers) != 2 || page.Subscribers[0].ClientID != "page-a" {
+		t.Fatalf("first page = %+v", page)
+	}
+	page = subscriberPage{}
+	request(t, server, http.MethodGet, "/api/v1/subscribers?topic=admin/page/1&limit=2&after=page-b", "", "", &page)
+	if page.Next != "" || len(page.Subscribers) != 1 || page.Subscribers[0].ClientID != "page-c" || page.Subscribers[0].Online {
+		t.Fatalf("last page = %+v", page)
+	}
+
+	for _, target := range []string{
+		"/api/v1/subscribers",
+		"/api/v1/subscribers?topic=admin/page/%2B",
+		"/api/v1/subscribers?topic=admin/page/1&limit=0",
+		"/api/v1/subscribers?topic=admin/page/1&limit=1001",
+	} {
+		if status := request(t, server, http.MethodGet, target, "", "", nil); status != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", target, status)
+		}
+	}
+}
+
+// TestAdminPublish 以服务端身份发布消息，不合法的请求返回 400
+func TestAdminPublish(t *testing.T) {
+	var (
+		handler = service.NewHandlerService()
+		server  = New(Config{Listen: "127.0.0.1:0"}, handler)
+	)
+	conn := connectClient(t, handler, "admin-subscriber", "admin/publish")
+
+	if status := request(t, server, http.MethodPost, "/api/v1/publish", "", `{"topic":"admin/publish","payload":"aGVsbG8=","encoding":"base64"}`, nil); status != http.StatusNoContent {
+		t.Fatalf("publish: status %d", status)
+	}
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publish, ok := packet.(*packets.PublishPacket); !ok || string(publish.Payload) != "hello" {
+		t.Fatalf("received %s", packet.String())
+	}
+
+	for _, body := range []string{
+		`{"topic":"admin/publish"`,
+		`{"topic":"admin/publish","unknown":true}`,
+		`{"topic":""}`,
+		`{"topic":"admin/+"}`,
+		`{"topic":"$SYS/broker"}`,
+		`{"topic":"admin/publish","qos":3}`,
+		`{"topic":"admin/publish","payload":"%%%","encoding":"base64"}`,
+		`{"topic":"admin/publish","encoding":"hex"}`,
+	} {
+		if status := request(t, server, http.MethodPost, "/api/v1/publish", "", body, nil); status != http.StatusBadRequest {
+			t.Errorf("POST %s: status %d, want 400", body, status)
+		}
+	}
+	if status := request(t, server, http.MethodGet, "/api/v1/publish", "", "", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/v1/publish: status %d, want 405", status)
+	}
+}
@@ -0,0 +1,232 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/client"
+	"icetea/service/subtree"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// publisher 管理接口发布消息时使用的发布者ID
+const publisher = `$admin`
+
+const (
+	// defaultPageLimit 分页接口默认的每页数量
+	defaultPageLimit = 100
+	// maxPageLimit 分页接口每页数量的上限
+	maxPageLimit = 1000
+)
+
+type clientInfo struct {
+	ID              string     `json:"id"`
+	Online          bool       `json:"online"`
+	Username        string     `json:"username,omitempty"`
+	Address         string     `json:"address,omitempty"`
+	ProtocolVersion byte       `json:"protocol_version,omitempty"`
+	ConnectedAt     *time.Time `json:"connected_at,omitempty"`
+	Bridge          bool       `json:"bridge,omitempty"`
+	Inflight        int        `json:"inflight"`
+	// Queued 出站队列中等待写出的报文数
+	Queued int `json:"queued"`
+	// Node 订阅所在的集群节点，本节点为空
+	Node          string         `json:"node,omitempty"`
+	Subscriptions []subscription `json:"subscriptions,omitempty"`
+}
+
+type subscription struct {
+	Topic string `json:"topic"`
+	Qos   int32  `json:"qos"`
+}
+
+type subscriber struct {
+	ClientID string `json:"client_id"`
+	Qos      int32  `json:"qos"`
+	Online   bool   `json:"online"`
+	Node     string `json:"node,omitempty"`
+}
+
+// subscriberPage 一页订阅者，Next 为空时没有下一页
+type subscriberPage struct {
+	Total       int          `json:"total"`
+	Next        string       `json:"next,omitempty"`
+	Subscribers []subscriber `json:"subscribers"`
+}
+
+type publishRequest struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	// Encoding payload 的编码: 为空时按文本发布，base64 时解码后发布
+	Encoding string `json:"encoding"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+}
+
+func newClientInfo(c *client.Client) *clientInfo {
+	connectedAt := c.ConnectedAt()
+	return &clientInfo{
+		ID:              c.GetId(),
+		Online:          true,
+		Username:        c.GetUsername(),
+		Address:         c.GetConn().RemoteAddr().String(),
+		ProtocolVersion: c.ProtocolVersion(),
+		ConnectedAt:     &connectedAt,
+		Bridge:          c.IsBridge(),
+		Inflight:        c.InflightLen(),
+		Queued:          c.QueueLen(),
+	}
+}
+
+// listClients GET /api/v1/clients 在线客户端
+func (s *Server) listClients(w http.ResponseWriter, r *http.Request) {
+	clients := s.handler.ReadClients()
+	result := make([]*clientInfo, 0, len(clients))
+	for _, c := range clients {
+		result = append(result, newClientInfo(c))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// getClient GET /api/v1/clients/{id} 客户端详情与订阅，包括保留了会话的离线客户端
+func (s *Server) getClient(w http.ResponseWriter, clientId string) {
+	topics, ok := s.subscriptions(clientId)
+	if !ok {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	info := &clientInfo{ID: clientId}
+	if c, online := s.handler.ReadClient(clientId); online {
+		info = newClientInfo(c)
+	} else {
+		info.Node = subtree.GetTopicSub().ReadClientNode(clientId)
+	}
+	info.Subscriptions = topics
+	writeJSON(w, http.StatusOK, info)
+}
+
+// clientSubscriptions GET /api/v1/clients/{id}/subscriptions 客户端的订阅
+func (s *Server) clientSubscriptions(w http.ResponseWriter, clientId string) {
+	topics, ok := s.subscriptions(clientId)
+	if !ok {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, topics)
+}
+
+// kickClient DELETE /api/v1/clients/{id} 断开在线客户端
+func (s *Server) kickClient(w http.ResponseWriter, clientId string) {
+	if !s.handler.Kick(clientId) {
+		writeError(w, http.StatusNotFound, "client not connected")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSubscribers GET /api/v1/subscribers?topic=&after=&limit= 会收到该主题消息的客户端，不包括共享订阅。
+// 按客户端ID排序分页，after 为上一页返回的 next
+func (s *Server) listSubscribers(w http.ResponseWriter, r *http.Request) {
+	var (
+		query = r.URL.Query()
+		topic = query.Get("topic")
+		limit = defaultPageLimit
+	)
+	if topic == "" || subtree.HasWildcard(topic) {
+		writeError(w, http.StatusBadRequest, "topic is required and must not contain wildcards")
+		return
+	}
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxPageLimit {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+			return
+		}
+	}
+	page, total := subtree.GetTopicSub().ReadSubscribers(topic, query.Get("after"), limit)
+	result := subscriberPage{
+		Total:       total,
+		Subscribers: make([]subscriber, 0, len(page)),
+	}
+	for _, sub := range page {
+		_, online := s.handler.ReadClient(sub.ClientID)
+		result.Subscribers = append(result.Subscribers, subscriber{
+			ClientID: sub.ClientID,
+			Qos:      sub.Qos,
+			Online:   online,
+			Node:     subtree.GetTopicSub().ReadClientNode(sub.ClientID),
+		})
+	}
+	if len(page) == limit {
+		result.Next = page[len(page)-1].ClientID
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// publish POST /api/v1/publish 以服务端身份发布消息
+func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
+	var request publishRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if err := s.handler.TopicLimits().ValidateName(request.Topic); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid topic: "+err.Error())
+		return
+	}
+	if strings.HasPrefix(request.Topic, "$") {
+		writeError(w, http.StatusBadRequest, "topic must not start with $")
+		return
+	}
+	if request.Qos > 2 {
+		writeError(w, http.StatusBadRequest, "qos must be 0, 1 or 2")
+		return
+	}
+	payload := []byte(request.Payload)
+	switch request.Encoding {
+	case "":
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(request.Payload)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "payload is not valid base64")
+			return
+		}
+		payload = decoded
+	default:
+		writeError(w, http.StatusBadRequest, `encoding must be empty or "base64"`)
+		return
+	}
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = request.Topic
+	packet.Payload = payload
+	packet.Qos = request.Qos
+	packet.Retain = request.Retain
+	s.handler.PublishAs(publisher, packet, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// subscriptions 客户端的订阅，按主题排序
+//
+// return: 订阅，客户端是否在线或保留了会话
+func (s *Server) subscriptions(clientId string) ([]subscription, bool) {
+	_, online := s.handler.ReadClient(clientId)
+	if _, ok := subtree.GetTopicSub().ReadClientInfo(clientId); !ok && !online {
+		return nil, false
+	}
+	topics := subtree.GetTopicSub().ReadClientSubTopics(clientId)
+	result := make([]subscription, 0, len(topics))
+	for topic, qos := range topics {
+		result = append(result, subscription{Topic: topic, Qos: qos & subtree.SubQos})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Topic < result[j].Topic
+	})
+	return result, true
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"icetea/pkg"
+	"net"
+)
+
+// Credentials 客户端 CONNECT 时携带的身份信息
+type Credentials struct {
+	ClientID   string
+	Username   string
+	Password   []byte
+	RemoteAddr net.Addr
+	// Certificate 用户名是否派生自已校验的客户端证书
+	Certificate bool
+}
+
+// Authenticator 客户端连接认证
+//
+// 认证失败时返回 pkg.ErrBadUsernameOrPassword 或 pkg.ErrNotAuthorized，
+// 分别对应 CONNACK 返回码 0x04 和 0x05
+type Authenticator interface {
+	Authenticate(credentials *Credentials) error
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator
+type AuthenticatorFunc func(credentials *Credentials) error
+
+func (f AuthenticatorFunc) Authenticate(credentials *Credentials) error {
+	return f(credentials)
+}
+
+// AllowAll 允许所有客户端连接
+var AllowAll = AuthenticatorFunc(func(*Credentials) error {
+	return nil
+})
+
+// Anonymous 处理未携带用户名的匿名连接，带用户名的连接交给 next 认证
+//
+// param: allow 是否允许匿名连接
+// param: next 用户名认证，为nil时拒绝所有带用户名的连接
+// return: 认证器
+func Anonymous(allow bool, next Authenticator) Authenticator {
+	return AuthenticatorFunc(func(credentials *Credentials) error {
+		if credentials.Username == "" {
+			if allow {
+				return nil
+			}
+			return pkg.ErrNotAuthorized
+		}
+		if next == nil {
+			return pkg.ErrBadUsernameOrPassword
+		}
+		return next.Authenticate(credentials)
+	})
+}
+
+// Certificate 用户名派生自已校验客户端证书的连接直接通过，其余连接交给 next 认证
+func Certificate(next Authenticator) Authenticator {
+	return AuthenticatorFunc(func(credentials *Credentials) error {
+		if credentials.Certificate {
+			return nil
+		}
+		return next.Authenticate(credentials)
+	})
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"icetea/pkg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePasswordFile 写入一个账号文件，密码使用最低的 bcrypt 代价
+func writePasswordFile(t *testing.T, users map[string]string) string {
+	t.Helper()
+	content := "# username:bcrypt-hash\n\n"
+	for username, password := range users {
+		content += username + ":" + mustHash(t, password) + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestPasswordFile 用户名不存在或密码错误都返回 ErrBadUsernameOrPassword，Reload 读取修改后的文件
+func TestPasswordFile(t *testing.T) {
+	path := writePasswordFile(t, map[string]string{"alice": "secret"})
+	f, err := NewPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"alice", "secret", nil},
+		{"alice", "wrong", pkg.ErrBadUsernameOrPassword},
+		{"alice", "", pkg.ErrBadUsernameOrPassword},
+		{"bob", "secret", pkg.ErrBadUsernameOrPassword},
+	}
+	for _, tt := range tests {
+		err := f.Authenticate(&Credentials{Username: tt.username, Password: []byte(tt.password)})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Authenticate(%s, %s) = %v, want %v", tt.username, tt.password, err, tt.err)
+		}
+	}
+
+	os.WriteFile(path, []byte("bob:"+mustHash(t, "hunter2")+"\n"), 0600)
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Authenticate(&Credentials{Username: "bob", Password: []byte("hunter2")}); err != nil {
+		t.Fatalf("reloaded user rejected: %v", err)
+	}
+	if err := f.Authenticate(&Credentials{Username: "alice", Password: []byte("secret")}); err == nil {
+		t.Fatal("removed user accepted")
+	}
+}
+
+// TestPasswordFileInvalid 格式错误或不是 bcrypt 哈希的行使加载失败
+func TestPasswordFileInvalid(t *testing.T) {
+	for _, content := range []string{"alice\n", ":hash\n", "alice:\n", "alice:plaintext\n"} {
+		path := filepath.Join(t.TempDir(), "passwd")
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := NewPasswordFile(path); err == nil {
+			t.Errorf("NewPasswordFile(%q) succeeded", content)
+		}
+	}
+	if _, err := NewPasswordFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+// TestAuthenticatorChain 证书认证、匿名连接与账号文件组合后的结果
+func TestAuthenticatorChain(t *testing.T) {
+	f, err := NewPasswordFile(writePasswordFile(t, map[string]string{"alice": "secret"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		credentials   Credentials
+		err           error
+	}{
+		{"anonymous allowed", Anonymous(true, f), Credentials{}, nil},
+		{"anonymous refused", Anonymous(false, f), Credentials{}, pkg.ErrNotAuthorized},
+		{"password", Anonymous(false, f), Credentials{Username: "alice", Password: []byte("secret")}, nil},
+		{"wrong password", Anonymous(true, f), Credentials{Username: "alice", Password: []byte("wrong")}, pkg.ErrBadUsernameOrPassword},
+		{"no password file", Anonymous(true, nil), Credentials{Username: "alice", Password: []byte("secret")}, pkg.ErrBadUsernameOrPassword},
+		{"certificate", Certificate(Anonymous(false, nil)), Credentials{Username: "device-1", Certificate: true}, nil},
+		{"certificate with password file", Certificate(Anonymous(false, f)), Credentials{Username: "device-1", Certificate: true}, nil},
+		{"no certificate", Certificate(Anonymous(false, f)), Credentials{Username: "device-1"}, pkg.ErrBadUsernameOrPassword},
+		{"no certificate anonymous", Certificate(Anonymous(false, f)), Credentials{}, pkg.ErrNotAuthorized},
+	}
+	for _, tt := range tests {
+		if err := tt.authenticator.Authenticate(&tt.credentials); !errors.Is(err, tt.err) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"icetea/pkg"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PasswordFile 基于静态账号文件的认证，文件每行一个账号，格式为 username:bcrypt-hash，
+// 以 # 开头的行为注释
+type PasswordFile struct {
+	path  string
+	mux   sync.RWMutex
+	users map[string][]byte
+}
+
+func NewPasswordFile(path string) (*PasswordFile, error) {
+	f := &PasswordFile{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload 重新读取账号文件
+func (f *PasswordFile) Reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.Index(text, ":")
+		if i <= 0 || i == len(text)-1 {
+			return fmt.Errorf("%s:%d: expected username:bcrypt-hash", f.path, line)
+		}
+		hash := []byte(text[i+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return fmt.Errorf("%s:%d: %w", f.path, line, err)
+		}
+		users[text[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.mux.Lock()
+	f.users = users
+	f.mux.Unlock()
+	return nil
+}
+
+func (f *PasswordFile) Authenticate(credentials *Credentials) error {
+	f.mux.RLock()
+	hash, ok := f.users[credentials.Username]
+	f.mux.RUnlock()
+	if !ok {
+		return pkg.ErrBadUsernameOrPassword
+	}
+	if bcrypt.CompareHashAndPassword(hash, credentials.Password) != nil {
+		return pkg.ErrBadUsernameOrPassword
+	}
+	return nil
+}
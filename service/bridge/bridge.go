@@ -0,0 +1,272 @@
+package bridge
+
+import (
+	"context"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg/mqtt5"
+	"icetea/service"
+	"icetea/service/subtree"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bridgeProtocolVersion MQTT 3.1.1 协议级别加上桥接标志
+	bridgeProtocolVersion = 0x84
+	// drainTimeout Stop 等待队列中的消息转发到远端的时间
+	drainTimeout = 5 * time.Second
+)
+
+// Bridge 连接远端服务端，按转发规则在本地与远端之间转发消息
+type Bridge struct {
+	config  Config
+	handler *service.HandlerService
+	client  mqtt.Client
+	// publisher 桥接在本地发布消息时使用的发布者ID，用于识别并跳过自己转入的消息
+	publisher string
+	// outgoing 等待转发到远端的消息，由 send 协程写出，发布回调不会因远端变慢而阻塞
+	outgoing chan outgoing
+	running  atomic.Bool
+	// removeHook 注销发布回调
+	removeHook func()
+	// stop 关闭时 send 协程退出，done 在 send 协程退出后关闭
+	stop chan struct{}
+	done chan struct{}
+}
+
+// outgoing 一条等待转发到远端的消息
+type outgoing struct {
+	topic   string
+	qos     byte
+	retain  bool
+	payload []byte
+}
+
+// New 创建桥接服务
+//
+// param: config 已经校验过的桥接配置
+// param: handler 本地的报文处理器
+func New(config Config, handler *service.HandlerService) *Bridge {
+	return &Bridge{
+		config:    config,
+		handler:   handler,
+		publisher: `$bridge/` + config.Name,
+		outgoing:  make(chan outgoing, config.QueueLength),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (b *Bridge) Run(ctx context.Context) error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.config.Address).
+		SetClientID(b.config.ClientID).
+		SetUsername(b.config.Username).
+		SetPassword(b.config.Password).
+		SetCleanSession(b.config.CleanSession).
+		SetKeepAlive(b.config.KeepAlive).
+		SetTLSConfig(b.config.TLS).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(b.config.MinBackoff).
+		SetMaxReconnectInterval(b.config.MaxBackoff).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(b.onConnectionLost)
+	if b.config.TryPrivate {
+		opts.SetProtocolVersion(bridgeProtocolVersion)
+	}
+	b.client = mqtt.NewClient(opts)
+	b.running.Store(true)
+	go b.send()
+	b.removeHook = b.handler.AddPublishHook(b.forward)
+	// 开启 ConnectRetry 后连接失败会在后台重试，不阻塞启动
+	b.client.Connect()
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Stop()
+		case <-b.stop:
+		}
+	}()
+	return nil
+}
+
+func (b *Bridge) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	return b.Shutdown(ctx)
+}
+
+// Shutdown 注销发布回调并停止 send 协程，在 ctx 的截止时间前将队列中剩余的消息转发到远端，
+// 远端未连接或超时后剩余的消息被丢弃并记录数量，最后断开连接
+func (b *Bridge) Shutdown(ctx context.Context) error {
+	if !b.running.CompareAndSwap(true, false) {
+		return nil
+	}
+	b.removeHook()
+	close(b.stop)
+	<-b.done
+	b.drain(ctx)
+	b.client.Disconnect(250)
+	return nil
+}
+
+func (b *Bridge) Name() string {
+	return `bridge:` + b.config.Name
+}
+
+// onConnect 连接或重连成功后订阅所有转入的主题
+func (b *Bridge) onConnect(client mqtt.Client) {
+	filters := make(map[string]byte)
+	for _, m := range b.config.Mappings {
+		if m.in() {
+			filters[m.remote()] = m.Qos
+		}
+	}
+	logrus.WithFields(map[string]interface{}{
+		"bridge":  b.config.Name,
+		"address": b.config.Address,
+		"topics":  filters,
+	}).Info("bridge connected")
+	if len(filters) == 0 {
+		return
+	}
+	token := client.SubscribeMultiple(filters, b.receive)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			logrus.WithFields(map[string]interface{}{
+				"bridge": b.config.Name,
+				"error":  token.Error(),
+			}).Error("bridge subscribe failed")
+		}
+	}()
+}
+
+func (b *Bridge) onConnectionLost(client mqtt.Client, err error) {
+	logrus.WithFields(map[string]interface{}{
+		"bridge":  b.config.Name,
+		"address": b.config.Address,
+		"error":   err,
+	}).Warn("bridge connection lost, reconnecting")
+}
+
+// receive 将远端的消息转发到本地
+func (b *Bridge) receive(client mqtt.Client, message mqtt.Message) {
+	for _, m := range b.config.Mappings {
+		if !m.in() || !subtree.TopicMatch(m.remote(), message.Topic()) {
+			continue
+		}
+		packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		packet.TopicName = m.LocalPrefix + strings.TrimPrefix(message.Topic(), m.RemotePrefix)
+		packet.Payload = message.Payload()
+		packet.Qos = minQos(message.Qos(), m.Qos)
+		packet.Retain = message.Retained()
+		b.handler.PublishAs(b.publisher, packet, nil)
+		return
+	}
+}
+
+// forward 将本地发布的消息转发到远端，跳过由桥接自己转入的消息
+func (b *Bridge) forward(publisher string, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	if publisher == b.publisher || !b.running.Load() {
+		return
+	}
+	for _, m := range b.config.Mappings {
+		if !m.out() || !subtree.TopicMatch(m.local(), packet.TopicName) {
+			continue
+		}
+		message := outgoing{
+			topic:   m.RemotePrefix + strings.TrimPrefix(packet.TopicName, m.LocalPrefix),
+			qos:     minQos(packet.Qos, m.Qos),
+			retain:  packet.Retain,
+			payload: packet.Payload,
+		}
+		select {
+		case b.outgoing <- message:
+		default:
+			logrus.WithFields(map[string]interface{}{
+				"bridge": b.config.Name,
+				"topic":  message.topic,
+				"qos":    message.qos,
+			}).Warn("bridge queue full, message dropped")
+		}
+		return
+	}
+}
+
+// send 按顺序将队列中的消息发布到远端，QoS > 0 的消息等待确认后再发送下一条，
+// 远端变慢或断线期间消息在队列中积压
+func (b *Bridge) send() {
+	defer close(b.done)
+	for {
+		select {
+		case <-b.stop:
+			return
+		case message := <-b.outgoing:
+			b.publish(message, b.stop)
+		}
+	}
+}
+
+// drain 在 ctx 结束前将队列中剩余的消息转发到远端，远端未连接或 ctx 结束后丢弃剩余的消息
+func (b *Bridge) drain(ctx context.Context) {
+	var forwarded, dropped int
+	for {
+		select {
+		case message := <-b.outgoing:
+			if ctx.Err() == nil && b.client.IsConnectionOpen() && b.publish(message, ctx.Done()) {
+				forwarded++
+			} else {
+				dropped++
+			}
+		default:
+			if forwarded+dropped == 0 {
+				return
+			}
+			entry := logrus.WithFields(map[string]interface{}{
+				"bridge":    b.config.Name,
+				"forwarded": forwarded,
+				"dropped":   dropped,
+			})
+			if dropped > 0 {
+				entry.Warn("bridge stopped, queued messages dropped")
+			} else {
+				entry.Info("bridge stopped, queued messages forwarded")
+			}
+			return
+		}
+	}
+}
+
+// publish 将一条消息发布到远端并等待确认，done 关闭后不再等待
+//
+// return: 远端是否已经确认
+func (b *Bridge) publish(message outgoing, done <-chan struct{}) bool {
+	token := b.client.Publish(message.topic, message.qos, message.retain, message.payload)
+	select {
+	case <-done:
+		return false
+	case <-token.Done():
+	}
+	if err := token.Error(); err != nil {
+		logrus.WithFields(map[string]interface{}{
+			"bridge": b.config.Name,
+			"topic":  message.topic,
+			"qos":    message.qos,
+			"error":  err,
+		}).Error("bridge publish failed")
+		return false
+	}
+	return true
+}
+
+// minQos 转发的 QoS 取消息 QoS 与规则 QoS 中较小的一个
+func minQos(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,315 @@
+package bridge
+
+import (
+	"context"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg/mqtt5"
+	"icetea/service"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRemote 在测试中扮演远端服务端，记录桥接发布的消息，ack 关闭之前不确认 QoS 1 消息。
+// 同一进程中的报文处理器共享订阅树，不能用另一个 HandlerService 作为远端
+type fakeRemote struct {
+	t        *testing.T
+	listener net.Listener
+	received chan *packets.PublishPacket
+	ack      chan struct{}
+	// connects 桥接的 CONNECT 报文，subscribed 完成订阅的连接
+	connects   chan *packets.ConnectPacket
+	subscribed chan *remoteConn
+}
+
+// remoteConn 远端一侧的连接，写入可以来自多个协程
+type remoteConn struct {
+	conn net.Conn
+	wmux sync.Mutex
+}
+
+func (c *remoteConn) write(packet packets.ControlPacket) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	packet.Write(c.conn)
+}
+
+func newFakeRemote(t *testing.T) *fakeRemote {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRemote{
+		t:          t,
+		listener:   listener,
+		received:   make(chan *packets.PublishPacket, 64),
+		ack:        make(chan struct{}),
+		connects:   make(chan *packets.ConnectPacket, 8),
+		subscribed: make(chan *remoteConn, 8),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go r.serve()
+	return r
+}
+
+func (r *fakeRemote) address() string {
+	return "tcp://" + r.listener.Addr().String()
+}
+
+func (r *fakeRemote) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.t.Cleanup(func() { conn.Close() })
+		go r.handle(&remoteConn{conn: conn})
+	}
+}
+
+func (r *fakeRemote) handle(c *remoteConn) {
+	for {
+		packet, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			r.connects <- p
+			c.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = p.Qoss
+			c.write(suback)
+			r.subscribed <- c
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.PublishPacket:
+			r.received <- p
+			if p.Qos == 1 {
+				go func(id uint16) {
+					<-r.ack
+					puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+					puback.MessageID = id
+					c.write(puback)
+				}(p.MessageID)
+			}
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// receive 远端收到的下一条消息
+func (r *fakeRemote) receive() *packets.PublishPacket {
+	r.t.Helper()
+	select {
+	case p := <-r.received:
+		return p
+	case <-time.After(5 * time.Second):
+		r.t.Fatal("remote received no PUBLISH")
+		return nil
+	}
+}
+
+// newTestBridge 创建将本地 bridge/# 转发到 address 的桥接
+func newTestBridge(t *testing.T, address string, queueLength int) (*Bridge, *service.HandlerService) {
+	config := Config{
+		Name:         "test",
+		Address:      address,
+		CleanSession: true,
+		MinBackoff:   10 * time.Millisecond,
+		QueueLength:  queueLength,
+		Mappings:     []Mapping{{Topic: "bridge/#", Direction: Out, Qos: 1}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	handler := service.NewHandlerService()
+	return New(config, handler), handler
+}
+
+func publishPacket(topic, payload string) *packets.PublishPacket {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Qos = 1
+	packet.Payload = []byte(payload)
+	return packet
+}
+
+// waitConnected 等待桥接连接到远端
+func waitConnected(t *testing.T, b *Bridge) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.client.IsConnectionOpen() {
+		if time.Now().After(deadline) {
+			t.Fatal("bridge not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestBridgeStopDrain 停止时注销发布回调，队列中剩余的消息在断开前转发到远端
+func TestBridgeStopDrain(t *testing.T) {
+	remote := newFakeRemote(t)
+	b, handler := newTestBridge(t, remote.address(), 16)
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(t, b)
+
+	// 远端不确认第一条消息，其余消息留在队列中
+	for _, payload := range []string{"1", "2", "3"} {
+		handler.Publish(publishPacket("bridge/drain", payload), nil)
+	}
+	if p := remote.receive(); string(p.Payload) != "1" {
+		t.Fatalf("remote received %q, want 1", p.Payload)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		b.Stop()
+		close(stopped)
+	}()
+	close(remote.ack)
+	for _, want := range []string{"2", "3"} {
+		if p := remote.receive(); string(p.Payload) != want {
+			t.Fatalf("remote received %q, want %s", p.Payload, want)
+		}
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return")
+	}
+
+	handler.Publish(publishPacket("bridge/drain", "after stop"), nil)
+	if len(b.outgoing) != 0 {
+		t.Fatalf("%d messages queued after stop", len(b.outgoing))
+	}
+}
+
+// TestBridgeStopDisconnected 远端未连接时停止不等待，丢弃队列中的消息
+func TestBridgeStopDisconnected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	b, handler := newTestBridge(t, address, 16)
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"1", "2", "3"} {
+		handler.Publish(publishPacket("bridge/offline", payload), nil)
+	}
+	start := time.Now()
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= drainTimeout {
+		t.Fatalf("Stop took %v", elapsed)
+	}
+	if len(b.outgoing) != 0 {
+		t.Fatalf("%d messages left in the queue", len(b.outgoing))
+	}
+}
+
+// TestBridgeForward 按转发规则替换前缀、取较小的 QoS 入队，跳过桥接自己转入的消息，队列已满时丢弃新消息
+func TestBridgeForward(t *testing.T) {
+	config := Config{
+		Name:        "forward",
+		Address:     "tcp://127.0.0.1:1883",
+		QueueLength: 2,
+		Mappings: []Mapping{
+			{Topic: "sensors/#", Direction: Out, Qos: 1, LocalPrefix: "site/", RemotePrefix: "edge-1/"},
+			{Topic: "commands/#", Direction: In, Qos: 2},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b := New(config, service.NewHandlerService())
+	b.running.Store(true)
+
+	qos2 := publishPacket("site/sensors/temp", "qos 2")
+	qos2.Qos = 2
+	b.forward("", qos2, nil)
+	b.forward(b.publisher, publishPacket("site/sensors/temp", "bridged in"), nil)
+	b.forward("", publishPacket("commands/reboot", "in only"), nil)
+	b.forward("", publishPacket("sensors/temp", "no prefix"), nil)
+	b.forward("sensor-1", publishPacket("site/sensors/humidity", "second"), nil)
+	b.forward("", publishPacket("site/sensors/temp", "dropped"), nil)
+
+	if len(b.outgoing) != 2 {
+		t.Fatalf("%d messages queued, want 2", len(b.outgoing))
+	}
+	first, second := <-b.outgoing, <-b.outgoing
+	if first.topic != "edge-1/sensors/temp" || first.qos != 1 || string(first.payload) != "qos 2" {
+		t.Fatalf("first = %+v", first)
+	}
+	if second.topic != "edge-1/sensors/humidity" || string(second.payload) != "second" {
+		t.Fatalf("second = %+v", second)
+	}
+
+	b.running.Store(false)
+	b.forward("", publishPacket("site/sensors/temp", "stopped"), nil)
+	if len(b.outgoing) != 0 {
+		t.Fatal("stopped bridge queued a message")
+	}
+}
+
+// TestBridgeLoopPrevention 双向转发时，从远端转入的消息在本地发布后不会再转发回远端；
+// 开启 TryPrivate 时以桥接协议级别连接
+func TestBridgeLoopPrevention(t *testing.T) {
+	remote := newFakeRemote(t)
+	config := Config{
+		Name:         "loop",
+		Address:      remote.address(),
+		CleanSession: true,
+		TryPrivate:   true,
+		Mappings:     []Mapping{{Topic: "bridge/#", Direction: Both, Qos: 1}},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	handler := service.NewHandlerService()
+	local := make(chan string, 8)
+	handler.AddPublishHook(func(publisher string, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+		local <- publisher + " " + packet.TopicName
+	})
+	b := New(config, handler)
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	close(remote.ack)
+
+	if connect := <-remote.connects; connect.ProtocolVersion != bridgeProtocolVersion {
+		t.Fatalf("protocol version %#x, want %#x", connect.ProtocolVersion, bridgeProtocolVersion)
+	}
+	var conn *remoteConn
+	select {
+	case conn = <-remote.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not subscribe")
+	}
+	conn.write(publishPacket("bridge/from-remote", "in"))
+	select {
+	case got := <-local:
+		if got != b.publisher+" bridge/from-remote" {
+			t.Fatalf("published locally as %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message from remote not published locally")
+	}
+
+	// 本地发布的消息转发到远端，且是远端收到的第一条消息
+	handler.Publish(publishPacket("bridge/from-local", "out"), nil)
+	if p := remote.receive(); p.TopicName != "bridge/from-local" {
+		t.Fatalf("remote received %s, the bridged message looped back", p.TopicName)
+	}
+}
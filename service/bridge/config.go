@@ -0,0 +1,126 @@
+package bridge
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Direction 主题转发的方向
+type Direction string
+
+const (
+	// In 从远端服务端转发到本地
+	In Direction = "in"
+	// Out 从本地转发到远端服务端
+	Out Direction = "out"
+	// Both 双向转发
+	Both Direction = "both"
+)
+
+const (
+	// DefaultMinBackoff 重连的初始间隔
+	DefaultMinBackoff = time.Second
+	// DefaultMaxBackoff 重连的最大间隔，每次重连失败间隔翻倍
+	DefaultMaxBackoff = 2 * time.Minute
+	// DefaultKeepAlive 与远端服务端的心跳间隔
+	DefaultKeepAlive = 60 * time.Second
+	// DefaultQueueLength 等待转发到远端的消息数量上限
+	DefaultQueueLength = 1024
+)
+
+// Mapping 一条主题转发规则，与 Mosquitto 的 topic 配置相同：
+// 本地主题为 LocalPrefix + Topic，远端主题为 RemotePrefix + Topic
+type Mapping struct {
+	// Topic 不含前缀的主题过滤器，可以包含通配符
+	Topic        string
+	Direction    Direction
+	Qos          byte
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Config 一个桥接的配置
+type Config struct {
+	// Name 桥接名称，也是默认的客户端ID
+	Name string
+	// Address 远端服务端地址，例如 tcp://central:1883, ssl://central:8883
+	Address      string
+	ClientID     string
+	Username     string
+	Password     string
+	CleanSession bool
+	KeepAlive    time.Duration
+	TLS          *tls.Config
+	// TryPrivate 以桥接协议级别连接，远端不会把桥接发布的消息再发回来
+	TryPrivate bool
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// QueueLength 等待转发到远端的消息数量上限，队列已满时丢弃新消息
+	QueueLength int
+	Mappings    []Mapping
+}
+
+// Validate 校验配置并填充默认值
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("bridge: name is required")
+	}
+	if c.Address == "" {
+		return fmt.Errorf("bridge %s: address is required", c.Name)
+	}
+	if len(c.Mappings) == 0 {
+		return fmt.Errorf("bridge %s: no topic mappings", c.Name)
+	}
+	for i, m := range c.Mappings {
+		switch m.Direction {
+		case In, Out, Both:
+		default:
+			return fmt.Errorf("bridge %s: mapping %d: unknown direction %q", c.Name, i, m.Direction)
+		}
+		if m.Qos > 2 {
+			return fmt.Errorf("bridge %s: mapping %d: invalid qos %d", c.Name, i, m.Qos)
+		}
+		if m.Topic == "" {
+			return fmt.Errorf("bridge %s: mapping %d: topic is required", c.Name, i)
+		}
+		if strings.ContainsAny(m.LocalPrefix+m.RemotePrefix, "+#") {
+			return fmt.Errorf("bridge %s: mapping %d: prefix must not contain wildcards", c.Name, i)
+		}
+	}
+	if c.ClientID == "" {
+		c.ClientID = c.Name
+	}
+	if c.KeepAlive <= 0 {
+		c.KeepAlive = DefaultKeepAlive
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	if c.QueueLength <= 0 {
+		c.QueueLength = DefaultQueueLength
+	}
+	return nil
+}
+
+// local 本地主题过滤器
+func (m *Mapping) local() string {
+	return m.LocalPrefix + m.Topic
+}
+
+// remote 远端主题过滤器
+func (m *Mapping) remote() string {
+	return m.RemotePrefix + m.Topic
+}
+
+func (m *Mapping) in() bool {
+	return m.Direction == In || m.Direction == Both
+}
+
+func (m *Mapping) out() bool {
+	return m.Direction == Out || m.Direction == Both
+}
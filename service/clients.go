@@ -0,0 +1,46 @@
+package service
+
+import (
+	"icetea/client"
+	"icetea/pkg/mqtt5"
+	"sort"
+)
+
+// ReadClients 在线客户端，按客户端ID排序
+func (s *HandlerService) ReadClients() []*client.Client {
+	s.mux.RLock()
+	clients := make([]*client.Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mux.RUnlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].GetId() < clients[j].GetId()
+	})
+	return clients
+}
+
+// ReadClient 获取在线客户端
+//
+// param: clientId 客户端ID
+// return: 客户端，是否在线
+func (s *HandlerService) ReadClient(clientId string) (*client.Client, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	c, ok := s.clients[clientId]
+	return c, ok
+}
+
+// Kick 断开在线客户端的连接，MQTT 5.0 客户端会收到 AdministrativeAction，
+// 会话按客户端的会话过期设置保留
+//
+// param: clientId 客户端ID
+// return: 客户端是否在线
+func (s *HandlerService) Kick(clientId string) bool {
+	c, ok := s.ReadClient(clientId)
+	if !ok {
+		return false
+	}
+	c.Disconnect(mqtt5.AdministrativeAction)
+	return true
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg/mqtt5"
+	"icetea/service/subtree"
+)
+
+// Cluster 集群中其他节点的路由，本节点的订阅变化与需要跨节点投递的消息通过它同步给其他节点
+type Cluster interface {
+	// Subscribe 本节点的客户端增加了订阅
+	Subscribe(clientID string, topics map[string]int32)
+	// Unsubscribe 本节点的客户端删除了订阅
+	Unsubscribe(clientID string, topics map[string]int32)
+	// DeleteSession 本节点的客户端会话被删除
+	DeleteSession(clientID string)
+	// Connect 客户端连接到本节点，其他节点上同一客户端ID的连接需要断开
+	Connect(clientID string)
+	// Nodes 当前连接的其他节点
+	Nodes() []string
+	// Forward 将消息转发给其他节点
+	//
+	// param: node 节点地址
+	// param: clientID 定向投递的客户端ID，为空时投递给节点上所有匹配的订阅者
+	Forward(node, clientID string, packet *packets.PublishPacket, properties *mqtt5.Properties)
+}
+
+// Standalone 单机运行，不与其他节点同步
+var Standalone Cluster = standalone{}
+
+type standalone struct{}
+
+func (standalone) Subscribe(string, map[string]int32)   {}
+func (standalone) Unsubscribe(string, map[string]int32) {}
+func (standalone) DeleteSession(string)                 {}
+func (standalone) Connect(string)                       {}
+func (standalone) Nodes() []string                      { return nil }
+func (standalone) Forward(string, string, *packets.PublishPacket, *mqtt5.Properties) {
+}
+
+// SetCluster 设置集群路由
+func (s *HandlerService) SetCluster(cluster Cluster) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.cluster = cluster
+}
+
+func (s *HandlerService) getCluster() Cluster {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.cluster
+}
+
+// PublishRemote 投递其他节点转发的消息，只投递给本节点的订阅者，不再转发。
+// 其他节点的 $SYS 消息会覆盖本节点的统计信息，直接丢弃
+//
+// param: packet 消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (s *HandlerService) PublishRemote(packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	if isSysTopic(packet.TopicName) {
+		logrus.WithFields(map[string]interface{}{
+			"topic": packet.TopicName,
+		}).Debug("drop $SYS message forwarded by another node")
+		return
+	}
+	if packet.Retain {
+		s.retain.Store(packet, properties)
+	}
+	s.publish("", packet, properties, false)
+}
+
+// DeliverRemote 投递其他节点的共享订阅选中本节点客户端的消息，离线时进入会话队列
+//
+// param: clientID 客户端ID
+// param: packet 按授予的qos下发的消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (s *HandlerService) DeliverRemote(clientID string, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	s.mux.RLock()
+	conn, ok := s.clients[clientID]
+	s.mux.RUnlock()
+	if !ok {
+		if packet.Qos > 0 {
+			s.enqueue(clientID, packet, properties)
+		}
+		return
+	}
+	if err := conn.Publish(packet, properties); err != nil {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": clientID,
+			"error":    err,
+		}).Error("deliver remote message failed")
+	}
+}
+
+// TakeOver 客户端连接到了其他节点，断开本节点的连接并删除本节点的会话
+//
+// param: clientID 客户端ID
+func (s *HandlerService) TakeOver(clientID string) {
+	s.mux.Lock()
+	old, ok := s.clients[clientID]
+	delete(s.clients, clientID)
+	s.cancelSessionExpiry(clientID)
+	// 客户端已在其他节点重连，不再发布延迟的遗嘱
+	s.cancelWill(clientID)
+	s.mux.Unlock()
+	if ok {
+		old.Disconnect(mqtt5.SessionTakenOver)
+	}
+	subtree.GetTopicSub().DeleteNodeClient(clientID, "")
+}
@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// nonceSize 认证问候消息的随机数长度
+const nonceSize = 32
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// helloAuth 问候消息的认证码，未配置共享密钥时为nil
+//
+// param: secret 集群共享密钥
+// param: nonce 接收方发送的随机数
+// param: node 发送方的节点地址
+// return: HMAC-SHA256(secret, nonce || node)
+func helloAuth(secret string, nonce []byte, node string) []byte {
+	if secret == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	mac.Write([]byte(node))
+	return mac.Sum(nil)
+}
+
+// verifyHello 校验问候消息的认证码，未配置共享密钥时不校验
+func verifyHello(secret string, nonce []byte, hello *message) bool {
+	if secret == "" {
+		return true
+	}
+	return hmac.Equal(hello.Auth, helloAuth(secret, nonce, hello.Node))
+}
@@ -0,0 +1,343 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg"
+	"icetea/pkg/mqtt5"
+	"icetea/service"
+	"icetea/service/subtree"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMinBackoff 重连其他节点的初始间隔
+	DefaultMinBackoff = time.Second
+	// DefaultMaxBackoff 重连其他节点的最大间隔
+	DefaultMaxBackoff = 30 * time.Second
+	// handshakeTimeout 入站连接发送问候消息的期限
+	handshakeTimeout = 10 * time.Second
+)
+
+// Config 集群配置
+type Config struct {
+	// Listen 集群端口的监听地址，例如 0.0.0.0:7946
+	Listen string
+	// Advertise 其他节点连接本节点的地址，也是本节点的ID，默认与 Listen 相同
+	Advertise string
+	// Seeds 启动时连接的节点地址，其他节点会通过问候消息互相发现
+	Seeds []string
+	// Secret 节点之间的共享密钥，连接时用它认证问候消息，只能为空在监听回环地址时。
+	// 密钥不会加密节点之间的消息，跨主机部署时集群端口应位于可信网络中
+	Secret     string
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Validate 校验配置并填充默认值
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("cluster: listen address is required")
+	}
+	if c.Secret == "" && !pkg.IsLoopback(c.Listen) {
+		return fmt.Errorf("cluster: secret is required when listen address %q is not loopback", c.Listen)
+	}
+	if c.Advertise == "" {
+		c.Advertise = c.Listen
+	}
+	host, _, err := net.SplitHostPort(c.Advertise)
+	if err != nil {
+		return fmt.Errorf("cluster: advertise address %q: %w", c.Advertise, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("cluster: advertise address %q must be reachable by other nodes", c.Advertise)
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = DefaultMaxBackoff
+	}
+	return nil
+}
+
+// Node 集群中的本节点：向其他节点同步本节点的订阅，接收其他节点的订阅并转发消息
+type Node struct {
+	config   Config
+	handler  *service.HandlerService
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.RWMutex
+	// peers 出站连接，key 为节点地址
+	peers map[string]*peer
+	// inbound 每个节点当前的入站连接，旧连接断开时不会删除新连接同步的订阅
+	inbound map[string]net.Conn
+}
+
+// New 创建集群节点
+//
+// param: config 已经校验过的集群配置
+// param: handler 本地的报文处理器
+func New(config Config, handler *service.HandlerService) *Node {
+	return &Node{
+		config:  config,
+		handler: handler,
+		peers:   make(map[string]*peer),
+		inbound: make(map[string]net.Conn),
+	}
+}
+
+func (n *Node) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", n.config.Listen)
+	if err != nil {
+		return err
+	}
+	n.listener = listener
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	n.handler.SetCluster(n)
+	for _, addr := range n.config.Seeds {
+		n.addPeer(addr)
+	}
+	go n.accept()
+	return nil
+}
+
+func (n *Node) Stop() error {
+	n.handler.SetCluster(service.Standalone)
+	if n.cancel != nil {
+		n.cancel()
+	}
+	if n.listener != nil {
+		return n.listener.Close()
+	}
+	return nil
+}
+
+func (n *Node) Name() string {
+	return `cluster`
+}
+
+// addPeer 开始连接一个新发现的节点
+func (n *Node) addPeer(addr string) {
+	if addr == "" || addr == n.config.Advertise {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.peers[addr]; ok {
+		return
+	}
+	p := newPeer(addr, n)
+	n.peers[addr] = p
+	go p.run(n.ctx)
+}
+
+func (n *Node) accept() {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if n.ctx.Err() == nil {
+				logrus.WithField("error", err).Error("cluster accept failed")
+			}
+			return
+		}
+		go n.receive(conn)
+	}
+}
+
+// receive 处理其他节点的入站连接，连接断开时删除该节点的全部订阅
+func (n *Node) receive(conn net.Conn) {
+	defer conn.Close()
+	decoder := gob.NewDecoder(conn)
+	hello, err := n.handshake(conn, decoder)
+	if err != nil {
+		logrus.WithFields(map[string]interface{}{
+			"addr":  conn.RemoteAddr().String(),
+			"error": err,
+		}).Warn("cluster handshake failed")
+		return
+	}
+	node := hello.Node
+	n.mu.Lock()
+	if old, ok := n.inbound[node]; ok {
+		old.Close()
+	}
+	n.inbound[node] = conn
+	n.mu.Unlock()
+	n.addPeer(node)
+	for _, addr := range hello.Peers {
+		n.addPeer(addr)
+	}
+	defer func() {
+		n.mu.Lock()
+		current := n.inbound[node] == conn
+		if current {
+			delete(n.inbound, node)
+		}
+		n.mu.Unlock()
+		if current {
+			subtree.GetTopicSub().DeleteNodeClients(node)
+			logrus.WithField("node", node).Info("cluster node left")
+		}
+	}()
+
+	for {
+		var m message
+		if err := decoder.Decode(&m); err != nil {
+			return
+		}
+		n.handle(node, &m)
+	}
+}
+
+// handshake 向入站连接发送随机数，接收并认证问候消息
+func (n *Node) handshake(conn net.Conn, decoder *gob.Decoder) (*message, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err = gob.NewEncoder(conn).Encode(&message{Type: typeChallenge, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+	var hello message
+	if err = decoder.Decode(&hello); err != nil {
+		return nil, err
+	}
+	if hello.Type != typeHello || hello.Node == "" {
+		return nil, pkg.ErrClusterHandshake
+	}
+	if !verifyHello(n.config.Secret, nonce, &hello) {
+		return nil, pkg.ErrClusterAuthFailed
+	}
+	return &hello, nil
+}
+
+// handle 处理其他节点发来的一条消息
+func (n *Node) handle(node string, m *message) {
+	topicSub := subtree.GetTopicSub()
+	switch m.Type {
+	case typeSync:
+		topicSub.DeleteNodeClients(node)
+		for id, topics := range m.Sessions {
+			topicSub.CreateSub(topics, id, map[string]string{}, node)
+		}
+	case typeSubscribe:
+		topicSub.CreateSub(m.Topics, m.ClientID, map[string]string{}, node)
+	case typeUnsubscribe:
+		if topicSub.ReadClientNode(m.ClientID) == node {
+			topicSub.DeleteSub(m.Topics, m.ClientID)
+		}
+	case typeDeleteSession:
+		topicSub.DeleteNodeClient(m.ClientID, node)
+	case typeConnect:
+		n.handler.TakeOver(m.ClientID)
+		// 通知其他节点删除本节点上这个客户端的订阅
+		n.DeleteSession(m.ClientID)
+	case typePublish:
+		packet, properties, err := mqtt5.UnmarshalPublish(m.Publish)
+		if err != nil {
+			logrus.WithFields(map[string]interface{}{
+				"node":  node,
+				"error": err,
+			}).Error("decode cluster message failed")
+			return
+		}
+		properties.StartExpiry(time.Now())
+		if m.ClientID != "" {
+			n.handler.DeliverRemote(m.ClientID, packet, properties)
+		} else {
+			n.handler.PublishRemote(packet, properties)
+		}
+	}
+}
+
+// hello 连接后发送的问候消息
+//
+// param: nonce 接收方发送的随机数
+func (n *Node) hello(nonce []byte) *message {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	peers := make([]string, 0, len(n.peers))
+	for addr := range n.peers {
+		peers = append(peers, addr)
+	}
+	return &message{
+		Type:  typeHello,
+		Node:  n.config.Advertise,
+		Peers: peers,
+		Auth:  helloAuth(n.config.Secret, nonce, n.config.Advertise),
+	}
+}
+
+// sync 本节点全部客户端的订阅
+func (n *Node) sync() *message {
+	return &message{
+		Type:     typeSync,
+		Node:     n.config.Advertise,
+		Sessions: subtree.GetTopicSub().ReadNodeSubTopics(""),
+	}
+}
+
+// broadcast 将消息发送给所有节点
+func (n *Node) broadcast(m *message) {
+	m.Node = n.config.Advertise
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, p := range n.peers {
+		p.send(m)
+	}
+}
+
+func (n *Node) Subscribe(clientID string, topics map[string]int32) {
+	n.broadcast(&message{Type: typeSubscribe, ClientID: clientID, Topics: topics})
+}
+
+func (n *Node) Unsubscribe(clientID string, topics map[string]int32) {
+	n.broadcast(&message{Type: typeUnsubscribe, ClientID: clientID, Topics: topics})
+}
+
+func (n *Node) DeleteSession(clientID string) {
+	n.broadcast(&message{Type: typeDeleteSession, ClientID: clientID})
+}
+
+func (n *Node) Connect(clientID string) {
+	n.broadcast(&message{Type: typeConnect, ClientID: clientID})
+}
+
+func (n *Node) Nodes() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	nodes := make([]string, 0, len(n.peers))
+	for addr, p := range n.peers {
+		if p.connected.Load() {
+			nodes = append(nodes, addr)
+		}
+	}
+	return nodes
+}
+
+func (n *Node) Forward(node, clientID string, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	n.mu.RLock()
+	p, ok := n.peers[node]
+	n.mu.RUnlock()
+	if !ok {
+		return
+	}
+	body, err := mqtt5.MarshalPublish(packet, properties.ForForward(time.Now()))
+	if err != nil {
+		logrus.WithFields(map[string]interface{}{
+			"node":  node,
+			"error": err,
+		}).Error("encode cluster message failed")
+		return
+	}
+	p.send(&message{Type: typePublish, Node: n.config.Advertise, ClientID: clientID, Publish: body, Qos: packet.Qos})
+}
@@ -0,0 +1,423 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/client"
+	"icetea/pkg/mqtt5"
+	"icetea/service"
+	"icetea/service/subtree"
+	"net"
+	"testing"
+	"time"
+)
+
+const testSecret = "cluster-test-secret"
+
+// testPeer 在测试中扮演另一个节点，直接收发集群消息。
+// 同一进程中的节点共享订阅树，不能在一个测试中运行两个 Node
+type testPeer struct {
+	t        *testing.T
+	addr     string
+	listener net.Listener
+}
+
+func newTestPeer(t *testing.T) *testPeer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return &testPeer{t: t, addr: listener.Addr().String(), listener: listener}
+}
+
+// peerConn 集群连接的一端
+type peerConn struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func newPeerConn(t *testing.T, conn net.Conn) *peerConn {
+	t.Cleanup(func() { conn.Close() })
+	return &peerConn{t: t, conn: conn, encoder: gob.NewEncoder(conn), decoder: gob.NewDecoder(conn)}
+}
+
+func (c *peerConn) send(m *message) {
+	c.t.Helper()
+	if err := c.encoder.Encode(m); err != nil {
+		c.t.Fatalf("send %d: %v", m.Type, err)
+	}
+}
+
+func (c *peerConn) receive() *message {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m message
+	if err := c.decoder.Decode(&m); err != nil {
+		c.t.Fatalf("receive: %v", err)
+	}
+	return &m
+}
+
+// accept 接受被测节点的出站连接，完成认证并返回被测节点的全量同步
+func (p *testPeer) accept(node string) (*peerConn, *message) {
+	p.t.Helper()
+	p.listener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := p.listener.Accept()
+	if err != nil {
+		p.t.Fatalf("accept: %v", err)
+	}
+	c := newPeerConn(p.t, conn)
+	nonce, _ := newNonce()
+	c.send(&message{Type: typeChallenge, Nonce: nonce})
+	hello := c.receive()
+	if hello.Type != typeHello || hello.Node != node {
+		p.t.Fatalf("hello = %+v", hello)
+	}
+	if !verifyHello(testSecret, nonce, hello) {
+		p.t.Fatal("hello authentication failed")
+	}
+	sync := c.receive()
+	if sync.Type != typeSync {
+		p.t.Fatalf("expected sync, got %d", sync.Type)
+	}
+	return c, sync
+}
+
+// dial 连接到被测节点并发送问候消息
+func (p *testPeer) dial(addr, secret string) *peerConn {
+	p.t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		p.t.Fatalf("dial: %v", err)
+	}
+	c := newPeerConn(p.t, conn)
+	challenge := c.receive()
+	if challenge.Type != typeChallenge {
+		p.t.Fatalf("expected challenge, got %d", challenge.Type)
+	}
+	c.send(&message{Type: typeHello, Node: p.addr, Auth: helloAuth(secret, challenge.Nonce, p.addr)})
+	return c
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func publishPacket(topic string, qos byte, payload string) *packets.PublishPacket {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Qos = qos
+	packet.Payload = []byte(payload)
+	return packet
+}
+
+func receivePublish(t *testing.T, c *peerConn) *packets.PublishPacket {
+	t.Helper()
+	m := c.receive()
+	if m.Type != typePublish {
+		t.Fatalf("expected publish, got %d", m.Type)
+	}
+	packet, _, err := mqtt5.UnmarshalPublish(m.Publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func TestNodeSyncPublishReconnect(t *testing.T) {
+	var (
+		topicSub = subtree.GetTopicSub()
+		handler  = service.NewHandlerService()
+		peer     = newTestPeer(t)
+		config   = Config{
+			Listen:     freeAddr(t),
+			Seeds:      []string{peer.addr},
+			Secret:     testSecret,
+			MinBackoff: 50 * time.Millisecond,
+			MaxBackoff: 100 * time.Millisecond,
+		}
+	)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	topicSub.CreateSub(map[string]int32{"local/t": 1}, "local-client", map[string]string{}, "")
+	defer topicSub.DeleteClient("local-client")
+	defer topicSub.DeleteNodeClients(peer.addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := New(config, handler)
+	if err := node.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	// 被测节点连接种子节点并同步本节点的订阅
+	out, sync := peer.accept(config.Advertise)
+	if sync.Sessions["local-client"]["local/t"] != 1 {
+		t.Fatalf("sync sessions = %v", sync.Sessions)
+	}
+
+	// 种子节点连接被测节点并同步它的订阅
+	in := peer.dial(config.Listen, testSecret)
+	in.send(&message{Type: typeSync, Node: peer.addr, Sessions: map[string]map[string]int32{
+		"remote-client": {"remote/t": 1},
+	}})
+	waitFor(t, "remote subscription", func() bool {
+		return topicSub.ReadClientNode("remote-client") == peer.addr
+	})
+
+	// 发布给其他节点订阅者的消息转发给该节点
+	handler.Publish(publishPacket("remote/t", 1, "first"), nil)
+	if packet := receivePublish(t, out); packet.TopicName != "remote/t" || string(packet.Payload) != "first" || packet.Qos != 1 {
+		t.Fatalf("forwarded %s %q qos %d", packet.TopicName, packet.Payload, packet.Qos)
+	}
+
+	// 断开期间转发的消息在重连并同步之后发送，订阅的增量由全量同步代替
+	out.conn.Close()
+	node.mu.RLock()
+	p := node.peers[peer.addr]
+	node.mu.RUnlock()
+	waitFor(t, "peer disconnect", func() bool {
+		return !p.connected.Load()
+	})
+	handler.Publish(publishPacket("remote/t", 1, "second"), nil)
+	node.Subscribe("local-client", map[string]int32{"local/u": 0})
+	out, sync = peer.accept(config.Advertise)
+	if packet := receivePublish(t, out); string(packet.Payload) != "second" {
+		t.Fatalf("payload after reconnect = %q", packet.Payload)
+	}
+	if _, ok := sync.Sessions["local-client"]["local/t"]; !ok {
+		t.Fatalf("sync sessions after reconnect = %v", sync.Sessions)
+	}
+
+	// 其他节点断开后删除它同步的订阅
+	in.conn.Close()
+	waitFor(t, "remote subscription removed", func() bool {
+		return topicSub.ReadClientNode("remote-client") == ""
+	})
+}
+
+// localClient 通过 net.Pipe 连接到被测节点的 MQTT 3.1.1 客户端
+type localClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func dialLocal(t *testing.T, handler *service.HandlerService, clientID string) *localClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	local, remote := net.Pipe()
+	c := client.NewClient(remote, handler)
+	c.Run(ctx)
+	t.Cleanup(func() {
+		local.Close()
+		cancel()
+		<-c.Done()
+	})
+	l := &localClient{t: t, conn: local}
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.CleanSession = true
+	connect.ClientIdentifier = clientID
+	connect.Keepalive = 30
+	l.write(connect)
+	if connAck, ok := l.read().(*packets.ConnackPacket); !ok || connAck.ReturnCode != packets.Accepted {
+		t.Fatal("connect failed")
+	}
+	return l
+}
+
+func (l *localClient) write(packet packets.ControlPacket) {
+	l.t.Helper()
+	l.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := packet.Write(l.conn); err != nil {
+		l.t.Fatalf("write %s: %v", packet.String(), err)
+	}
+}
+
+func (l *localClient) read() packets.ControlPacket {
+	l.t.Helper()
+	l.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packet, err := packets.ReadPacket(l.conn)
+	if err != nil {
+		l.t.Fatalf("read: %v", err)
+	}
+	return packet
+}
+
+// subscribe 以 QoS 0 订阅并等待 SUBACK，不读取订阅后下发的保留消息
+func (l *localClient) subscribe(filter string) {
+	l.t.Helper()
+	packet := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	packet.MessageID = 1
+	packet.Topics = []string{filter}
+	packet.Qoss = []byte{0}
+	l.write(packet)
+	if _, ok := l.read().(*packets.SubackPacket); !ok {
+		l.t.Fatal("expected SUBACK")
+	}
+}
+
+func (l *localClient) readPublish() *packets.PublishPacket {
+	l.t.Helper()
+	packet, ok := l.read().(*packets.PublishPacket)
+	if !ok {
+		l.t.Fatal("expected PUBLISH")
+	}
+	return packet
+}
+
+func retainedPacket(topic, payload string) *packets.PublishPacket {
+	packet := publishPacket(topic, 0, payload)
+	packet.Retain = true
+	return packet
+}
+
+// TestNodeSysTopicsStayLocal 每个节点的 $SYS 统计信息只在本节点保存与投递，
+// 不转发给其他节点，其他节点转发来的 $SYS 消息也不覆盖本节点的统计信息
+func TestNodeSysTopicsStayLocal(t *testing.T) {
+	var (
+		topicSub = subtree.GetTopicSub()
+		handler  = service.NewHandlerService()
+		peer     = newTestPeer(t)
+		config   = Config{
+			Listen: freeAddr(t),
+			Seeds:  []string{peer.addr},
+			Secret: testSecret,
+		}
+	)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	defer topicSub.DeleteNodeClients(peer.addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := New(config, handler)
+	if err := node.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	out, _ := peer.accept(config.Advertise)
+	in := peer.dial(config.Listen, testSecret)
+	in.send(&message{Type: typeSync, Node: peer.addr, Sessions: map[string]map[string]int32{
+		"remote-sys": {"$SYS/#": 0, "status/#": 0},
+	}})
+	waitFor(t, "remote subscription", func() bool {
+		return topicSub.ReadClientNode("remote-sys") == peer.addr
+	})
+
+	// 本节点的 $SYS 保留消息既不转发给订阅了 $SYS/# 的其他节点，也不作为保留消息同步，
+	// 其他节点先收到的是之后发布的普通保留消息
+	handler.Publish(retainedPacket("$SYS/broker/uptime", "local"), nil)
+	handler.Publish(retainedPacket("status/local", "marker"), nil)
+	if packet := receivePublish(t, out); packet.TopicName != "status/local" {
+		t.Fatalf("forwarded %s %q", packet.TopicName, packet.Payload)
+	}
+
+	sub := dialLocal(t, handler, "local-sys")
+	defer topicSub.DeleteClient("local-sys")
+	sub.subscribe("$SYS/#")
+	if packet := sub.readPublish(); packet.TopicName != "$SYS/broker/uptime" || string(packet.Payload) != "local" {
+		t.Fatalf("retained %s %q", packet.TopicName, packet.Payload)
+	}
+	sub.subscribe("status/remote")
+
+	// 其他节点的 $SYS 消息不投递给本节点的订阅者，同一连接上之后的消息先到达
+	for _, packet := range []*packets.PublishPacket{
+		retainedPacket("$SYS/broker/uptime", "remote"),
+		publishPacket("status/remote", 0, "marker"),
+	} {
+		body, err := mqtt5.MarshalPublish(packet, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.send(&message{Type: typePublish, Node: peer.addr, Publish: body})
+	}
+	if packet := sub.readPublish(); packet.TopicName != "status/remote" {
+		t.Fatalf("received %s %q from another node", packet.TopicName, packet.Payload)
+	}
+
+	// 本节点保存的仍然是自己的统计信息
+	sub.subscribe("$SYS/broker/uptime")
+	if packet := sub.readPublish(); string(packet.Payload) != "local" {
+		t.Fatalf("retained $SYS/broker/uptime = %q", packet.Payload)
+	}
+}
+
+func TestNodeRejectsUnauthenticatedPeer(t *testing.T) {
+	var (
+		topicSub = subtree.GetTopicSub()
+		peer     = newTestPeer(t)
+		config   = Config{Listen: freeAddr(t), Secret: testSecret}
+	)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node := New(config, service.NewHandlerService())
+	if err := node.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	in := peer.dial(config.Listen, "wrong-secret")
+	in.encoder.Encode(&message{Type: typeSync, Node: peer.addr, Sessions: map[string]map[string]int32{
+		"evil-client": {"#": 2},
+	}})
+	in.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m message
+	if err := in.decoder.Decode(&m); err == nil {
+		t.Fatalf("expected connection to be closed, got %d", m.Type)
+	}
+	if _, ok := topicSub.ReadClientInfo("evil-client"); ok {
+		t.Fatal("unauthenticated peer created a subscription")
+	}
+	if nodes := node.Nodes(); len(nodes) != 0 {
+		t.Fatalf("unauthenticated peer was added: %v", nodes)
+	}
+}
+
+func TestConfigValidateSecret(t *testing.T) {
+	cases := []struct {
+		listen, secret string
+		ok             bool
+	}{
+		{"127.0.0.1:7946", "", true},
+		{"localhost:7946", "", true},
+		{"[::1]:7946", "", true},
+		{"0.0.0.0:7946", "", false},
+		{":7946", "", false},
+		{"10.0.0.1:7946", "", false},
+		{"10.0.0.1:7946", "secret", true},
+	}
+	for _, c := range cases {
+		config := Config{Listen: c.listen, Advertise: "10.0.0.1:7946", Secret: c.secret}
+		if err := config.Validate(); (err == nil) != c.ok {
+			t.Errorf("Validate(listen=%q, secret=%q) = %v", c.listen, c.secret, err)
+		}
+	}
+}
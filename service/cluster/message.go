@@ -0,0 +1,38 @@
+package cluster
+
+// messageType 节点之间同步的消息类型
+type messageType byte
+
+const (
+	// typeHello 连接后发送的第一条消息，携带发送方的节点地址与已知的节点
+	typeHello messageType = iota + 1
+	// typeSync 发送方本节点全部客户端的订阅，接收方用它替换该节点原有的订阅
+	typeSync
+	typeSubscribe
+	typeUnsubscribe
+	typeDeleteSession
+	typeConnect
+	// typePublish 转发的消息，ClientID 不为空时定向投递给该客户端
+	typePublish
+	// typeChallenge 接收方收到连接后发送的第一条消息，携带用于认证问候消息的随机数
+	typeChallenge
+)
+
+// message 节点之间传输的消息，使用 gob 编码
+type message struct {
+	Type     messageType
+	Node     string
+	Peers    []string
+	ClientID string
+	Topics   map[string]int32
+	// Sessions 客户端ID到订阅的topic,qos，用于 typeSync
+	Sessions map[string]map[string]int32
+	// Publish 使用 mqtt5.MarshalPublish 编码的 PUBLISH 报文
+	Publish []byte
+	// Qos 转发的消息的 QoS，用于丢弃消息时的日志
+	Qos byte
+	// Nonce typeChallenge 的随机数
+	Nonce []byte
+	// Auth typeHello 使用共享密钥对随机数与节点地址计算的 HMAC
+	Auth []byte
+}
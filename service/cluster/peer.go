@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// peerQueueLength 发往一个节点的消息队列长度，队列已满时丢弃消息
+const peerQueueLength = 4096
+
+// peer 到另一个节点的出站连接，只用于发送本节点的消息，断开后按退避间隔重连
+type peer struct {
+	addr  string
+	node  *Node
+	queue chan *message
+	// pending 断开期间积压的转发消息与接管通知，重连并同步后首先发送，只在 run 协程中访问
+	pending []*message
+	// connected 连接成功并完成全量同步后为 true
+	connected atomic.Bool
+}
+
+func newPeer(addr string, node *Node) *peer {
+	return &peer{
+		addr:  addr,
+		node:  node,
+		queue: make(chan *message, peerQueueLength),
+	}
+}
+
+// send 将消息放入发送队列，不阻塞调用方
+func (p *peer) send(m *message) {
+	select {
+	case p.queue <- m:
+	default:
+		p.drop(m, "cluster peer queue full, message dropped")
+	}
+}
+
+// drop 记录丢弃的消息，丢弃转发的 QoS 1/2 消息时记录为错误
+func (p *peer) drop(m *message, msg string) {
+	entry := logrus.WithFields(map[string]interface{}{
+		"peer":     p.addr,
+		"type":     m.Type,
+		"clientId": m.ClientID,
+		"qos":      m.Qos,
+	})
+	if m.Type == typePublish && m.Qos > 0 {
+		entry.Error(msg)
+	} else {
+		entry.Warn(msg)
+	}
+}
+
+// isDelta 是否为订阅的增量，增量已经包含在重连后的全量同步中
+func (m *message) isDelta() bool {
+	switch m.Type {
+	case typeSubscribe, typeUnsubscribe, typeDeleteSession:
+		return true
+	default:
+		return false
+	}
+}
+
+// takeBacklog 取出断开期间积压的消息，丢弃订阅的增量，保留转发的消息与接管通知
+func (p *peer) takeBacklog() {
+	for {
+		select {
+		case m := <-p.queue:
+			if m.isDelta() {
+				continue
+			}
+			if len(p.pending) >= peerQueueLength {
+				p.drop(p.pending[0], "cluster peer backlog full, message dropped")
+				p.pending = p.pending[1:]
+			}
+			p.pending = append(p.pending, m)
+		default:
+			return
+		}
+	}
+}
+
+// run 连接节点并发送消息，直到 ctx 结束
+func (p *peer) run(ctx context.Context) {
+	backoff := p.node.config.MinBackoff
+	for {
+		start := time.Now()
+		err := p.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// 连接保持过一段时间则重新从最小间隔开始退避
+		if time.Since(start) > p.node.config.MaxBackoff {
+			backoff = p.node.config.MinBackoff
+		}
+		logrus.WithFields(map[string]interface{}{
+			"peer":    p.addr,
+			"error":   err,
+			"backoff": backoff.String(),
+		}).Debug("cluster peer disconnected")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > p.node.config.MaxBackoff {
+			backoff = p.node.config.MaxBackoff
+		}
+	}
+}
+
+// serve 建立一次连接，发送问候与全量订阅后持续发送队列中的消息
+func (p *peer) serve(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: p.node.config.MinBackoff * 5}
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	var challenge message
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err = gob.NewDecoder(conn).Decode(&challenge); err != nil {
+		return err
+	}
+	if challenge.Type != typeChallenge {
+		return pkg.ErrClusterHandshake
+	}
+	conn.SetReadDeadline(time.Time{})
+	// 接收方在发送随机数之后不再发送数据，读到 EOF 说明连接已经断开，不用等到下一次写出失败
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	// 在全量同步之前取出积压的消息，同步之后的增量继续留在队列中
+	p.takeBacklog()
+	encoder := gob.NewEncoder(conn)
+	if err = encoder.Encode(p.node.hello(challenge.Nonce)); err != nil {
+		return err
+	}
+	if err = encoder.Encode(p.node.sync()); err != nil {
+		return err
+	}
+	for len(p.pending) > 0 {
+		if err = encoder.Encode(p.pending[0]); err != nil {
+			return err
+		}
+		p.pending = p.pending[1:]
+	}
+	p.connected.Store(true)
+	defer p.connected.Store(false)
+	logrus.WithFields(map[string]interface{}{
+		"peer": p.addr,
+	}).Info("cluster peer connected")
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-closed:
+			return io.EOF
+		case m := <-p.queue:
+			if err = encoder.Encode(m); err != nil {
+				// 写出失败的消息在重连后重新发送，订阅的增量由全量同步代替
+				if !m.isDelta() {
+					p.pending = append(p.pending, m)
+				}
+				return err
+			}
+		}
+	}
+}
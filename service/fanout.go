@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"icetea/client"
+	"icetea/pkg"
+	"icetea/service/subtree"
+	"runtime"
+	"sync"
+)
+
+// fanoutChunk 每个任务下发的订阅者数量，订阅者不超过该数量时在发布者的协程中直接下发
+const fanoutChunk = 512
+
+// publishBatch 发布消息时每批读取的订阅者数量，每批分成若干块并行下发
+const publishBatch = fanoutChunk * 8
+
+// publishBuffer 发布消息时读取订阅者与下发使用的缓冲，大小固定，不随订阅者数量增长
+type publishBuffer struct {
+	subscribers []subtree.Subscriber
+	targets     []delivery
+}
+
+var publishBuffers = sync.Pool{
+	New: func() interface{} {
+		return &publishBuffer{
+			subscribers: make([]subtree.Subscriber, publishBatch),
+			targets:     make([]delivery, 0, publishBatch),
+		}
+	},
+}
+
+// release 放回缓冲池，每批下发后已经清除了对客户端的引用
+func (b *publishBuffer) release() {
+	publishBuffers.Put(b)
+}
+
+// delivery 一个在线订阅者及授予的 QoS
+type delivery struct {
+	client *client.Client
+	qos    byte
+	// retainAsPublished 是否保持消息的保留标志
+	retainAsPublished bool
+}
+
+// fanoutPool 并行下发消息的协程池，协程数量为 GOMAXPROCS，第一次使用时启动
+type fanoutPool struct {
+	once  sync.Once
+	tasks chan func()
+}
+
+func (p *fanoutPool) start() {
+	p.tasks = make(chan func())
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+}
+
+// run 并行执行任务并等待全部完成，没有空闲的协程时在调用者的协程中执行
+func (p *fanoutPool) run(tasks []func()) {
+	p.once.Do(p.start)
+	var wg sync.WaitGroup
+	wg.Add(len(tasks))
+	for _, task := range tasks {
+		task := task
+		wrapped := func() {
+			defer wg.Done()
+			task()
+		}
+		select {
+		case p.tasks <- wrapped:
+		default:
+			wrapped()
+		}
+	}
+	wg.Wait()
+}
+
+// deliver 向在线订阅者下发消息，订阅者较多时分块交给协程池并行下发。
+// 等待全部下发完成后返回，同一发布者的消息在每个订阅者的出站队列中保持顺序
+//
+// param: fanout 一次下发
+// param: targets 在线订阅者
+func (s *HandlerService) deliver(fanout *client.Fanout, targets []delivery) {
+	if len(targets) <= fanoutChunk {
+		deliverChunk(fanout, targets)
+		return
+	}
+	tasks := make([]func(), 0, len(targets)/fanoutChunk+1)
+	for start := 0; start < len(targets); start += fanoutChunk {
+		end := start + fanoutChunk
+		if end > len(targets) {
+			end = len(targets)
+		}
+		chunk := targets[start:end]
+		tasks = append(tasks, func() {
+			deliverChunk(fanout, chunk)
+		})
+	}
+	s.fanout.run(tasks)
+}
+
+func deliverChunk(fanout *client.Fanout, targets []delivery) {
+	for _, t := range targets {
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.WithFields(map[string]interface{}{
+				"clientId": t.client.GetId(),
+				"qos":      t.qos,
+			}).Debug("publish message to sub client")
+		}
+		err := t.client.PublishFanout(fanout, t.qos, t.retainAsPublished)
+		if errors.Is(err, pkg.ErrMessageDropped) {
+			// 溢出已计入 metrics.OutboundOverflow
+			logrus.WithField("clientId", t.client.GetId()).Debug("outbound queue full, message dropped")
+		} else if err != nil {
+			logrus.WithFields(map[string]interface{}{
+				"clientId": t.client.GetId(),
+				"error":    err,
+			}).Error("publish message to sub client failed")
+		}
+	}
+}
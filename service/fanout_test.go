@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/client"
+	"icetea/service/subtree"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardConn 丢弃写入的数据，读取阻塞到连接关闭
+type discardConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newDiscardConn() *discardConn {
+	return &discardConn{closed: make(chan struct{})}
+}
+
+func (c *discardConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *discardConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *discardConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func BenchmarkPublishFanout(b *testing.B) {
+	for _, subscribers := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("subscribers=%dk", subscribers/1000), func(b *testing.B) {
+			benchmarkPublishFanout(b, subscribers)
+		})
+	}
+}
+
+// benchmarkPublishFanout 向订阅同一主题的在线 QoS 0 订阅者发布消息，报告每秒下发的消息数
+func benchmarkPublishFanout(b *testing.B, subscribers int) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		handler     = NewHandlerService()
+		topicSub    = subtree.GetTopicSub()
+		topic       = fmt.Sprintf("bench/fanout/%d", subscribers)
+		clients     = make([]*client.Client, 0, subscribers)
+	)
+	defer cancel()
+	for i := 0; i < subscribers; i++ {
+		id := fmt.Sprintf("bench-%d-%d", subscribers, i)
+		c := client.NewClient(newDiscardConn(), handler, client.WithOutboundQueue(0, client.DropNewest))
+		c.SetId(id)
+		c.Run(ctx)
+		handler.clients[id] = c
+		topicSub.CreateSub(map[string]int32{topic: 0}, id, nil, "")
+		clients = append(clients, c)
+	}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+			topicSub.DeleteClient(c.GetId())
+		}
+	}()
+
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Payload = make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		handler.publish("", packet, nil, false)
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+	b.ReportMetric(float64(subscribers)*float64(b.N)/elapsed.Seconds(), "deliveries/s")
+}
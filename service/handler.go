@@ -2,12 +2,19 @@ package service
 
 import (
 	"errors"
+	"fmt"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/sirupsen/logrus"
 	"icetea/client"
+	"icetea/pkg"
+	"icetea/pkg/metrics"
+	"icetea/pkg/mqtt5"
+	"icetea/service/acl"
+	"icetea/service/auth"
+	"icetea/service/server"
 	"icetea/service/subtree"
-	"strings"
 	"sync"
+	"time"
 )
 
 type SubTree interface {
@@ -21,59 +28,553 @@ var Handler = NewHandlerService()
 
 type ClientId = string
 
+// PublishHook 消息发布后的回调
+//
+// param: publisher 发布者客户端ID，服务端发布的消息为空
+type PublishHook func(publisher string, packet *packets.PublishPacket, properties *mqtt5.Properties)
+
 type HandlerService struct {
-	clients map[ClientId]*client.Client
-	mux     sync.RWMutex
+	clients       map[ClientId]*client.Client
+	retain        *RetainStore
+	authenticator auth.Authenticator
+	authorizer    acl.Authorizer
+	// expiring 已断开、等待过期删除的会话
+	expiring map[ClientId]*time.Timer
+	// wills 已断开、等待延迟发布的遗嘱消息
+	wills   map[ClientId]*delayedWill
+	shared  *sharedBalancer
+	hooks   []*PublishHook
+	cluster Cluster
+	fanout  *fanoutPool
+	// topicLimits 客户端发布、订阅的主题的限制
+	topicLimits subtree.TopicLimits
+	mux         sync.RWMutex
 }
 
 func NewHandlerService() *HandlerService {
 	return &HandlerService{
-		clients: make(map[ClientId]*client.Client),
+		clients:       make(map[ClientId]*client.Client),
+		retain:        NewRetainStore(),
+		authenticator: auth.AllowAll,
+		authorizer:    acl.AllowAll,
+		expiring:      make(map[ClientId]*time.Timer),
+		wills:         make(map[ClientId]*delayedWill),
+		shared:        newSharedBalancer(ShareRandom),
+		cluster:       Standalone,
+		fanout:        &fanoutPool{},
+		topicLimits:   subtree.DefaultTopicLimits,
 	}
 }
 
+// SetAuthenticator 设置客户端连接的认证方式
+func (s *HandlerService) SetAuthenticator(authenticator auth.Authenticator) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.authenticator = authenticator
+}
+
+// SetAuthorizer 设置发布、订阅的授权方式
+func (s *HandlerService) SetAuthorizer(authorizer acl.Authorizer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.authorizer = authorizer
+}
+
+// SetTopicLimits 设置客户端发布、订阅的主题的长度与层级限制
+func (s *HandlerService) SetTopicLimits(limits subtree.TopicLimits) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.topicLimits = limits
+}
+
+// TopicLimits 客户端发布、订阅的主题的长度与层级限制，管理接口发布消息时也使用该限制
+func (s *HandlerService) TopicLimits() subtree.TopicLimits {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.topicLimits
+}
+
+// invalidTopic 记录客户端发送的非法主题
+//
+// param: topic 主题名或主题过滤器
+// param: err 违反的规则
+func invalidTopic(client *client.Client, topic string, err error) {
+	logrus.WithFields(map[string]interface{}{
+		"clientId": client.GetId(),
+		"addr":     client.GetConn().RemoteAddr().String(),
+		"topic":    topic,
+		"error":    err,
+	}).Warn("invalid topic")
+}
+
 func (s *HandlerService) ConnectPacket(client *client.Client, packet *packets.ConnectPacket) error {
 	var (
-		clientId = packet.ClientIdentifier
-		connAck  = packets.NewControlPacket(packets.Connack)
+		certificate = applyCertIdentity(client, packet)
+		connAck     = packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+		v5          = client.PacketV5()
+		topicSub    = subtree.GetTopicSub()
 	)
-	connAck.(*packets.ConnackPacket).ReturnCode = 0x00
+	connAck.ReturnCode = s.authenticate(client, packet, certificate)
+	if connAck.ReturnCode != packets.Accepted {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": packet.ClientIdentifier,
+			"username": packet.Username,
+			"addr":     client.GetConn().RemoteAddr().String(),
+			"code":     connAck.ReturnCode,
+		}).Warn("connect refused")
+		if connAck.ReturnCode != packets.ErrProtocolViolation {
+			client.HandleWrite(connAck)
+		}
+		return pkg.ErrConnectRefused
+	}
+	if packet.WillFlag {
+		if err := s.TopicLimits().ValidateName(packet.WillTopic); err != nil {
+			logrus.WithFields(map[string]interface{}{
+				"clientId": packet.ClientIdentifier,
+				"addr":     client.GetConn().RemoteAddr().String(),
+				"topic":    packet.WillTopic,
+				"error":    err,
+			}).Warn("invalid will topic")
+			if v5 != nil {
+				client.HandleWrite(mqtt5.Wrap(connAck, nil, mqtt5.TopicNameInvalid))
+			}
+			return pkg.ErrConnectRefused
+		}
+	}
+	if v5 != nil && v5.Properties != nil && v5.Properties.AuthMethod != "" {
+		// 不支持增强认证
+		client.HandleWrite(mqtt5.Wrap(connAck, nil, mqtt5.BadAuthenticationMethod))
+		return pkg.ErrConnectRefused
+	}
+	assigned := packet.ClientIdentifier == ""
+	if assigned {
+		packet.ClientIdentifier = newClientId()
+	}
+	clientId := packet.ClientIdentifier
+	// 遗嘱消息由服务端代为发布，需要客户端对遗嘱主题有发布权限
+	if packet.WillFlag && !s.authorizeAccess(&acl.Access{
+		Username: packet.Username,
+		ClientID: clientId,
+		Topic:    packet.WillTopic,
+		Action:   acl.Publish,
+	}) {
+		connAck.ReturnCode = packets.ErrRefusedNotAuthorised
+		client.HandleWrite(connAck)
+		return pkg.ErrConnectRefused
+	}
+
 	s.mux.Lock()
-	defer s.mux.Unlock()
-	if old, ok := s.clients[clientId]; ok {
-		old.Close()
+	old, ok := s.clients[clientId]
+	wills := s.takeWills(clientId, old, packet.CleanSession)
+	if ok {
+		old.Disconnect(mqtt5.SessionTakenOver)
+		if old.SessionExpiry() > 0 {
+			s.saveInflight(old)
+		}
 	}
+	s.cancelSessionExpiry(clientId)
 	client.SetId(clientId)
+	client.SetUsername(packet.Username)
+	client.SetSessionExpiry(sessionExpiry(packet, v5))
+	if v5 != nil {
+		client.SetPeerLimits(peerLimits(v5.Properties))
+	}
+	if packet.CleanSession {
+		topicSub.DeleteClient(clientId)
+		s.cluster.DeleteSession(clientId)
+	} else {
+		// 其他节点上的会话不会迁移到本节点
+		_, connAck.SessionPresent = topicSub.ReadClientInfo(clientId)
+		connAck.SessionPresent = connAck.SessionPresent && topicSub.ReadClientNode(clientId) == ""
+	}
+	s.cluster.Connect(clientId)
+	if packet.WillFlag {
+		client.SetWill(willMessage(packet, v5))
+	}
 	s.clients[clientId] = client
-	return client.HandleWrite(connAck)
+	s.mux.Unlock()
+	for _, will := range wills {
+		s.publishWill(clientId, will)
+	}
+
+	var err error
+	if v5 != nil {
+		err = client.HandleWrite(mqtt5.Wrap(connAck, connAckProperties(client, assigned), mqtt5.Success))
+	} else {
+		err = client.HandleWrite(connAck)
+	}
+	if err != nil {
+		return err
+	}
+	if connAck.SessionPresent {
+		return s.resumeSession(client)
+	}
+	return nil
+}
+
+// willMessage 由 CONNECT 报文生成遗嘱消息
+//
+// param: packet CONNECT 报文
+// param: v5 MQTT 5.0 附加信息，3.1.1 连接为nil
+func willMessage(packet *packets.ConnectPacket, v5 *mqtt5.Packet) *client.Message {
+	will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	will.TopicName = packet.WillTopic
+	will.Payload = packet.WillMessage
+	will.Qos = packet.WillQos
+	will.Retain = packet.WillRetain
+	message := &client.Message{Packet: will}
+	if v5 != nil {
+		message.Properties = v5.WillProperties
+	}
+	return message
+}
+
+// connAckProperties MQTT 5.0 CONNACK 中告知客户端的服务端限制
+//
+// param: client 连接的客户端
+// param: assigned 客户端ID是否由服务端分配
+func connAckProperties(client *client.Client, assigned bool) *mqtt5.Properties {
+	var (
+		topicAliasMaximum = client.TopicAliasMaximum()
+		unavailable       byte
+		properties        = &mqtt5.Properties{
+			TopicAliasMaximum: &topicAliasMaximum,
+			SubIDAvailable:    &unavailable,
+		}
+	)
+	if maxPacketSize := client.MaxPacketSize(); maxPacketSize > 0 {
+		properties.MaximumPacketSize = &maxPacketSize
+	}
+	if assigned {
+		properties.AssignedClientID = client.GetId()
+	}
+	return properties
+}
+
+// peerLimits MQTT 5.0 客户端在 CONNECT 中声明的接收最大值与最大报文长度
+func peerLimits(properties *mqtt5.Properties) (uint16, uint32) {
+	var (
+		receiveMaximum uint16
+		maxPacketSize  uint32
+	)
+	if properties == nil {
+		return receiveMaximum, maxPacketSize
+	}
+	if properties.ReceiveMaximum != nil {
+		receiveMaximum = *properties.ReceiveMaximum
+	}
+	if properties.MaximumPacketSize != nil {
+		maxPacketSize = *properties.MaximumPacketSize
+	}
+	return receiveMaximum, maxPacketSize
+}
+
+// authenticate 校验 CONNECT 报文并认证客户端
+//
+// return: CONNACK 返回码
+func (s *HandlerService) authenticate(client *client.Client, packet *packets.ConnectPacket, certificate bool) byte {
+	// MQTT 5.0 CONNECT 已经在解码时校验，且允许空的客户端ID
+	if client.PacketV5() == nil {
+		if code := packet.Validate(); code != packets.Accepted {
+			return code
+		}
+	}
+	s.mux.RLock()
+	authenticator := s.authenticator
+	s.mux.RUnlock()
+	err := authenticator.Authenticate(&auth.Credentials{
+		ClientID:    packet.ClientIdentifier,
+		Username:    packet.Username,
+		Password:    packet.Password,
+		RemoteAddr:  client.GetConn().RemoteAddr(),
+		Certificate: certificate,
+	})
+	switch {
+	case err == nil:
+		return packets.Accepted
+	case errors.Is(err, pkg.ErrBadUsernameOrPassword):
+		return packets.ErrRefusedBadUsernameOrPassword
+	default:
+		return packets.ErrRefusedNotAuthorised
+	}
+}
+
+// applyCertIdentity 使用客户端证书派生的用户名、客户端ID替换 CONNECT 中携带的值
+//
+// return: 用户名是否派生自客户端证书
+func applyCertIdentity(client *client.Client, packet *packets.ConnectPacket) bool {
+	identity, ok := client.GetConn().(server.CertIdentity)
+	if !ok {
+		return false
+	}
+	if clientId, ok := identity.CertClientID(); ok {
+		packet.ClientIdentifier = clientId
+	}
+	username, ok := identity.CertUsername()
+	if ok {
+		packet.Username = username
+		packet.UsernameFlag = true
+	}
+	return ok
 }
 
 func (s *HandlerService) PublishPacket(client *client.Client, packet *packets.PublishPacket) error {
 	var (
-		topic      = packet.TopicName
-		clients, _ = subtree.GetTopicSub().ReadSubClients(topic)
-		errs       []string
+		properties = packetProperties(client)
+		reason     = byte(mqtt5.Success)
 	)
+	if err := s.TopicLimits().ValidateName(packet.TopicName); err != nil {
+		invalidTopic(client, packet.TopicName, err)
+		return pkg.ErrTopicNameInvalid
+	}
+	properties.StartExpiry(time.Now())
+	switch packet.Qos {
+	case 0:
+		s.publishFrom(client, packet, properties)
+		return nil
+	case 1:
+		if !s.publishFrom(client, packet, properties) {
+			reason = mqtt5.NotAuthorized
+		}
+		pubAck := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pubAck.MessageID = packet.MessageID
+		return client.HandleWrite(mqtt5.Wrap(pubAck, nil, reason))
+	case 2:
+		// 重复的 QoS 2 消息不再投递，只重新确认
+		if client.StoreAwaitingRel(packet.MessageID) && !s.publishFrom(client, packet, properties) {
+			// 失败的 PUBREC 结束 QoS 2 流程，客户端不会再发送 PUBREL
+			reason = mqtt5.NotAuthorized
+			client.ReleaseAwaitingRel(packet.MessageID)
+		}
+		pubRec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubRec.MessageID = packet.MessageID
+		return client.HandleWrite(mqtt5.Wrap(pubRec, nil, reason))
+	default:
+		return pkg.ErrMQTTCodeProtocolError
+	}
+}
+
+// publishFrom 校验客户端的发布权限后发布消息，无权限的消息被丢弃
+//
+// return: 是否有发布权限
+func (s *HandlerService) publishFrom(client *client.Client, packet *packets.PublishPacket, properties *mqtt5.Properties) bool {
+	if !s.authorize(client, packet.TopicName, acl.Publish) {
+		return false
+	}
+	s.PublishAs(client.GetId(), packet, properties)
+	return true
+}
+
+// authorize 校验客户端对主题的发布、订阅权限
+func (s *HandlerService) authorize(client *client.Client, topic string, action acl.Action) bool {
+	return s.authorizeAccess(&acl.Access{
+		Username: client.GetUsername(),
+		ClientID: client.GetId(),
+		Topic:    topic,
+		Action:   action,
+	})
+}
+
+// authorizeAccess 校验一次授权请求，拒绝时记录日志
+func (s *HandlerService) authorizeAccess(access *acl.Access) bool {
 	s.mux.RLock()
-	defer s.mux.RUnlock()
-	for _, c := range clients {
-		if conn, ok := s.clients[c.GetID()]; ok {
-			newPacket := packet.Copy()
-			// TODO: messageId 生成器
-			newPacket.MessageID = client.NextMessageId()
-			logrus.WithFields(map[string]interface{}{
-				"clientId": c.GetID(),
-				"packet":   newPacket.Details(),
-			}).Debug("publish message to sub client")
-			if err := conn.HandleWrite(newPacket); err != nil {
-				errs = append(errs, err.Error())
+	authorizer := s.authorizer
+	s.mux.RUnlock()
+	allowed := authorizer.Authorize(access)
+	if !allowed {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": access.ClientID,
+			"username": access.Username,
+			"topic":    access.Topic,
+			"action":   access.Action.String(),
+		}).Warn("access denied")
+	}
+	return allowed
+}
+
+// Publish 发布一条消息，保存保留消息并投递给订阅者
+//
+// param: packet 消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (s *HandlerService) Publish(packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	s.PublishAs("", packet, properties)
+}
+
+// PublishAs 以指定的发布者发布一条消息，保存保留消息并投递给订阅者，
+// 发布者用于 No Local 订阅、共享订阅的哈希策略与发布回调中的环路检测
+//
+// param: publisher 发布者客户端ID，服务端发布的消息为空
+// param: packet 消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (s *HandlerService) PublishAs(publisher string, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	if packet.Retain {
+		s.retain.Store(packet, properties)
+	}
+	s.publish(publisher, packet, properties, true)
+
+	s.mux.RLock()
+	hooks := s.hooks
+	s.mux.RUnlock()
+	for _, hook := range hooks {
+		(*hook)(publisher, packet, properties)
+	}
+}
+
+// AddPublishHook 增加一个消息发布后的回调，回调在发布者的协程中执行，不能阻塞
+//
+// return: 注销该回调的函数，注销前已经开始的调用仍会执行完
+func (s *HandlerService) AddPublishHook(hook PublishHook) func() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	registered := &hook
+	s.hooks = append(s.hooks[:len(s.hooks):len(s.hooks)], registered)
+	return func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		hooks := make([]*PublishHook, 0, len(s.hooks))
+		for _, h := range s.hooks {
+			if h != registered {
+				hooks = append(hooks, h)
 			}
 		}
+		s.hooks = hooks
+	}
+}
+
+// publish 将消息投递给所有订阅了该主题的客户端，离线的持久会话客户端进入会话队列，
+// 每个共享订阅组只投递给其中一个成员。
+// 订阅者按批读取，每批只在查找在线客户端时持有 s.mux 读锁，下发时不持有任何锁
+//
+// param: forward 是否转发给有匹配订阅者的其他节点，其他节点转发来的消息只投递给本节点的订阅者
+func (s *HandlerService) publish(publisher string, packet *packets.PublishPacket, properties *mqtt5.Properties, forward bool) {
+	var (
+		topic    = packet.TopicName
+		topicSub = subtree.GetTopicSub()
+		cluster  = s.getCluster()
+		nodes    = map[string]struct{}{}
+		message  = client.NewFanout(packet, properties)
+		buf      = publishBuffers.Get().(*publishBuffer)
+		fanout   = 0
+	)
+	defer buf.release()
+	// 共享订阅由发布消息的节点在整个集群内选择成员
+	if forward {
+		for _, group := range topicSub.ReadSharedSubs(topic) {
+			s.publishShared(publisher, group, packet, properties)
+			fanout++
+		}
+	}
+	topicSub.ForEachSubscriberBatch(topic, buf.subscribers, func(batch []subtree.Subscriber) bool {
+		var (
+			targets = buf.targets[:0]
+			// offline 不在本节点在线的订阅者，复用 batch 的空间
+			offline = batch[:0]
+		)
+		s.mux.RLock()
+		for _, subscriber := range batch {
+			// No Local 的订阅不会收到自己发布的消息
+			if subscriber.ClientID == publisher && subscriber.Qos&subtree.SubNoLocal != 0 {
+				continue
+			}
+			conn, ok := s.clients[subscriber.ClientID]
+			if !ok {
+				offline = append(offline, subscriber)
+				continue
+			}
+			targets = append(targets, delivery{
+				client:            conn,
+				qos:               minQos(packet.Qos, subscriber.Qos),
+				retainAsPublished: subscriber.Qos&subtree.SubRetainAsPublished != 0,
+			})
+		}
+		s.mux.RUnlock()
+		s.deliver(message, targets)
+		fanout += len(targets)
+		for i := range targets {
+			targets[i] = delivery{}
+		}
+		for _, subscriber := range offline {
+			// 其他节点的订阅者，每个节点只转发一次
+			if node := topicSub.ReadClientNode(subscriber.ClientID); node != "" {
+				nodes[node] = struct{}{}
+			} else if qos := minQos(packet.Qos, subscriber.Qos); qos > 0 {
+				// 离线的持久会话客户端，消息进入会话队列
+				newPacket := packet.Copy()
+				newPacket.Qos = qos
+				newPacket.Retain = packet.Retain && subscriber.Qos&subtree.SubRetainAsPublished != 0
+				s.enqueue(subscriber.ClientID, newPacket, properties)
+				fanout++
+			}
+		}
+		return true
+	})
+	metrics.PublishFanout.Observe(float64(fanout))
+	// $SYS 是本节点的统计信息，不转发给其他节点的订阅者，也不让其他节点保存
+	if !forward || isSysTopic(topic) {
+		return
+	}
+	// 保留消息转发给所有节点，每个节点都保存一份
+	if packet.Retain {
+		for _, node := range cluster.Nodes() {
+			nodes[node] = struct{}{}
+		}
 	}
-	if len(errs) != 0 {
-		return errors.New(strings.Join(errs, ","))
+	for node := range nodes {
+		cluster.Forward(node, "", packet, properties)
 	}
+}
+
+func (s *HandlerService) PubackPacket(client *client.Client, packet *packets.PubackPacket) error {
+	if !client.AckPublish(packet.MessageID) {
+		logrus.WithFields(map[string]interface{}{
+			"clientId":  client.GetId(),
+			"messageId": packet.MessageID,
+		}).Warn("puback for unknown message")
+	}
+	return nil
+}
+
+func (s *HandlerService) PubrecPacket(client *client.Client, packet *packets.PubrecPacket) error {
+	var (
+		failed = false
+		reason = byte(mqtt5.Success)
+	)
+	if v5 := client.PacketV5(); v5 != nil {
+		failed = v5.ReasonCode >= mqtt5.UnspecifiedError
+	}
+	if !client.ReceivedPublish(packet.MessageID, failed) {
+		logrus.WithFields(map[string]interface{}{
+			"clientId":  client.GetId(),
+			"messageId": packet.MessageID,
+		}).Warn("pubrec for unknown message")
+		reason = mqtt5.PacketIdentifierNotFound
+	}
+	// 失败的 PUBREC 结束 QoS 2 流程，不再发送 PUBREL
+	if failed {
+		return nil
+	}
+	pubRel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubRel.MessageID = packet.MessageID
+	return client.HandleWrite(mqtt5.Wrap(pubRel, nil, reason))
+}
+
+func (s *HandlerService) PubrelPacket(client *client.Client, packet *packets.PubrelPacket) error {
+	var reason = byte(mqtt5.Success)
+	if !client.ReleaseAwaitingRel(packet.MessageID) {
+		reason = mqtt5.PacketIdentifierNotFound
+	}
+	pubComp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubComp.MessageID = packet.MessageID
+	return client.HandleWrite(mqtt5.Wrap(pubComp, nil, reason))
+}
 
+func (s *HandlerService) PubcompPacket(client *client.Client, packet *packets.PubcompPacket) error {
+	if !client.CompletePublish(packet.MessageID) {
+		logrus.WithFields(map[string]interface{}{
+			"clientId":  client.GetId(),
+			"messageId": packet.MessageID,
+		}).Warn("pubcomp for unknown message")
+	}
 	return nil
 }
 
@@ -81,29 +582,104 @@ func (s *HandlerService) SubscribePacket(client *client.Client, packet *packets.
 	var (
 		topics    = packet.Topics
 		qoss      = packet.Qoss
-		subTopics = topicQosMerge(packet.Topics, packet.Qoss)
+		subTopics = map[string]int32{}
+		retained  = map[string]int32{}
+		existing  = subtree.GetTopicSub().ReadClientSubTopics(client.GetId())
 		subAck    = packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		v5        = client.PacketV5()
+		limits    = s.TopicLimits()
 		err       error
 	)
 	subAck.MessageID = packet.MessageID
+	for i := 0; i < len(topics) && i < len(qoss); i++ {
+		// 请求的 QoS 为 3 或保留位不为0的订阅是畸形报文，断开连接 [MQTT-3.8.3-4]
+		if qoss[i] > 2 {
+			return fmt.Errorf("%w: subscription options %#x", mqtt5.ErrMalformed, qoss[i])
+		}
+		if err := limits.ValidateFilter(topics[i]); err != nil {
+			invalidTopic(client, topics[i], err)
+			subAck.ReturnCodes = append(subAck.ReturnCodes, mqtt5.TopicFilterInvalid)
+			continue
+		}
+		// 共享订阅按组内的主题过滤器授权，且不下发保留消息
+		filter, shared := topics[i], subtree.IsShared(topics[i])
+		options := subscriptionOptions(client, v5, i)
+		if shared {
+			_, filter, _ = subtree.ParseShared(topics[i])
+			// 共享订阅设置 No Local 是协议错误 [MQTT-3.8.3-4]
+			if v5 != nil && options&subtree.SubNoLocal != 0 {
+				return mqtt5.ErrProtocol
+			}
+			options &^= subtree.SubNoLocal
+		}
+		if !s.authorize(client, filter, acl.Subscribe) {
+			subAck.ReturnCodes = append(subAck.ReturnCodes, mqtt5.NotAuthorized)
+			continue
+		}
+		subTopics[topics[i]] = int32(qoss[i]) | options
+		subAck.ReturnCodes = append(subAck.ReturnCodes, qoss[i])
+		if shared {
+			continue
+		}
+
+		// Retain Handling: 0 总是下发保留消息，1 只在新订阅时下发，2 不下发
+		var retainHandling byte
+		if v5 != nil && i < len(v5.SubOptions) {
+			retainHandling = mqtt5.RetainHandling(v5.SubOptions[i])
+		}
+		if _, ok := existing[topics[i]]; retainHandling == 0 || (retainHandling == 1 && !ok) {
+			retained[topics[i]] = int32(qoss[i])
+		}
+	}
 	err = subtree.GetTopicSub().CreateSub(subTopics, client.GetId(), map[string]string{}, "")
 	if err != nil {
-		for i := 0; i < len(topics) && i < len(qoss); i++ {
-			subAck.ReturnCodes = append(subAck.ReturnCodes, 0x80)
+		for i := range subAck.ReturnCodes {
+			subAck.ReturnCodes[i] = mqtt5.UnspecifiedError
 		}
 		return client.HandleWrite(subAck)
 	}
-	for i := 0; i < len(topics) && i < len(qoss); i++ {
-		qos := int32(qoss[i])
-		subTopics[topics[i]] = qos
-		if qos == 1 {
-			subAck.ReturnCodes = append(subAck.ReturnCodes, 0x02)
-		} else {
-			subAck.ReturnCodes = append(subAck.ReturnCodes, 0x00)
+	s.getCluster().Subscribe(client.GetId(), subTopics)
+	if err = client.HandleWrite(subAck); err != nil {
+		return err
+	}
+	return s.publishRetained(client, retained)
+}
 
+// subscriptionOptions 订阅保存的 No Local 与 Retain As Published 选项。
+// 3.1.1 的订阅下发的消息保留标志为 0，桥接连接相当于设置了这两个选项：
+// 不会收到自己发布的消息，避免消息在服务端之间循环，并保持保留标志
+//
+// param: v5 SUBSCRIBE 的 MQTT 5.0 附加信息，3.1.1 连接为nil
+// param: i 订阅在报文中的下标
+func subscriptionOptions(client *client.Client, v5 *mqtt5.Packet, i int) int32 {
+	if v5 != nil {
+		if i < len(v5.SubOptions) {
+			return int32(v5.SubOptions[i]) & (subtree.SubNoLocal | subtree.SubRetainAsPublished)
 		}
+		return 0
+	}
+	if client.IsBridge() {
+		return subtree.SubNoLocal | subtree.SubRetainAsPublished
 	}
-	return client.HandleWrite(subAck)
+	return 0
+}
+
+// publishRetained 向新订阅的客户端下发匹配的保留消息
+//
+// param: client 订阅的客户端
+// param: topics 新订阅的主题过滤器及其授予的qos
+func (s *HandlerService) publishRetained(client *client.Client, topics map[string]int32) error {
+	for filter, subQos := range topics {
+		for _, message := range s.retain.Match(filter) {
+			newPacket := message.Packet.Copy()
+			newPacket.Retain = true
+			newPacket.Qos = minQos(message.Packet.Qos, subQos)
+			if err := client.Publish(newPacket, message.Properties); err != nil && !errors.Is(err, pkg.ErrMessageDropped) {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (s *HandlerService) UnsubscribePacket(client *client.Client, packet *packets.UnsubscribePacket) error {
@@ -111,9 +687,16 @@ func (s *HandlerService) UnsubscribePacket(client *client.Client, packet *packet
 		unsubAck = packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 		topics   = map[string]int32{}
 		clientId = client.GetId()
+		existing = subtree.GetTopicSub().ReadClientSubTopics(clientId)
+		reasons  = make([]byte, 0, len(packet.Topics))
 	)
 	for _, v := range packet.Topics {
 		topics[v] = 0
+		if _, ok := existing[v]; ok {
+			reasons = append(reasons, mqtt5.Success)
+		} else {
+			reasons = append(reasons, mqtt5.NoSubscriptionExisted)
+		}
 	}
 	err := subtree.GetTopicSub().DeleteSub(topics, clientId)
 	unsubAck.MessageID = packet.MessageID
@@ -124,7 +707,8 @@ func (s *HandlerService) UnsubscribePacket(client *client.Client, packet *packet
 		}).Error(`unsub failed `)
 		return err
 	}
-	return client.HandleWrite(unsubAck)
+	s.getCluster().Unsubscribe(clientId, topics)
+	return client.HandleWrite(&mqtt5.Packet{ControlPacket: unsubAck, ReasonCodes: reasons})
 }
 
 func (s *HandlerService) PingPacket(client *client.Client, packet *packets.PingreqPacket) error {
@@ -135,13 +719,75 @@ func (s *HandlerService) PingPacket(client *client.Client, packet *packets.Pingr
 }
 
 func (s *HandlerService) DisconnectPacket(client *client.Client, packet *packets.DisconnectPacket) error {
+	if v5 := client.PacketV5(); v5 != nil {
+		if v5.Properties != nil && v5.Properties.SessionExpiryInterval != nil {
+			expiry := *v5.Properties.SessionExpiryInterval
+			// CONNECT 时会话过期时间为0的客户端不能在断开时重新设置
+			if client.SessionExpiry() == 0 && expiry != 0 {
+				return mqtt5.ErrProtocol
+			}
+			client.SetSessionExpiry(expiry)
+		}
+		if v5.ReasonCode == mqtt5.DisconnectWithWill {
+			return client.Close()
+		}
+	}
+	// 正常断开时丢弃遗嘱
+	client.TakeWill()
 	return client.Close()
 }
 
-func topicQosMerge(topic []string, qos []byte) map[string]int32 {
-	var topics = map[string]int32{}
-	for i := 0; i < len(topic) && i < len(qos); i++ {
-		topics[topic[i]] = int32(qos[i])
+func (s *HandlerService) ConnectionLost(client *client.Client, err error) {
+	var (
+		clientId = client.GetId()
+		will     = client.TakeWill()
+	)
+	s.mux.Lock()
+	if c, ok := s.clients[clientId]; ok && c == client {
+		delete(s.clients, clientId)
+		expiry := client.SessionExpiry()
+		if expiry == 0 {
+			subtree.GetTopicSub().DeleteClient(clientId)
+			s.cluster.DeleteSession(clientId)
+		} else {
+			s.saveInflight(client)
+			subtree.GetTopicSub().SaveSessionExpiry(clientId, expiry, time.Now())
+			s.scheduleSessionExpiry(clientId, expiry)
+		}
+		if will != nil {
+			if delay := willDelay(will, expiry); delay > 0 {
+				s.scheduleWill(clientId, will, delay)
+				will = nil
+			}
+		}
+	}
+	s.mux.Unlock()
+
+	if will != nil {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": clientId,
+			"topic":    will.Packet.TopicName,
+			"error":    err,
+		}).Debug("publish will message")
+		s.publishWill(clientId, will)
+	}
+}
+
+// packetProperties 正在处理的 MQTT 5.0 报文的属性，3.1.1 报文返回nil
+func packetProperties(client *client.Client) *mqtt5.Properties {
+	if v5 := client.PacketV5(); v5 != nil {
+		return v5.Properties
+	}
+	return nil
+}
+
+// minQos 下发的 QoS 取发布 QoS 与订阅 QoS 中较小的一个
+//
+// param: pubQos 发布的 QoS
+// param: subQos 订阅的值，只取其中授予的 QoS
+func minQos(pubQos byte, subQos int32) byte {
+	if qos := byte(subQos & subtree.SubQos); qos < pubQos {
+		return qos
 	}
-	return topics
+	return pubQos
 }
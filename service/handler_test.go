@@ -0,0 +1,645 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"golang.org/x/crypto/bcrypt"
+	"icetea/client"
+	"icetea/pkg/mqtt5"
+	"icetea/service/acl"
+	"icetea/service/auth"
+	"icetea/service/subtree"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConn 通过 net.Pipe 连接到 HandlerService 的测试客户端
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	// v5 是否以 MQTT 5.0 连接
+	v5 bool
+}
+
+// dial 创建一个连接到 handler 的客户端，返回客户端一侧的连接
+func dial(t *testing.T, handler *HandlerService) *testConn {
+	t.Helper()
+	return dialConn(t, handler, func(conn net.Conn) net.Conn { return conn })
+}
+
+// dialConn 与 dial 相同，服务端一侧的连接经过 wrap 包装
+func dialConn(t *testing.T, handler *HandlerService, wrap func(net.Conn) net.Conn) *testConn {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	local, remote := net.Pipe()
+	c := client.NewClient(wrap(remote), handler)
+	c.Run(ctx)
+	t.Cleanup(func() {
+		local.Close()
+		cancel()
+		<-c.Done()
+	})
+	return &testConn{t: t, conn: local}
+}
+
+func (c *testConn) write(packet packets.ControlPacket) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := packet.Write(c.conn); err != nil {
+		c.t.Fatalf("write %s: %v", packet.String(), err)
+	}
+}
+
+// read 读取服务端发送的下一个报文，连接关闭时返回 nil
+func (c *testConn) read() packets.ControlPacket {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	packet, err := packets.ReadPacket(c.conn)
+	if err != nil {
+		return nil
+	}
+	return packet
+}
+
+// closed 服务端是否在超时之前关闭了连接
+func (c *testConn) closed() bool {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := packets.ReadPacket(c.conn)
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// connect 发送 CONNECT 报文并返回 CONNACK 的返回码
+func (c *testConn) connect(packet *packets.ConnectPacket) byte {
+	c.t.Helper()
+	c.write(packet)
+	connAck, ok := c.read().(*packets.ConnackPacket)
+	if !ok {
+		c.t.Fatal("expected CONNACK")
+	}
+	return connAck.ReturnCode
+}
+
+func newConnectPacket(clientId string) *packets.ConnectPacket {
+	packet := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	packet.ProtocolName = "MQTT"
+	packet.ProtocolVersion = 4
+	packet.CleanSession = true
+	packet.ClientIdentifier = clientId
+	packet.Keepalive = 30
+	return packet
+}
+
+func TestConnectWillTopicNotAuthorized(t *testing.T) {
+	handler := NewHandlerService()
+	handler.SetAuthorizer(&acl.RuleSet{
+		Rules: []acl.Rule{
+			{Allow: true, Actions: acl.Publish, Topic: "clients/%c/#"},
+		},
+	})
+
+	packet := newConnectPacket("will-denied")
+	packet.WillFlag = true
+	packet.WillTopic = "alarm"
+	packet.WillMessage = []byte("offline")
+	conn := dial(t, handler)
+	if code := conn.connect(packet); code != packets.ErrRefusedNotAuthorised {
+		t.Fatalf("connect return code = %#x, want %#x", code, packets.ErrRefusedNotAuthorised)
+	}
+	if !conn.closed() {
+		t.Fatal("expected connection to be closed")
+	}
+
+	packet = newConnectPacket("will-allowed")
+	packet.WillFlag = true
+	packet.WillTopic = "clients/will-allowed/status"
+	packet.WillMessage = []byte("offline")
+	if code := dial(t, handler).connect(packet); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x, want %#x", code, packets.Accepted)
+	}
+}
+
+func TestConnectPacketTooLarge(t *testing.T) {
+	conn := dial(t, NewHandlerService())
+	// 固定报头声明 200 MiB 的剩余长度，服务端不读取报文体直接关闭连接
+	conn.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := conn.conn.Write([]byte{packets.Connect << 4, 0x80, 0x80, 0x80, 0x64}); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.closed() {
+		t.Fatal("expected connection to be closed")
+	}
+}
+
+func (c *testConn) writeRaw(raw []byte) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write(raw); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// readRaw 读取服务端发送的下一个报文的原始字节
+func (c *testConn) readRaw() []byte {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	raw, err := mqtt5.ReadRaw(c.conn, 0)
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return raw
+}
+
+// readPublish 读取服务端下发的 PUBLISH，兼容 3.1.1 与 5.0
+func (c *testConn) readPublish() *packets.PublishPacket {
+	c.t.Helper()
+	if !c.v5 {
+		packet, ok := c.read().(*packets.PublishPacket)
+		if !ok {
+			c.t.Fatal("expected PUBLISH")
+		}
+		return packet
+	}
+	raw := c.readRaw()
+	if raw[0]>>4 != packets.Publish {
+		c.t.Fatalf("expected PUBLISH, got packet type %d", raw[0]>>4)
+	}
+	packet, _, err := mqtt5.UnmarshalPublish(raw)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return packet
+}
+
+// mqttString MQTT 的 UTF-8 字符串编码
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// withHeader 为可变报头与负载加上固定报头，剩余长度不超过 127
+func withHeader(header byte, body []byte) []byte {
+	return append([]byte{header, byte(len(body))}, body...)
+}
+
+// connectV5 以 MQTT 5.0 连接并等待 CONNACK
+func (c *testConn) connectV5(clientId string) {
+	c.t.Helper()
+	body := append(mqttString("MQTT"), 5, 0x02, 0, 30, 0)
+	c.writeRaw(withHeader(packets.Connect<<4, append(body, mqttString(clientId)...)))
+	if raw := c.readRaw(); raw[0]>>4 != packets.Connack || raw[3] != mqtt5.Success {
+		c.t.Fatalf("connack = %x", raw)
+	}
+	c.v5 = true
+}
+
+// subscribeV5 以 MQTT 5.0 订阅一个主题并等待 SUBACK
+func (c *testConn) subscribeV5(filter string, options byte) {
+	c.t.Helper()
+	body := append([]byte{0, 1, 0}, mqttString(filter)...)
+	c.writeRaw(withHeader(packets.Subscribe<<4|0x02, append(body, options)))
+	if raw := c.readRaw(); raw[0]>>4 != packets.Suback || raw[len(raw)-1] != options&mqtt5.SubOptionQos {
+		c.t.Fatalf("suback = %x", raw)
+	}
+}
+
+// subscribe 以 3.1.1 订阅一个主题并等待 SUBACK
+func (c *testConn) subscribe(filter string, qos byte) byte {
+	c.t.Helper()
+	packet := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	packet.MessageID = 1
+	packet.Topics = []string{filter}
+	packet.Qoss = []byte{qos}
+	c.write(packet)
+	subAck, ok := c.read().(*packets.SubackPacket)
+	if !ok {
+		c.t.Fatal("expected SUBACK")
+	}
+	return subAck.ReturnCodes[0]
+}
+
+func newPublishPacket(topic, payload string, retain bool) *packets.PublishPacket {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Payload = []byte(payload)
+	packet.Retain = retain
+	return packet
+}
+
+func TestSubscribeNoLocal(t *testing.T) {
+	handler := NewHandlerService()
+	local := dial(t, handler)
+	local.connectV5("no-local")
+	defer subtree.GetTopicSub().DeleteClient("no-local")
+	local.subscribeV5("options/no-local", byte(subtree.SubNoLocal))
+	other := dial(t, handler)
+	if code := other.connect(newConnectPacket("no-local-other")); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	defer subtree.GetTopicSub().DeleteClient("no-local-other")
+	other.subscribe("options/no-local", 0)
+
+	raw, _ := mqtt5.MarshalPublish(newPublishPacket("options/no-local", "own", false), nil)
+	local.writeRaw(raw)
+	if packet := other.readPublish(); string(packet.Payload) != "own" {
+		t.Fatalf("other received %q", packet.Payload)
+	}
+	// 同一订阅者的消息按顺序下发，先收到其他客户端的消息说明自己的消息没有下发
+	other.write(newPublishPacket("options/no-local", "other", false))
+	if packet := local.readPublish(); string(packet.Payload) != "other" {
+		t.Fatalf("no local subscriber received %q", packet.Payload)
+	}
+}
+
+func TestSubscribeRetainAsPublished(t *testing.T) {
+	handler := NewHandlerService()
+	asPublished := dial(t, handler)
+	asPublished.connectV5("rap")
+	defer subtree.GetTopicSub().DeleteClient("rap")
+	asPublished.subscribeV5("options/rap", byte(subtree.SubRetainAsPublished))
+	cleared := dial(t, handler)
+	cleared.connectV5("rap-cleared")
+	defer subtree.GetTopicSub().DeleteClient("rap-cleared")
+	cleared.subscribeV5("options/rap", 0)
+	v311 := dial(t, handler)
+	if code := v311.connect(newConnectPacket("rap-v311")); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	defer subtree.GetTopicSub().DeleteClient("rap-v311")
+	v311.subscribe("options/rap", 0)
+
+	handler.Publish(newPublishPacket("options/rap", "retained", true), nil)
+	if packet := asPublished.readPublish(); !packet.Retain {
+		t.Fatal("retain as published subscriber received retain flag 0")
+	}
+	if packet := cleared.readPublish(); packet.Retain {
+		t.Fatal("MQTT 5.0 subscriber without retain as published received retain flag 1")
+	}
+	if packet := v311.readPublish(); packet.Retain {
+		t.Fatal("3.1.1 subscriber received retain flag 1 for a live message")
+	}
+}
+
+// connectWillV5 以 MQTT 5.0 连接并设置延迟发布的遗嘱
+//
+// param: delay Will Delay Interval 秒数
+// param: expiry Session Expiry Interval 秒数
+func (c *testConn) connectWillV5(clientId, topic string, delay, expiry uint32) {
+	c.t.Helper()
+	body := append(mqttString("MQTT"), 5, 0x06, 0, 30)
+	body = append(body, 5, 0x11, byte(expiry>>24), byte(expiry>>16), byte(expiry>>8), byte(expiry))
+	body = append(body, mqttString(clientId)...)
+	body = append(body, 5, 0x18, byte(delay>>24), byte(delay>>16), byte(delay>>8), byte(delay))
+	body = append(body, mqttString(topic)...)
+	body = append(body, mqttString("offline")...)
+	c.writeRaw(withHeader(packets.Connect<<4, body))
+	if raw := c.readRaw(); raw[0]>>4 != packets.Connack || raw[3] != mqtt5.Success {
+		c.t.Fatalf("connack = %x", raw)
+	}
+	c.v5 = true
+}
+
+// TestWillDelay 遗嘱在 Will Delay Interval 之后发布，延迟期内重连则不发布
+func TestWillDelay(t *testing.T) {
+	handler := NewHandlerService()
+	watcher := dial(t, handler)
+	if code := watcher.connect(newConnectPacket("will-watcher")); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	defer subtree.GetTopicSub().DeleteClient("will-watcher")
+	watcher.subscribe("wills/#", 0)
+
+	delayed := dial(t, handler)
+	delayed.connectWillV5("will-delayed", "wills/delayed", 1, 60)
+	defer subtree.GetTopicSub().DeleteClient("will-delayed")
+	delayed.conn.Close()
+	start := time.Now()
+	watcher.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	packet, err := packets.ReadPacket(watcher.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if publish, ok := packet.(*packets.PublishPacket); !ok || publish.TopicName != "wills/delayed" {
+		t.Fatalf("expected will message, got %s", packet)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("will published after %s, want about 1s", elapsed)
+	}
+
+	reconnect := dial(t, handler)
+	reconnect.connectWillV5("will-reconnect", "wills/reconnect", 1, 60)
+	defer subtree.GetTopicSub().DeleteClient("will-reconnect")
+	reconnect.conn.Close()
+	resume := newConnectPacket("will-reconnect")
+	resume.CleanSession = false
+	if code := dial(t, handler).connect(resume); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	watcher.conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+	if packet, err := packets.ReadPacket(watcher.conn); err == nil {
+		t.Fatalf("will published after reconnect: %s", packet)
+	}
+
+	// 新连接结束了原有会话，遗嘱立即发布
+	clean := dial(t, handler)
+	clean.connectWillV5("will-clean", "wills/clean", 60, 60)
+	defer subtree.GetTopicSub().DeleteClient("will-clean")
+	clean.conn.Close()
+	dial(t, handler).connectV5("will-clean")
+	if publish, ok := watcher.read().(*packets.PublishPacket); !ok || publish.TopicName != "wills/clean" {
+		t.Fatal("expected will message after clean start")
+	}
+}
+
+// TestSubscribeInvalidFilter 非法的主题过滤器在 SUBACK 中返回 0x80，同一报文中的其他过滤器正常订阅，连接保持
+func TestSubscribeInvalidFilter(t *testing.T) {
+	handler := NewHandlerService()
+	handler.SetTopicLimits(subtree.TopicLimits{MaxLevels: 3})
+	conn := dial(t, handler)
+	if code := conn.connect(newConnectPacket("invalid-filter")); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	defer subtree.GetTopicSub().DeleteClient("invalid-filter")
+
+	filters := []string{"a/#/b", "sport+", "$share//sport", "a/b/c/d", "validate/+", "sport\x00"}
+	packet := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	packet.MessageID = 1
+	packet.Topics = filters
+	packet.Qoss = make([]byte, len(filters))
+	packet.Qoss[4] = 1
+	conn.write(packet)
+	subAck, ok := conn.read().(*packets.SubackPacket)
+	if !ok {
+		t.Fatal("expected SUBACK")
+	}
+	want := []byte{0x80, 0x80, 0x80, 0x80, 1, 0x80}
+	if string(subAck.ReturnCodes) != string(want) {
+		t.Fatalf("suback return codes = %x, want %x", subAck.ReturnCodes, want)
+	}
+	if subs := subtree.GetTopicSub().ReadClientSubTopics("invalid-filter"); len(subs) != 1 || subs["validate/+"] == 0 {
+		t.Fatalf("subscriptions = %v", subs)
+	}
+	if code := conn.subscribe("validate/#", 0); code != 0 {
+		t.Fatalf("subscribe after invalid filter return code = %#x", code)
+	}
+}
+
+// TestPublishInvalidTopic 主题名非法的 PUBLISH 是协议错误，服务端断开连接
+func TestPublishInvalidTopic(t *testing.T) {
+	handler := NewHandlerService()
+	handler.SetTopicLimits(subtree.TopicLimits{MaxLevels: 3})
+	for _, topic := range []string{"sport/+", "sport/#", "sport\x00", "sport/\xff", "a/b/c/d"} {
+		conn := dial(t, handler)
+		if code := conn.connect(newConnectPacket("invalid-topic")); code != packets.Accepted {
+			t.Fatalf("connect return code = %#x", code)
+		}
+		conn.write(newPublishPacket(topic, "invalid", false))
+		if !conn.closed() {
+			t.Fatalf("publish to %q: expected connection to be closed", topic)
+		}
+	}
+}
+
+// connectSession 以 3.1.1 CleanSession=false 连接并返回 CONNACK 的 Session Present
+func (c *testConn) connectSession(clientId string) bool {
+	c.t.Helper()
+	packet := newConnectPacket(clientId)
+	packet.CleanSession = false
+	c.write(packet)
+	connAck, ok := c.read().(*packets.ConnackPacket)
+	if !ok || connAck.ReturnCode != packets.Accepted {
+		c.t.Fatal("expected accepted CONNACK")
+	}
+	return connAck.SessionPresent
+}
+
+// TestResumeSessionPubrel 收到 PUBREC 后断开的 QoS 2 消息，会话恢复时在 CONNACK 之后重发 PUBREL 而不是 PUBLISH
+func TestResumeSessionPubrel(t *testing.T) {
+	handler := NewHandlerService()
+	subscriber := dial(t, handler)
+	subscriber.connectSession("pubrel-resume")
+	defer subtree.GetTopicSub().DeleteClient("pubrel-resume")
+	subscriber.subscribe("resume/pubrel", 2)
+
+	publish := newPublishPacket("resume/pubrel", "exactly once", false)
+	publish.Qos = 2
+	handler.Publish(publish, nil)
+	received := subscriber.readPublish()
+	pubRec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubRec.MessageID = received.MessageID
+	subscriber.write(pubRec)
+	if pubRel, ok := subscriber.read().(*packets.PubrelPacket); !ok || pubRel.MessageID != received.MessageID {
+		t.Fatal("expected PUBREL")
+	}
+	// 不发送 PUBCOMP 直接断开
+	subscriber.conn.Close()
+
+	resumed := dial(t, handler)
+	if !resumed.connectSession("pubrel-resume") {
+		t.Fatal("expected session present")
+	}
+	pubRel, ok := resumed.read().(*packets.PubrelPacket)
+	if !ok || pubRel.MessageID != received.MessageID {
+		t.Fatalf("expected PUBREL %d after CONNACK", received.MessageID)
+	}
+	pubComp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubComp.MessageID = pubRel.MessageID
+	resumed.write(pubComp)
+	// 同一连接上的报文按顺序处理，收到 PINGRESP 时 PUBCOMP 已经处理
+	resumed.write(packets.NewControlPacket(packets.Pingreq))
+	if _, ok := resumed.read().(*packets.PingrespPacket); !ok {
+		t.Fatal("expected PINGRESP, the message was sent again")
+	}
+	if conn, _ := handler.ReadClient("pubrel-resume"); conn.InflightLen() != 0 {
+		t.Fatalf("inflight after PUBCOMP = %d", conn.InflightLen())
+	}
+}
+
+// TestSubscribeInvalidQos 请求 QoS 3 的订阅是畸形报文，断开连接，MQTT 5.0 客户端先收到原因码 0x81 的 DISCONNECT
+func TestSubscribeInvalidQos(t *testing.T) {
+	handler := NewHandlerService()
+	conn := dial(t, handler)
+	if code := conn.connect(newConnectPacket("invalid-qos")); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	defer subtree.GetTopicSub().DeleteClient("invalid-qos")
+	packet := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	packet.MessageID = 1
+	packet.Topics = []string{"valid/qos", "invalid/qos"}
+	packet.Qoss = []byte{1, 3}
+	conn.write(packet)
+	if !conn.closed() {
+		t.Fatal("expected connection to be closed")
+	}
+	if subs := subtree.GetTopicSub().ReadClientSubTopics("invalid-qos"); len(subs) != 0 {
+		t.Fatalf("subscriptions = %v", subs)
+	}
+
+	v5 := dial(t, handler)
+	v5.connectV5("invalid-qos-v5")
+	defer subtree.GetTopicSub().DeleteClient("invalid-qos-v5")
+	v5.writeRaw(withHeader(packets.Subscribe<<4|0x02, append(append([]byte{0, 1, 0}, mqttString("invalid/qos")...), 3)))
+	if raw := v5.readRaw(); raw[0]>>4 != packets.Disconnect || raw[2] != mqtt5.MalformedPacket {
+		t.Fatalf("disconnect = %x", raw)
+	}
+}
+
+// TestRemovePublishHook 注销的发布回调不再被调用，其他回调不受影响
+func TestRemovePublishHook(t *testing.T) {
+	var (
+		handler       = NewHandlerService()
+		first, second int
+	)
+	remove := handler.AddPublishHook(func(string, *packets.PublishPacket, *mqtt5.Properties) { first++ })
+	handler.AddPublishHook(func(string, *packets.PublishPacket, *mqtt5.Properties) { second++ })
+
+	handler.Publish(newPublishPacket("hook/remove", "1", false), nil)
+	remove()
+	remove()
+	handler.Publish(newPublishPacket("hook/remove", "2", false), nil)
+	if first != 1 || second != 2 {
+		t.Fatalf("hooks called %d and %d times, want 1 and 2", first, second)
+	}
+}
+
+// TestResumeSession 持久会话重连后 SessionPresent 为1，先重发未确认的消息（DUP，原报文ID），再下发离线期间的消息；
+// CleanSession 连接丢弃会话
+func TestResumeSession(t *testing.T) {
+	const clientId = "session-resume"
+	handler := NewHandlerService()
+	defer subtree.GetTopicSub().DeleteClient(clientId)
+
+	subscriber := dial(t, handler)
+	if subscriber.connectSession(clientId) {
+		t.Fatal("new session reported as present")
+	}
+	subscriber.subscribe("resume/queue", 1)
+	publish := newPublishPacket("resume/queue", "unacked", false)
+	publish.Qos = 1
+	handler.Publish(publish, nil)
+	unacked := subscriber.readPublish()
+	// 不发送 PUBACK 直接断开
+	subscriber.conn.Close()
+	waitDisconnected(t, handler, clientId)
+
+	offline := newPublishPacket("resume/queue", "offline", false)
+	offline.Qos = 1
+	handler.Publish(offline, nil)
+
+	resumed := dial(t, handler)
+	if !resumed.connectSession(clientId) {
+		t.Fatal("expected session present")
+	}
+	resent := resumed.readPublish()
+	if string(resent.Payload) != "unacked" || !resent.Dup || resent.MessageID != unacked.MessageID {
+		t.Fatalf("resent %q dup=%v id=%d, want unacked dup=true id=%d", resent.Payload, resent.Dup, resent.MessageID, unacked.MessageID)
+	}
+	if queued := resumed.readPublish(); string(queued.Payload) != "offline" {
+		t.Fatalf("received %q, want offline", queued.Payload)
+	}
+	resumed.conn.Close()
+	waitDisconnected(t, handler, clientId)
+
+	clean := dial(t, handler)
+	if code := clean.connect(newConnectPacket(clientId)); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	handler.Publish(newPublishPacket("resume/queue", "after clean", false), nil)
+	if packet := clean.read(); packet != nil {
+		t.Fatalf("clean session received %s", packet.String())
+	}
+}
+
+// waitDisconnected 等待服务端处理完客户端的断开
+func waitDisconnected(t *testing.T, handler *HandlerService, clientId string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, ok := handler.ReadClient(clientId); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still connected", clientId)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// certConn 用户名派生自客户端证书的连接
+type certConn struct {
+	net.Conn
+	username string
+}
+
+func (c certConn) CertUsername() (string, bool) {
+	return c.username, true
+}
+
+func (c certConn) CertClientID() (string, bool) {
+	return "", false
+}
+
+// TestConnectAuthentication 3.1.1 客户端认证失败时收到的 CONNACK 返回码：
+// 用户名或密码错误为 0x04，拒绝匿名连接为 0x05，证书派生的用户名不需要密码
+func TestConnectAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(path, []byte("alice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passwordFile, err := auth.NewPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandlerService()
+	handler.SetAuthenticator(auth.Certificate(auth.Anonymous(false, passwordFile)))
+
+	tests := []struct {
+		name        string
+		username    string
+		password    string
+		certificate string
+		code        byte
+	}{
+		{"password", "alice", "secret", "", packets.Accepted},
+		{"wrong password", "alice", "wrong", "", packets.ErrRefusedBadUsernameOrPassword},
+		{"unknown user", "bob", "secret", "", packets.ErrRefusedBadUsernameOrPassword},
+		{"anonymous", "", "", "", packets.ErrRefusedNotAuthorised},
+		{"certificate", "", "", "device-1", packets.Accepted},
+		{"certificate overrides username", "alice", "wrong", "device-1", packets.Accepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialConn(t, handler, func(conn net.Conn) net.Conn {
+				if tt.certificate == "" {
+					return conn
+				}
+				return certConn{Conn: conn, username: tt.certificate}
+			})
+			packet := newConnectPacket("auth-" + strings.ReplaceAll(tt.name, " ", "-"))
+			if tt.username != "" {
+				packet.UsernameFlag = true
+				packet.Username = tt.username
+			}
+			if tt.password != "" {
+				packet.PasswordFlag = true
+				packet.Password = []byte(tt.password)
+			}
+			defer subtree.GetTopicSub().DeleteClient(packet.ClientIdentifier)
+			if code := conn.connect(packet); code != tt.code {
+				t.Fatalf("return code = %#x, want %#x", code, tt.code)
+			}
+			if tt.code != packets.Accepted && !conn.closed() {
+				t.Fatal("refused connection not closed")
+			}
+		})
+	}
+}
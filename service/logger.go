@@ -3,20 +3,46 @@ package service
 import (
 	"context"
 	"github.com/sirupsen/logrus"
+	"os"
 )
 
-type Logger struct{}
+type Logger struct {
+	level logrus.Level
+	json  bool
+	path  string
+	file  *os.File
+}
 
-func NewLogger() *Logger {
-	return &Logger{}
+// NewLogger 创建日志服务
+//
+// param: level 日志级别
+// param: json 是否输出 JSON 格式
+// param: path 日志文件，为空时输出到标准错误
+func NewLogger(level logrus.Level, json bool, path string) *Logger {
+	return &Logger{level: level, json: json, path: path}
 }
 
 func (l *Logger) Run(ctx context.Context) error {
-	logrus.SetLevel(logrus.DebugLevel)
+	logrus.SetLevel(l.level)
+	if l.json {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+	if l.path != "" {
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		l.file = file
+		logrus.SetOutput(file)
+	}
 	return nil
 }
 
 func (l *Logger) Stop() error {
+	if l.file != nil {
+		logrus.SetOutput(os.Stderr)
+		return l.file.Close()
+	}
 	return nil
 }
 
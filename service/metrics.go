@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"icetea/service/subtree"
+	"net"
+	"net/http"
+	"time"
+)
+
+// MetricsService 以 Prometheus 文本格式在 /metrics 提供服务端的指标
+type MetricsService struct {
+	handler *HandlerService
+	listen  string
+	server  *http.Server
+}
+
+// NewMetricsService 创建指标服务，客户端、订阅、保留消息与飞行消息的数量注册在服务自己的 Registry 上，
+// 与 prometheus.DefaultGatherer 中的连接、报文指标一起提供，同一进程中可以创建多个服务
+//
+// param: handler 报文处理器
+// param: listen 监听地址，例如 0.0.0.0:9100
+func NewMetricsService(handler *HandlerService, listen string) *MetricsService {
+	gauges := map[string]struct {
+		help  string
+		value func() float64
+	}{
+		"clients_connected": {"Clients currently connected.", func() float64 {
+			connected, _ := handler.clientCounts()
+			return float64(connected)
+		}},
+		"sessions_disconnected": {"Persistent sessions whose client is disconnected.", func() float64 {
+			connected, total := handler.clientCounts()
+			return float64(total - connected)
+		}},
+		"subscriptions": {"Active subscriptions.", func() float64 {
+			return float64(subtree.GetTopicSub().SubscriptionCount())
+		}},
+		"retained_messages": {"Retained messages stored.", func() float64 {
+			return float64(handler.retain.Len())
+		}},
+		"outbound_queued_packets": {"Packets waiting in client outbound queues to be written.", func() float64 {
+			return float64(handler.outboundCount())
+		}},
+		"inflight_messages": {"Outbound QoS 1 and 2 messages awaiting acknowledgement.", func() float64 {
+			return float64(handler.inflightCount())
+		}},
+	}
+	registry := prometheus.NewRegistry()
+	for name, g := range gauges {
+		registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "icetea",
+			Name:      name,
+			Help:      g.help,
+		}, g.value))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{registry, prometheus.DefaultGatherer}, promhttp.HandlerOpts{}))
+	return &MetricsService{
+		handler: handler,
+		listen:  listen,
+		server: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+func (m *MetricsService) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", m.listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := m.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.WithFields(map[string]interface{}{
+				"listen": m.listen,
+				"error":  err,
+			}).Error("metrics server stopped")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		m.Stop()
+	}()
+	return nil
+}
+
+func (m *MetricsService) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return m.server.Shutdown(ctx)
+}
+
+func (m *MetricsService) Name() string {
+	return `metrics`
+}
@@ -0,0 +1,27 @@
+package service
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestMetricsServiceRegistry 每个指标服务使用自己的 Registry，创建多个服务不会重复注册，且各自提供自己的报文处理器的指标
+func TestMetricsServiceRegistry(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		metrics := NewMetricsService(NewHandlerService(), "127.0.0.1:0")
+		recorder := httptest.NewRecorder()
+		metrics.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status %d", recorder.Code)
+		}
+		body, _ := io.ReadAll(recorder.Body)
+		for _, name := range []string{"icetea_clients_connected 0", "icetea_retained_messages 0", "icetea_connections_accepted_total"} {
+			if !strings.Contains(string(body), name) {
+				t.Fatalf("metrics missing %q:\n%s", name, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/client"
+	"icetea/pkg/mqtt5"
+	"icetea/service/subtree"
+	"sync"
+	"time"
+)
+
+// RetainStore 保留消息存储，每个主题只保留最后一条消息
+type RetainStore struct {
+	mux      sync.RWMutex
+	messages map[string]*client.Message
+}
+
+func NewRetainStore() *RetainStore {
+	return &RetainStore{
+		messages: make(map[string]*client.Message),
+	}
+}
+
+// Store 保存一条保留消息，负载为空时删除该主题的保留消息
+//
+// param: packet 带有 retain 标志的消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (r *RetainStore) Store(packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(packet.Payload) == 0 {
+		delete(r.messages, packet.TopicName)
+		return
+	}
+	message := packet.Copy()
+	message.Qos = packet.Qos
+	message.Retain = true
+	r.messages[packet.TopicName] = &client.Message{Packet: message, Properties: properties.ForForward(time.Now())}
+}
+
+// Match 查找与主题过滤器匹配的保留消息
+//
+// param: filter 主题过滤器，可以包含通配符
+// return: 未过期的保留消息切片
+func (r *RetainStore) Match(filter string) []*client.Message {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	now := time.Now()
+	if !subtree.HasWildcard(filter) {
+		if message, ok := r.messages[filter]; ok && !message.Properties.Expired(now) {
+			return []*client.Message{message}
+		}
+		return nil
+	}
+	var result []*client.Message
+	for topic, message := range r.messages {
+		if subtree.TopicMatch(filter, topic) && !message.Properties.Expired(now) {
+			result = append(result, message)
+		}
+	}
+	return result
+}
+
+// Len 保留消息数量
+func (r *RetainStore) Len() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return len(r.messages)
+}
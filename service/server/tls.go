@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// IdentityCN 使用客户端证书的 Subject CommonName 作为身份
+	IdentityCN = "cn"
+	// IdentitySAN 使用客户端证书的第一个 SAN (DNS、Email、URI) 作为身份
+	IdentitySAN = "san"
+)
+
+// TLSConfig TLS 监听配置
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// CAFile 校验客户端证书的CA，为空时不校验客户端证书
+	CAFile string
+	// RequireClientCert 是否要求客户端必须提供证书，否则仅在提供时校验
+	RequireClientCert bool
+	// MinVersion 最低的 TLS 版本: 1.0, 1.1, 1.2, 1.3，默认为 1.2
+	MinVersion string
+	// CipherSuites 允许的密码套件名称，为空时使用 Go 的默认值
+	CipherSuites []string
+	// UsernameFrom 从客户端证书派生 MQTT 用户名: cn, san，为空时不派生
+	UsernameFrom string
+	// ClientIDFrom 从客户端证书派生 MQTT 客户端ID: cn, san，为空时不派生
+	ClientIDFrom string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Build 加载证书并生成 tls.Config
+func (c *TLSConfig) Build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version %q", c.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	if len(c.CipherSuites) != 0 {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(`no certificates found in ` + c.CAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// CertIdentity 由已校验的客户端证书派生出的身份
+type CertIdentity interface {
+	CertUsername() (string, bool)
+	CertClientID() (string, bool)
+}
+
+type TLSListener struct {
+	listener net.Listener
+	addr     *net.TCPAddr
+	config   *TLSConfig
+}
+
+func NewTLSListener(host string, port int, config *TLSConfig) *TLSListener {
+	addr, err := net.ResolveTCPAddr("tcp", host+":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return &TLSListener{
+		addr:   addr,
+		config: config,
+	}
+}
+
+func (t *TLSListener) Listen() error {
+	tlsConfig, err := t.config.Build()
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenTCP("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	t.listener = tls.NewListener(listener, tlsConfig)
+	return nil
+}
+
+func (t *TLSListener) Accept() (net.Conn, error) {
+	conn, err := t.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &TLSConn{Conn: conn.(*tls.Conn), config: t.config}, nil
+}
+
+func (t *TLSListener) Close() error {
+	return t.listener.Close()
+}
+
+func (t *TLSListener) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// TLSConn 记录了监听配置的 TLS 连接，用于从客户端证书派生身份
+type TLSConn struct {
+	*tls.Conn
+	config *TLSConfig
+}
+
+func (c *TLSConn) CertUsername() (string, bool) {
+	return c.identity(c.config.UsernameFrom)
+}
+
+func (c *TLSConn) CertClientID() (string, bool) {
+	return c.identity(c.config.ClientIDFrom)
+}
+
+// identity 从已校验的客户端证书中读取身份
+//
+// param: from 身份来源: cn, san
+// return: 身份，证书未校验或没有对应字段时返回false
+func (c *TLSConn) identity(from string) (string, bool) {
+	if from == "" {
+		return "", false
+	}
+	if err := c.Handshake(); err != nil {
+		return "", false
+	}
+	state := c.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	cert := state.PeerCertificates[0]
+	switch from {
+	case IdentityCN:
+		return cert.Subject.CommonName, cert.Subject.CommonName != ""
+	case IdentitySAN:
+		switch {
+		case len(cert.DNSNames) != 0:
+			return cert.DNSNames[0], true
+		case len(cert.EmailAddresses) != 0:
+			return cert.EmailAddresses[0], true
+		case len(cert.URIs) != 0:
+			return cert.URIs[0].String(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA 测试用的证书签发机构，证书与私钥以 PEM 文件写入临时目录
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// file CA 证书文件
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "icetea test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.file = ca.write("ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) write(name, kind string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// issue 签发证书，返回证书与私钥文件
+func (ca *testCA) issue(name string, usage x509.ExtKeyUsage, subject string, dnsNames ...string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: subject},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.write(name+".crt", "CERTIFICATE", der), ca.write(name+".key", "EC PRIVATE KEY", keyDer)
+}
+
+// dialTLS 以客户端证书连接监听，certFile 为空时不提供证书，返回握手错误
+func dialTLS(t *testing.T, listener *TLSListener, ca *testCA, certFile, keyFile string) <-chan error {
+	config := &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "localhost"}
+	config.RootCAs.AddCert(ca.cert)
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	result := make(chan error, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err == nil {
+			// TLS 1.3 的客户端在服务端校验证书之前就完成握手，读取以等待服务端的结果
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, err = conn.Read(make([]byte, 1)); isTimeout(err) {
+				err = nil
+			}
+			conn.Close()
+		}
+		result <- err
+	}()
+	return result
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// TestTLSClientCertificate 校验客户端证书并从证书派生用户名与客户端ID，要求证书时拒绝没有证书的连接
+func TestTLSClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue("server", x509.ExtKeyUsageServerAuth, "localhost", "localhost")
+	clientCert, clientKey := ca.issue("client", x509.ExtKeyUsageClientAuth, "device-1", "device-1.example.com")
+
+	tests := []struct {
+		name     string
+		require  bool
+		withCert bool
+		username string
+		clientID string
+		refused  bool
+	}{
+		{"client certificate", true, true, "device-1", "device-1.example.com", false},
+		{"no certificate required", true, false, "", "", true},
+		{"optional certificate", false, true, "device-1", "device-1.example.com", false},
+		{"no optional certificate", false, false, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := NewTLSListener("127.0.0.1", 0, &TLSConfig{
+				CertFile:          serverCert,
+				KeyFile:           serverKey,
+				CAFile:            ca.file,
+				RequireClientCert: tt.require,
+				UsernameFrom:      IdentityCN,
+				ClientIDFrom:      IdentitySAN,
+			})
+			if err := listener.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			certFile, keyFile := "", ""
+			if tt.withCert {
+				certFile, keyFile = clientCert, clientKey
+			}
+			dialed := dialTLS(t, listener, ca, certFile, keyFile)
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			identity := conn.(CertIdentity)
+			username, ok := identity.CertUsername()
+			if username != tt.username || ok != (tt.username != "") {
+				t.Fatalf("username = %q, %v, want %q", username, ok, tt.username)
+			}
+			clientID, _ := identity.CertClientID()
+			if clientID != tt.clientID {
+				t.Fatalf("client id = %q, want %q", clientID, tt.clientID)
+			}
+			if err := <-dialed; (err != nil) != tt.refused {
+				t.Fatalf("client handshake error = %v, refused %v", err, tt.refused)
+			}
+		})
+	}
+}
+
+// TestTLSConfigBuild 不支持的 TLS 版本、密码套件与不含证书的 CA 文件使配置失败
+func TestTLSConfigBuild(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue("server", x509.ExtKeyUsageServerAuth, "localhost", "localhost")
+	empty := filepath.Join(t.TempDir(), "empty.crt")
+	os.WriteFile(empty, nil, 0o600)
+
+	tests := []struct {
+		name   string
+		config TLSConfig
+		ok     bool
+	}{
+		{"default", TLSConfig{CertFile: cert, KeyFile: key}, true},
+		{"tls 1.3", TLSConfig{CertFile: cert, KeyFile: key, MinVersion: "1.3"}, true},
+		{"cipher suite", TLSConfig{CertFile: cert, KeyFile: key, CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, true},
+		{"unknown version", TLSConfig{CertFile: cert, KeyFile: key, MinVersion: "2.0"}, false},
+		{"insecure cipher suite", TLSConfig{CertFile: cert, KeyFile: key, CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}, false},
+		{"empty ca file", TLSConfig{CertFile: cert, KeyFile: key, CAFile: empty}, false},
+		{"missing key", TLSConfig{CertFile: cert, KeyFile: key + ".missing"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := tt.config.Build(); (err == nil) != tt.ok {
+			t.Errorf("%s: Build() = %v", tt.name, err)
+		}
+	}
+}
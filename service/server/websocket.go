@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebsocketListener MQTT over WebSocket 监听，在指定的 HTTP 路径上提供 mqtt 子协议。
+// 只接受请求了 mqtt 子协议的连接，浏览器的跨域请求需要 Origin 在允许列表中
+type WebsocketListener struct {
+	addr string
+	path string
+	// allowedOrigins 允许跨域连接的 Origin，* 允许所有来源
+	allowedOrigins []string
+	tls            *TLSConfig
+	server         *http.Server
+	upgrader       websocket.Upgrader
+	conns          chan net.Conn
+	closed         chan struct{}
+	closeOnce      sync.Once
+}
+
+// NewWebsocketListener 创建 WebSocket 监听
+//
+// param: path HTTP 路径，为空时使用 /mqtt
+// param: allowedOrigins 允许跨域连接的 Origin，为空时只允许同源与不带 Origin 的请求
+// param: tlsConfig 不为nil时提供 wss
+func NewWebsocketListener(host string, port int, path string, allowedOrigins []string, tlsConfig *TLSConfig) *WebsocketListener {
+	if path == "" {
+		path = "/mqtt"
+	}
+	w := &WebsocketListener{
+		addr:           net.JoinHostPort(host, strconv.Itoa(port)),
+		path:           path,
+		allowedOrigins: allowedOrigins,
+		tls:            tlsConfig,
+		conns:          make(chan net.Conn),
+		closed:         make(chan struct{}),
+	}
+	w.upgrader = websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+		CheckOrigin:  w.checkOrigin,
+	}
+	return w
+}
+
+// checkOrigin 是否接受请求的来源：不带 Origin 的非浏览器客户端、与 Host 相同的来源以及允许列表中的来源
+func (w *WebsocketListener) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range w.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (w *WebsocketListener) Listen() error {
+	listener, err := net.Listen("tcp", w.addr)
+	if err != nil {
+		return err
+	}
+	if w.tls != nil {
+		tlsConfig, err := w.tls.Build()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(w.path, w.handleUpgrade)
+	w.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go w.server.Serve(listener)
+	return nil
+}
+
+func (w *WebsocketListener) handleUpgrade(rw http.ResponseWriter, r *http.Request) {
+	if !requestsMQTT(r) {
+		http.Error(rw, "websocket: mqtt subprotocol required", http.StatusBadRequest)
+		return
+	}
+	ws, err := w.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case w.conns <- newWebsocketConn(ws):
+	case <-w.closed:
+		ws.Close()
+	}
+}
+
+// requestsMQTT 请求的子协议中是否有 mqtt
+func requestsMQTT(r *http.Request) bool {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == "mqtt" {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WebsocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-w.conns:
+		return conn, nil
+	case <-w.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (w *WebsocketListener) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+	})
+	if w.server == nil {
+		return nil
+	}
+	return w.server.Close()
+}
+
+// websocketConn 将 WebSocket 二进制帧适配为 net.Conn 的字节流
+type websocketConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+	rmux   sync.Mutex
+	wmux   sync.Mutex
+}
+
+func newWebsocketConn(ws *websocket.Conn) *websocketConn {
+	return &websocketConn{ws: ws}
+}
+
+func (c *websocketConn) Read(b []byte) (int, error) {
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				return 0, errors.New(`websocket: mqtt requires binary frames`)
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(b []byte) (int, error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *websocketConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *websocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *websocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *websocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
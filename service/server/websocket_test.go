@@ -0,0 +1,75 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebsocketUpgrade 只接受请求了 mqtt 子协议的连接，跨域请求需要 Origin 在允许列表中
+func TestWebsocketUpgrade(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowedOrigins []string
+		origin         string
+		subprotocols   []string
+		status         int
+	}{
+		{"no origin", nil, "", []string{"mqtt"}, http.StatusSwitchingProtocols},
+		{"same origin", nil, "http://{host}", []string{"mqtt"}, http.StatusSwitchingProtocols},
+		{"cross origin", nil, "https://evil.example.com", []string{"mqtt"}, http.StatusForbidden},
+		{"allowed origin", []string{"https://app.example.com"}, "https://app.example.com", []string{"mqtt"}, http.StatusSwitchingProtocols},
+		{"other origin", []string{"https://app.example.com"}, "https://evil.example.com", []string{"mqtt"}, http.StatusForbidden},
+		{"any origin", []string{"*"}, "https://evil.example.com", []string{"mqtt"}, http.StatusSwitchingProtocols},
+		{"mqtt among subprotocols", nil, "", []string{"mqttv3.1", "mqtt"}, http.StatusSwitchingProtocols},
+		{"no subprotocol", nil, "", nil, http.StatusBadRequest},
+		{"other subprotocol", nil, "", []string{"mqttv3.1"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := NewWebsocketListener("127.0.0.1", 0, "", tt.allowedOrigins, nil)
+			server := httptest.NewServer(http.HandlerFunc(listener.handleUpgrade))
+			defer server.Close()
+			defer listener.Close()
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					conn.Close()
+				}
+			}()
+
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", strings.Replace(tt.origin, "{host}", strings.TrimPrefix(server.URL, "http://"), 1))
+			}
+			dialer := websocket.Dialer{Subprotocols: tt.subprotocols}
+			ws, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), header)
+			if ws != nil {
+				defer ws.Close()
+			}
+			if resp == nil {
+				t.Fatalf("no response: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if ws != nil && ws.Subprotocol() != "mqtt" {
+				t.Fatalf("subprotocol %q, want mqtt", ws.Subprotocol())
+			}
+		})
+	}
+}
+
+// TestWebsocketReadHeaderTimeout HTTP 服务设置了读取请求头的超时，迟迟不发完请求头的连接不会一直占用
+func TestWebsocketReadHeaderTimeout(t *testing.T) {
+	listener := NewWebsocketListener("127.0.0.1", 0, "", nil, nil)
+	if err := listener.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if listener.server.ReadHeaderTimeout != 10*time.Second {
+		t.Fatalf("ReadHeaderTimeout = %v, want 10s", listener.server.ReadHeaderTimeout)
+	}
+}
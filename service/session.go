@@ -0,0 +1,259 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"icetea/client"
+	"icetea/pkg"
+	"icetea/pkg/mqtt5"
+	"icetea/service/subtree"
+	"icetea/service/subtree/proto"
+	"time"
+)
+
+// enqueue 将 QoS > 0 的消息加入离线客户端的会话队列
+//
+// param: clientId 客户端ID
+// param: packet 按授予的qos下发的消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (s *HandlerService) enqueue(clientId string, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	now := time.Now()
+	if properties.Expired(now) {
+		return
+	}
+	body, err := mqtt5.MarshalPublish(packet, properties.ForForward(now))
+	if err != nil {
+		logrus.WithFields(map[string]interface{}{
+			"clientId": clientId,
+			"error":    err,
+		}).Error("encode offline message failed")
+		return
+	}
+	subtree.GetTopicSub().EnqueuePacket(clientId, &proto.Packet{
+		Body:      body,
+		Topic:     packet.TopicName,
+		Timestamp: uint64(now.Unix()),
+	})
+}
+
+// saveInflight 将客户端未确认的出站消息放回会话队列，记录等待 PUBCOMP 的报文ID，重连后重发
+//
+// param: client 断开的客户端
+func (s *HandlerService) saveInflight(client *client.Client) {
+	messages, releases := client.TakeInflight()
+	subtree.GetTopicSub().SaveReleases(client.GetId(), releases)
+	for _, message := range messages {
+		s.enqueue(client.GetId(), message.Packet, message.Properties)
+	}
+}
+
+// resumeSession 向重连的客户端下发离线期间的消息
+//
+// param: client 重连的客户端
+// return: 写入错误
+func (s *HandlerService) resumeSession(client *client.Client) error {
+	topicSub := subtree.GetTopicSub()
+	// 先重发断开前已收到 PUBREC 的消息的 PUBREL，再下发未确认与离线期间的消息
+	if err := client.ResumeReleases(topicSub.TakeReleases(client.GetId())); err != nil {
+		return err
+	}
+	for _, p := range topicSub.DequeuePackets(client.GetId()) {
+		publish, properties, err := mqtt5.UnmarshalPublish(p.Body)
+		if err != nil {
+			logrus.WithFields(map[string]interface{}{
+				"clientId": client.GetId(),
+				"error":    err,
+			}).Error("decode offline message failed")
+			continue
+		}
+		// 入队时 MessageExpiry 已换算为剩余秒数，从入队时间开始计算过期
+		properties.StartExpiry(time.Unix(int64(p.Timestamp), 0))
+		if err = client.Publish(publish, properties); err != nil && !errors.Is(err, pkg.ErrMessageDropped) {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduleSessionExpiry 会话过期后删除断开的客户端的订阅与离线消息，调用方持有 s.mux
+//
+// param: clientId 客户端ID
+// param: expiry 会话保留的秒数
+func (s *HandlerService) scheduleSessionExpiry(clientId string, expiry uint32) {
+	if expiry == client.SessionNeverExpire {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(expiry)*time.Second, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		// 客户端已经重连或重新计时
+		if s.expiring[clientId] != timer {
+			return
+		}
+		delete(s.expiring, clientId)
+		if _, ok := s.clients[clientId]; !ok {
+			subtree.GetTopicSub().DeleteNodeClient(clientId, "")
+			s.cluster.DeleteSession(clientId)
+		}
+	})
+	s.cancelSessionExpiry(clientId)
+	s.expiring[clientId] = timer
+}
+
+// restoreSessionExpiry 从快照恢复的离线会话从断开的时间开始计算过期，已经过期的会话直接删除。
+// 没有记录过期时间的会话（旧版本的快照）与永不过期的会话不处理
+//
+// param: now 恢复的时间
+// return: 删除的过期会话数量
+func (s *HandlerService) restoreSessionExpiry(now time.Time) int {
+	var (
+		topicSub = subtree.GetTopicSub()
+		expired  = 0
+	)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, clientId := range topicSub.ReadClientIDs() {
+		if _, online := s.clients[clientId]; online || topicSub.ReadClientNode(clientId) != "" {
+			continue
+		}
+		expiry, disconnectedAt, ok := topicSub.ReadSessionExpiry(clientId)
+		if !ok || expiry == client.SessionNeverExpire {
+			continue
+		}
+		remaining := disconnectedAt.Add(time.Duration(expiry) * time.Second).Sub(now)
+		if remaining <= 0 {
+			topicSub.DeleteNodeClient(clientId, "")
+			expired++
+			continue
+		}
+		// 不足一秒按一秒计算
+		s.scheduleSessionExpiry(clientId, uint32((remaining+time.Second-1)/time.Second))
+	}
+	return expired
+}
+
+// cancelSessionExpiry 客户端重连时取消会话过期，调用方持有 s.mux
+func (s *HandlerService) cancelSessionExpiry(clientId string) {
+	if timer, ok := s.expiring[clientId]; ok {
+		timer.Stop()
+		delete(s.expiring, clientId)
+	}
+}
+
+// delayedWill 等待延迟发布的遗嘱消息
+type delayedWill struct {
+	timer *time.Timer
+	will  *client.Message
+}
+
+// willDelay 遗嘱消息延迟发布的秒数，会话先于延迟结束时在会话结束时发布
+//
+// param: will 遗嘱消息
+// param: expiry 会话保留的秒数
+func willDelay(will *client.Message, expiry uint32) uint32 {
+	if will.Properties == nil || will.Properties.WillDelayInterval == nil {
+		return 0
+	}
+	if delay := *will.Properties.WillDelayInterval; delay < expiry {
+		return delay
+	}
+	return expiry
+}
+
+// scheduleWill 延迟发布断开的客户端的遗嘱消息，调用方持有 s.mux
+//
+// param: clientId 客户端ID
+// param: will 遗嘱消息
+// param: delay 延迟的秒数
+func (s *HandlerService) scheduleWill(clientId string, will *client.Message, delay uint32) {
+	delayed := &delayedWill{will: will}
+	delayed.timer = time.AfterFunc(time.Duration(delay)*time.Second, func() {
+		s.mux.Lock()
+		// 客户端已经重连
+		if s.wills[clientId] != delayed {
+			s.mux.Unlock()
+			return
+		}
+		delete(s.wills, clientId)
+		s.mux.Unlock()
+		s.publishWill(clientId, will)
+	})
+	s.cancelWill(clientId)
+	s.wills[clientId] = delayed
+}
+
+// cancelWill 客户端重连时取消延迟发布的遗嘱，调用方持有 s.mux
+//
+// return: 被取消的遗嘱消息，没有时为nil
+func (s *HandlerService) cancelWill(clientId string) *client.Message {
+	delayed, ok := s.wills[clientId]
+	if !ok {
+		return nil
+	}
+	delayed.timer.Stop()
+	delete(s.wills, clientId)
+	return delayed.will
+}
+
+// takeWills 客户端重连时取出需要立即发布的遗嘱，调用方持有 s.mux
+//
+// 延迟期内重连不发布遗嘱；被接管的连接的遗嘱没有延迟时立即发布；新连接结束原有会话时都立即发布
+//
+// param: clientId 客户端ID
+// param: old 被接管的连接，没有时为nil
+// param: cleanSession 新连接是否结束原有会话
+// return: 需要立即发布的遗嘱消息
+func (s *HandlerService) takeWills(clientId string, old *client.Client, cleanSession bool) []*client.Message {
+	var wills []*client.Message
+	if will := s.cancelWill(clientId); will != nil && cleanSession {
+		wills = append(wills, will)
+	}
+	if old == nil {
+		return wills
+	}
+	if will := old.TakeWill(); will != nil && (cleanSession || willDelay(will, old.SessionExpiry()) == 0) {
+		wills = append(wills, will)
+	}
+	return wills
+}
+
+// publishWill 以客户端的身份发布遗嘱消息，Will Delay Interval 不是 PUBLISH 的属性，发布前去掉
+//
+// param: clientId 客户端ID
+// param: will 遗嘱消息
+func (s *HandlerService) publishWill(clientId string, will *client.Message) {
+	properties := will.Properties.Copy()
+	if properties != nil {
+		properties.WillDelayInterval = nil
+	}
+	properties.StartExpiry(time.Now())
+	s.PublishAs(clientId, will.Packet, properties)
+}
+
+// sessionExpiry 断开后会话保留的秒数，3.1.1 中 CleanSession 为 false 的会话永不过期
+//
+// param: packet CONNECT 报文
+// param: v5 MQTT 5.0 附加信息，3.1.1 连接为nil
+func sessionExpiry(packet *packets.ConnectPacket, v5 *mqtt5.Packet) uint32 {
+	if v5 != nil {
+		if v5.Properties != nil && v5.Properties.SessionExpiryInterval != nil {
+			return *v5.Properties.SessionExpiryInterval
+		}
+		return 0
+	}
+	if packet.CleanSession {
+		return 0
+	}
+	return client.SessionNeverExpire
+}
+
+// newClientId 为客户端ID为空的 MQTT 5.0 客户端分配ID
+func newClientId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return `icetea-` + hex.EncodeToString(b)
+}
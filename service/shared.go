@@ -0,0 +1,163 @@
+package service
+
+import (
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sirupsen/logrus"
+	"hash/fnv"
+	"icetea/pkg"
+	"icetea/pkg/mqtt5"
+	"icetea/service/subtree"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// ShareStrategy 共享订阅组内选择成员的策略
+type ShareStrategy string
+
+const (
+	// ShareRandom 随机选择成员
+	ShareRandom ShareStrategy = "random"
+	// ShareRoundRobin 按客户端ID顺序轮流选择成员
+	ShareRoundRobin ShareStrategy = "round_robin"
+	// ShareSticky 一直选择同一个成员，直到它离线或退出共享订阅组
+	ShareSticky ShareStrategy = "sticky"
+	// ShareHash 按发布者的客户端ID哈希选择成员，成员不变时同一发布者的消息总是投递给同一个成员。
+	// 服务端发布与其他节点转发的消息没有发布者，改按消息主题哈希
+	ShareHash ShareStrategy = "hash"
+)
+
+// ParseShareStrategy 解析共享订阅策略名称
+func ParseShareStrategy(name string) (ShareStrategy, error) {
+	switch strategy := ShareStrategy(name); strategy {
+	case ShareRandom, ShareRoundRobin, ShareSticky, ShareHash:
+		return strategy, nil
+	default:
+		return "", pkg.ErrUnknownShareStrategy
+	}
+}
+
+// sharedBalancer 为共享订阅组选择接收消息的成员
+type sharedBalancer struct {
+	mux      sync.Mutex
+	strategy ShareStrategy
+	// counters 轮询策略每个共享订阅组的计数
+	counters map[string]uint64
+	// sticky 粘性策略每个共享订阅组当前选择的成员
+	sticky map[string]string
+}
+
+func newSharedBalancer(strategy ShareStrategy) *sharedBalancer {
+	return &sharedBalancer{
+		strategy: strategy,
+		counters: make(map[string]uint64),
+		sticky:   make(map[string]string),
+	}
+}
+
+// pick 从候选成员中选择一个
+//
+// param: group 共享订阅主题
+// param: key 哈希策略使用的键，发布者客户端ID，没有发布者时为消息主题
+// param: candidates 按客户端ID排序的候选成员，不能为空
+// return: 选择的成员下标
+func (b *sharedBalancer) pick(group, key string, candidates []string) int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.strategy {
+	case ShareRoundRobin:
+		n := b.counters[group]
+		b.counters[group] = n + 1
+		return int(n % uint64(len(candidates)))
+	case ShareSticky:
+		if id, ok := b.sticky[group]; ok {
+			if i := sort.SearchStrings(candidates, id); i < len(candidates) && candidates[i] == id {
+				return i
+			}
+		}
+		i := rand.Intn(len(candidates))
+		b.sticky[group] = candidates[i]
+		return i
+	case ShareHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return int(h.Sum32() % uint32(len(candidates)))
+	default:
+		return rand.Intn(len(candidates))
+	}
+}
+
+// SetShareStrategy 设置共享订阅组内选择成员的策略
+func (s *HandlerService) SetShareStrategy(strategy ShareStrategy) {
+	s.shared.mux.Lock()
+	defer s.shared.mux.Unlock()
+	s.shared.strategy = strategy
+	s.shared.counters = make(map[string]uint64)
+	s.shared.sticky = make(map[string]string)
+}
+
+// publishShared 将消息投递给共享订阅组中的一个成员，写入失败时换另一个成员重试，
+// 选中其他节点的成员时转发给该节点，
+// 没有在线成员时 QoS > 0 的消息进入其中一个成员的会话队列，只在查找成员的连接时持有 s.mux 读锁
+//
+// param: publisher 发布者客户端ID，服务端发布与其他节点转发的消息为空
+// param: group 共享订阅组
+// param: packet 消息
+// param: properties MQTT 5.0 属性，可以为nil
+func (s *HandlerService) publishShared(publisher string, group *subtree.SharedGroup, packet *packets.PublishPacket, properties *mqtt5.Properties) {
+	var (
+		candidates = append([]string(nil), group.Clients...)
+		offline    string
+		key        = publisher
+	)
+	if key == "" {
+		key = packet.TopicName
+	}
+	for len(candidates) > 0 {
+		i := s.shared.pick(group.Topic, key, candidates)
+		id := candidates[i]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+
+		newPacket := sharedPacket(packet, group.Members[id])
+		s.mux.RLock()
+		conn, ok := s.clients[id]
+		s.mux.RUnlock()
+		if !ok {
+			// 其他节点的成员由所在节点投递，$SYS 消息只投递给本节点的成员
+			if node := subtree.GetTopicSub().ReadClientNode(id); node != "" {
+				if isSysTopic(packet.TopicName) {
+					continue
+				}
+				s.getCluster().Forward(node, id, newPacket, properties)
+				return
+			}
+			if offline == "" {
+				offline = id
+			}
+			continue
+		}
+		err := conn.Publish(newPacket, properties)
+		if err == nil {
+			return
+		}
+		logrus.WithFields(map[string]interface{}{
+			"clientId": id,
+			"group":    group.Topic,
+			"error":    err,
+		}).Warn("publish to shared subscriber failed, retry another member")
+	}
+	if offline != "" && minQos(packet.Qos, group.Members[offline]) > 0 {
+		s.enqueue(offline, sharedPacket(packet, group.Members[offline]), properties)
+	}
+}
+
+// sharedPacket 按成员订阅的值生成下发的消息
+//
+// param: packet 消息
+// param: options 成员订阅的值
+func sharedPacket(packet *packets.PublishPacket, options int32) *packets.PublishPacket {
+	newPacket := packet.Copy()
+	newPacket.Qos = minQos(packet.Qos, options)
+	newPacket.Retain = packet.Retain && options&subtree.SubRetainAsPublished != 0
+	return newPacket
+}
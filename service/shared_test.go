@@ -0,0 +1,101 @@
+package service
+
+import (
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/client"
+	"icetea/service/subtree"
+	"testing"
+)
+
+// TestShareHashPick 哈希策略按发布者选择成员：同一发布者总是选择同一个成员，不同发布者分散到各个成员
+func TestShareHashPick(t *testing.T) {
+	var (
+		balancer   = newSharedBalancer(ShareHash)
+		candidates = []string{"a", "b", "c", "d"}
+		picked     = make(map[int]struct{})
+	)
+	for i := 0; i < 64; i++ {
+		publisher := fmt.Sprintf("sensor-%d", i)
+		first := balancer.pick("$share/g/sensors/+", publisher, candidates)
+		for j := 0; j < 3; j++ {
+			if got := balancer.pick("$share/g/sensors/+", publisher, candidates); got != first {
+				t.Fatalf("%s: picked %d, then %d", publisher, first, got)
+			}
+		}
+		picked[first] = struct{}{}
+	}
+	if len(picked) != len(candidates) {
+		t.Fatalf("64 publishers picked only %d of %d members", len(picked), len(candidates))
+	}
+}
+
+// TestPublishSharedHash 哈希策略下同一发布者不同主题的消息投递给同一个成员，服务端发布的消息按主题选择成员
+func TestPublishSharedHash(t *testing.T) {
+	const filter = "$share/hash/shared/hash/+"
+	var (
+		handler  = NewHandlerService()
+		topicSub = subtree.GetTopicSub()
+		members  = make(map[string]*testConn)
+	)
+	handler.SetShareStrategy(ShareHash)
+	for _, id := range []string{"hash-a", "hash-b", "hash-c"} {
+		member := dial(t, handler)
+		if code := member.connect(newConnectPacket(id)); code != packets.Accepted {
+			t.Fatalf("connect return code = %#x", code)
+		}
+		defer topicSub.DeleteClient(id)
+		member.subscribe(filter, 0)
+		members[id] = member
+	}
+	candidates := []string{"hash-a", "hash-b", "hash-c"}
+
+	// 同一发布者发布到不同主题
+	want := candidates[newSharedBalancer(ShareHash).pick(filter, "hash-publisher", candidates)]
+	for i := 0; i < 4; i++ {
+		topic := fmt.Sprintf("shared/hash/%d", i)
+		handler.PublishAs("hash-publisher", newPublishPacket(topic, topic, false), nil)
+		if packet := members[want].readPublish(); packet.TopicName != topic {
+			t.Fatalf("%s received %q, want %q", want, packet.TopicName, topic)
+		}
+	}
+
+	// 没有发布者时按主题选择
+	const topic = "shared/hash/server"
+	want = candidates[newSharedBalancer(ShareHash).pick(filter, topic, candidates)]
+	handler.Publish(newPublishPacket(topic, topic, false), nil)
+	if packet := members[want].readPublish(); packet.TopicName != topic {
+		t.Fatalf("%s received %q, want %q", want, packet.TopicName, topic)
+	}
+}
+
+// TestPublishSharedRetryOnDrop 选中的成员出站队列已满、消息被丢弃时改投组内的其他成员
+func TestPublishSharedRetryOnDrop(t *testing.T) {
+	const filter = "$share/retry/shared/retry"
+	var (
+		handler  = NewHandlerService()
+		topicSub = subtree.GetTopicSub()
+	)
+	handler.SetShareStrategy(ShareRoundRobin)
+	// 没有写协程，出站队列中的一条消息一直不会写出
+	full := client.NewClient(newDiscardConn(), handler, client.WithOutboundQueue(1, client.DropNewest))
+	full.SetId("a-full")
+	if err := full.HandleWrite(newPublishPacket("shared/retry", "queued", false)); err != nil {
+		t.Fatal(err)
+	}
+	handler.clients["a-full"] = full
+	topicSub.CreateSub(map[string]int32{filter: 0}, "a-full", nil, "")
+	defer topicSub.DeleteClient("a-full")
+
+	member := dial(t, handler)
+	if code := member.connect(newConnectPacket("b-member")); code != packets.Accepted {
+		t.Fatalf("connect return code = %#x", code)
+	}
+	defer topicSub.DeleteClient("b-member")
+	member.subscribe(filter, 0)
+
+	handler.Publish(newPublishPacket("shared/retry", "retried", false), nil)
+	if packet := member.readPublish(); string(packet.Payload) != "retried" {
+		t.Fatalf("member received %q", packet.Payload)
+	}
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"icetea/pkg"
+	"icetea/service/subtree"
+	"icetea/service/subtree/proto"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultSnapshotPath 订阅快照的默认文件
+	DefaultSnapshotPath = "data/subscriptions.snapshot"
+	// DefaultSnapshotInterval 订阅快照的默认保存间隔
+	DefaultSnapshotInterval = time.Minute
+)
+
+// SnapshotService 启动时从快照恢复订阅，运行期间定时保存，停止时再保存一次
+type SnapshotService struct {
+	handler  *HandlerService
+	path     string
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewSnapshotService 创建订阅快照服务
+//
+// param: handler 报文处理器，用于判断在线客户端的会话是否需要保存
+// param: path 快照文件路径，为空时不保存
+// param: interval 定时保存的间隔，小于等于0时只在停止时保存
+func NewSnapshotService(handler *HandlerService, path string, interval time.Duration) *SnapshotService {
+	return &SnapshotService{
+		handler:  handler,
+		path:     path,
+		interval: interval,
+	}
+}
+
+func (s *SnapshotService) Run(ctx context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+	count, err := subtree.GetTopicSub().Restore(s.path)
+	if errors.Is(err, pkg.ErrSnapshotCorrupt) {
+		// 保留损坏的文件以便排查，以空的订阅状态启动
+		logrus.WithFields(map[string]interface{}{
+			"path":  s.path,
+			"error": err,
+		}).Error("snapshot corrupt, starting without subscriptions")
+		os.Rename(s.path, s.path+".corrupt")
+	} else if err != nil {
+		return err
+	} else {
+		logrus.WithFields(map[string]interface{}{
+			"path":    s.path,
+			"clients": count,
+			"expired": s.handler.restoreSessionExpiry(time.Now()),
+		}).Info("subscriptions restored")
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		var tick <-chan time.Time
+		if s.interval > 0 {
+			ticker := time.NewTicker(s.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				s.save()
+				return
+			case <-tick:
+				s.save()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop 停止定时保存并等待最后一次保存完成
+func (s *SnapshotService) Stop() error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *SnapshotService) Name() string {
+	return `snapshot`
+}
+
+// save 保存一次快照，只保存本节点的持久会话：其他节点的客户端由所在节点同步，
+// 在线且会话过期时间为0的客户端断开时就会删除会话。
+// 在线的持久会话记录为在保存时断开，进程异常退出后从快照恢复时从这一刻开始计算过期
+func (s *SnapshotService) save() {
+	var (
+		topicSub = subtree.GetTopicSub()
+		online   = s.handler.onlineSessions()
+		now      = time.Now()
+	)
+	for id, expiry := range online {
+		if expiry > 0 {
+			topicSub.SaveSessionExpiry(id, expiry, now)
+		}
+	}
+	count, err := topicSub.Snapshot(s.path, func(client *proto.Client) bool {
+		expiry, ok := online[client.ID]
+		return client.NodeIP == "" && (!ok || expiry > 0)
+	})
+	if err != nil {
+		logrus.WithFields(map[string]interface{}{
+			"path":  s.path,
+			"error": err,
+		}).Error("save snapshot failed")
+		return
+	}
+	logrus.WithFields(map[string]interface{}{
+		"path":    s.path,
+		"clients": count,
+	}).Debug("snapshot saved")
+}
+
+// onlineSessions 在线客户端的会话过期时间，为0的会话在断开时就会删除
+func (s *HandlerService) onlineSessions() map[string]uint32 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	result := make(map[string]uint32, len(s.clients))
+	for id, c := range s.clients {
+		result[id] = c.SessionExpiry()
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"icetea/client"
+	"icetea/service/subtree"
+	"icetea/service/subtree/proto"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSnapshotSessionExpiry 从快照恢复的会话从断开的时间开始计算过期，已经过期的会话直接删除
+func TestSnapshotSessionExpiry(t *testing.T) {
+	var (
+		handler  = NewHandlerService()
+		topicSub = subtree.GetTopicSub()
+		path     = filepath.Join(t.TempDir(), "subscriptions.snapshot")
+		now      = time.Now()
+		sessions = map[string]struct {
+			expiry         uint32
+			disconnectedAt time.Time
+		}{
+			"snapshot-expired":  {60, now.Add(-2 * time.Minute)},
+			"snapshot-expiring": {61, now.Add(-time.Minute)},
+			"snapshot-kept":     {3600, now},
+			"snapshot-never":    {client.SessionNeverExpire, now.Add(-24 * time.Hour)},
+		}
+	)
+	for id, session := range sessions {
+		topicSub.CreateSub(map[string]int32{"snapshot/expiry": 1}, id, nil, "")
+		topicSub.SaveSessionExpiry(id, session.expiry, session.disconnectedAt)
+		defer topicSub.DeleteClient(id)
+	}
+	if _, err := topicSub.Snapshot(path, func(client *proto.Client) bool {
+		_, ok := sessions[client.ID]
+		return ok
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟重启：清空会话后从快照恢复
+	for id := range sessions {
+		topicSub.DeleteClient(id)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshot := NewSnapshotService(handler, path, 0)
+	if err := snapshot.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Stop()
+
+	if _, ok := topicSub.ReadClientInfo("snapshot-expired"); ok {
+		t.Fatal("expired session restored")
+	}
+	for _, id := range []string{"snapshot-expiring", "snapshot-kept", "snapshot-never"} {
+		if _, ok := topicSub.ReadClientInfo(id); !ok {
+			t.Fatalf("session %s not restored", id)
+		}
+	}
+	// 剩余约一秒的会话到期后删除
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, ok := topicSub.ReadClientInfo("snapshot-expiring"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("restored session did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := topicSub.ReadClientInfo("snapshot-kept"); !ok {
+		t.Fatal("session with remaining expiry deleted")
+	}
+}
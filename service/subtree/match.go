@@ -0,0 +1,124 @@
+package subtree
+
+import (
+	"strings"
+)
+
+// 通配符订阅保存在订阅树中，每个节点对应主题过滤器的一个层级，
+// 节点的 clients 为以该层级结尾的过滤器的订阅者。匹配规则见 MQTT 3.1.1 4.7
+
+// treeNode 订阅树的节点
+type treeNode struct {
+	// section 主题过滤器的一个层级
+	section string
+	// topic 到该层级为止的完整主题过滤器
+	topic string
+	// clients 订阅者的客户端ID到授予的qos
+	clients map[string]int32
+	// groups 共享订阅树中以该层级结尾的过滤器的共享订阅组，key 为完整的共享订阅主题
+	groups   map[string]*SharedGroup
+	children map[string]*treeNode
+}
+
+func newTreeNode(section, topic string) *treeNode {
+	return &treeNode{
+		section:  section,
+		topic:    topic,
+		clients:  make(map[string]int32),
+		children: make(map[string]*treeNode),
+	}
+}
+
+// createWildcardTopic 为客户端增加一条包含通配符的主题, 比如： a/+/b or a/#
+//
+// param: topic 包含通配符的主题
+// param: qos 授予的qos
+// param: clientID 客户端ID
+func (t *TopicSub) createWildcardTopic(topic string, qos int32, clientID string) {
+	t.treeMu.Lock()
+	defer t.treeMu.Unlock()
+	path := t.tree.walk(splitTopic(topic), true)
+	path[len(path)-1].clients[clientID] = qos
+}
+
+// deleteWildcardSubTopic 从订阅树中删除客户端的一条通配符订阅，并删除不再有订阅者的节点
+//
+// param: topic 包含通配符的主题
+// param: clientID 客户端ID
+func (t *TopicSub) deleteWildcardSubTopic(topic, clientID string) {
+	t.treeMu.Lock()
+	defer t.treeMu.Unlock()
+	path := t.tree.walk(splitTopic(topic), false)
+	if path == nil {
+		return
+	}
+	delete(path[len(path)-1].clients, clientID)
+	prune(path)
+}
+
+// walk 沿主题过滤器的层级从 n 向下查找节点
+//
+// param: topicSlice 主题过滤器的全部层级
+// param: create 是否创建不存在的节点
+// return: 从 n 到过滤器最后一层的节点，节点不存在且不创建时为nil
+func (n *treeNode) walk(topicSlice []string, create bool) []*treeNode {
+	path := make([]*treeNode, 0, len(topicSlice)+1)
+	path = append(path, n)
+	for level, section := range topicSlice {
+		parent := path[len(path)-1]
+		child, ok := parent.children[section]
+		if !ok {
+			if !create {
+				return nil
+			}
+			child = newTreeNode(section, strings.Join(topicSlice[:level+1], "/"))
+			parent.children[section] = child
+		}
+		path = append(path, child)
+	}
+	return path
+}
+
+// prune 从 walk 返回的路径末端向上删除不再有订阅者、共享订阅组与子节点的节点
+func prune(path []*treeNode) {
+	for level := len(path) - 1; level > 0; level-- {
+		node := path[level]
+		if len(node.clients) > 0 || len(node.groups) > 0 || len(node.children) > 0 {
+			return
+		}
+		delete(path[level-1].children, node.section)
+	}
+}
+
+// matchTreeNode 在 parent 的子树中查找与主题第 level 层及之后的层级匹配的节点
+//
+// param: parent 已经匹配了前 level 层的节点
+// param: topicSlice 主题的全部层级
+// param: level 待匹配的层级
+// param: sys 主题是否以 $ 开头，此时第一层不匹配通配符
+// param: visit 匹配节点的回调
+func matchTreeNode(parent *treeNode, topicSlice []string, level int, sys bool, visit func(*treeNode)) {
+	wildcard := level > 0 || !sys
+	if wildcard {
+		// # 匹配剩余的所有层级，也匹配父层级本身
+		if node, ok := parent.children["#"]; ok {
+			visit(node)
+		}
+	}
+	if level == len(topicSlice) {
+		visit(parent)
+		return
+	}
+	if wildcard {
+		if node, ok := parent.children["+"]; ok {
+			matchTreeNode(node, topicSlice, level+1, sys, visit)
+		}
+	}
+	section := topicSlice[level]
+	if section == "+" || section == "#" {
+		return
+	}
+	if node, ok := parent.children[section]; ok {
+		matchTreeNode(node, topicSlice, level+1, sys, visit)
+	}
+}
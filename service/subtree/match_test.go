@@ -0,0 +1,369 @@
+package subtree
+
+import (
+	"fmt"
+	"icetea/service/subtree/proto"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// matchCases MQTT 3.1.1 4.7 的主题匹配规则，包括规范中的示例
+var matchCases = []struct {
+	filter string
+	topic  string
+	match  bool
+}{
+	// 4.7.1.2 多层通配符
+	{"sport/tennis/player1/#", "sport/tennis/player1", true},
+	{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+	{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+	{"sport/tennis/player1/#", "sport/tennis/player2", false},
+	{"sport/#", "sport", true},
+	{"sport/#", "sports", false},
+	{"sport/#", "sport/", true},
+	{"#", "sport", true},
+	{"#", "sport/tennis", true},
+	{"#", "/", true},
+	{"#", "/sport", true},
+
+	// 4.7.1.3 单层通配符
+	{"sport/tennis/+", "sport/tennis/player1", true},
+	{"sport/tennis/+", "sport/tennis/player2", true},
+	{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+	{"sport/+", "sport", false},
+	{"sport/+", "sport/", true},
+	{"+", "sport", true},
+	{"+", "/sport", false},
+	{"+/+", "/finance", true},
+	{"/+", "/finance", true},
+	{"+", "/finance", false},
+	{"+/tennis/#", "sport/tennis/player1", true},
+	{"+/tennis/#", "sport/tennis", true},
+	{"+/tennis/#", "sport/football", false},
+	{"sport/+/player1", "sport/tennis/player1", true},
+	{"sport/+/player1", "sport//player1", true},
+	{"+/+/+", "a/b", false},
+
+	// 4.7.2 以 $ 开头的主题
+	{"#", "$SYS/broker/clients", false},
+	{"+/monitor/Clients", "$SYS/monitor/Clients", false},
+	{"$SYS/#", "$SYS/monitor/Clients", true},
+	{"$SYS/monitor/+", "$SYS/monitor/Clients", true},
+	{"$SYS/#", "$SYS", true},
+	{"+", "$SYS", false},
+	{"a/#", "a/$SYS", true},
+	{"a/+", "a/$SYS", true},
+
+	// 4.7.3 空的层级是有意义的
+	{"a/b", "a/b", true},
+	{"a/b", "a//b", false},
+	{"a//b", "a//b", true},
+	{"a/+/b", "a//b", true},
+	{"a/+/b", "a/b", false},
+	{"a/b", "/a/b", false},
+	{"/a/b", "/a/b", true},
+	{"a/b/", "a/b", false},
+	{"a/b/", "a/b/", true},
+	{"a/b/+", "a/b/", true},
+	{"+/a", "/a", true},
+	{"/#", "/", true},
+	{"/#", "a", false},
+
+	// 主题与过滤器区分大小写
+	{"ACCOUNTS", "Accounts", false},
+	{"Accounts/+", "Accounts/a", true},
+	{"Accounts payable", "Accounts payable", true},
+}
+
+func TestTopicMatch(t *testing.T) {
+	for _, c := range matchCases {
+		if got := TopicMatch(c.filter, c.topic); got != c.match {
+			t.Errorf("TopicMatch(%q, %q) = %v, want %v", c.filter, c.topic, got, c.match)
+		}
+	}
+}
+
+// TestReadSubscribers 订阅树与哈希表的匹配结果与 TopicMatch 一致
+func TestReadSubscribers(t *testing.T) {
+	for _, c := range matchCases {
+		topicSub := newTopicSub()
+		if err := topicSub.CreateSub(map[string]int32{c.filter: 1}, "c1", nil, ""); err != nil {
+			t.Fatal(err)
+		}
+		subscribers, _ := topicSub.ReadSubscribers(c.topic, "", 0)
+		if got := len(subscribers) == 1; got != c.match {
+			t.Errorf("filter %q topic %q: matched %d clients, want match %v", c.filter, c.topic, len(subscribers), c.match)
+		}
+		if qos := topicSub.ReadSubClientsQos(c.topic); c.match && qos["c1"] != 1 {
+			t.Errorf("filter %q topic %q: qos %v, want 1", c.filter, c.topic, qos)
+		}
+	}
+}
+
+// TestReadSubscribersAll 所有过滤器同时订阅时，每个主题匹配到的客户端与逐个 TopicMatch 的结果一致
+func TestReadSubscribersAll(t *testing.T) {
+	topicSub := newTopicSub()
+	filters := make(map[string]string)
+	for i, c := range matchCases {
+		id, ok := filters[c.filter]
+		if !ok {
+			id = fmt.Sprintf("c%d", i)
+			filters[c.filter] = id
+		}
+		if err := topicSub.CreateSub(map[string]int32{c.filter: 0}, id, nil, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range matchCases {
+		var want []string
+		for filter, id := range filters {
+			if TopicMatch(filter, c.topic) {
+				want = append(want, id)
+			}
+		}
+		subscribers, _ := topicSub.ReadSubscribers(c.topic, "", 0)
+		var got []string
+		for _, subscriber := range subscribers {
+			got = append(got, subscriber.ClientID)
+		}
+		sort.Strings(want)
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("topic %q: got %v, want %v", c.topic, got, want)
+		}
+	}
+}
+
+// TestReadSubscribersDuplicate 客户端的多个订阅匹配同一主题时只返回一次
+func TestReadSubscribersDuplicate(t *testing.T) {
+	topicSub := newTopicSub()
+	topics := map[string]int32{"a/b": 0, "a/+": 1, "a/#": 2, "#": 0}
+	if err := topicSub.CreateSub(topics, "c1", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if subscribers, total := topicSub.ReadSubscribers("a/b", "", 0); len(subscribers) != 1 || total != 1 {
+		t.Fatalf("got %d clients, total %d, want 1", len(subscribers), total)
+	}
+	if qos := topicSub.ReadSubClientsQos("a/b")["c1"]; qos != 2 {
+		t.Fatalf("got qos %d, want 2", qos)
+	}
+}
+
+// TestDeleteWildcardSub 删除订阅后不再匹配，且不再有订阅者的节点被删除
+func TestDeleteWildcardSub(t *testing.T) {
+	topicSub := newTopicSub()
+	if err := topicSub.CreateSub(map[string]int32{"a/+/c/#": 0, "a/+": 0}, "c1", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := topicSub.CreateSub(map[string]int32{"a//c/#": 0}, "c2", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := topicSub.DeleteSub(map[string]int32{"a/+/c/#": 0}, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if subscribers, _ := topicSub.ReadSubscribers("a/b/c", "", 0); len(subscribers) != 0 {
+		t.Fatalf("got %d clients after delete, want 0", len(subscribers))
+	}
+	if subscribers, _ := topicSub.ReadSubscribers("a//c/d", "", 0); len(subscribers) != 1 || subscribers[0].ClientID != "c2" {
+		t.Fatalf("got %v, want c2", subscribers)
+	}
+	a := topicSub.tree.children["a"]
+	if _, ok := a.children["+"].children["c"]; ok {
+		t.Fatal("empty node a/+/c not removed")
+	}
+	if err := topicSub.DeleteClient("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := topicSub.DeleteClient("c2"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(topicSub.tree.children); n != 0 {
+		t.Fatalf("tree has %d children after all clients deleted, want 0", n)
+	}
+}
+
+// TestTreeNodeTopic 节点保存到该层级为止的完整过滤器，空的层级不被丢弃
+func TestTreeNodeTopic(t *testing.T) {
+	topicSub := newTopicSub()
+	if err := topicSub.CreateSub(map[string]int32{"/a//+": 0}, "c1", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	node := topicSub.tree
+	for _, want := range []string{"", "/a", "/a/", "/a//+"} {
+		var ok bool
+		section := want[strings.LastIndexByte(want, '/')+1:]
+		if node, ok = node.children[section]; !ok {
+			t.Fatalf("node %q not found", want)
+		}
+		if node.topic != want {
+			t.Fatalf("node topic %q, want %q", node.topic, want)
+		}
+	}
+	if _, ok := node.clients["c1"]; !ok {
+		t.Fatal("client not stored on leaf node")
+	}
+}
+
+// benchFilters 生成 n 个通配符过滤器，形如 device/<i>/+/status、device/<i>/#、+/<i>/telemetry
+func benchFilters(n int) []string {
+	filters := make([]string, 0, n)
+	for i := 0; len(filters) < n; i++ {
+		switch i % 3 {
+		case 0:
+			filters = append(filters, fmt.Sprintf("device/%d/+/status", i))
+		case 1:
+			filters = append(filters, fmt.Sprintf("device/%d/#", i))
+		default:
+			filters = append(filters, fmt.Sprintf("+/%d/telemetry", i))
+		}
+	}
+	return filters
+}
+
+func benchTopics(n int) []string {
+	topics := make([]string, 0, 1024)
+	for i := 0; i < 1024; i++ {
+		topics = append(topics, fmt.Sprintf("device/%d/sensor/status", i*7%n))
+	}
+	return topics
+}
+
+func BenchmarkReadWildcardSubClients(b *testing.B) {
+	for _, n := range []int{100, 10000, 100000} {
+		filters, topics := benchFilters(n), benchTopics(n)
+		b.Run(fmt.Sprintf("filters=%d/trie", n), func(b *testing.B) {
+			topicSub := newTopicSub()
+			for i, filter := range filters {
+				topicSub.createWildcardTopic(filter, 0, fmt.Sprintf("c%d", i))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				topicSub.ForEachSubscriber(topics[i%len(topics)], func(string, int32) bool { return true })
+			}
+		})
+		b.Run(fmt.Sprintf("filters=%d/legacy", n), func(b *testing.B) {
+			tree := newLegacyTreeNode("/", "/")
+			for i, filter := range filters {
+				legacyCreateWildcardTopic(tree, filter, newClient(fmt.Sprintf("c%d", i)))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				legacyReadWildcardSubClients(tree, topics[i%len(topics)])
+			}
+		})
+	}
+}
+
+func BenchmarkTopicMatch(b *testing.B) {
+	b.Run("current", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c := matchCases[i%len(matchCases)]
+			TopicMatch(c.filter, c.topic)
+		}
+	})
+	b.Run("legacy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			c := matchCases[i%len(matchCases)]
+			legacyTopicMatch(c.filter, c.topic)
+		}
+	})
+}
+
+// 以下为原来的实现，仅用于基准测试的对比
+
+func legacySplitTopic(topic string) []string {
+	tmp := strings.Split(strings.Trim(topic, "/"), "/")
+	for _, v := range tmp {
+		if v == "" {
+			result := make([]string, 0)
+			for _, v := range tmp {
+				if v != "" {
+					result = append(result, v)
+				}
+			}
+			return result
+		}
+	}
+	return tmp
+}
+
+func legacyTopicMatch(filter, topic string) bool {
+	var (
+		filterSlice = legacySplitTopic(filter)
+		topicSlice  = legacySplitTopic(topic)
+	)
+	for i, section := range filterSlice {
+		if section == "#" {
+			return true
+		}
+		if i >= len(topicSlice) {
+			return false
+		}
+		if section != "+" && section != topicSlice[i] {
+			return false
+		}
+	}
+	return len(filterSlice) == len(topicSlice)
+}
+
+func newLegacyTreeNode(topicSection, topic string) *proto.TreeNode {
+	return &proto.TreeNode{
+		TopicSection: topicSection,
+		Topic:        topic,
+		Clients:      make(map[string]*proto.Client),
+		ChildNode:    make(map[string]*proto.TreeNode),
+	}
+}
+
+func legacyCreateWildcardTopic(tree *proto.TreeNode, topic string, client *proto.Client) {
+	topicSlice := legacySplitTopic(topic)
+	parent := tree
+	childTopic := ""
+	for level := 0; level < len(topicSlice); level++ {
+		section := topicSlice[level]
+		childTopic += "/" + section
+		childNode, ok := parent.ChildNode[section]
+		if !ok {
+			childNode = newLegacyTreeNode(section, childTopic)
+			parent.ChildNode[section] = childNode
+		}
+		parent = childNode
+	}
+	parent.Clients[client.ID] = client
+}
+
+func legacyReadWildcardSubClients(tree *proto.TreeNode, topic string) (clients []*proto.Client) {
+	clients = make([]*proto.Client, 0)
+	topicSlice := legacySplitTopic(topic)
+	topicLevel := len(topicSlice)
+	nextParents := []*proto.TreeNode{tree}
+	for level := 0; level < len(topicSlice); level++ {
+		parents := nextParents
+		nextParents = make([]*proto.TreeNode, 0)
+		for _, parent := range parents {
+			if tmp, ok := parent.ChildNode[topicSlice[level]]; ok && tmp.TopicSection == topicSlice[level] {
+				nextParents = append(nextParents, tmp)
+				if level == topicLevel-1 {
+					for _, v := range tmp.Clients {
+						clients = append(clients, v)
+					}
+				}
+			}
+			if tmp, ok := parent.ChildNode["+"]; ok {
+				nextParents = append(nextParents, tmp)
+				if level == topicLevel-1 {
+					for _, v := range tmp.Clients {
+						clients = append(clients, v)
+					}
+				}
+			}
+			if tmp, ok := parent.ChildNode["#"]; ok {
+				for _, v := range tmp.Clients {
+					clients = append(clients, v)
+				}
+			}
+		}
+	}
+	return clients
+}
@@ -0,0 +1,71 @@
+package subtree
+
+import (
+	"icetea/service/subtree/proto"
+)
+
+// DefaultMaxQueueLength 离线客户端消息队列的默认最大长度
+const DefaultMaxQueueLength = 1000
+
+// SetMaxQueueLength 设置离线客户端消息队列的最大长度，超出时丢弃最早的消息
+//
+// param: length 最大长度，小于等于0表示不限制
+func (t *TopicSub) SetMaxQueueLength(length int32) {
+	t.maxQueueLength.Store(length)
+}
+
+// EnqueuePacket 将消息加入离线客户端的消息队列
+//
+// param: clientID 客户端ID
+// param: packet 消息
+// return: 客户端是否存在
+func (t *TopicSub) EnqueuePacket(clientID string, packet *proto.Packet) bool {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	client, ok := shard.clients[clientID]
+	if !ok {
+		return false
+	}
+	if client.Queue == nil {
+		client.Queue = new(proto.Queue)
+	}
+	queue := client.Queue
+	packet.Next = nil
+	if queue.Last == nil {
+		queue.First = packet
+	} else {
+		queue.Last.Next = packet
+	}
+	queue.Last = packet
+	queue.Length++
+	// 队列已满时丢弃最早的消息
+	maxQueueLength := t.maxQueueLength.Load()
+	for maxQueueLength > 0 && queue.Length > maxQueueLength {
+		queue.First = queue.First.Next
+		queue.Length--
+	}
+	return true
+}
+
+// DequeuePackets 取出并清空客户端消息队列中的全部消息
+//
+// param: clientID 客户端ID
+// return: 按入队顺序排列的消息
+func (t *TopicSub) DequeuePackets(clientID string) []*proto.Packet {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	client, ok := shard.clients[clientID]
+	if !ok || client.Queue == nil {
+		return nil
+	}
+	result := make([]*proto.Packet, 0, client.Queue.Length)
+	for p := client.Queue.First; p != nil; p = p.Next {
+		result = append(result, p)
+	}
+	client.Queue.First = nil
+	client.Queue.Last = nil
+	client.Queue.Length = 0
+	return result
+}
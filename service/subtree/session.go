@@ -0,0 +1,101 @@
+package subtree
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 断开的持久会话需要在重连或重启后继续的状态记录在客户端的 Meta 中，随快照保存
+const (
+	// metaReleases 已收到 PUBREC、等待 PUBCOMP 的出站报文ID，以逗号分隔
+	metaReleases = "releases"
+	// metaSessionExpiry 会话保留的秒数，断开的时间记录在 AliveTime
+	metaSessionExpiry = "sessionExpiry"
+)
+
+// SaveSessionExpiry 记录客户端断开的时间与会话保留的秒数，从快照恢复时据此计算会话剩余的时间
+//
+// param: clientID 客户端ID
+// param: expiry 会话保留的秒数
+// param: disconnectedAt 断开的时间
+// return: 客户端是否存在
+func (t *TopicSub) SaveSessionExpiry(clientID string, expiry uint32, disconnectedAt time.Time) bool {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	client, ok := shard.clients[clientID]
+	if !ok {
+		return false
+	}
+	client.Meta[metaSessionExpiry] = strconv.FormatUint(uint64(expiry), 10)
+	client.AliveTime = disconnectedAt.Unix()
+	return true
+}
+
+// ReadSessionExpiry 客户端断开的时间与会话保留的秒数
+//
+// param: clientID 客户端ID
+// return: 会话保留的秒数，断开的时间，是否记录过
+func (t *TopicSub) ReadSessionExpiry(clientID string) (uint32, time.Time, bool) {
+	shard := t.clientShard(clientID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	client, ok := shard.clients[clientID]
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	expiry, err := strconv.ParseUint(client.Meta[metaSessionExpiry], 10, 32)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return uint32(expiry), time.Unix(client.AliveTime, 0), true
+}
+
+// SaveReleases 记录客户端断开时已收到 PUBREC、等待 PUBCOMP 的出站报文ID，重连后重发 PUBREL
+//
+// param: clientID 客户端ID
+// param: ids 报文ID，为空时删除记录
+// return: 客户端是否存在
+func (t *TopicSub) SaveReleases(clientID string, ids []uint16) bool {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	client, ok := shard.clients[clientID]
+	if !ok {
+		return false
+	}
+	if len(ids) == 0 {
+		delete(client.Meta, metaReleases)
+		return true
+	}
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = strconv.Itoa(int(id))
+	}
+	client.Meta[metaReleases] = strings.Join(values, ",")
+	return true
+}
+
+// TakeReleases 取出并清空客户端等待 PUBCOMP 的出站报文ID
+//
+// param: clientID 客户端ID
+// return: 按断开前的下发顺序排列的报文ID
+func (t *TopicSub) TakeReleases(clientID string) []uint16 {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	client, ok := shard.clients[clientID]
+	if !ok || client.Meta[metaReleases] == "" {
+		return nil
+	}
+	values := strings.Split(client.Meta[metaReleases], ",")
+	delete(client.Meta, metaReleases)
+	ids := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if id, err := strconv.ParseUint(value, 10, 16); err == nil && id != 0 {
+			ids = append(ids, uint16(id))
+		}
+	}
+	return ids
+}
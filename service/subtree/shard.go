@@ -0,0 +1,74 @@
+package subtree
+
+import (
+	"icetea/service/subtree/proto"
+	"sync"
+)
+
+// shardCount 客户端与不含通配符的订阅的分片数
+const shardCount = 64
+
+// clientShard 一部分客户端，客户端的订阅、元数据与离线消息都由分片的锁保护
+type clientShard struct {
+	mu      sync.RWMutex
+	clients map[string]*proto.Client
+}
+
+// hashShard 一部分不含通配符的订阅，主题到订阅的客户端ID与授予的qos
+type hashShard struct {
+	mu     sync.RWMutex
+	topics map[string]map[string]int32
+}
+
+// shardIndex FNV-1a 散列，不分配内存
+func shardIndex(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % shardCount
+}
+
+// clientShard 客户端所在的分片
+func (t *TopicSub) clientShard(clientID string) *clientShard {
+	return &t.clients[shardIndex(clientID)]
+}
+
+// hashShard 主题所在的分片
+func (t *TopicSub) hashShard(topic string) *hashShard {
+	return &t.hash[shardIndex(topic)]
+}
+
+// createSimpleTopic 为客户端增加一个不含通配符的主题订阅
+//
+// param: topic 不含通配符的主题
+// param: qos 授予的qos
+// param: clientID 客户端ID
+func (t *TopicSub) createSimpleTopic(topic string, qos int32, clientID string) {
+	shard := t.hashShard(topic)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	clients, ok := shard.topics[topic]
+	if !ok {
+		clients = make(map[string]int32)
+		shard.topics[topic] = clients
+	}
+	clients[clientID] = qos
+}
+
+// deleteSimpleSubTopic 删除客户端不包含通配符的主题订阅
+//
+// param: topic 主题
+// param: clientID 客户端ID
+func (t *TopicSub) deleteSimpleSubTopic(topic, clientID string) {
+	shard := t.hashShard(topic)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if clients, ok := shard.topics[topic]; ok {
+		delete(clients, clientID)
+		if len(clients) == 0 {
+			delete(shard.topics, topic)
+		}
+	}
+}
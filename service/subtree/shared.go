@@ -0,0 +1,172 @@
+package subtree
+
+import (
+	"sort"
+	"strings"
+)
+
+// SharedPrefix 共享订阅的前缀，格式为 $share/<group>/<filter>
+const SharedPrefix = "$share/"
+
+// SharedGroup 共享订阅组，组内每条消息只投递给其中一个成员
+type SharedGroup struct {
+	// Topic 完整的共享订阅主题 $share/<group>/<filter>
+	Topic  string
+	Group  string
+	Filter string
+	// Members 成员客户端ID到订阅的值。成员变化时替换为新的映射，已经读取的映射不会再被修改
+	Members map[string]int32
+	// Clients 按客户端ID排序的成员，与 Members 一起替换
+	Clients []string
+}
+
+// ParseShared 解析共享订阅主题
+//
+// param: topic 订阅的主题
+// return: 组名，主题过滤器，是否为合法的共享订阅
+func ParseShared(topic string) (group, filter string, ok bool) {
+	if !strings.HasPrefix(topic, SharedPrefix) {
+		return "", "", false
+	}
+	rest := topic[len(SharedPrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	group, filter = rest[:i], rest[i+1:]
+	if strings.ContainsAny(group, "+#") {
+		return "", "", false
+	}
+	return group, filter, true
+}
+
+// IsShared 主题是否以 $share/ 开头，不校验格式
+func IsShared(topic string) bool {
+	return strings.HasPrefix(topic, SharedPrefix)
+}
+
+// ReadSharedSubs 与topic匹配的所有共享订阅组。
+// 共享订阅组按过滤器索引在哈希表与共享订阅树中，只查找匹配的组，不复制成员
+//
+// param: topic 发布的主题
+// return: 共享订阅组的浅拷贝，成员不能修改
+func (t *TopicSub) ReadSharedSubs(topic string) []*SharedGroup {
+	t.sharedMu.RLock()
+	defer t.sharedMu.RUnlock()
+	var result []*SharedGroup
+	add := func(groups map[string]*SharedGroup) {
+		for _, group := range groups {
+			g := *group
+			result = append(result, &g)
+		}
+	}
+	add(t.sharedHash[topic])
+	matchTreeNode(t.sharedTree, splitTopic(topic), 0, strings.HasPrefix(topic, "$"), func(node *treeNode) {
+		add(node.groups)
+	})
+	return result
+}
+
+// createSharedTopic 客户端加入共享订阅组，新建的组加入过滤器索引
+//
+// param: topic 共享订阅主题
+// param: qos 订阅的值
+// param: clientID 客户端ID
+func (t *TopicSub) createSharedTopic(topic string, qos int32, clientID string) {
+	t.sharedMu.Lock()
+	defer t.sharedMu.Unlock()
+	group, ok := t.shared[topic]
+	if !ok {
+		name, filter, _ := ParseShared(topic)
+		group = &SharedGroup{
+			Topic:  topic,
+			Group:  name,
+			Filter: filter,
+		}
+		t.shared[topic] = group
+		t.indexSharedGroup(group)
+	}
+	members := make(map[string]int32, len(group.Members)+1)
+	for id, q := range group.Members {
+		members[id] = q
+	}
+	members[clientID] = qos
+	if _, ok = group.Members[clientID]; !ok {
+		i := sort.SearchStrings(group.Clients, clientID)
+		clients := make([]string, 0, len(group.Clients)+1)
+		clients = append(clients, group.Clients[:i]...)
+		clients = append(clients, clientID)
+		group.Clients = append(clients, group.Clients[i:]...)
+	}
+	group.Members = members
+}
+
+// deleteSharedTopic 客户端退出共享订阅组，组内没有成员时删除该组
+//
+// param: topic 共享订阅主题
+// param: clientID 客户端ID
+func (t *TopicSub) deleteSharedTopic(topic, clientID string) {
+	t.sharedMu.Lock()
+	defer t.sharedMu.Unlock()
+	group, ok := t.shared[topic]
+	if !ok {
+		return
+	}
+	if _, ok = group.Members[clientID]; !ok {
+		return
+	}
+	if len(group.Members) == 1 {
+		delete(t.shared, topic)
+		t.unindexSharedGroup(group)
+		return
+	}
+	members := make(map[string]int32, len(group.Members)-1)
+	for id, q := range group.Members {
+		if id != clientID {
+			members[id] = q
+		}
+	}
+	i := sort.SearchStrings(group.Clients, clientID)
+	clients := make([]string, 0, len(group.Clients)-1)
+	clients = append(clients, group.Clients[:i]...)
+	group.Clients = append(clients, group.Clients[i+1:]...)
+	group.Members = members
+}
+
+// indexSharedGroup 按过滤器索引共享订阅组，调用方持有 sharedMu
+func (t *TopicSub) indexSharedGroup(group *SharedGroup) {
+	if !HasWildcard(group.Filter) {
+		groups, ok := t.sharedHash[group.Filter]
+		if !ok {
+			groups = make(map[string]*SharedGroup)
+			t.sharedHash[group.Filter] = groups
+		}
+		groups[group.Topic] = group
+		return
+	}
+	path := t.sharedTree.walk(splitTopic(group.Filter), true)
+	node := path[len(path)-1]
+	if node.groups == nil {
+		node.groups = make(map[string]*SharedGroup)
+	}
+	node.groups[group.Topic] = group
+}
+
+// unindexSharedGroup 从过滤器索引中删除共享订阅组，调用方持有 sharedMu
+func (t *TopicSub) unindexSharedGroup(group *SharedGroup) {
+	if !HasWildcard(group.Filter) {
+		if groups, ok := t.sharedHash[group.Filter]; ok {
+			delete(groups, group.Topic)
+			if len(groups) == 0 {
+				delete(t.sharedHash, group.Filter)
+			}
+		}
+		return
+	}
+	path := t.sharedTree.walk(splitTopic(group.Filter), false)
+	if path == nil {
+		return
+	}
+	delete(path[len(path)-1].groups, group.Topic)
+	prune(path)
+}
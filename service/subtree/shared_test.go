@@ -0,0 +1,66 @@
+package subtree
+
+import (
+	"sort"
+	"testing"
+)
+
+// TestReadSharedSubs 按过滤器索引的共享订阅组只返回与主题匹配的组，成员按客户端ID排序
+func TestReadSharedSubs(t *testing.T) {
+	topicSub := newTopicSub()
+	topicSub.CreateSub(map[string]int32{"$share/g1/a/b": 1, "$share/g2/a/+": 0}, "c2", nil, "")
+	topicSub.CreateSub(map[string]int32{"$share/g1/a/b": 2, "$share/g3/#": 0, "$share/g4/x/y": 0}, "c1", nil, "")
+	topicSub.CreateSub(map[string]int32{"$share/g5/$SYS/#": 0}, "c3", nil, "")
+
+	tests := []struct {
+		topic  string
+		groups []string
+	}{
+		{"a/b", []string{"$share/g1/a/b", "$share/g2/a/+", "$share/g3/#"}},
+		{"a/c", []string{"$share/g2/a/+", "$share/g3/#"}},
+		{"x/y", []string{"$share/g3/#", "$share/g4/x/y"}},
+		{"$SYS/x", []string{"$share/g5/$SYS/#"}},
+	}
+	for _, tt := range tests {
+		var groups []string
+		for _, group := range topicSub.ReadSharedSubs(tt.topic) {
+			groups = append(groups, group.Topic)
+		}
+		sort.Strings(groups)
+		if len(groups) != len(tt.groups) {
+			t.Errorf("%s: groups %v, want %v", tt.topic, groups, tt.groups)
+			continue
+		}
+		for i := range groups {
+			if groups[i] != tt.groups[i] {
+				t.Errorf("%s: groups %v, want %v", tt.topic, groups, tt.groups)
+				break
+			}
+		}
+	}
+
+	var group *SharedGroup
+	for _, g := range topicSub.ReadSharedSubs("a/b") {
+		if g.Topic == "$share/g1/a/b" {
+			group = g
+		}
+	}
+	if group == nil || len(group.Clients) != 2 || group.Clients[0] != "c1" || group.Clients[1] != "c2" || group.Members["c1"] != 2 {
+		t.Fatalf("group clients %v, members %v", group.Clients, group.Members)
+	}
+	// 读取到的组不受之后成员变化的影响
+	topicSub.DeleteSub(map[string]int32{"$share/g1/a/b": 0}, "c1")
+	if len(group.Clients) != 2 || len(group.Members) != 2 {
+		t.Fatalf("group changed after read: clients %v, members %v", group.Clients, group.Members)
+	}
+
+	topicSub.DeleteClient("c1")
+	topicSub.DeleteClient("c2")
+	topicSub.DeleteClient("c3")
+	if groups := topicSub.ReadSharedSubs("a/b"); len(groups) != 0 {
+		t.Fatalf("%d groups left", len(groups))
+	}
+	if len(topicSub.sharedHash) != 0 || len(topicSub.sharedTree.children) != 0 {
+		t.Fatalf("shared index not empty: %v, %v", topicSub.sharedHash, topicSub.sharedTree.children)
+	}
+}
@@ -0,0 +1,184 @@
+package subtree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	protobuf "github.com/golang/protobuf/proto"
+	"hash/crc32"
+	"icetea/pkg"
+	"icetea/service/subtree/proto"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshotMagic 快照文件头，后面依次是版本、负载长度与负载的 CRC32-C 校验和
+var snapshotMagic = [4]byte{'I', 'C', 'T', 'S'}
+
+const snapshotVersion = 1
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Snapshot 将客户端的订阅与离线消息序列化到文件，先写临时文件再原子替换。
+// 订阅树与哈希表可以由客户端的订阅重建，不写入快照
+//
+// param: path 快照文件路径
+// param: keep 是否保存一个客户端，为nil时保存全部客户端
+// return: 保存的客户端数量，错误信息
+func (t *TopicSub) Snapshot(path string, keep func(client *proto.Client) bool) (int, error) {
+	body, count, err := t.marshalClients(keep)
+	if err != nil {
+		return 0, err
+	}
+	var header [16]byte
+	copy(header[:4], snapshotMagic[:])
+	binary.BigEndian.PutUint32(header[4:8], snapshotVersion)
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[12:16], crc32.Checksum(body, crcTable))
+
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(header[:]); err == nil {
+		_, err = tmp.Write(body)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	// 同步目录，保证重命名落盘
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return count, nil
+}
+
+// marshalClients 序列化需要保存的客户端，逐个分片拷贝客户端后在锁外序列化
+func (t *TopicSub) marshalClients(keep func(client *proto.Client) bool) ([]byte, int, error) {
+	snapshot := &proto.TopicSub{Clients: make(map[string]*proto.Client)}
+	for i := range t.clients {
+		shard := &t.clients[i]
+		shard.mu.RLock()
+		for id, client := range shard.clients {
+			if keep != nil && !keep(client) {
+				continue
+			}
+			c := copyClient(client)
+			if client.Queue != nil {
+				c.Queue = copyQueue(client.Queue)
+			}
+			snapshot.Clients[id] = c
+		}
+		shard.mu.RUnlock()
+	}
+	body, err := protobuf.Marshal(snapshot)
+	return body, len(snapshot.Clients), err
+}
+
+// copyQueue 离线消息队列的拷贝，入队会修改队尾消息的 Next，不能与在线的队列共享消息。
+// Last 是 First 链表的最后一个节点，恢复时重新计算，不重复写入
+func copyQueue(queue *proto.Queue) *proto.Queue {
+	result := &proto.Queue{Length: queue.Length}
+	var last *proto.Packet
+	for p := queue.First; p != nil; p = p.Next {
+		packet := &proto.Packet{
+			Body:      p.Body,
+			ID:        p.ID,
+			Timestamp: p.Timestamp,
+			Topic:     p.Topic,
+		}
+		if last == nil {
+			result.First = packet
+		} else {
+			last.Next = packet
+		}
+		last = packet
+	}
+	return result
+}
+
+// Restore 从快照文件恢复客户端的订阅与离线消息，文件不存在时不做任何处理
+//
+// param: path 快照文件路径
+// return: 恢复的客户端数量，错误信息
+func (t *TopicSub) Restore(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var header [16]byte
+	if _, err = io.ReadFull(f, header[:]); err != nil {
+		return 0, pkg.ErrSnapshotCorrupt
+	}
+	if !bytes.Equal(header[:4], snapshotMagic[:]) {
+		return 0, pkg.ErrSnapshotCorrupt
+	}
+	if binary.BigEndian.Uint32(header[4:8]) != snapshotVersion {
+		return 0, pkg.ErrSnapshotVersion
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err = io.ReadFull(f, body); err != nil {
+		return 0, pkg.ErrSnapshotCorrupt
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[12:16]) {
+		return 0, pkg.ErrSnapshotCorrupt
+	}
+	snapshot := new(proto.TopicSub)
+	if err = protobuf.Unmarshal(body, snapshot); err != nil {
+		return 0, pkg.ErrSnapshotCorrupt
+	}
+
+	for _, client := range snapshot.Clients {
+		t.restoreClient(client)
+	}
+	return len(snapshot.Clients), nil
+}
+
+// restoreClient 恢复一个客户端，重建它在订阅树、哈希表与共享订阅组中的订阅
+//
+// param: client 快照中的客户端
+func (t *TopicSub) restoreClient(client *proto.Client) {
+	if client.SubTopics == nil {
+		client.SubTopics = make(map[string]int32)
+	}
+	if client.Meta == nil {
+		client.Meta = make(map[string]string)
+	}
+	if client.Queue == nil {
+		client.Queue = new(proto.Queue)
+	}
+	// 重新计算队尾与长度
+	client.Queue.Last = nil
+	client.Queue.Length = 0
+	for p := client.Queue.First; p != nil; p = p.Next {
+		client.Queue.Last = p
+		client.Queue.Length++
+	}
+	shard := t.clientShard(client.ID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.clients[client.ID] = client
+	for topic, qos := range client.SubTopics {
+		t.createTopic(topic, qos, client.ID)
+	}
+}
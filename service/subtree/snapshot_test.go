@@ -0,0 +1,57 @@
+package subtree
+
+import (
+	"icetea/service/subtree/proto"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSnapshotRestore 快照恢复客户端的订阅、离线消息与会话状态，并重建订阅索引
+func TestSnapshotRestore(t *testing.T) {
+	var (
+		saved          = newTopicSub()
+		path           = filepath.Join(t.TempDir(), "subscriptions.snapshot")
+		disconnectedAt = time.Unix(1700000000, 0)
+	)
+	saved.CreateSub(map[string]int32{"snapshot/+": 1, "$share/g/snapshot/t": 2}, "persistent", nil, "")
+	saved.EnqueuePacket("persistent", &proto.Packet{Body: []byte("first"), Topic: "snapshot/t"})
+	saved.EnqueuePacket("persistent", &proto.Packet{Body: []byte("second"), Topic: "snapshot/t"})
+	saved.SaveSessionExpiry("persistent", 300, disconnectedAt)
+	saved.SaveReleases("persistent", []uint16{7, 3})
+	saved.CreateSub(map[string]int32{"snapshot/t": 0}, "transient", nil, "")
+	count, err := saved.Snapshot(path, func(client *proto.Client) bool {
+		return client.ID != "transient"
+	})
+	if err != nil || count != 1 {
+		t.Fatalf("Snapshot = %d, %v", count, err)
+	}
+
+	restored := newTopicSub()
+	if count, err = restored.Restore(path); err != nil || count != 1 {
+		t.Fatalf("Restore = %d, %v", count, err)
+	}
+	if qos := restored.ReadSubClientsQos("snapshot/t"); len(qos) != 1 || qos["persistent"] != 1 {
+		t.Fatalf("subscribers = %v", qos)
+	}
+	if groups := restored.ReadSharedSubs("snapshot/t"); len(groups) != 1 || groups[0].Members["persistent"] != 2 {
+		t.Fatalf("shared groups = %v", groups)
+	}
+	packets := restored.DequeuePackets("persistent")
+	if len(packets) != 2 || string(packets[0].Body) != "first" || string(packets[1].Body) != "second" {
+		t.Fatalf("queue = %v", packets)
+	}
+	expiry, at, ok := restored.ReadSessionExpiry("persistent")
+	if !ok || expiry != 300 || !at.Equal(disconnectedAt) {
+		t.Fatalf("session expiry = %d, %s, %v", expiry, at, ok)
+	}
+	if ids := restored.TakeReleases("persistent"); len(ids) != 2 || ids[0] != 7 || ids[1] != 3 {
+		t.Fatalf("releases = %v", ids)
+	}
+	if ids := restored.TakeReleases("persistent"); len(ids) != 0 {
+		t.Fatalf("releases after take = %v", ids)
+	}
+	if _, ok := restored.ReadClientInfo("transient"); ok {
+		t.Fatal("transient client restored")
+	}
+}
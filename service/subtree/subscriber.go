@@ -0,0 +1,181 @@
+package subtree
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+)
+
+// 订阅保存的值与 MQTT 5.0 SUBSCRIBE 报文中订阅选项的低 4 位相同：
+// 低 2 位为授予的 qos，0x04 为 No Local，0x08 为 Retain As Published
+const (
+	SubQos               int32 = 0x03
+	SubNoLocal           int32 = 0x04
+	SubRetainAsPublished int32 = 0x08
+)
+
+// mergeSubscription 合并同一客户端与主题匹配的多个订阅：qos 取最大的，
+// 所有订阅都设置了 No Local 时才不接收自己发布的消息，任一订阅设置了 Retain As Published 时保持保留标志
+func mergeSubscription(a, b int32) int32 {
+	qos := a & SubQos
+	if b&SubQos > qos {
+		qos = b & SubQos
+	}
+	return qos | a&b&SubNoLocal | (a|b)&SubRetainAsPublished
+}
+
+// Subscriber 会收到某个主题消息的客户端
+type Subscriber struct {
+	ClientID string
+	// Qos 客户端所有与主题匹配的订阅中最大的qos，ForEachSubscriberBatch 中为合并后的订阅的值
+	Qos int32
+}
+
+// ForEachSubscriber 遍历订阅了topic的客户端，不包括共享订阅，回调返回false时停止遍历。
+// 按 ForEachSubscriberBatch 分批读取，fn 在不持有订阅索引的锁时调用
+//
+// param: topic 发布的主题
+// param: fn 客户端ID与订阅的值（授予的qos与订阅选项）的回调，返回是否继续
+func (t *TopicSub) ForEachSubscriber(topic string, fn func(clientID string, qos int32) bool) {
+	var batch [64]Subscriber
+	t.ForEachSubscriberBatch(topic, batch[:], func(subscribers []Subscriber) bool {
+		for _, subscriber := range subscribers {
+			if !fn(subscriber.ClientID, subscriber.Qos) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// ForEachSubscriberBatch 分批遍历订阅了topic的客户端，不包括共享订阅，Subscriber.Qos 为订阅的值。
+// 客户端有多个订阅匹配topic时只回调一次，订阅的值按 mergeSubscription 合并。
+// 读取一批订阅者时持有订阅索引的读锁，回调前释放，fn 可以调用 TopicSub 的方法，
+// 订阅者数量巨大时也不会长时间阻塞订阅，内存占用不超过 batch 的大小。
+// 遍历期间新增的订阅可能被遍历到也可能不会；客户端在遍历期间新增了另一个匹配的订阅时可能被回调两次，
+// MQTT 允许为重叠的订阅多次下发同一条消息
+//
+// param: topic 发布的主题
+// param: batch 保存一批订阅者的缓冲，回调返回后会被下一批覆盖，不能为空
+// param: fn 一批订阅者的回调，返回是否继续
+func (t *TopicSub) ForEachSubscriberBatch(topic string, batch []Subscriber, fn func(subscribers []Subscriber) bool) {
+	shard := t.hashShard(topic)
+	lock := func() {
+		shard.mu.RLock()
+		t.treeMu.RLock()
+	}
+	unlock := func() {
+		t.treeMu.RUnlock()
+		shard.mu.RUnlock()
+	}
+	lock()
+	// 匹配的订阅来自哈希表中的一项与订阅树中的若干节点，数量很少。
+	// 客户端在它出现的第一个来源中回调，同时出现在之后的来源中的客户端记录在 merged 中，
+	// 只有这部分客户端需要额外的内存
+	var sources []map[string]int32
+	if clients, ok := shard.topics[topic]; ok {
+		sources = append(sources, clients)
+	}
+	matchTreeNode(t.tree, splitTopic(topic), 0, strings.HasPrefix(topic, "$"), func(node *treeNode) {
+		if len(node.clients) > 0 {
+			sources = append(sources, node.clients)
+		}
+	})
+	var (
+		n      int
+		merged map[string]struct{}
+	)
+	for i, clients := range sources {
+		// 释放锁期间 map 可能被修改，Go 允许遍历过程中修改 map，由锁保证不会并发访问
+		for clientID, qos := range clients {
+			if _, ok := merged[clientID]; ok {
+				continue
+			}
+			for _, rest := range sources[i+1:] {
+				if q, ok := rest[clientID]; ok {
+					qos = mergeSubscription(qos, q)
+					if merged == nil {
+						merged = make(map[string]struct{})
+					}
+					merged[clientID] = struct{}{}
+				}
+			}
+			batch[n] = Subscriber{ClientID: clientID, Qos: qos}
+			if n++; n < len(batch) {
+				continue
+			}
+			unlock()
+			next := fn(batch)
+			n = 0
+			if !next {
+				return
+			}
+			lock()
+		}
+	}
+	unlock()
+	if n > 0 {
+		fn(batch[:n])
+	}
+}
+
+// ReadSubscribers 按客户端ID排序分页读取订阅了topic的客户端，不包括共享订阅。
+// 只保留一页的订阅者，不会因订阅者数量巨大而分配大量内存
+//
+// param: topic 发布的主题
+// param: after 上一页最后一个客户端ID，第一页为空
+// param: limit 每页数量，小于等于0时不限制
+// return: 客户端ID大于after的前limit个订阅者，订阅者总数
+func (t *TopicSub) ReadSubscribers(topic, after string, limit int) (page []Subscriber, total int) {
+	h := &subscriberHeap{}
+	t.ForEachSubscriber(topic, func(clientID string, qos int32) bool {
+		total++
+		if clientID <= after {
+			return true
+		}
+		if limit <= 0 || h.Len() < limit {
+			heap.Push(h, Subscriber{ClientID: clientID, Qos: qos & SubQos})
+		} else if clientID < (*h)[0].ClientID {
+			(*h)[0] = Subscriber{ClientID: clientID, Qos: qos & SubQos}
+			heap.Fix(h, 0)
+		}
+		return true
+	})
+	page = *h
+	sort.Slice(page, func(i, j int) bool {
+		return page[i].ClientID < page[j].ClientID
+	})
+	return page, total
+}
+
+// ReadSubClientsQos 订阅了topic的所有客户端及其授予的qos，
+// 客户端有多个订阅匹配topic时取其中最大的qos
+//
+// param: topic 发布的主题
+// return: 客户端ID到qos的映射
+func (t *TopicSub) ReadSubClientsQos(topic string) map[string]int32 {
+	result := make(map[string]int32)
+	t.ForEachSubscriber(topic, func(clientID string, qos int32) bool {
+		result[clientID] = qos & SubQos
+		return true
+	})
+	return result
+}
+
+// subscriberHeap 按客户端ID的大顶堆，堆顶是当前页中最大的客户端ID
+type subscriberHeap []Subscriber
+
+func (h subscriberHeap) Len() int           { return len(h) }
+func (h subscriberHeap) Less(i, j int) bool { return h[i].ClientID > h[j].ClientID }
+func (h subscriberHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *subscriberHeap) Push(x interface{}) {
+	*h = append(*h, x.(Subscriber))
+}
+
+func (h *subscriberHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,202 @@
+package subtree
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestForEachSubscriberStop 回调返回false时停止遍历
+func TestForEachSubscriberStop(t *testing.T) {
+	topicSub := newTopicSub()
+	for i := 0; i < 100; i++ {
+		filter := "a/b"
+		if i%2 == 0 {
+			filter = "a/+"
+		}
+		topicSub.CreateSub(map[string]int32{filter: 0}, fmt.Sprintf("c%d", i), nil, "")
+	}
+	calls := 0
+	topicSub.ForEachSubscriber("a/b", func(string, int32) bool {
+		calls++
+		return calls < 10
+	})
+	if calls != 10 {
+		t.Fatalf("fn called %d times, want 10", calls)
+	}
+}
+
+// TestReadSubscribersPages 分页按客户端ID排序，遍历所有页得到每个订阅者恰好一次，总数包括通配符订阅
+func TestReadSubscribersPages(t *testing.T) {
+	topicSub := newTopicSub()
+	want := make(map[string]int32)
+	for i := 0; i < 250; i++ {
+		id := fmt.Sprintf("c%03d", i)
+		topics := map[string]int32{"a/b": 0}
+		switch i % 3 {
+		case 1:
+			topics = map[string]int32{"a/+": 1}
+		case 2:
+			topics = map[string]int32{"#": 0, "a/#": 2, "a/b": 1}
+		}
+		topicSub.CreateSub(topics, id, nil, "")
+		want[id] = 0
+		for _, qos := range topics {
+			if qos > want[id] {
+				want[id] = qos
+			}
+		}
+	}
+	topicSub.CreateSub(map[string]int32{"x/#": 0, "$share/g/a/b": 1}, "other", nil, "")
+
+	var (
+		after string
+		pages int
+		seen  = make(map[string]int32)
+	)
+	for {
+		page, total := topicSub.ReadSubscribers("a/b", after, 100)
+		if total != len(want) {
+			t.Fatalf("total %d, want %d", total, len(want))
+		}
+		for i, subscriber := range page {
+			if subscriber.ClientID <= after || (i > 0 && subscriber.ClientID <= page[i-1].ClientID) {
+				t.Fatalf("page %d not in order at %q", pages, subscriber.ClientID)
+			}
+			if _, ok := seen[subscriber.ClientID]; ok {
+				t.Fatalf("%q returned twice", subscriber.ClientID)
+			}
+			seen[subscriber.ClientID] = subscriber.Qos
+		}
+		pages++
+		if len(page) < 100 {
+			break
+		}
+		after = page[len(page)-1].ClientID
+	}
+	if pages != 3 {
+		t.Fatalf("%d pages, want 3", pages)
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("got %d subscribers, want %d", len(seen), len(want))
+	}
+	for id, qos := range want {
+		if seen[id] != qos {
+			t.Fatalf("%s qos %d, want %d", id, seen[id], qos)
+		}
+	}
+}
+
+// BenchmarkSubscribers 遍历大量订阅者，ForEachSubscriber 不随订阅者数量分配内存
+func BenchmarkSubscribers(b *testing.B) {
+	for _, n := range []int{10000, 1000000} {
+		topicSub := newTopicSub()
+		for i := 0; i < n; i++ {
+			filter := "sensors/temperature"
+			if i%2 == 0 {
+				filter = "sensors/+"
+			}
+			topicSub.CreateSub(map[string]int32{filter: 1}, fmt.Sprintf("client-%d", i), nil, "")
+		}
+		b.Run(fmt.Sprintf("subscribers=%d/ForEachSubscriber", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				topicSub.ForEachSubscriber("sensors/temperature", func(string, int32) bool { return true })
+			}
+		})
+		b.Run(fmt.Sprintf("subscribers=%d/ReadSubscribers", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				topicSub.ReadSubscribers("sensors/temperature", "client-5", 100)
+			}
+		})
+		b.Run(fmt.Sprintf("subscribers=%d/ReadSubClientsQos", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				topicSub.ReadSubClientsQos("sensors/temperature")
+			}
+		})
+	}
+}
+
+// TestForEachSubscriberOptions 客户端多个匹配的订阅合并为一次回调：qos 取最大，
+// 所有订阅都有 No Local 时才保留 No Local，任一订阅有 Retain As Published 时保留
+func TestForEachSubscriberOptions(t *testing.T) {
+	topicSub := newTopicSub()
+	topicSub.CreateSub(map[string]int32{"a/b": 1 | SubNoLocal, "a/+": 0 | SubNoLocal | SubRetainAsPublished}, "both", nil, "")
+	topicSub.CreateSub(map[string]int32{"a/b": 0 | SubNoLocal, "#": 2}, "mixed", nil, "")
+	want := map[string]int32{
+		"both":  1 | SubNoLocal | SubRetainAsPublished,
+		"mixed": 2,
+	}
+	got := make(map[string]int32)
+	topicSub.ForEachSubscriber("a/b", func(clientID string, options int32) bool {
+		got[clientID] = options
+		return true
+	})
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for id, options := range want {
+		if got[id] != options {
+			t.Errorf("%s: options %#x, want %#x", id, got[id], options)
+		}
+	}
+	page, _ := topicSub.ReadSubscribers("a/b", "", 0)
+	for _, subscriber := range page {
+		if subscriber.Qos != want[subscriber.ClientID]&SubQos {
+			t.Errorf("%s: qos %d, want %d", subscriber.ClientID, subscriber.Qos, want[subscriber.ClientID]&SubQos)
+		}
+	}
+}
+
+// TestForEachSubscriberBatch 订阅者按批回调，每个客户端只回调一次，回调时不持有索引的锁，可以修改订阅
+func TestForEachSubscriberBatch(t *testing.T) {
+	topicSub := newTopicSub()
+	want := make(map[string]int32)
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("c%d", i)
+		topics := map[string]int32{"a/b": 1}
+		if i%2 == 0 {
+			topics["a/+"] = 2
+		}
+		topicSub.CreateSub(topics, id, nil, "")
+		want[id] = 1
+		if i%2 == 0 {
+			want[id] = 2
+		}
+	}
+	var (
+		batch   = make([]Subscriber, 3)
+		seen    = make(map[string]int32)
+		batches = 0
+	)
+	topicSub.ForEachSubscriberBatch("a/b", batch, func(subscribers []Subscriber) bool {
+		batches++
+		if len(subscribers) > len(batch) {
+			t.Fatalf("batch of %d subscribers", len(subscribers))
+		}
+		for _, subscriber := range subscribers {
+			if _, ok := seen[subscriber.ClientID]; ok {
+				t.Fatalf("%s visited twice", subscriber.ClientID)
+			}
+			seen[subscriber.ClientID] = subscriber.Qos
+			// 遍历已经读到的订阅者可以删除订阅
+			topicSub.DeleteClient(subscriber.ClientID)
+		}
+		return true
+	})
+	if batches != 4 {
+		t.Fatalf("%d batches, want 4", batches)
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("got %v, want %v", seen, want)
+	}
+	for id, qos := range want {
+		if seen[id] != qos {
+			t.Errorf("%s: qos %d, want %d", id, seen[id], qos)
+		}
+	}
+	if n := len(topicSub.ReadClientIDs()); n != 0 {
+		t.Fatalf("%d clients left", n)
+	}
+}
@@ -3,7 +3,7 @@ package subtree
 import (
 	"icetea/service/subtree/proto"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type SubClient interface {
@@ -16,19 +16,30 @@ var topicSub *TopicSub
 var onceTopicSub sync.Once
 
 // TopicSub 主题订阅状态机
-// TODO hash订阅与通配符订阅可以使用两把锁，已提高写的速率
+//
+// 客户端按客户端ID分片，客户端的订阅、元数据与离线消息由所在分片的锁保护，
+// 修改订阅的操作在整个过程中持有客户端分片的锁。订阅同时记录在三个索引中：
+// 按主题分片的哈希表、订阅树与共享订阅组，各自有独立的锁，索引中保存授予的qos，
+// 发布消息时只需要获取索引的读锁。
+// 加锁顺序：客户端分片 → 哈希表分片 → treeMu，遍历订阅者时同时持有哈希表分片与 treeMu 的读锁，
+// 回调前释放全部索引锁，回调中可以再调用 TopicSub 的方法；sharedMu 只在客户端分片之后获取，
+// 不与哈希表分片或 treeMu 同时持有。不同时持有两个客户端分片或两个哈希表分片的锁
 type TopicSub struct {
-	mu       *sync.RWMutex
-	topicSub *proto.TopicSub
-}
-
-func newTreeNode(topicSection, topic string) *proto.TreeNode {
-	return &proto.TreeNode{
-		TopicSection: topicSection,
-		Topic:        topic,
-		Clients:      make(map[string]*proto.Client),
-		ChildNode:    make(map[string]*proto.TreeNode),
-	}
+	clients [shardCount]clientShard
+	// hash 不含通配符的订阅
+	hash [shardCount]hashShard
+	// treeMu 保护通配符订阅树
+	treeMu sync.RWMutex
+	tree   *treeNode
+	// sharedMu 保护共享订阅组及其索引
+	sharedMu sync.RWMutex
+	// shared 共享订阅组，key 为完整的共享订阅主题
+	shared map[string]*SharedGroup
+	// sharedHash 过滤器不含通配符的共享订阅组，过滤器到共享订阅主题到组
+	sharedHash map[string]map[string]*SharedGroup
+	// sharedTree 过滤器含通配符的共享订阅组，与订阅树的结构相同，组记录在节点的 groups 中
+	sharedTree     *treeNode
+	maxQueueLength atomic.Int32
 }
 
 // GetTopicSub 获取主题订阅状态机
@@ -46,25 +57,20 @@ func GetTopicSub() *TopicSub {
 // return: 主题订阅状态机
 func newTopicSub() *TopicSub {
 	t := TopicSub{}
-	t.topicSub = newProtoTopicSub()
-	t.mu = new(sync.RWMutex)
+	for i := range t.clients {
+		t.clients[i].clients = make(map[string]*proto.Client)
+	}
+	for i := range t.hash {
+		t.hash[i].topics = make(map[string]map[string]int32)
+	}
+	t.tree = newTreeNode("", "")
+	t.shared = make(map[string]*SharedGroup)
+	t.sharedHash = make(map[string]map[string]*SharedGroup)
+	t.sharedTree = newTreeNode("", "")
+	t.maxQueueLength.Store(DefaultMaxQueueLength)
 	return &t
 }
 
-func newProtoTopicSub() *proto.TopicSub {
-
-	topicSub := new(proto.TopicSub)
-
-	hash := new(proto.HashSubTopic)
-	hash.Clients = make(map[string]*proto.Client)
-	hash.HashSubTopic = make(map[string]*proto.TopicClientsID)
-
-	topicSub.Tree = newTreeNode("/", "/")
-	topicSub.Hash = hash
-	topicSub.Clients = make(map[string]*proto.Client)
-	return topicSub
-}
-
 // newClient 创建一个客户端
 //
 // return: 客户端实例
@@ -78,191 +84,111 @@ func newClient(clientID string) *proto.Client {
 	}
 }
 
-// ReadClientSubTopics 获取客户端订阅的全部topic,qos
+// copyClient 客户端的拷贝，不包括离线消息，调用方持有客户端分片的锁
+func copyClient(client *proto.Client) *proto.Client {
+	c := &proto.Client{
+		ID:        client.ID,
+		SubTopics: make(map[string]int32, len(client.SubTopics)),
+		Meta:      make(map[string]string, len(client.Meta)),
+		AliveTime: client.AliveTime,
+		NodeIP:    client.NodeIP,
+	}
+	for topic, qos := range client.SubTopics {
+		c.SubTopics[topic] = qos
+	}
+	for k, v := range client.Meta {
+		c.Meta[k] = v
+	}
+	return c
+}
+
+// ReadClientSubTopics 获取客户端订阅的全部topic与订阅的值，值的低 2 位为授予的qos
 //
 // param: clientID 客户端ID
 // return: 客户端订阅的topic
 func (t *TopicSub) ReadClientSubTopics(clientID string) map[string]int32 {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+	shard := t.clientShard(clientID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 	topics := make(map[string]int32)
-	if client, ok := t.topicSub.Clients[clientID]; ok {
-		topics = client.SubTopics
+	if client, ok := shard.clients[clientID]; ok {
+		for topic, qos := range client.SubTopics {
+			topics[topic] = qos
+		}
 	}
 	return topics
 }
 
-// ReadClientInfo 获取客户端详情，包括meta，topic
+// ReadClientInfo 获取客户端详情的拷贝，包括meta，topic，不包括离线消息
 //
 // param: clientID
 // return: 客户端实例,是否存在
 func (t *TopicSub) ReadClientInfo(clientID string) (*proto.Client, bool) {
-
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	if client, ok := t.topicSub.Clients[clientID]; ok {
-		return client, ok
-	} else {
-		return nil, false
-	}
-}
-
-// ReadSubClients 订阅了topic的所有客户端
-//
-// param: topic 搜索的主题
-// return: 客户端切片，客户端数量
-func (t *TopicSub) ReadSubClients(topic string) (clients []*proto.Client, total int) {
-	// TODO 分页无法使用map，map的无序性
-
-	t.mu.RLock()
-	defer t.mu.RUnlock()
-	clients = make([]*proto.Client, 0)
-	clientsMap := make(map[string]bool)
-	if subClients, ok := t.topicSub.Hash.HashSubTopic[topic]; ok {
-		total = len(subClients.Clients)
-		for cID := range subClients.Clients {
-			if client, ok := t.topicSub.Clients[cID]; ok {
-				clients = append(clients, client)
-				clientsMap[client.ID] = true
-			}
-		}
-	}
-	// 返回通配符订阅的client , 去重处理
-	for _, v := range t.readWildcardSubClients(topic) {
-		if _, ok := clientsMap[v.GetID()]; !ok {
-			clients = append(clients, v)
-		}
-	}
-	return clients, total
-}
-
-// readWildcardSubClients 查找订阅了通配符主题的所有客户端
-//
-// param: topic 带通配符的主题
-// return: 客户端切片
-func (t *TopicSub) readWildcardSubClients(topic string) (clients []*proto.Client) {
-
-	// FIXME 客户端数量过大时需要分页
-	clients = make([]*proto.Client, 0)
-	topicSlice := splitTopic(topic)
-	topicLevel := len(topicSlice)
-	nextParents := []*proto.TreeNode{t.topicSub.Tree}
-	for level := 0; level < len(topicSlice); level++ {
-		parents := nextParents
-		nextParents = make([]*proto.TreeNode, 0)
-		for _, parent := range parents {
-			if tmp, ok := parent.ChildNode[topicSlice[level]]; ok && tmp.TopicSection == topicSlice[level] {
-				nextParents = append(nextParents, tmp)
-				if parent == nil {
-					return
-				}
-				if level == topicLevel-1 {
-					for _, v := range tmp.Clients {
-						clients = append(clients, v)
-					}
-				} else if level >= topicLevel {
-					return clients
-				}
-
-			}
-			if tmp, ok := parent.ChildNode["+"]; ok {
-				nextParents = append(nextParents, tmp)
-				if level == topicLevel-1 {
-					for _, v := range tmp.Clients {
-						clients = append(clients, v)
-					}
-				} else if level >= topicLevel {
-					return clients
-				}
-			}
-			if tmp, ok := parent.ChildNode["#"]; ok {
-				for _, v := range tmp.Clients {
-					clients = append(clients, v)
-				}
-			}
-		}
+	shard := t.clientShard(clientID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if client, ok := shard.clients[clientID]; ok {
+		return copyClient(client), true
 	}
-	return clients
+	return nil, false
 }
 
 // CreateSub 为一个客户端增加主题订阅
 //
 // param: topics 订阅的主题
 // param: clientID 客户端ID
-// param: meta 元数据
+// param: meta 元数据，合并到客户端已有的元数据中
 // return:
 func (t *TopicSub) CreateSub(topics map[string]int32, clientID string, meta map[string]string, nodeIP string) error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	var ok bool
-	var c *proto.Client
-	if c, ok = t.topicSub.Clients[clientID]; !ok {
+	c, ok := shard.clients[clientID]
+	if !ok {
 		c = newClient(clientID)
+		shard.clients[clientID] = c
+	}
+	for k, v := range meta {
+		c.Meta[k] = v
 	}
-	c.Meta = meta
 	c.NodeIP = nodeIP
-	c.ID = clientID
-	t.createClientWithoutLock(c)
 	for topic, qos := range topics {
-		// 判断topic是否为通配符订阅
 		c.SubTopics[topic] = qos
-		if !HasWildcard(topic) {
-			t.createSimpleTopicWithoutLock(topic, c)
-		} else {
-			t.createWildcardTopicWithoutLock(topic, c)
-		}
+		t.createTopic(topic, qos, clientID)
 	}
-
 	return nil
 }
 
-// createClientWithoutLock 创建客户端
+// createTopic 将客户端的一条订阅加入对应的索引，调用方持有客户端分片的锁
 //
-// param: client
-func (t *TopicSub) createClientWithoutLock(client *proto.Client) {
-	t.topicSub.Clients[client.ID] = client
-}
-
-// createSimpleTopicWithoutLock add simple topic , doesn't have wildcard mark
-// createSimpleTopicWithoutLock 为客户端增加一个不含通配符的主题订阅
-//
-// param: topic 不含通配符的主题
-// param: client 客户端实例指针
-func (t *TopicSub) createSimpleTopicWithoutLock(topic string, client *proto.Client) {
-	if clientsID, ok := t.topicSub.Hash.HashSubTopic[topic]; ok {
-		clientsID.Clients[client.GetID()] = time.Now().Unix()
+// param: topic 订阅的主题
+// param: qos 授予的qos
+// param: clientID 客户端ID
+func (t *TopicSub) createTopic(topic string, qos int32, clientID string) {
+	// 判断topic是否为通配符订阅
+	if IsShared(topic) {
+		t.createSharedTopic(topic, qos, clientID)
+	} else if !HasWildcard(topic) {
+		t.createSimpleTopic(topic, qos, clientID)
 	} else {
-		c := new(proto.TopicClientsID)
-		c.Clients = make(map[string]int64)
-		c.Clients[client.GetID()] = time.Now().Unix()
-		t.topicSub.Hash.HashSubTopic[topic] = c
+		t.createWildcardTopic(topic, qos, clientID)
 	}
-	t.topicSub.Clients[client.GetID()] = client
 }
 
-// createWildcardTopicWithoutLock 为客户端增加一条包含通配符的主题, 比如： /a/+/b or /a/#
+// deleteTopic 从对应的索引中删除客户端的一条订阅，调用方持有客户端分片的锁
 //
-// param: topic 包含通配符的主题
-// param: client 客户端实例指针
-func (t *TopicSub) createWildcardTopicWithoutLock(topic string, client *proto.Client) {
-	topicSlice := splitTopic(topic)
-	parent := t.topicSub.Tree
-	childTopic := ""
-	for level := 0; level <= len(topicSlice); level++ {
-		section := topicSlice[level]
-		childTopic += "/" + section
-		if childNode, ok := parent.ChildNode[section]; ok {
-			parent = childNode
-		} else {
-			childNode = newTreeNode(section, childTopic)
-			parent.ChildNode[section] = childNode
-			parent = childNode
-		}
-		if level == len(topicSlice)-1 {
-			parent.Clients[client.ID] = client
-			break
-		}
+// param: topic 订阅的主题
+// param: clientID 客户端ID
+func (t *TopicSub) deleteTopic(topic, clientID string) {
+	if IsShared(topic) {
+		t.deleteSharedTopic(topic, clientID)
+	} else if !HasWildcard(topic) {
+		// 从哈希表删除订阅
+		t.deleteSimpleSubTopic(topic, clientID)
+	} else {
+		// 从订阅树中删除订阅
+		t.deleteWildcardSubTopic(topic, clientID)
 	}
 }
 
@@ -271,116 +197,171 @@ func (t *TopicSub) createWildcardTopicWithoutLock(topic string, client *proto.Cl
 // param: clientID 客户端ID
 // return: 是否成功，错误信息
 func (t *TopicSub) DeleteSub(topics map[string]int32, clientID string) error {
-	t.mu.RLock()
-	client, ok := t.topicSub.Clients[clientID]
-	t.mu.RUnlock()
-	if ok {
-		t.mu.Lock()
-		defer t.mu.Unlock()
-		t.deleteSubWithoutLock(topics, client)
-		if len(client.SubTopics) == 0 {
-			delete(t.topicSub.Clients, clientID)
-		}
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if client, ok := shard.clients[clientID]; ok {
+		t.deleteSubWithoutLock(shard, topics, client)
 	}
 	return nil
 }
 
-// deleteSubWithoutLock 客户端删除topic,不请求客户端的锁，不可以在并发条件下单独使用。
+// deleteSubWithoutLock 客户端删除topic，调用方持有客户端分片的锁
 //
+// param: shard 客户端所在的分片
 // param: topics 主题
 // param: client 客户端实例指针
-func (t *TopicSub) deleteSubWithoutLock(topics map[string]int32, client *proto.Client) {
-
-	clientID := client.ID
+func (t *TopicSub) deleteSubWithoutLock(shard *clientShard, topics map[string]int32, client *proto.Client) {
 	for topic := range topics {
-		if !HasWildcard(topic) {
-			// 从哈希表删除订阅
-			t.deleteSimpleSubTopicWithoutLock(topic, clientID)
-		} else {
-			// 从订阅树中删除订阅
-			t.deleteWildcardSubTopicWithoutLock(topic, clientID)
+		if _, ok := client.SubTopics[topic]; !ok {
+			continue
 		}
+		t.deleteTopic(topic, client.ID)
 		// 客户端信息中删除订阅了topic
 		delete(client.SubTopics, topic)
 	}
 	// 客户端无订阅的主题时删除客户端记录
 	if len(client.SubTopics) == 0 {
-		delete(t.topicSub.Clients, clientID)
+		delete(shard.clients, client.ID)
 	}
 }
 
-// deleteSimpleSubTopicWithoutLock 删除客户端不包含通配符的topic
+// DeleteClient delete all sub topics from a client
+func (t *TopicSub) DeleteClient(clientID string) error {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if client, ok := shard.clients[clientID]; ok {
+		t.deleteClientWithoutLock(shard, client)
+	}
+	return nil
+}
 
-// param: topics 主题
-// param: clientID 客户端ID
-func (t *TopicSub) deleteSimpleSubTopicWithoutLock(topic, clientID string) {
+// deleteClientWithoutLock 删除客户端的全部订阅与客户端记录，调用方持有客户端分片的锁
+func (t *TopicSub) deleteClientWithoutLock(shard *clientShard, client *proto.Client) {
+	for topic := range client.SubTopics {
+		t.deleteTopic(topic, client.ID)
+	}
+	delete(shard.clients, client.ID)
+}
 
-	if tmp, ok := t.topicSub.Hash.HashSubTopic[topic]; ok {
-		delete(tmp.Clients, clientID)
-		if len(tmp.Clients) == 0 {
-			delete(t.topicSub.Hash.HashSubTopic, topic)
-		}
+func (t *TopicSub) subQosMoreThan0(clientID string) bool {
+	shard := t.clientShard(clientID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if client, ok := shard.clients[clientID]; ok {
+		return subQosMoreThan0(client.SubTopics)
 	}
 
+	return false
 }
 
-func (t *TopicSub) deleteWildcardSubTopicWithoutLock(topic, clientID string) {
+// updateClientAliveTime 更新客户端活跃时间
+//
+// param: clientID
+// param: timestamp
+func (t *TopicSub) updateClientAliveTime(clientID string, timestamp int64) {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if client, ok := shard.clients[clientID]; ok {
+		client.AliveTime = timestamp
+	}
+}
 
-	topicSlice := splitTopic(topic)
-	topicLevel := len(topicSlice)
-	parent := t.topicSub.Tree
-	for level := 0; level < len(topicSlice); level++ {
-		if childNode, ok := parent.ChildNode[topicSlice[level]]; ok {
-			if level == topicLevel-1 {
-				delete(childNode.Clients, clientID)
-				if len(childNode.Clients) == 0 {
-					delete(parent.ChildNode, topicSlice[level])
-				}
-			}
-			parent = childNode
-			if parent == nil {
-				return
-			}
+// ReadClientIDs 所有有订阅或离线消息的客户端ID
+//
+// return: 客户端ID切片
+func (t *TopicSub) ReadClientIDs() []string {
+	ids := make([]string, 0)
+	for i := range t.clients {
+		shard := &t.clients[i]
+		shard.mu.RLock()
+		for id := range shard.clients {
+			ids = append(ids, id)
 		}
+		shard.mu.RUnlock()
 	}
+	return ids
 }
 
-// DeleteClient delete all sub topics from a client
-func (t *TopicSub) DeleteClient(clientID string) error {
-
-	t.mu.RLock()
-	if client, ok := t.topicSub.Clients[clientID]; !ok {
-		t.mu.RUnlock()
-		return nil
-	} else {
-		t.mu.RUnlock()
-		t.mu.Lock()
-		t.deleteClientWithoutLock(client)
-		t.mu.Unlock()
-		return nil
+// SubscriptionCount 所有客户端的订阅总数
+func (t *TopicSub) SubscriptionCount() int {
+	count := 0
+	for i := range t.clients {
+		shard := &t.clients[i]
+		shard.mu.RLock()
+		for _, client := range shard.clients {
+			count += len(client.SubTopics)
+		}
+		shard.mu.RUnlock()
 	}
-}
-func (t *TopicSub) deleteClientWithoutLock(client *proto.Client) {
-	t.deleteSubWithoutLock(client.GetSubTopics(), client)
-	delete(t.topicSub.Clients, client.ID)
+	return count
 }
 
-func (t *TopicSub) subQosMoreThan0(clientID string) bool {
-
-	if client, ok := t.topicSub.Clients[clientID]; ok {
-		return subQosMoreThan0(client.SubTopics)
+// ReadClientNode 客户端所在的节点，本节点的客户端为空
+//
+// param: clientID 客户端ID
+// return: 节点地址
+func (t *TopicSub) ReadClientNode(clientID string) string {
+	shard := t.clientShard(clientID)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if client, ok := shard.clients[clientID]; ok {
+		return client.NodeIP
 	}
+	return ""
+}
 
-	return false
+// ReadNodeSubTopics 某个节点上所有客户端的订阅
+//
+// param: nodeIP 节点地址，本节点为空
+// return: 客户端ID到订阅的topic,qos
+func (t *TopicSub) ReadNodeSubTopics(nodeIP string) map[string]map[string]int32 {
+	result := make(map[string]map[string]int32)
+	for i := range t.clients {
+		shard := &t.clients[i]
+		shard.mu.RLock()
+		for id, client := range shard.clients {
+			if client.NodeIP != nodeIP {
+				continue
+			}
+			topics := make(map[string]int32, len(client.SubTopics))
+			for topic, qos := range client.SubTopics {
+				topics[topic] = qos
+			}
+			result[id] = topics
+		}
+		shard.mu.RUnlock()
+	}
+	return result
 }
 
-// updateClientAliveTime 更新客户端活跃时间
+// DeleteNodeClient 删除某个节点上的客户端，客户端已经属于其他节点时不删除
 //
-// param: clientID
-// param: timestamp
-func (t *TopicSub) updateClientAliveTime(clientID string, timestamp int64) {
+// param: clientID 客户端ID
+// param: nodeIP 节点地址
+func (t *TopicSub) DeleteNodeClient(clientID, nodeIP string) {
+	shard := t.clientShard(clientID)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if client, ok := shard.clients[clientID]; ok && client.NodeIP == nodeIP {
+		t.deleteClientWithoutLock(shard, client)
+	}
+}
 
-	if client, ok := t.topicSub.Clients[clientID]; ok {
-		client.AliveTime = timestamp
+// DeleteNodeClients 删除某个节点上的所有客户端，节点断开时调用
+//
+// param: nodeIP 节点地址
+func (t *TopicSub) DeleteNodeClients(nodeIP string) {
+	for i := range t.clients {
+		shard := &t.clients[i]
+		shard.mu.Lock()
+		for _, client := range shard.clients {
+			if client.NodeIP == nodeIP {
+				t.deleteClientWithoutLock(shard, client)
+			}
+		}
+		shard.mu.Unlock()
 	}
 }
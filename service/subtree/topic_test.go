@@ -0,0 +1,294 @@
+package subtree
+
+import (
+	"fmt"
+	"icetea/service/subtree/proto"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stressFilters 压力测试使用的订阅，包括不含通配符的订阅、通配符订阅与共享订阅
+var stressFilters = []string{
+	"a/b", "a/c", "a/b/c", "x/y", "a//b", "$SYS/x",
+	"a/+", "a/#", "+/b", "#", "+/+/c", "a/+/c/#", "$SYS/#",
+	"$share/g1/a/+", "$share/g2/#", "$share/g1/x/y",
+}
+
+var stressTopics = []string{"a/b", "a/c", "a/b/c", "x/y", "a//b", "$SYS/x", "a", "b/b"}
+
+// TestConcurrentSubscriptions 并发增删订阅、读取订阅者、离线消息与快照，
+// 结束后索引与客户端的订阅一致。需要使用 -race 运行
+func TestConcurrentSubscriptions(t *testing.T) {
+	var (
+		topicSub = newTopicSub()
+		wg       sync.WaitGroup
+		stop     atomic.Bool
+		misses   atomic.Int64
+	)
+	topicSub.SetMaxQueueLength(8)
+	// stable 的订阅在测试期间不变，每次读取都应该匹配到它
+	if err := topicSub.CreateSub(map[string]int32{"#": 1}, "stable", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				for _, topic := range stressTopics {
+					if topic[0] == '$' {
+						continue
+					}
+					if _, ok := topicSub.ReadSubClientsQos(topic)["stable"]; !ok {
+						misses.Add(1)
+					}
+					topicSub.ReadSharedSubs(topic)
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	var writers sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		writers.Add(1)
+		go func(seed int64) {
+			defer writers.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				clientID := fmt.Sprintf("c%d", r.Intn(32))
+				filter := stressFilters[r.Intn(len(stressFilters))]
+				switch r.Intn(10) {
+				case 0, 1, 2:
+					topicSub.CreateSub(map[string]int32{filter: int32(r.Intn(3))}, clientID, map[string]string{}, "")
+				case 3, 4:
+					topicSub.DeleteSub(map[string]int32{filter: 0}, clientID)
+				case 5:
+					topicSub.DeleteClient(clientID)
+				case 6:
+					topicSub.EnqueuePacket(clientID, &proto.Packet{Topic: filter, Body: []byte("x")})
+				case 7:
+					topicSub.DequeuePackets(clientID)
+				case 8:
+					if _, _, err := topicSub.marshalClients(nil); err != nil {
+						t.Error(err)
+					}
+				default:
+					topicSub.ReadClientSubTopics(clientID)
+					topicSub.ReadNodeSubTopics("")
+					topicSub.SubscriptionCount()
+				}
+			}
+		}(int64(w))
+	}
+	writers.Wait()
+	stop.Store(true)
+	wg.Wait()
+	if n := misses.Load(); n > 0 {
+		t.Fatalf("stable subscriber missed %d times", n)
+	}
+	checkIndexes(t, topicSub)
+}
+
+// TestConcurrentNodeClients 并发同步、删除其他节点的客户端，与本节点客户端的订阅互不影响
+func TestConcurrentNodeClients(t *testing.T) {
+	var (
+		topicSub = newTopicSub()
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			node := fmt.Sprintf("10.0.0.%d:7946", w%2)
+			for i := 0; i < 500; i++ {
+				clientID := fmt.Sprintf("c%d", i%50)
+				if w%2 == 0 {
+					topicSub.CreateSub(map[string]int32{"a/+": 1, "a/b": 0}, clientID+"@"+node, nil, node)
+					topicSub.CreateSub(map[string]int32{"a/#": 2}, clientID, nil, "")
+				} else if i%10 == 0 {
+					topicSub.DeleteNodeClients(node)
+				} else {
+					topicSub.DeleteNodeClient(clientID+"@"+node, node)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	checkIndexes(t, topicSub)
+	topicSub.DeleteNodeClients("10.0.0.0:7946")
+	topicSub.DeleteNodeClients("10.0.0.1:7946")
+	if n := len(topicSub.ReadClientIDs()); n != 50 {
+		t.Fatalf("%d clients left, want 50 local clients", n)
+	}
+	if qos := topicSub.ReadSubClientsQos("a/b"); len(qos) != 50 {
+		t.Fatalf("%d subscribers of a/b, want 50", len(qos))
+	}
+	checkIndexes(t, topicSub)
+}
+
+// checkIndexes 索引中的每一条订阅都属于一个存在的客户端且qos一致，客户端的每一条订阅都在索引中，
+// 订阅树中没有空的节点
+func checkIndexes(t *testing.T, topicSub *TopicSub) {
+	t.Helper()
+	want := make(map[string]int32)
+	for i := range topicSub.clients {
+		for id, client := range topicSub.clients[i].clients {
+			if len(client.SubTopics) == 0 && (client.Queue == nil || client.Queue.Length == 0) {
+				t.Errorf("client %s has no subscriptions", id)
+			}
+			for filter, qos := range client.SubTopics {
+				want[filter+" "+id] = qos
+			}
+		}
+	}
+	got := make(map[string]int32)
+	for i := range topicSub.hash {
+		for topic, clients := range topicSub.hash[i].topics {
+			if len(clients) == 0 {
+				t.Errorf("empty hash entry %q", topic)
+			}
+			for id, qos := range clients {
+				got[topic+" "+id] = qos
+			}
+		}
+	}
+	var walk func(node *treeNode)
+	walk = func(node *treeNode) {
+		for _, child := range node.children {
+			if len(child.clients) == 0 && len(child.children) == 0 {
+				t.Errorf("empty tree node %q", child.topic)
+			}
+			for id, qos := range child.clients {
+				got[child.topic+" "+id] = qos
+			}
+			walk(child)
+		}
+	}
+	walk(topicSub.tree)
+	indexed := make(map[string]*SharedGroup)
+	for filter, groups := range topicSub.sharedHash {
+		if len(groups) == 0 {
+			t.Errorf("empty shared hash entry %q", filter)
+		}
+		for topic, group := range groups {
+			indexed[topic] = group
+		}
+	}
+	var walkShared func(node *treeNode)
+	walkShared = func(node *treeNode) {
+		for _, child := range node.children {
+			if len(child.groups) == 0 && len(child.children) == 0 {
+				t.Errorf("empty shared tree node %q", child.topic)
+			}
+			for topic, group := range child.groups {
+				indexed[topic] = group
+			}
+			walkShared(child)
+		}
+	}
+	walkShared(topicSub.sharedTree)
+	if len(indexed) != len(topicSub.shared) {
+		t.Errorf("%d shared groups indexed, want %d", len(indexed), len(topicSub.shared))
+	}
+	for topic, group := range topicSub.shared {
+		if indexed[topic] != group {
+			t.Errorf("shared group %q is not indexed", topic)
+		}
+		if len(group.Clients) != len(group.Members) || !sort.StringsAreSorted(group.Clients) {
+			t.Errorf("shared group %q clients %v, members %v", topic, group.Clients, group.Members)
+		}
+		for id, qos := range group.Members {
+			got[topic+" "+id] = qos
+		}
+	}
+	for key, qos := range want {
+		if q, ok := got[key]; !ok || q != qos {
+			t.Errorf("subscription %q qos %d, indexed %d %v", key, qos, q, ok)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("stale index entry %q", key)
+		}
+	}
+}
+
+// globalLock 用一把读写锁保护全部操作，模拟分片之前的加锁方式，作为基准测试的对比
+type globalLock struct {
+	mu sync.RWMutex
+	*TopicSub
+}
+
+func (g *globalLock) ReadSubClientsQos(topic string) map[string]int32 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.TopicSub.ReadSubClientsQos(topic)
+}
+
+func (g *globalLock) CreateSub(topics map[string]int32, clientID string, meta map[string]string, nodeIP string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.TopicSub.CreateSub(topics, clientID, meta, nodeIP)
+}
+
+func (g *globalLock) DeleteSub(topics map[string]int32, clientID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.TopicSub.DeleteSub(topics, clientID)
+}
+
+type subscriptionStore interface {
+	ReadSubClientsQos(topic string) map[string]int32
+	CreateSub(topics map[string]int32, clientID string, meta map[string]string, nodeIP string) error
+	DeleteSub(topics map[string]int32, clientID string) error
+}
+
+// BenchmarkContention 并发发布与订阅，writes 为订阅、取消订阅占全部操作的百分比
+func BenchmarkContention(b *testing.B) {
+	stores := []struct {
+		name string
+		new  func() subscriptionStore
+	}{
+		{"sharded", func() subscriptionStore { return newTopicSub() }},
+		{"global", func() subscriptionStore { return &globalLock{TopicSub: newTopicSub()} }},
+	}
+	for _, writes := range []int{1, 10, 50} {
+		for _, store := range stores {
+			b.Run(fmt.Sprintf("writes=%d%%/%s", writes, store.name), func(b *testing.B) {
+				benchmarkContention(b, store.new(), writes)
+			})
+		}
+	}
+}
+
+func benchmarkContention(b *testing.B, store subscriptionStore, writes int) {
+	for i := 0; i < 10000; i++ {
+		store.CreateSub(map[string]int32{
+			fmt.Sprintf("device/%d/status", i%1000): 1,
+			fmt.Sprintf("device/%d/+", i%1000):      0,
+		}, fmt.Sprintf("client-%d", i), nil, "")
+	}
+	var worker atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			id     = worker.Add(1)
+			r      = rand.New(rand.NewSource(id))
+			client = fmt.Sprintf("bench-%d", id)
+		)
+		for pb.Next() {
+			n := r.Intn(1000)
+			if r.Intn(100) < writes {
+				topics := map[string]int32{fmt.Sprintf("device/%d/#", n): 1}
+				store.CreateSub(topics, client, nil, "")
+				store.DeleteSub(topics, client)
+			} else {
+				store.ReadSubClientsQos(fmt.Sprintf("device/%d/status", n))
+			}
+		}
+	})
+}
@@ -2,23 +2,11 @@ package subtree
 
 import "strings"
 
+// splitTopic 按 / 拆分主题的层级，空的层级同样是一个层级，a/b 与 a//b、/a 与 a 是不同的主题
 func splitTopic(topic string) []string {
-	tmp := strings.Split(strings.Trim(topic, "/"), "/")
-
-	// 去除所有的空字符
-	for _, v := range tmp {
-		if v == "" {
-			result := make([]string, 0)
-			for _, v := range tmp {
-				if v != "" {
-					result = append(result, v)
-				}
-			}
-			return result
-		}
-	}
-	return tmp
+	return strings.Split(topic, "/")
 }
+
 func HasWildcard(topic string) bool {
 
 	for i := 0; i < len(topic); i++ {
@@ -30,10 +18,45 @@ func HasWildcard(topic string) bool {
 
 }
 
+// TopicMatch 判断主题是否匹配订阅的主题过滤器，规则见 MQTT 3.1.1 4.7：
+// + 匹配一个层级（包括空的层级），# 匹配零个或多个层级（包括父层级本身），
+// 以通配符开头的过滤器不匹配以 $ 开头的主题
+//
+// param: filter 主题过滤器，可以包含通配符
+// param: topic 发布的主题
+// return: 是否匹配
+func TopicMatch(filter, topic string) bool {
+	var (
+		sys       = strings.HasPrefix(topic, "$")
+		topicDone = false
+	)
+	for level := 0; ; level++ {
+		section, filterRest, filterMore := strings.Cut(filter, "/")
+		if section == "#" {
+			return level > 0 || !sys
+		}
+		if topicDone {
+			return false
+		}
+		topicSection, topicRest, topicMore := strings.Cut(topic, "/")
+		if section == "+" {
+			if level == 0 && sys {
+				return false
+			}
+		} else if section != topicSection {
+			return false
+		}
+		if !filterMore {
+			return !topicMore
+		}
+		filter, topic, topicDone = filterRest, topicRest, !topicMore
+	}
+}
+
 // 判断订阅的topic是否有大于0
 func subQosMoreThan0(topics map[string]int32) bool {
 	for _, v := range topics {
-		if v > 0 {
+		if v&SubQos > 0 {
 			return true
 		}
 	}
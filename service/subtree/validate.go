@@ -0,0 +1,89 @@
+package subtree
+
+import (
+	"icetea/pkg"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxTopicLength 协议允许的主题最大字节数
+const MaxTopicLength = 65535
+
+// DefaultTopicLimits 默认只使用协议的限制
+var DefaultTopicLimits = TopicLimits{MaxLength: MaxTopicLength}
+
+// TopicLimits 主题名与主题过滤器的长度与层级限制
+type TopicLimits struct {
+	// MaxLength 主题的最大字节数，0 表示使用协议的上限
+	MaxLength int
+	// MaxLevels 主题的最大层级数，0 表示不限制
+	MaxLevels int
+}
+
+// ValidateName 校验 PUBLISH 的主题名，规则见 MQTT 3.1.1 4.7.3、1.5.3
+//
+// param: topic 主题名
+// return: 违反的规则
+func (l TopicLimits) ValidateName(topic string) error {
+	if err := l.validate(topic); err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return pkg.ErrTopicNameWildcard
+	}
+	return l.validateLevels(topic)
+}
+
+// ValidateFilter 校验订阅的主题过滤器，共享订阅校验组名与其中的主题过滤器
+//
+// param: filter 主题过滤器
+// return: 违反的规则
+func (l TopicLimits) ValidateFilter(filter string) error {
+	if err := l.validate(filter); err != nil {
+		return err
+	}
+	if IsShared(filter) {
+		var ok bool
+		if _, filter, ok = ParseShared(filter); !ok {
+			return pkg.ErrSharedFilterInvalid
+		}
+	}
+	for rest, more := filter, true; more; {
+		var section string
+		section, rest, more = strings.Cut(rest, "/")
+		if (section == "#" && !more) || section == "+" {
+			continue
+		}
+		if strings.ContainsAny(section, "+#") {
+			return pkg.ErrTopicFilterWildcard
+		}
+	}
+	return l.validateLevels(filter)
+}
+
+// validate 主题名与主题过滤器共同的规则：非空、长度、UTF-8 编码且不含空字符
+func (l TopicLimits) validate(topic string) error {
+	maxLength := l.MaxLength
+	if maxLength <= 0 || maxLength > MaxTopicLength {
+		maxLength = MaxTopicLength
+	}
+	switch {
+	case topic == "":
+		return pkg.ErrTopicEmpty
+	case len(topic) > maxLength:
+		return pkg.ErrTopicTooLong
+	case !utf8.ValidString(topic):
+		return pkg.ErrTopicInvalidUTF8
+	case strings.IndexByte(topic, 0) >= 0:
+		return pkg.ErrTopicNullCharacter
+	}
+	return nil
+}
+
+// validateLevels 主题的层级数，共享订阅只计算其中的主题过滤器
+func (l TopicLimits) validateLevels(topic string) error {
+	if l.MaxLevels > 0 && strings.Count(topic, "/")+1 > l.MaxLevels {
+		return pkg.ErrTopicTooManyLevels
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package subtree
+
+import (
+	"errors"
+	"icetea/pkg"
+	"strings"
+	"testing"
+)
+
+// TestValidateName PUBLISH 主题名的规则：非空、UTF-8、不含空字符与通配符，以及长度与层级限制
+func TestValidateName(t *testing.T) {
+	limits := TopicLimits{MaxLength: 16, MaxLevels: 3}
+	tests := []struct {
+		limits TopicLimits
+		topic  string
+		err    error
+	}{
+		{limits, "sport/tennis", nil},
+		{limits, "/", nil},
+		{limits, "$SYS/broker", nil},
+		{limits, "", pkg.ErrTopicEmpty},
+		{limits, "sport/+", pkg.ErrTopicNameWildcard},
+		{limits, "sport/#", pkg.ErrTopicNameWildcard},
+		{limits, "sport+", pkg.ErrTopicNameWildcard},
+		{limits, "#", pkg.ErrTopicNameWildcard},
+		{limits, "sport\x00", pkg.ErrTopicNullCharacter},
+		{limits, "sport/\xff", pkg.ErrTopicInvalidUTF8},
+		{limits, strings.Repeat("a", 16), nil},
+		{limits, strings.Repeat("a", 17), pkg.ErrTopicTooLong},
+		{limits, "a/b/c", nil},
+		{limits, "a/b/c/d", pkg.ErrTopicTooManyLevels},
+		{limits, "a/b//", pkg.ErrTopicTooManyLevels},
+		{DefaultTopicLimits, strings.Repeat("a", MaxTopicLength), nil},
+		{DefaultTopicLimits, strings.Repeat("a", MaxTopicLength+1), pkg.ErrTopicTooLong},
+		{TopicLimits{MaxLength: MaxTopicLength * 2}, strings.Repeat("a", MaxTopicLength+1), pkg.ErrTopicTooLong},
+		{TopicLimits{}, strings.Repeat("a/", 1000), nil},
+	}
+	for _, tt := range tests {
+		if err := tt.limits.ValidateName(tt.topic); !errors.Is(err, tt.err) {
+			t.Errorf("ValidateName(%.20q) = %v, want %v", tt.topic, err, tt.err)
+		}
+	}
+}
+
+// TestValidateFilter 订阅主题过滤器的规则：通配符必须占据整个层级、# 只能是最后一层，共享订阅的组名与过滤器
+func TestValidateFilter(t *testing.T) {
+	limits := TopicLimits{MaxLength: 32, MaxLevels: 3}
+	tests := []struct {
+		limits TopicLimits
+		filter string
+		err    error
+	}{
+		{limits, "sport/tennis", nil},
+		{limits, "#", nil},
+		{limits, "+", nil},
+		{limits, "+/+", nil},
+		{limits, "sport/#", nil},
+		{limits, "sport/+/player1", nil},
+		{limits, "/+", nil},
+		{limits, "", pkg.ErrTopicEmpty},
+		{limits, "a/#/b", pkg.ErrTopicFilterWildcard},
+		{limits, "#/", pkg.ErrTopicFilterWildcard},
+		{limits, "sport+", pkg.ErrTopicFilterWildcard},
+		{limits, "sport/tennis#", pkg.ErrTopicFilterWildcard},
+		{limits, "sport/++", pkg.ErrTopicFilterWildcard},
+		{limits, "sport\x00", pkg.ErrTopicNullCharacter},
+		{limits, "sport/\xff", pkg.ErrTopicInvalidUTF8},
+		{limits, strings.Repeat("a", 32), nil},
+		{limits, strings.Repeat("a", 33), pkg.ErrTopicTooLong},
+		{limits, "a/b/#", nil},
+		{limits, "a/b/c/#", pkg.ErrTopicTooManyLevels},
+
+		// 共享订阅
+		{limits, "$share/group/sport/#", nil},
+		{limits, "$share/group/#", nil},
+		{limits, "$share/group/a/b/c", nil},
+		{limits, "$share/group/a/b/c/d", pkg.ErrTopicTooManyLevels},
+		{limits, "$share/group/a/#/b", pkg.ErrTopicFilterWildcard},
+		{limits, "$share/", pkg.ErrSharedFilterInvalid},
+		{limits, "$share/group", pkg.ErrSharedFilterInvalid},
+		{limits, "$share/group/", pkg.ErrSharedFilterInvalid},
+		{limits, "$share//sport", pkg.ErrSharedFilterInvalid},
+		{limits, "$share/+/sport", pkg.ErrSharedFilterInvalid},
+		{limits, "$share/#/sport", pkg.ErrSharedFilterInvalid},
+		{limits, "$share/gr+oup/sport", pkg.ErrSharedFilterInvalid},
+		{limits, "$share/group/sport\x00", pkg.ErrTopicNullCharacter},
+		{DefaultTopicLimits, strings.Repeat("a", MaxTopicLength+1), pkg.ErrTopicTooLong},
+	}
+	for _, tt := range tests {
+		if err := tt.limits.ValidateFilter(tt.filter); !errors.Is(err, tt.err) {
+			t.Errorf("ValidateFilter(%.20q) = %v, want %v", tt.filter, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"icetea/pkg"
+	"icetea/pkg/stats"
+	"icetea/service/subtree"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSysInterval $SYS 统计信息的默认发布间隔
+const DefaultSysInterval = 10 * time.Second
+
+// sysPrefix 统计信息的主题前缀，与 Mosquitto 的 $SYS 主题树保持一致
+const sysPrefix = "$SYS/broker/"
+
+// sysTopicPrefix $SYS 主题的前缀，每个节点的统计信息只在本节点投递与保存
+const sysTopicPrefix = "$SYS/"
+
+// isSysTopic 主题是否属于 $SYS，这些消息不转发给其他节点，也不接受其他节点转发
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, sysTopicPrefix)
+}
+
+// SysPublisher 定时以保留消息发布服务端的统计信息到 $SYS/broker/...
+type SysPublisher struct {
+	handler  *HandlerService
+	interval time.Duration
+	started  time.Time
+	cancel   context.CancelFunc
+}
+
+// NewSysPublisher 创建统计信息发布服务
+//
+// param: handler 发布消息的处理器
+// param: interval 发布间隔，小于等于0时不发布
+func NewSysPublisher(handler *HandlerService, interval time.Duration) *SysPublisher {
+	return &SysPublisher{
+		handler:  handler,
+		interval: interval,
+		started:  time.Now(),
+	}
+}
+
+func (p *SysPublisher) Run(ctx context.Context) error {
+	if p.interval <= 0 {
+		return nil
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.publish(sysPrefix+"version", `icetea version `+pkg.Version)
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		p.publishStats()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.publishStats()
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *SysPublisher) Stop() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	return nil
+}
+
+func (p *SysPublisher) Name() string {
+	return `sys`
+}
+
+// publishStats 发布一次全部统计信息
+func (p *SysPublisher) publishStats() {
+	connected, total := p.handler.clientCounts()
+	values := map[string]uint64{
+		"clients/connected":         uint64(connected),
+		"clients/disconnected":      uint64(total - connected),
+		"clients/total":             uint64(total),
+		"clients/connections":       stats.ClientsConnected.Load(),
+		"subscriptions/count":       uint64(subtree.GetTopicSub().SubscriptionCount()),
+		"retained messages/count":   uint64(p.handler.retain.Len()),
+		"messages/inflight":         uint64(p.handler.inflightCount()),
+		"messages/received":         stats.MessagesReceived.Load(),
+		"messages/sent":             stats.MessagesSent.Load(),
+		"publish/messages/received": stats.PublishReceived.Load(),
+		"publish/messages/sent":     stats.PublishSent.Load(),
+		"bytes/received":            stats.BytesReceived.Load(),
+		"bytes/sent":                stats.BytesSent.Load(),
+	}
+	p.publish(sysPrefix+"uptime", fmt.Sprintf("%d seconds", int64(time.Since(p.started).Seconds())))
+	for topic, value := range values {
+		p.publish(sysPrefix+topic, strconv.FormatUint(value, 10))
+	}
+}
+
+// publish 以 QoS 0 保留消息发布一条统计信息
+func (p *SysPublisher) publish(topic, payload string) {
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = topic
+	packet.Payload = []byte(payload)
+	packet.Retain = true
+	p.handler.Publish(packet, nil)
+}
+
+// clientCounts 在线客户端数量，以及在线与保留了会话的离线客户端总数
+func (s *HandlerService) clientCounts() (connected, total int) {
+	ids := subtree.GetTopicSub().ReadClientIDs()
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	connected = len(s.clients)
+	total = connected
+	for _, id := range ids {
+		if _, ok := s.clients[id]; !ok {
+			total++
+		}
+	}
+	return connected, total
+}
+
+// outboundCount 所有在线客户端出站队列中等待写出的报文总数
+func (s *HandlerService) outboundCount() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	count := 0
+	for _, c := range s.clients {
+		count += c.QueueLen()
+	}
+	return count
+}
+
+// inflightCount 所有在线客户端未确认的出站消息总数
+func (s *HandlerService) inflightCount() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	count := 0
+	for _, c := range s.clients {
+		count += c.InflightLen()
+	}
+	return count
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"context"
+	"icetea/service/subtree"
+	"testing"
+	"time"
+)
+
+// TestSysPublisher 启动时发布版本与统计信息的保留消息，只投递给订阅了 $SYS 的客户端，# 不匹配 $SYS 主题
+func TestSysPublisher(t *testing.T) {
+	var (
+		handler  = NewHandlerService()
+		topicSub = subtree.GetTopicSub()
+	)
+	sys := dial(t, handler)
+	sys.connect(newConnectPacket("sys-subscriber"))
+	defer topicSub.DeleteClient("sys-subscriber")
+	sys.subscribe("$SYS/broker/#", 0)
+	all := dial(t, handler)
+	all.connect(newConnectPacket("sys-all"))
+	defer topicSub.DeleteClient("sys-all")
+	all.subscribe("#", 0)
+
+	publisher := NewSysPublisher(handler, time.Hour)
+	if err := publisher.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Stop()
+
+	want := map[string]string{
+		"$SYS/broker/version":             "",
+		"$SYS/broker/clients/connected":   "2",
+		"$SYS/broker/clients/total":       "2",
+		"$SYS/broker/subscriptions/count": "2",
+	}
+	for received := 0; received < len(want); {
+		packet := sys.readPublish()
+		value, ok := want[packet.TopicName]
+		if !ok {
+			continue
+		}
+		if value != "" && string(packet.Payload) != value {
+			t.Fatalf("%s = %q, want %q", packet.TopicName, packet.Payload, value)
+		}
+		received++
+	}
+	if packet := all.read(); packet != nil {
+		t.Fatalf("# subscriber received %s", packet.String())
+	}
+
+	// 统计信息是保留消息，之后订阅的客户端立即收到
+	late := dial(t, handler)
+	late.connect(newConnectPacket("sys-late"))
+	defer topicSub.DeleteClient("sys-late")
+	late.subscribe("$SYS/broker/version", 0)
+	if packet := late.readPublish(); !packet.Retain || packet.TopicName != "$SYS/broker/version" {
+		t.Fatalf("late subscriber received %s", packet.String())
+	}
+}